@@ -0,0 +1,2 @@
+-- Accounts that only accept hybrid ECDSA + ML-DSA machine keys and tokens.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS require_hybrid_auth boolean NOT NULL DEFAULT false;
@@ -0,0 +1,4 @@
+-- Per-account algorithm policy and classical key migration deadline.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS allowed_key_algorithms text[];
+ALTER TABLE users ADD COLUMN IF NOT EXISTS allowed_jwt_algorithms text[];
+ALTER TABLE users ADD COLUMN IF NOT EXISTS classical_migrate_by timestamp;
@@ -0,0 +1,3 @@
+-- Suspended machines cannot authenticate until reinstated.
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS suspended_at timestamp;
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS suspended_reason text;
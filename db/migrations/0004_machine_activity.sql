@@ -0,0 +1,8 @@
+-- Last-seen information recorded by the auth middleware.
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS last_seen_at timestamp;
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS last_seen_ip text;
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS last_seen_user_agent text;
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS last_auth_algorithm text;
+-- When the machine was added.
+-- Existing machines count as created when this migration runs.
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS created_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC');
@@ -0,0 +1,2 @@
+-- Reinstating a machine restarts its dormancy clock.
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS reinstated_at timestamp;
@@ -0,0 +1,2 @@
+-- Names a machine was known by, still accepted in tokens after a rename.
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS previous_names text[] NOT NULL DEFAULT '{}';
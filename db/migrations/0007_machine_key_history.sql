@@ -0,0 +1,14 @@
+-- Public keys a machine replaced.
+CREATE TABLE IF NOT EXISTS machine_key_history (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    machine_id uuid NOT NULL REFERENCES machines (id) ON DELETE CASCADE,
+    public_key bytea NOT NULL,
+    replaced_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+);
+CREATE INDEX IF NOT EXISTS machine_key_history_machine_id_idx ON machine_key_history (machine_id);
+-- Nonces a machine signs with its new key when replacing its public key.
+CREATE TABLE IF NOT EXISTS key_proof_nonces (
+    nonce_hash text PRIMARY KEY,
+    machine_id uuid NOT NULL REFERENCES machines (id) ON DELETE CASCADE,
+    expires_at timestamp NOT NULL
+);
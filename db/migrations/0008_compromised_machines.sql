@@ -0,0 +1,5 @@
+-- Set when a machine is reported compromised, until the next rotation.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS rotation_required_at timestamp;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS rotation_required_reason text;
+-- Machines reported compromised, which can never be reinstated.
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS compromised_at timestamp;
@@ -0,0 +1,3 @@
+-- Master key epochs. Existing accounts and rotations start at epoch 0.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS master_key_epoch bigint NOT NULL DEFAULT 0;
+ALTER TABLE master_key_rotations ADD COLUMN IF NOT EXISTS epoch bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- Rotations are kept once applied, for the status report.
+ALTER TABLE master_key_rotations ADD COLUMN IF NOT EXISTS acknowledged_at timestamp;
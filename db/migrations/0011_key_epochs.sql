@@ -0,0 +1,2 @@
+-- The master key epoch each key file was encrypted under.
+ALTER TABLE ssh_keys ADD COLUMN IF NOT EXISTS key_epoch bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,12 @@
+-- Challenges for adding machines, shared between server instances when
+-- CHALLENGE_STORE=postgres.
+CREATE TABLE IF NOT EXISTS challenge_sessions (
+    id text PRIMARY KEY,
+    username text NOT NULL,
+    public_key bytea,
+    encapsulation_key bytea,
+    encrypted_master_key bytea,
+    created_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'),
+    accepted_at timestamp
+);
+CREATE INDEX IF NOT EXISTS challenge_sessions_created_at_idx ON challenge_sessions (created_at);
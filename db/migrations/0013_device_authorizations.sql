@@ -0,0 +1,18 @@
+-- Pending device authorization requests for adding machines.
+CREATE TABLE IF NOT EXISTS device_authorizations (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    machine_name text NOT NULL,
+    public_key bytea NOT NULL,
+    encapsulation_key bytea,
+    device_code_hash text NOT NULL UNIQUE,
+    user_code text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'),
+    expires_at timestamp NOT NULL,
+    last_polled_at timestamp,
+    encrypted_master_key bytea,
+    approved_at timestamp,
+    approved_by uuid
+);
+CREATE INDEX IF NOT EXISTS device_authorizations_user_id_idx ON device_authorizations (user_id);
+CREATE INDEX IF NOT EXISTS device_authorizations_expires_at_idx ON device_authorizations (expires_at);
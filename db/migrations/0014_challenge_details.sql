@@ -0,0 +1,6 @@
+-- What the approving machine is shown about the new one, and its decision.
+ALTER TABLE challenge_sessions ADD COLUMN IF NOT EXISTS machine_name text NOT NULL DEFAULT '';
+ALTER TABLE challenge_sessions ADD COLUMN IF NOT EXISTS source_ip text NOT NULL DEFAULT '';
+ALTER TABLE challenge_sessions ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+ALTER TABLE challenge_sessions ADD COLUMN IF NOT EXISTS denied_at timestamp;
+ALTER TABLE challenge_sessions ADD COLUMN IF NOT EXISTS denied_reason text;
@@ -0,0 +1,14 @@
+-- Security relevant events kept for later review. Rows outlive the machines
+-- they name. Deleting an account clears user_id and machine_id of its rows
+-- instead of deleting them.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    event text NOT NULL,
+    user_id uuid,
+    machine_id uuid,
+    source_ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    details text NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+);
+CREATE INDEX IF NOT EXISTS audit_events_user_id_idx ON audit_events (user_id);
@@ -0,0 +1,5 @@
+-- How many machines must approve a new one, and who has in a challenge.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS machine_approval_quorum integer NOT NULL DEFAULT 0;
+ALTER TABLE challenge_sessions ADD COLUMN IF NOT EXISTS quorum integer NOT NULL DEFAULT 0;
+ALTER TABLE challenge_sessions ADD COLUMN IF NOT EXISTS joined_by uuid[] NOT NULL DEFAULT '{}';
+ALTER TABLE challenge_sessions ADD COLUMN IF NOT EXISTS approved_by uuid[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+-- Paper recovery keys are kept as machines that can only recover the account.
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS recovery_key boolean NOT NULL DEFAULT false;
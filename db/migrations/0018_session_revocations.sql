@@ -0,0 +1,6 @@
+-- Users and machines whose sessions were revoked, until those sessions expire.
+CREATE TABLE IF NOT EXISTS session_revocations (
+    subject_id uuid PRIMARY KEY,
+    revoked_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL
+);
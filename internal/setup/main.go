@@ -2,10 +2,14 @@ package setup
 
 import (
 	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/jobs"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
 )
 
 func SetupServices(i *do.Injector) {
@@ -58,6 +62,45 @@ func SetupServices(i *do.Injector) {
 		dataAccessor := do.MustInvoke[database.DataAccessor](i)
 		return &query.QueryServiceImpl[models.MasterKeyRotation]{DataAccessor: dataAccessor}, nil
 	})
+	do.Provide(i, func(i *do.Injector) (query.QueryService[models.MachineKeyHistory], error) {
+		dataAccessor := do.MustInvoke[database.DataAccessor](i)
+		return &query.QueryServiceImpl[models.MachineKeyHistory]{DataAccessor: dataAccessor}, nil
+	})
+	do.Provide(i, func(i *do.Injector) (query.QueryService[models.ChallengeSession], error) {
+		dataAccessor := do.MustInvoke[database.DataAccessor](i)
+		return &query.QueryServiceImpl[models.ChallengeSession]{DataAccessor: dataAccessor}, nil
+	})
+	do.Provide(i, func(i *do.Injector) (query.QueryService[models.DeviceAuthorization], error) {
+		dataAccessor := do.MustInvoke[database.DataAccessor](i)
+		return &query.QueryServiceImpl[models.DeviceAuthorization]{DataAccessor: dataAccessor}, nil
+	})
+	do.Provide(i, func(i *do.Injector) (query.QueryService[models.SessionRevocation], error) {
+		dataAccessor := do.MustInvoke[database.DataAccessor](i)
+		return &query.QueryServiceImpl[models.SessionRevocation]{DataAccessor: dataAccessor}, nil
+	})
+	do.Provide(i, func(i *do.Injector) (*crypto.SessionManager, error) {
+		return crypto.LoadSharedSessionManager(do.MustInvoke[repository.SessionRevocationRepository](i))
+	})
+	do.Provide(i, func(i *do.Injector) (*crypto.PublicKeyCache, error) {
+		return crypto.LoadPublicKeyCache()
+	})
+	do.Provide(i, func(i *do.Injector) (*crypto.KeyProofNonces, error) {
+		return crypto.NewSharedKeyProofNonces(crypto.KeyProofNonceTTL, do.MustInvoke[repository.KeyProofNonceRepository](i)), nil
+	})
+	do.Provide(i, func(i *do.Injector) (*middleware.AuthLimiter, error) {
+		return middleware.LoadAuthLimiter()
+	})
+	do.Provide(i, middleware.LoadActivityTracker)
+	do.Provide(i, jobs.LoadDormantMachineExpirer)
+	do.Provide(i, jobs.LoadPendingRotationExpirer)
+	do.Provide(i, func(i *do.Injector) (*live.ChallengeGuard, error) {
+		return live.LoadChallengeGuard()
+	})
+	do.Provide(i, live.LoadChallengeStore)
+	do.Provide(i, live.LoadEventBroker)
+	do.Provide(i, func(i *do.Injector) (*live.Connections, error) {
+		return live.LoadConnections()
+	})
 	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
 		return &repository.UserRepo{Injector: i}, nil
 	})
@@ -76,5 +119,20 @@ func SetupServices(i *do.Injector) {
 	do.Provide(i, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
 		return &repository.MasterKeyRotationRepo{Injector: i}, nil
 	})
+	do.Provide(i, func(i *do.Injector) (repository.ChallengeSessionRepository, error) {
+		return &repository.ChallengeSessionRepo{Injector: i}, nil
+	})
+	do.Provide(i, func(i *do.Injector) (repository.DeviceAuthorizationRepository, error) {
+		return &repository.DeviceAuthorizationRepo{Injector: i}, nil
+	})
+	do.Provide(i, func(i *do.Injector) (repository.AuditEventRepository, error) {
+		return &repository.AuditEventRepo{Injector: i}, nil
+	})
+	do.Provide(i, func(i *do.Injector) (repository.KeyProofNonceRepository, error) {
+		return &repository.KeyProofNonceRepo{Injector: i}, nil
+	})
+	do.Provide(i, func(i *do.Injector) (repository.SessionRevocationRepository, error) {
+		return &repository.SessionRevocationRepo{Injector: i}, nil
+	})
 
 }
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
 	"github.com/samber/do"
 	"github.com/therealpaulgg/ssh-sync-server/internal/setup"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/jobs"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/router"
 )
 
@@ -19,13 +31,133 @@ func main() {
 	if os.Getenv("NO_DOTENV") != "1" && err != nil {
 		log.Fatal().Err(err).Msg("Error loading .env file")
 	}
+	if _, err := crypto.LoadServerAlgorithmPolicy(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid algorithm policy")
+	}
+	if _, err := do.Invoke[*crypto.SessionManager](injector); err != nil {
+		log.Fatal().Err(err).Msg("Error loading session signing key")
+	}
+	if _, err := do.Invoke[*crypto.PublicKeyCache](injector); err != nil {
+		log.Fatal().Err(err).Msg("Error configuring public key cache")
+	}
+	if _, err := do.Invoke[live.ChallengeStore](injector); err != nil {
+		log.Fatal().Err(err).Msg("Error configuring challenge store")
+	}
+	if _, err := do.Invoke[live.EventBroker](injector); err != nil {
+		log.Fatal().Err(err).Msg("Error configuring event broker")
+	}
+	connections, err := do.Invoke[*live.Connections](injector)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error configuring websockets")
+	}
+	shutdownTimeout, err := loadShutdownTimeout()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid shutdown timeout")
+	}
+	trustedProxies, err := middleware.LoadTrustedProxies()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid trusted proxies")
+	}
+	middleware.SetTrustedProxies(trustedProxies)
+	if _, err := do.Invoke[*middleware.AuthLimiter](injector); err != nil {
+		log.Fatal().Err(err).Msg("Error configuring authentication rate limits")
+	}
+	activityTracker, err := do.Invoke[*middleware.ActivityTracker](injector)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error configuring machine activity tracking")
+	}
+	// Jobs run until the server has drained, so that the activity of the last
+	// requests is flushed.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	activityFlushed := make(chan struct{})
+	go func() {
+		activityTracker.Run(jobsCtx)
+		close(activityFlushed)
+	}()
+	dormantMachineExpirer, err := do.Invoke[*jobs.DormantMachineExpirer](injector)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error configuring dormant machine expiry")
+	}
+	go dormantMachineExpirer.Run(jobsCtx)
+	pendingRotationExpirer, err := do.Invoke[*jobs.PendingRotationExpirer](injector)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error configuring master key rotation expiry")
+	}
+	go pendingRotationExpirer.Run(jobsCtx)
+	if metricsPort := os.Getenv("METRICS_PORT"); metricsPort != "" {
+		metricsHost := os.Getenv("METRICS_HOST")
+		if metricsHost == "" {
+			metricsHost = "127.0.0.1"
+		}
+		serveMetrics(injector, net.JoinHostPort(metricsHost, metricsPort))
+	}
 	r := router.Router(injector)
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
 	}
-	log.Info().Msg(fmt.Sprintf("Server started on port %s", port))
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", port), r); err != nil {
-		log.Fatal().Err(err).Msg("Error starting server")
+	server := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: r}
+	// Live connections are not drained by Shutdown, so they are told to end
+	// as soon as it stops accepting new connections.
+	server.RegisterOnShutdown(connections.Shutdown)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		log.Info().Msg(fmt.Sprintf("Server started on port %s", port))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msg("Error starting server")
+		}
+	}()
+	<-ctx.Done()
+	stop()
+	log.Info().Msg("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Err(err).Msg("Error draining requests")
+	}
+	if err := connections.Wait(shutdownCtx); err != nil {
+		log.Err(err).Msg("Error waiting for live connections to end")
+	}
+	stopJobs()
+	<-activityFlushed
+	log.Info().Msg("Server stopped")
+}
+
+// loadShutdownTimeout reads SHUTDOWN_TIMEOUT, how long in-flight requests and
+// live connections are given to finish once the server is asked to stop.
+func loadShutdownTimeout() (time.Duration, error) {
+	value := os.Getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return 30 * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid SHUTDOWN_TIMEOUT: %q", value)
 	}
+	return timeout, nil
+}
+
+// serveMetrics exposes expvar counters on /debug/vars and the currently locked
+// out identities on /admin/lockouts on a separate address, so they are not
+// reachable through the public API. Neither needs authentication, so addr is
+// on localhost unless configured otherwise.
+func serveMetrics(injector *do.Injector, addr string) {
+	publicKeyCache := do.MustInvoke[*crypto.PublicKeyCache](injector)
+	expvar.Publish("auth_public_key_cache", expvar.Func(func() any {
+		return publicKeyCache.Stats()
+	}))
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	authLimiter := do.MustInvoke[*middleware.AuthLimiter](injector)
+	mux.HandleFunc("/admin/lockouts", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(authLimiter.Locked(time.Now()))
+	})
+	go func() {
+		log.Info().Msg(fmt.Sprintf("Metrics available on %s", addr))
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Err(err).Msg("Error starting metrics server")
+		}
+	}()
 }
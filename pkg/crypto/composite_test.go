@@ -0,0 +1,137 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"filippo.io/mldsa"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generateHybridPEM(t *testing.T) ([]byte, *ecdsa.PrivateKey, *mldsa.PrivateKey) {
+	t.Helper()
+	ecPriv, ecPEM := generateECDSAKeyPair(t, elliptic.P256())
+	mldsaPEM, _, mldsaPriv := generateMLDSAPEM(t)
+	return append(ecPEM, mldsaPEM...), ecPriv, mldsaPriv
+}
+
+func signCompositeJWT(t *testing.T, ecPriv *ecdsa.PrivateKey, mldsaPriv *mldsa.PrivateKey, exp time.Time) string {
+	t.Helper()
+	alg := CompositeAlgorithm{MLDSA: mldsa.MLDSA65(), EC: jwa.ES256}
+	header := fmt.Sprintf(`{"alg":"%s","typ":"JWT"}`, alg.String())
+	claims := fmt.Sprintf(`{"iss":"test","exp":%d,"username":"user1","machine":"machine1"}`, exp.Unix())
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mldsaSig, err := mldsaPriv.Sign(nil, []byte(signingInput), nil)
+	require.NoError(t, err)
+	signer, err := jws.NewSigner(jwa.ES256)
+	require.NoError(t, err)
+	ecSig, err := signer.Sign([]byte(signingInput), ecPriv)
+	require.NoError(t, err)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(append(mldsaSig, ecSig...))
+}
+
+func TestParseCompositeAlgorithm(t *testing.T) {
+	alg, err := ParseCompositeAlgorithm("ML-DSA-87-ES512")
+	require.NoError(t, err)
+	assert.Equal(t, mldsa.MLDSA87(), alg.MLDSA)
+	assert.Equal(t, jwa.ES512, alg.EC)
+	assert.Equal(t, "ML-DSA-87-ES512", alg.String())
+}
+
+func TestParseCompositeAlgorithm_Unsupported(t *testing.T) {
+	for _, algStr := range []string{"ES256", mldsa.MLDSA65().String(), "ML-DSA-65-RS256", "ML-DSA-69-ES256", ""} {
+		_, err := ParseCompositeAlgorithm(algStr)
+		assert.Error(t, err, algStr)
+	}
+}
+
+func TestDetectKeyType_Hybrid(t *testing.T) {
+	pemBytes, _, _ := generateHybridPEM(t)
+	assert.Equal(t, KeyTypeHybrid, DetectKeyType(pemBytes))
+}
+
+func TestDetectKeyType_DuplicateBlocks(t *testing.T) {
+	ecPEM := generateECDSAPEM(t)
+	assert.Equal(t, KeyTypeUnknown, DetectKeyType(append(ecPEM, ecPEM...)))
+}
+
+func TestValidatePublicKey_Hybrid(t *testing.T) {
+	pemBytes, _, _ := generateHybridPEM(t)
+	kt, err := ValidatePublicKey(pemBytes)
+	require.NoError(t, err)
+	assert.Equal(t, KeyTypeHybrid, kt)
+}
+
+func TestExtractPublicKey_Hybrid(t *testing.T) {
+	pemBytes, _, _ := generateHybridPEM(t)
+	ecPEM, err := ExtractPublicKey(pemBytes, KeyTypeECDSA)
+	require.NoError(t, err)
+	assert.Equal(t, KeyTypeECDSA, DetectKeyType(ecPEM))
+	mldsaPEM, err := ExtractPublicKey(pemBytes, KeyTypeMLDSA)
+	require.NoError(t, err)
+	assert.Equal(t, KeyTypeMLDSA, DetectKeyType(mldsaPEM))
+}
+
+func TestVerifyJWT_Composite_Valid(t *testing.T) {
+	pemBytes, ecPriv, mldsaPriv := generateHybridPEM(t)
+	token := signCompositeJWT(t, ecPriv, mldsaPriv, time.Now().Add(5*time.Minute))
+	err := VerifyJWT(token, "ML-DSA-65-ES256", pemBytes)
+	assert.NoError(t, err)
+}
+
+func TestVerifyJWT_Composite_Expired(t *testing.T) {
+	pemBytes, ecPriv, mldsaPriv := generateHybridPEM(t)
+	token := signCompositeJWT(t, ecPriv, mldsaPriv, time.Now().Add(-5*time.Minute))
+	err := VerifyJWT(token, "ML-DSA-65-ES256", pemBytes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expired")
+}
+
+func TestVerifyJWT_Composite_WrongECKey(t *testing.T) {
+	pemBytes, _, mldsaPriv := generateHybridPEM(t)
+	otherEC, _ := generateECDSAKeyPair(t, elliptic.P256())
+	token := signCompositeJWT(t, otherEC, mldsaPriv, time.Now().Add(5*time.Minute))
+	err := VerifyJWT(token, "ML-DSA-65-ES256", pemBytes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ECDSA signature verification failed")
+}
+
+func TestVerifyJWT_Composite_WrongMLDSAKey(t *testing.T) {
+	pemBytes, ecPriv, _ := generateHybridPEM(t)
+	_, _, otherMLDSA := generateMLDSAPEM(t)
+	token := signCompositeJWT(t, ecPriv, otherMLDSA, time.Now().Add(5*time.Minute))
+	err := VerifyJWT(token, "ML-DSA-65-ES256", pemBytes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ML-DSA signature verification failed")
+}
+
+func TestVerifyJWT_Composite_NonHybridKey(t *testing.T) {
+	_, ecPriv, mldsaPriv := generateHybridPEM(t)
+	token := signCompositeJWT(t, ecPriv, mldsaPriv, time.Now().Add(5*time.Minute))
+	err := VerifyJWT(token, "ML-DSA-65-ES256", generateECDSAPEM(t))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "requires a hybrid public key")
+}
+
+func TestVerifyJWT_ES256_HybridKey(t *testing.T) {
+	pemBytes, ecPriv, _ := generateHybridPEM(t)
+	token := signECDSAJWT(t, ecPriv, jwa.ES256, time.Now().Add(5*time.Minute))
+	err := VerifyJWT(token, jwa.ES256.String(), pemBytes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "requires a composite JWT")
+}
+
+func TestVerifyJWT_MLDSA_HybridKey(t *testing.T) {
+	pemBytes, _, mldsaPriv := generateHybridPEM(t)
+	token := signMLDSAJWT(t, mldsaPriv, mldsa.MLDSA65(), "user1", "machine1", time.Now().Add(5*time.Minute))
+	err := VerifyJWT(token, mldsa.MLDSA65().String(), pemBytes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "requires a composite JWT")
+}
@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// userCodeAlphabet leaves out vowels and easily confused characters, as
+// suggested by RFC 8628 section 6.1.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+const userCodeLength = 8
+
+// NewDeviceCode returns the secret a new machine polls a device authorization
+// with. Only HashDeviceCode of it should be stored.
+func NewDeviceCode() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func HashDeviceCode(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewUserCode returns a short code such as "WDJB-MJHT" that the user reads off
+// the new machine and enters on the existing machine approving it.
+func NewUserCode() (string, error) {
+	b := make([]byte, userCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := make([]byte, userCodeLength)
+	for i := range b {
+		// 256 is not a multiple of 20, but the bias is far too small to matter
+		// for a code that is only valid for minutes.
+		code[i] = userCodeAlphabet[int(b[i])%len(userCodeAlphabet)]
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+// UserCodesMatch compares user codes ignoring case, dashes and spaces.
+func UserCodesMatch(expected, entered string) bool {
+	normalize := func(code string) string {
+		return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	}
+	return subtle.ConstantTimeCompare([]byte(normalize(expected)), []byte(normalize(entered))) == 1
+}
@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUserCode(t *testing.T) {
+	code, err := NewUserCode()
+	require.NoError(t, err)
+	require.Len(t, code, 9)
+	assert.Equal(t, byte('-'), code[4])
+	for _, c := range strings.ReplaceAll(code, "-", "") {
+		assert.Contains(t, userCodeAlphabet, string(c))
+	}
+}
+
+func TestUserCodesMatch(t *testing.T) {
+	assert.True(t, UserCodesMatch("WDJB-MJHT", "wdjbmjht"))
+	assert.True(t, UserCodesMatch("WDJB-MJHT", "WDJB MJHT"))
+	assert.False(t, UserCodesMatch("WDJB-MJHT", "WDJB-MJHB"))
+	assert.False(t, UserCodesMatch("WDJB-MJHT", ""))
+}
+
+func TestHashDeviceCode(t *testing.T) {
+	code, err := NewDeviceCode()
+	require.NoError(t, err)
+	other, err := NewDeviceCode()
+	require.NoError(t, err)
+	assert.NotEqual(t, code, other)
+	assert.Equal(t, HashDeviceCode(code), HashDeviceCode(code))
+	assert.NotEqual(t, HashDeviceCode(code), HashDeviceCode(other))
+}
@@ -0,0 +1,117 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultPublicKeyCacheTTL = 5 * time.Minute
+
+// PublicKeyCache keeps parsed machine public keys keyed by machine ID, so the
+// auth path does not re-parse PEM on every request. An entry is only used while
+// the PEM it was parsed from still matches the machine's stored key, so a key
+// changed by another server instance is never served stale.
+type PublicKeyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[uuid.UUID]publicKeyCacheEntry
+	hits    uint64
+	misses  uint64
+}
+
+type publicKeyCacheEntry struct {
+	pem       []byte
+	key       *PublicKey
+	expiresAt time.Time
+}
+
+type PublicKeyCacheStats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	Size    int     `json:"size"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// LoadPublicKeyCache creates the cache using PUBLIC_KEY_CACHE_TTL (a Go
+// duration, 5m by default). A TTL of 0 disables caching.
+func LoadPublicKeyCache() (*PublicKeyCache, error) {
+	ttl := defaultPublicKeyCacheTTL
+	if ttlStr := os.Getenv("PUBLIC_KEY_CACHE_TTL"); ttlStr != "" {
+		parsed, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PUBLIC_KEY_CACHE_TTL: %w", err)
+		}
+		if parsed < 0 {
+			return nil, errors.New("PUBLIC_KEY_CACHE_TTL must not be negative")
+		}
+		ttl = parsed
+	}
+	return NewPublicKeyCache(ttl), nil
+}
+
+func NewPublicKeyCache(ttl time.Duration) *PublicKeyCache {
+	return &PublicKeyCache{
+		ttl:     ttl,
+		entries: make(map[uuid.UUID]publicKeyCacheEntry),
+	}
+}
+
+// Get returns the parsed form of pemBytes, the current public key of the
+// machine, parsing and caching it on a miss.
+func (c *PublicKeyCache) Get(machineID uuid.UUID, pemBytes []byte) (*PublicKey, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[machineID]
+	if ok && now.Before(entry.expiresAt) && bytes.Equal(entry.pem, pemBytes) {
+		c.hits++
+		c.mu.Unlock()
+		return entry.key, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	key, err := ParsePublicKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	if c.ttl == 0 {
+		return key, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, e := range c.entries {
+		if !now.Before(e.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[machineID] = publicKeyCacheEntry{
+		pem:       bytes.Clone(pemBytes),
+		key:       key,
+		expiresAt: now.Add(c.ttl),
+	}
+	return key, nil
+}
+
+func (c *PublicKeyCache) Invalidate(machineID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, machineID)
+}
+
+func (c *PublicKeyCache) Stats() PublicKeyCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := PublicKeyCacheStats{Hits: c.hits, Misses: c.misses, Size: len(c.entries)}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRate = float64(c.hits) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicKeyCache_HitAndMiss(t *testing.T) {
+	cache := NewPublicKeyCache(time.Minute)
+	machineID := uuid.New()
+	pemBytes, _, _ := generateHybridPEM(t)
+
+	first, err := cache.Get(machineID, pemBytes)
+	require.NoError(t, err)
+	assert.Equal(t, KeyTypeHybrid, first.Type)
+	second, err := cache.Get(machineID, pemBytes)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Size)
+	assert.Equal(t, 0.5, stats.HitRate)
+}
+
+func TestPublicKeyCache_KeyChanged(t *testing.T) {
+	cache := NewPublicKeyCache(time.Minute)
+	machineID := uuid.New()
+	oldPEM := generateECDSAPEM(t)
+	newPEM, _, _ := generateMLDSAPEM(t)
+
+	_, err := cache.Get(machineID, oldPEM)
+	require.NoError(t, err)
+	key, err := cache.Get(machineID, newPEM)
+	require.NoError(t, err)
+	assert.Equal(t, KeyTypeMLDSA, key.Type)
+	assert.Equal(t, uint64(0), cache.Stats().Hits)
+}
+
+func TestPublicKeyCache_Invalidate(t *testing.T) {
+	cache := NewPublicKeyCache(time.Minute)
+	machineID := uuid.New()
+	pemBytes := generateECDSAPEM(t)
+
+	_, err := cache.Get(machineID, pemBytes)
+	require.NoError(t, err)
+	cache.Invalidate(machineID)
+	assert.Equal(t, 0, cache.Stats().Size)
+	_, err = cache.Get(machineID, pemBytes)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), cache.Stats().Misses)
+}
+
+func TestPublicKeyCache_Expired(t *testing.T) {
+	cache := NewPublicKeyCache(time.Nanosecond)
+	machineID := uuid.New()
+	pemBytes := generateECDSAPEM(t)
+
+	_, err := cache.Get(machineID, pemBytes)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	_, err = cache.Get(machineID, pemBytes)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), cache.Stats().Hits)
+}
+
+func TestPublicKeyCache_Disabled(t *testing.T) {
+	t.Setenv("PUBLIC_KEY_CACHE_TTL", "0")
+	cache, err := LoadPublicKeyCache()
+	require.NoError(t, err)
+	_, err = cache.Get(uuid.New(), generateECDSAPEM(t))
+	require.NoError(t, err)
+	assert.Equal(t, 0, cache.Stats().Size)
+}
+
+func TestPublicKeyCache_InvalidKey(t *testing.T) {
+	cache := NewPublicKeyCache(time.Minute)
+	_, err := cache.Get(uuid.New(), []byte("not a pem"))
+	assert.Error(t, err)
+	assert.Equal(t, 0, cache.Stats().Size)
+}
+
+func TestPublicKeyFingerprint(t *testing.T) {
+	pemBytes, _, _ := generateHybridPEM(t)
+	fingerprint := PublicKeyFingerprint(pemBytes)
+	assert.Regexp(t, `^SHA256:[A-Za-z0-9+/]{43}$`, fingerprint)
+	assert.Equal(t, fingerprint, PublicKeyFingerprint(pemBytes))
+	assert.NotEqual(t, fingerprint, PublicKeyFingerprint(generateECDSAPEM(t)))
+}
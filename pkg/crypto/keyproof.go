@@ -0,0 +1,128 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const KeyProofNonceTTL = 5 * time.Minute
+
+var ErrInvalidKeyProof = errors.New("invalid proof of possession for the new key")
+
+// KeyProofNonceStore keeps issued nonces until they are used or expire.
+type KeyProofNonceStore interface {
+	SaveKeyProofNonce(nonce string, machineID uuid.UUID, expiresAt time.Time) error
+	// ConsumeKeyProofNonce removes the nonce if it is live and was issued to
+	// the machine, returning when it would have expired, or nil otherwise.
+	ConsumeKeyProofNonce(nonce string, machineID uuid.UUID) (*time.Time, error)
+}
+
+// KeyProofNonces hands out single-use nonces that a machine signs with its new
+// private key when replacing its public key, proving it holds that key.
+type KeyProofNonces struct {
+	ttl   time.Duration
+	store KeyProofNonceStore
+}
+
+// NewKeyProofNonces keeps nonces in memory, so the key update has to reach the
+// server process that issued the nonce.
+func NewKeyProofNonces(ttl time.Duration) *KeyProofNonces {
+	return NewSharedKeyProofNonces(ttl, &memoryKeyProofNonceStore{nonces: make(map[string]keyProofNonce)})
+}
+
+// NewSharedKeyProofNonces keeps nonces in store, which may be shared between
+// server instances.
+func NewSharedKeyProofNonces(ttl time.Duration, store KeyProofNonceStore) *KeyProofNonces {
+	return &KeyProofNonces{ttl: ttl, store: store}
+}
+
+// Issue creates a nonce for the machine, valid until the returned time.
+func (n *KeyProofNonces) Issue(machineID uuid.UUID) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	expiresAt := time.Now().Add(n.ttl)
+	if err := n.store.SaveKeyProofNonce(nonce, machineID, expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	return nonce, expiresAt.Truncate(time.Second), nil
+}
+
+// Verify checks that proof is a token signed with alg by publicKeyPEM whose
+// nonce claim is a live nonce issued to the machine, then calls apply. A hybrid
+// key has to sign with a composite algorithm. The nonce is only used up if
+// apply succeeds, so a failed key update can be retried with the same proof.
+func (n *KeyProofNonces) Verify(machineID uuid.UUID, proof, alg string, publicKeyPEM []byte, apply func() error) error {
+	if DetectKeyType(publicKeyPEM) == KeyTypeHybrid {
+		if _, err := ParseCompositeAlgorithm(alg); err != nil {
+			return fmt.Errorf("%w: a hybrid key must sign with a composite algorithm", ErrInvalidKeyProof)
+		}
+	}
+	if err := VerifyJWT(proof, alg, publicKeyPEM); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidKeyProof, err)
+	}
+	token, err := jwt.ParseString(proof, jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidKeyProof, err)
+	}
+	nonce, _ := token.PrivateClaims()["nonce"].(string)
+	// Consuming the nonce before apply keeps concurrent requests from using it
+	// twice.
+	expiresAt, err := n.store.ConsumeKeyProofNonce(nonce, machineID)
+	if err != nil {
+		return err
+	}
+	if expiresAt == nil {
+		return fmt.Errorf("%w: unknown or expired nonce", ErrInvalidKeyProof)
+	}
+	if err := apply(); err != nil {
+		if restoreErr := n.store.SaveKeyProofNonce(nonce, machineID, *expiresAt); restoreErr != nil {
+			return errors.Join(err, restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+type keyProofNonce struct {
+	machineID uuid.UUID
+	expiresAt time.Time
+}
+
+type memoryKeyProofNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]keyProofNonce
+}
+
+func (s *memoryKeyProofNonceStore) SaveKeyProofNonce(nonce string, machineID uuid.UUID, expiresAt time.Time) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for issued, entry := range s.nonces {
+		if now.After(entry.expiresAt) {
+			delete(s.nonces, issued)
+		}
+	}
+	s.nonces[nonce] = keyProofNonce{machineID: machineID, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *memoryKeyProofNonceStore) ConsumeKeyProofNonce(nonce string, machineID uuid.UUID) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.nonces[nonce]
+	if !ok || entry.machineID != machineID || time.Now().After(entry.expiresAt) {
+		return nil, nil
+	}
+	delete(s.nonces, nonce)
+	return &entry.expiresAt, nil
+}
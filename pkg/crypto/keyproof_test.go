@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signKeyProof(t *testing.T, priv *ecdsa.PrivateKey, nonce string) string {
+	t.Helper()
+	tok, err := jwt.NewBuilder().IssuedAt(time.Now()).Claim("nonce", nonce).Build()
+	require.NoError(t, err)
+	key, err := jwk.FromRaw(priv)
+	require.NoError(t, err)
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.ES256, key))
+	require.NoError(t, err)
+	return string(signed)
+}
+
+func applyNothing() error { return nil }
+
+func TestKeyProofNonces_Verify(t *testing.T) {
+	nonces := NewKeyProofNonces(time.Minute)
+	machineID := uuid.New()
+	priv, pubPEM := generateECDSAKeyPair(t, elliptic.P256())
+	nonce, expiresAt, err := nonces.Issue(machineID)
+	require.NoError(t, err)
+	assert.True(t, expiresAt.After(time.Now()))
+
+	proof := signKeyProof(t, priv, nonce)
+	require.NoError(t, nonces.Verify(machineID, proof, jwa.ES256.String(), pubPEM, applyNothing))
+
+	// Nonces are single use.
+	assert.ErrorIs(t, nonces.Verify(machineID, proof, jwa.ES256.String(), pubPEM, applyNothing), ErrInvalidKeyProof)
+}
+
+func TestKeyProofNonces_FailedApplyKeepsNonce(t *testing.T) {
+	nonces := NewKeyProofNonces(time.Minute)
+	machineID := uuid.New()
+	priv, pubPEM := generateECDSAKeyPair(t, elliptic.P256())
+	nonce, _, err := nonces.Issue(machineID)
+	require.NoError(t, err)
+	proof := signKeyProof(t, priv, nonce)
+	errUpdate := errors.New("update failed")
+
+	err = nonces.Verify(machineID, proof, jwa.ES256.String(), pubPEM, func() error { return errUpdate })
+	assert.ErrorIs(t, err, errUpdate)
+
+	// The key update can be retried with the same proof.
+	assert.NoError(t, nonces.Verify(machineID, proof, jwa.ES256.String(), pubPEM, applyNothing))
+}
+
+func TestKeyProofNonces_SignedByOtherKey(t *testing.T) {
+	nonces := NewKeyProofNonces(time.Minute)
+	machineID := uuid.New()
+	_, pubPEM := generateECDSAKeyPair(t, elliptic.P256())
+	otherPriv, _ := generateECDSAKeyPair(t, elliptic.P256())
+	nonce, _, err := nonces.Issue(machineID)
+	require.NoError(t, err)
+
+	err = nonces.Verify(machineID, signKeyProof(t, otherPriv, nonce), jwa.ES256.String(), pubPEM, applyNothing)
+	assert.ErrorIs(t, err, ErrInvalidKeyProof)
+}
+
+func TestKeyProofNonces_WrongMachine(t *testing.T) {
+	nonces := NewKeyProofNonces(time.Minute)
+	priv, pubPEM := generateECDSAKeyPair(t, elliptic.P256())
+	nonce, _, err := nonces.Issue(uuid.New())
+	require.NoError(t, err)
+
+	err = nonces.Verify(uuid.New(), signKeyProof(t, priv, nonce), jwa.ES256.String(), pubPEM, applyNothing)
+	assert.ErrorIs(t, err, ErrInvalidKeyProof)
+}
+
+func TestKeyProofNonces_Expired(t *testing.T) {
+	nonces := NewKeyProofNonces(-time.Second)
+	machineID := uuid.New()
+	priv, pubPEM := generateECDSAKeyPair(t, elliptic.P256())
+	nonce, _, err := nonces.Issue(machineID)
+	require.NoError(t, err)
+
+	err = nonces.Verify(machineID, signKeyProof(t, priv, nonce), jwa.ES256.String(), pubPEM, applyNothing)
+	assert.ErrorIs(t, err, ErrInvalidKeyProof)
+}
+
+func TestKeyProofNonces_HybridKeySingleAlgorithm(t *testing.T) {
+	nonces := NewKeyProofNonces(time.Minute)
+	machineID := uuid.New()
+	pemBytes, ecPriv, _ := generateHybridPEM(t)
+	nonce, _, err := nonces.Issue(machineID)
+	require.NoError(t, err)
+
+	err = nonces.Verify(machineID, signKeyProof(t, ecPriv, nonce), jwa.ES256.String(), pemBytes, applyNothing)
+	assert.ErrorIs(t, err, ErrInvalidKeyProof)
+	assert.Contains(t, err.Error(), "composite algorithm")
+}
@@ -1,6 +1,8 @@
 package crypto
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -16,51 +18,156 @@ const (
 	KeyTypeUnknown KeyType = iota
 	KeyTypeECDSA
 	KeyTypeMLDSA
+	// KeyTypeHybrid is a PEM bundle holding both an ECDSA and an ML-DSA public key.
+	KeyTypeHybrid
+)
+
+const (
+	ecdsaPEMType = "PUBLIC KEY"
+	mldsaPEMType = "ML-DSA PUBLIC KEY"
 )
 
 func DetectKeyType(pemBytes []byte) KeyType {
-	block, _ := pem.Decode(pemBytes)
-	if block == nil {
-		return KeyTypeUnknown
+	var hasEC, hasMLDSA bool
+	rest := pemBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case ecdsaPEMType:
+			if hasEC {
+				return KeyTypeUnknown
+			}
+			hasEC = true
+		case mldsaPEMType:
+			if hasMLDSA {
+				return KeyTypeUnknown
+			}
+			hasMLDSA = true
+		default:
+			return KeyTypeUnknown
+		}
 	}
-	switch block.Type {
-	case "PUBLIC KEY":
+	switch {
+	case hasEC && hasMLDSA:
+		return KeyTypeHybrid
+	case hasEC:
 		return KeyTypeECDSA
-	case "ML-DSA PUBLIC KEY":
+	case hasMLDSA:
 		return KeyTypeMLDSA
 	default:
 		return KeyTypeUnknown
 	}
 }
 
+// ExtractPublicKey returns the PEM block of the given component type from a
+// public key, which may be a single key or a hybrid bundle.
+func ExtractPublicKey(pemBytes []byte, kt KeyType) ([]byte, error) {
+	var want string
+	switch kt {
+	case KeyTypeECDSA:
+		want = ecdsaPEMType
+	case KeyTypeMLDSA:
+		want = mldsaPEMType
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	rest := pemBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("no %s block found", want)
+		}
+		if block.Type == want {
+			return pem.EncodeToMemory(block), nil
+		}
+	}
+}
+
+// PublicKeyFingerprint returns "SHA256:" followed by the unpadded base64 SHA-256
+// digest of the key's PEM block contents, in the style of ssh-keygen -l. For a
+// hybrid key the blocks are hashed in order.
+func PublicKeyFingerprint(pemBytes []byte) string {
+	h := sha256.New()
+	rest := pemBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		h.Write(block.Bytes)
+	}
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
 func ValidatePublicKey(pemBytes []byte) (KeyType, error) {
 	kt := DetectKeyType(pemBytes)
 	switch kt {
 	case KeyTypeECDSA:
-		key, err := jwk.ParseKey(pemBytes, jwk.WithPEM(true))
-		if err != nil {
-			return KeyTypeUnknown, fmt.Errorf("invalid ECDSA key: %w", err)
-		}
-		if key.KeyType() != jwa.EC {
-			return KeyTypeUnknown, errors.New("key is not EC type")
+		if err := validateECDSAPublicKey(pemBytes); err != nil {
+			return KeyTypeUnknown, err
 		}
 		return KeyTypeECDSA, nil
 	case KeyTypeMLDSA:
-		block, _ := pem.Decode(pemBytes)
-		algBySize := map[int]*mldsa.Parameters{
-			mldsa.MLDSA44().PublicKeySize(): mldsa.MLDSA44(),
-			mldsa.MLDSA65().PublicKeySize(): mldsa.MLDSA65(),
-			mldsa.MLDSA87().PublicKeySize(): mldsa.MLDSA87(),
+		if err := validateMLDSAPublicKey(pemBytes); err != nil {
+			return KeyTypeUnknown, err
 		}
-		alg, ok := algBySize[len(block.Bytes)]
-		if !ok {
-			return KeyTypeUnknown, errors.New("invalid ML-DSA public key: unrecognized key size")
+		return KeyTypeMLDSA, nil
+	case KeyTypeHybrid:
+		ecPEM, err := ExtractPublicKey(pemBytes, KeyTypeECDSA)
+		if err != nil {
+			return KeyTypeUnknown, err
 		}
-		if _, err := ParseMLDSAPublicKey(pemBytes, alg); err != nil {
-			return KeyTypeUnknown, fmt.Errorf("invalid ML-DSA public key: %w", err)
+		if err := validateECDSAPublicKey(ecPEM); err != nil {
+			return KeyTypeUnknown, err
 		}
-		return KeyTypeMLDSA, nil
+		mldsaPEM, err := ExtractPublicKey(pemBytes, KeyTypeMLDSA)
+		if err != nil {
+			return KeyTypeUnknown, err
+		}
+		if err := validateMLDSAPublicKey(mldsaPEM); err != nil {
+			return KeyTypeUnknown, err
+		}
+		return KeyTypeHybrid, nil
 	default:
 		return KeyTypeUnknown, errors.New("unsupported key type")
 	}
 }
+
+func validateECDSAPublicKey(pemBytes []byte) error {
+	key, err := jwk.ParseKey(pemBytes, jwk.WithPEM(true))
+	if err != nil {
+		return fmt.Errorf("invalid ECDSA key: %w", err)
+	}
+	if key.KeyType() != jwa.EC {
+		return errors.New("key is not EC type")
+	}
+	return nil
+}
+
+func validateMLDSAPublicKey(pemBytes []byte) error {
+	block, _ := pem.Decode(pemBytes)
+	alg, ok := mldsaAlgorithmBySize(len(block.Bytes))
+	if !ok {
+		return errors.New("invalid ML-DSA public key: unrecognized key size")
+	}
+	if _, err := ParseMLDSAPublicKey(pemBytes, alg); err != nil {
+		return fmt.Errorf("invalid ML-DSA public key: %w", err)
+	}
+	return nil
+}
+
+func mldsaAlgorithmBySize(size int) (*mldsa.Parameters, bool) {
+	algBySize := map[int]*mldsa.Parameters{
+		mldsa.MLDSA44().PublicKeySize(): mldsa.MLDSA44(),
+		mldsa.MLDSA65().PublicKeySize(): mldsa.MLDSA65(),
+		mldsa.MLDSA87().PublicKeySize(): mldsa.MLDSA87(),
+	}
+	alg, ok := algBySize[size]
+	return alg, ok
+}
@@ -64,7 +64,11 @@ func VerifyMLDSAJWT(tokenString string, pubKey *mldsa.PublicKey) error {
 		return errors.New("ML-DSA signature verification failed")
 	}
 
-	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	return checkJWTExpiry(parts[1])
+}
+
+func checkJWTExpiry(payloadSegment string) error {
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(payloadSegment)
 	if err != nil {
 		return fmt.Errorf("failed to decode payload: %w", err)
 	}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"crypto/mlkem"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const mlkemPEMType = "ML-KEM PUBLIC KEY"
+
+// ML-KEM parameter sets accepted for machine encapsulation keys.
+const (
+	KEMParameterSetMLKEM768  = "ML-KEM-768"
+	KEMParameterSetMLKEM1024 = "ML-KEM-1024"
+)
+
+// ValidateEncapsulationKey checks that pemBytes is a single PEM encoded
+// ML-KEM-768 or ML-KEM-1024 encapsulation key and returns its parameter set.
+// The parameter set is told apart by the key size.
+func ValidateEncapsulationKey(pemBytes []byte) (string, error) {
+	block, rest := pem.Decode(pemBytes)
+	if block == nil {
+		return "", errors.New("invalid encapsulation key: failed to decode PEM block")
+	}
+	if block.Type != mlkemPEMType {
+		return "", fmt.Errorf("invalid encapsulation key: unexpected PEM block type: %s", block.Type)
+	}
+	if next, _ := pem.Decode(rest); next != nil {
+		return "", errors.New("invalid encapsulation key: expected a single PEM block")
+	}
+	switch len(block.Bytes) {
+	case mlkem.EncapsulationKeySize768:
+		if _, err := mlkem.NewEncapsulationKey768(block.Bytes); err != nil {
+			return "", fmt.Errorf("invalid %s encapsulation key: %w", KEMParameterSetMLKEM768, err)
+		}
+		return KEMParameterSetMLKEM768, nil
+	case mlkem.EncapsulationKeySize1024:
+		if _, err := mlkem.NewEncapsulationKey1024(block.Bytes); err != nil {
+			return "", fmt.Errorf("invalid %s encapsulation key: %w", KEMParameterSetMLKEM1024, err)
+		}
+		return KEMParameterSetMLKEM1024, nil
+	default:
+		return "", errors.New("invalid encapsulation key: unrecognized key size")
+	}
+}
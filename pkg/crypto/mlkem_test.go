@@ -0,0 +1,54 @@
+package crypto
+
+import (
+	"crypto/mlkem"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeEncapsulationKey(b []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "ML-KEM PUBLIC KEY", Bytes: b})
+}
+
+func TestValidateEncapsulationKey(t *testing.T) {
+	dk768, err := mlkem.GenerateKey768()
+	require.NoError(t, err)
+	dk1024, err := mlkem.GenerateKey1024()
+	require.NoError(t, err)
+
+	params, err := ValidateEncapsulationKey(encodeEncapsulationKey(dk768.EncapsulationKey().Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, KEMParameterSetMLKEM768, params)
+
+	params, err = ValidateEncapsulationKey(encodeEncapsulationKey(dk1024.EncapsulationKey().Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, KEMParameterSetMLKEM1024, params)
+}
+
+func TestValidateEncapsulationKey_Invalid(t *testing.T) {
+	dk, err := mlkem.GenerateKey768()
+	require.NoError(t, err)
+	ek := dk.EncapsulationKey().Bytes()
+	// Coefficients must be reduced modulo q; all ones is out of range.
+	unreduced := make([]byte, len(ek))
+	for i := range unreduced {
+		unreduced[i] = 0xff
+	}
+	mldsaPEM, _, _ := generateMLDSAPEM(t)
+
+	for name, pemBytes := range map[string][]byte{
+		"not PEM":        []byte("fake-encapsulation-key"),
+		"wrong PEM type": mldsaPEM,
+		"wrong size":     encodeEncapsulationKey(ek[:len(ek)-1]),
+		"unreduced":      encodeEncapsulationKey(unreduced),
+		"two blocks":     append(encodeEncapsulationKey(ek), encodeEncapsulationKey(ek)...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ValidateEncapsulationKey(pemBytes)
+			assert.Error(t, err)
+		})
+	}
+}
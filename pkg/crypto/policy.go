@@ -0,0 +1,175 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"filippo.io/mldsa"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+)
+
+var (
+	ErrKeyAlgorithmNotAllowed   = errors.New("machine key algorithm is not allowed by policy")
+	ErrJWTAlgorithmNotAllowed   = errors.New("JWT algorithm is not allowed by policy")
+	ErrClassicalKeyMigrationDue = errors.New("classical ECDSA keys are no longer accepted; rotate this machine to an ML-DSA key via PUT /api/v1/machines/key")
+)
+
+// AlgorithmPolicy restricts which machine key types and JWT algorithms may be
+// used. Nil lists allow everything.
+type AlgorithmPolicy struct {
+	KeyAlgorithms []string
+	JWTAlgorithms []string
+	RequireHybrid bool
+	// ClassicalMigrateBy is the deadline after which ECDSA-only machines must
+	// rotate to an ML-DSA (or hybrid) key.
+	ClassicalMigrateBy *time.Time
+}
+
+func (kt KeyType) String() string {
+	switch kt {
+	case KeyTypeECDSA:
+		return "ecdsa"
+	case KeyTypeMLDSA:
+		return "ml-dsa"
+	case KeyTypeHybrid:
+		return "hybrid"
+	default:
+		return "unknown"
+	}
+}
+
+func KeyTypeFromString(name string) (KeyType, error) {
+	for _, kt := range []KeyType{KeyTypeECDSA, KeyTypeMLDSA, KeyTypeHybrid} {
+		if kt.String() == name {
+			return kt, nil
+		}
+	}
+	return KeyTypeUnknown, fmt.Errorf("unsupported key algorithm: %s", name)
+}
+
+func IsSupportedJWTAlgorithm(alg string) bool {
+	switch alg {
+	case jwa.ES256.String(), jwa.ES512.String(), mldsa.MLDSA44().String(), mldsa.MLDSA65().String(), mldsa.MLDSA87().String():
+		return true
+	default:
+		return IsCompositeAlgorithm(alg)
+	}
+}
+
+// LoadServerAlgorithmPolicy reads the server-wide default policy from
+// ALLOWED_KEY_ALGORITHMS, ALLOWED_JWT_ALGORITHMS (comma separated) and
+// CLASSICAL_KEY_MIGRATE_BY (RFC 3339).
+func LoadServerAlgorithmPolicy() (AlgorithmPolicy, error) {
+	policy := AlgorithmPolicy{
+		KeyAlgorithms: splitList(os.Getenv("ALLOWED_KEY_ALGORITHMS")),
+		JWTAlgorithms: splitList(os.Getenv("ALLOWED_JWT_ALGORITHMS")),
+	}
+	if deadline := os.Getenv("CLASSICAL_KEY_MIGRATE_BY"); deadline != "" {
+		t, err := time.Parse(time.RFC3339, deadline)
+		if err != nil {
+			return AlgorithmPolicy{}, fmt.Errorf("invalid CLASSICAL_KEY_MIGRATE_BY: %w", err)
+		}
+		policy.ClassicalMigrateBy = &t
+	}
+	if err := policy.Validate(); err != nil {
+		return AlgorithmPolicy{}, err
+	}
+	return policy, nil
+}
+
+// PolicyForUser combines the server-wide policy with the user's own. A user can
+// only narrow the server policy, never widen it.
+func PolicyForUser(user *models.User) (AlgorithmPolicy, error) {
+	server, err := LoadServerAlgorithmPolicy()
+	if err != nil {
+		return AlgorithmPolicy{}, err
+	}
+	policy := AlgorithmPolicy{
+		KeyAlgorithms:      intersect(server.KeyAlgorithms, user.AllowedKeyAlgorithms),
+		JWTAlgorithms:      intersect(server.JWTAlgorithms, user.AllowedJWTAlgorithms),
+		RequireHybrid:      user.RequireHybridAuth,
+		ClassicalMigrateBy: server.ClassicalMigrateBy,
+	}
+	if user.ClassicalMigrateBy != nil && (policy.ClassicalMigrateBy == nil || user.ClassicalMigrateBy.Before(*policy.ClassicalMigrateBy)) {
+		policy.ClassicalMigrateBy = user.ClassicalMigrateBy
+	}
+	return policy, nil
+}
+
+func (p AlgorithmPolicy) Validate() error {
+	for _, name := range p.KeyAlgorithms {
+		if _, err := KeyTypeFromString(name); err != nil {
+			return err
+		}
+	}
+	for _, alg := range p.JWTAlgorithms {
+		if !IsSupportedJWTAlgorithm(alg) {
+			return fmt.Errorf("unsupported JWT algorithm: %s", alg)
+		}
+	}
+	return nil
+}
+
+// CheckKeyType reports whether a machine may hold a key of the given type.
+func (p AlgorithmPolicy) CheckKeyType(kt KeyType, now time.Time) error {
+	if p.RequireHybrid && kt != KeyTypeHybrid {
+		return ErrKeyAlgorithmNotAllowed
+	}
+	if p.KeyAlgorithms != nil && !slices.Contains(p.KeyAlgorithms, kt.String()) {
+		return ErrKeyAlgorithmNotAllowed
+	}
+	if kt == KeyTypeECDSA && p.ClassicalMigrateBy != nil && !now.Before(*p.ClassicalMigrateBy) {
+		return ErrClassicalKeyMigrationDue
+	}
+	return nil
+}
+
+func (p AlgorithmPolicy) CheckJWTAlgorithm(alg string) error {
+	if p.RequireHybrid && !IsCompositeAlgorithm(alg) {
+		return ErrJWTAlgorithmNotAllowed
+	}
+	if p.JWTAlgorithms != nil && !slices.Contains(p.JWTAlgorithms, alg) {
+		return ErrJWTAlgorithmNotAllowed
+	}
+	return nil
+}
+
+// PendingMigration returns the migration deadline when kt is a classical key
+// that is still accepted but will stop being accepted in the future.
+func (p AlgorithmPolicy) PendingMigration(kt KeyType, now time.Time) (time.Time, bool) {
+	if kt != KeyTypeECDSA || p.ClassicalMigrateBy == nil || !now.Before(*p.ClassicalMigrateBy) {
+		return time.Time{}, false
+	}
+	return *p.ClassicalMigrateBy, true
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func intersect(server, user []string) []string {
+	if server == nil {
+		return user
+	}
+	if user == nil {
+		return server
+	}
+	result := []string{}
+	for _, item := range user {
+		if slices.Contains(server, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,76 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+)
+
+func TestLoadServerAlgorithmPolicy(t *testing.T) {
+	t.Setenv("ALLOWED_KEY_ALGORITHMS", "ml-dsa, hybrid")
+	t.Setenv("ALLOWED_JWT_ALGORITHMS", "ML-DSA-65,ML-DSA-65-ES256")
+	t.Setenv("CLASSICAL_KEY_MIGRATE_BY", "2027-01-01T00:00:00Z")
+	policy, err := LoadServerAlgorithmPolicy()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ml-dsa", "hybrid"}, policy.KeyAlgorithms)
+	assert.Equal(t, []string{"ML-DSA-65", "ML-DSA-65-ES256"}, policy.JWTAlgorithms)
+	require.NotNil(t, policy.ClassicalMigrateBy)
+	assert.Equal(t, 2027, policy.ClassicalMigrateBy.Year())
+}
+
+func TestLoadServerAlgorithmPolicy_Invalid(t *testing.T) {
+	t.Setenv("ALLOWED_KEY_ALGORITHMS", "rsa")
+	_, err := LoadServerAlgorithmPolicy()
+	assert.Error(t, err)
+
+	t.Setenv("ALLOWED_KEY_ALGORITHMS", "")
+	t.Setenv("CLASSICAL_KEY_MIGRATE_BY", "next tuesday")
+	_, err = LoadServerAlgorithmPolicy()
+	assert.Error(t, err)
+}
+
+func TestPolicyForUser_NarrowsServerPolicy(t *testing.T) {
+	t.Setenv("ALLOWED_KEY_ALGORITHMS", "ecdsa,ml-dsa")
+	t.Setenv("CLASSICAL_KEY_MIGRATE_BY", "2027-01-01T00:00:00Z")
+	userDeadline := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	user := &models.User{AllowedKeyAlgorithms: []string{"ml-dsa", "hybrid"}, ClassicalMigrateBy: &userDeadline}
+	policy, err := PolicyForUser(user)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ml-dsa"}, policy.KeyAlgorithms)
+	assert.Equal(t, userDeadline, *policy.ClassicalMigrateBy)
+}
+
+func TestPolicyForUser_EmptyIntersectionDeniesAll(t *testing.T) {
+	t.Setenv("ALLOWED_KEY_ALGORITHMS", "ml-dsa")
+	policy, err := PolicyForUser(&models.User{AllowedKeyAlgorithms: []string{"ecdsa"}})
+	require.NoError(t, err)
+	assert.ErrorIs(t, policy.CheckKeyType(KeyTypeMLDSA, time.Now()), ErrKeyAlgorithmNotAllowed)
+	assert.ErrorIs(t, policy.CheckKeyType(KeyTypeECDSA, time.Now()), ErrKeyAlgorithmNotAllowed)
+}
+
+func TestAlgorithmPolicy_CheckKeyType_ClassicalDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	policy := AlgorithmPolicy{ClassicalMigrateBy: &deadline}
+	assert.NoError(t, policy.CheckKeyType(KeyTypeECDSA, time.Now()))
+	assert.ErrorIs(t, policy.CheckKeyType(KeyTypeECDSA, deadline.Add(time.Second)), ErrClassicalKeyMigrationDue)
+	assert.NoError(t, policy.CheckKeyType(KeyTypeMLDSA, deadline.Add(time.Second)))
+
+	pendingDeadline, pending := policy.PendingMigration(KeyTypeECDSA, time.Now())
+	assert.True(t, pending)
+	assert.Equal(t, deadline, pendingDeadline)
+	_, pending = policy.PendingMigration(KeyTypeMLDSA, time.Now())
+	assert.False(t, pending)
+}
+
+func TestAlgorithmPolicy_CheckJWTAlgorithm(t *testing.T) {
+	policy := AlgorithmPolicy{JWTAlgorithms: []string{"ML-DSA-65"}}
+	assert.NoError(t, policy.CheckJWTAlgorithm("ML-DSA-65"))
+	assert.ErrorIs(t, policy.CheckJWTAlgorithm("ES256"), ErrJWTAlgorithmNotAllowed)
+
+	hybrid := AlgorithmPolicy{RequireHybrid: true}
+	assert.NoError(t, hybrid.CheckJWTAlgorithm("ML-DSA-65-ES256"))
+	assert.ErrorIs(t, hybrid.CheckJWTAlgorithm("ML-DSA-65"), ErrJWTAlgorithmNotAllowed)
+}
@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"filippo.io/mldsa"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// PublicKey is a parsed machine public key. Parsing is comparatively expensive,
+// so a PublicKey can be kept and reused to verify many tokens.
+type PublicKey struct {
+	Type        KeyType
+	EC          jwk.Key
+	MLDSA       *mldsa.PublicKey
+	MLDSAParams *mldsa.Parameters
+}
+
+func ParsePublicKey(pemBytes []byte) (*PublicKey, error) {
+	kt := DetectKeyType(pemBytes)
+	pk := &PublicKey{Type: kt}
+	switch kt {
+	case KeyTypeECDSA:
+		key, err := jwk.ParseKey(pemBytes, jwk.WithPEM(true))
+		if err != nil {
+			return nil, fmt.Errorf("parsing EC public key: %w", err)
+		}
+		pk.EC = key
+	case KeyTypeMLDSA:
+		if err := pk.parseMLDSA(pemBytes); err != nil {
+			return nil, err
+		}
+	case KeyTypeHybrid:
+		ecPEM, err := ExtractPublicKey(pemBytes, KeyTypeECDSA)
+		if err != nil {
+			return nil, err
+		}
+		key, err := jwk.ParseKey(ecPEM, jwk.WithPEM(true))
+		if err != nil {
+			return nil, fmt.Errorf("parsing EC public key: %w", err)
+		}
+		pk.EC = key
+		mldsaPEM, err := ExtractPublicKey(pemBytes, KeyTypeMLDSA)
+		if err != nil {
+			return nil, err
+		}
+		if err := pk.parseMLDSA(mldsaPEM); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	return pk, nil
+}
+
+func (pk *PublicKey) parseMLDSA(pemBytes []byte) error {
+	block, _ := pem.Decode(pemBytes)
+	params, ok := mldsaAlgorithmBySize(len(block.Bytes))
+	if !ok {
+		return errors.New("parsing ML-DSA public key: unrecognized key size")
+	}
+	key, err := ParseMLDSAPublicKey(pemBytes, params)
+	if err != nil {
+		return fmt.Errorf("parsing ML-DSA public key: %w", err)
+	}
+	pk.MLDSA = key
+	pk.MLDSAParams = params
+	return nil
+}
+
+// VerifyJWT verifies a token signed with alg against this key. A hybrid key
+// only accepts composite tokens, since either half alone would let a break of
+// one algorithm through.
+func (pk *PublicKey) VerifyJWT(tokenString, alg string) error {
+	if pk.Type == KeyTypeHybrid {
+		if _, err := ParseCompositeAlgorithm(alg); err != nil {
+			return fmt.Errorf("hybrid public key requires a composite JWT, not %s", alg)
+		}
+	}
+	switch alg {
+	case jwa.ES256.String(), jwa.ES512.String():
+		if pk.EC == nil {
+			return errors.New("EC JWT requires an ECDSA public key")
+		}
+		if _, err := jwt.ParseString(tokenString, jwt.WithKey(jwa.SignatureAlgorithm(alg), pk.EC)); err != nil {
+			return fmt.Errorf("EC JWT verification failed: %w", err)
+		}
+	case mldsa.MLDSA44().String(), mldsa.MLDSA65().String(), mldsa.MLDSA87().String():
+		if err := pk.checkMLDSAParams(alg); err != nil {
+			return err
+		}
+		if err := VerifyMLDSAJWT(tokenString, pk.MLDSA); err != nil {
+			return err
+		}
+	default:
+		compositeAlg, err := ParseCompositeAlgorithm(alg)
+		if err != nil {
+			return fmt.Errorf("unsupported JWT algorithm: %s", alg)
+		}
+		if pk.Type != KeyTypeHybrid {
+			return errors.New("composite JWT requires a hybrid public key")
+		}
+		if err := pk.checkMLDSAParams(compositeAlg.MLDSA.String()); err != nil {
+			return err
+		}
+		if err := VerifyCompositeJWT(tokenString, compositeAlg, pk.EC, pk.MLDSA); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pk *PublicKey) checkMLDSAParams(alg string) error {
+	if pk.MLDSA == nil {
+		return errors.New("ML-DSA JWT requires an ML-DSA public key")
+	}
+	if pk.MLDSAParams.String() != alg {
+		return fmt.Errorf("ML-DSA public key is %s, not %s", pk.MLDSAParams.String(), alg)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package crypto
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/rs/zerolog/log"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+)
+
+const (
+	SessionIssuer    = "ssh-sync-server"
+	SessionTokenType = "ssh-sync-session+jwt"
+
+	defaultSessionTTL = 15 * time.Minute
+
+	revocationListenRetryDelay = 5 * time.Second
+)
+
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+type SessionClaims struct {
+	UserID      uuid.UUID
+	Username    string
+	MachineID   uuid.UUID
+	MachineName string
+	IssuedAt    time.Time
+	ExpiresAt   time.Time
+}
+
+// SessionRevocationStore shares session revocations between server
+// instances.
+type SessionRevocationStore interface {
+	SaveSessionRevocation(revocation models.SessionRevocation) error
+	// GetSessionRevocations returns every revocation that has not expired.
+	GetSessionRevocations() ([]models.SessionRevocation, error)
+	// ListenSessionRevocations calls listening once it receives revocations
+	// and revoked for every revocation saved from then on, until ctx is done
+	// or the store is disconnected.
+	ListenSessionRevocations(ctx context.Context, listening func(), revoked func(models.SessionRevocation)) error
+}
+
+// SessionManager issues and verifies short-lived, server-signed session tokens
+// that are exchanged for a client-signed token. Revocations of a user or
+// machine are kept in memory, so verifying a session needs no database.
+type SessionManager struct {
+	key       jwk.Key
+	publicKey jwk.Key
+	ttl       time.Duration
+	store     SessionRevocationStore
+
+	mu      sync.Mutex
+	revoked map[uuid.UUID]models.SessionRevocation
+}
+
+// LoadSessionManager creates the session manager from SESSION_SIGNING_KEY_FILE
+// (a PEM encoded ECDSA P-256 private key) and SESSION_TOKEN_TTL (a Go duration,
+// 15m by default). Without a signing key file an ephemeral key is generated, so
+// sessions do not survive a restart. Revocations only apply to this server
+// process.
+func LoadSessionManager() (*SessionManager, error) {
+	return loadSessionManager(nil)
+}
+
+// LoadSharedSessionManager creates the session manager like
+// LoadSessionManager, sharing revocations with the other server instances
+// through store. The live revocations are loaded at once and kept current
+// while the manager listens for new ones.
+func LoadSharedSessionManager(store SessionRevocationStore) (*SessionManager, error) {
+	s, err := loadSessionManager(store)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load session revocations: %w", err)
+	}
+	go s.Listen(context.Background())
+	return s, nil
+}
+
+func loadSessionManager(store SessionRevocationStore) (*SessionManager, error) {
+	ttl := defaultSessionTTL
+	if ttlStr := os.Getenv("SESSION_TOKEN_TTL"); ttlStr != "" {
+		parsed, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SESSION_TOKEN_TTL: %w", err)
+		}
+		if parsed <= 0 {
+			return nil, errors.New("SESSION_TOKEN_TTL must be positive")
+		}
+		ttl = parsed
+	}
+	keyFile := os.Getenv("SESSION_SIGNING_KEY_FILE")
+	if keyFile == "" {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewSharedSessionManager(priv, ttl, store)
+	}
+	keyBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SESSION_SIGNING_KEY_FILE: %w", err)
+	}
+	raw, err := jwk.ParseKey(keyBytes, jwk.WithPEM(true))
+	if err != nil {
+		return nil, fmt.Errorf("invalid session signing key: %w", err)
+	}
+	var priv ecdsa.PrivateKey
+	if err := raw.Raw(&priv); err != nil {
+		return nil, errors.New("session signing key must be an ECDSA private key")
+	}
+	return NewSharedSessionManager(&priv, ttl, store)
+}
+
+func NewSessionManager(priv *ecdsa.PrivateKey, ttl time.Duration) (*SessionManager, error) {
+	return NewSharedSessionManager(priv, ttl, nil)
+}
+
+func NewSharedSessionManager(priv *ecdsa.PrivateKey, ttl time.Duration, store SessionRevocationStore) (*SessionManager, error) {
+	if priv.Curve != elliptic.P256() {
+		return nil, errors.New("session signing key must use the P-256 curve")
+	}
+	key, err := jwk.FromRaw(priv)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := jwk.PublicKeyOf(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionManager{
+		key:       key,
+		publicKey: publicKey,
+		ttl:       ttl,
+		store:     store,
+		revoked:   make(map[uuid.UUID]models.SessionRevocation),
+	}, nil
+}
+
+// IsSessionToken reports whether the token claims to be a session token. It does
+// not verify the token.
+func IsSessionToken(tokenString string) bool {
+	header, err := parseJWTHeader(tokenString)
+	return err == nil && header.Typ == SessionTokenType
+}
+
+func (s *SessionManager) Issue(user *models.User, machine *models.Machine) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(s.ttl)
+	token, err := jwt.NewBuilder().
+		Issuer(SessionIssuer).
+		Subject(user.ID.String()).
+		IssuedAt(now).
+		Expiration(expiresAt).
+		Claim("username", user.Username).
+		Claim("machine", machine.Name).
+		Claim("machine_id", machine.ID.String()).
+		Build()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.TypeKey, SessionTokenType); err != nil {
+		return "", time.Time{}, err
+	}
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.ES256, s.key, jws.WithProtectedHeaders(headers)))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return string(signed), expiresAt.Truncate(time.Second), nil
+}
+
+func (s *SessionManager) Verify(tokenString string) (*SessionClaims, error) {
+	if !IsSessionToken(tokenString) {
+		return nil, errors.New("not a session token")
+	}
+	token, err := jwt.ParseString(tokenString, jwt.WithKey(jwa.ES256, s.publicKey), jwt.WithIssuer(SessionIssuer))
+	if err != nil {
+		return nil, fmt.Errorf("session token verification failed: %w", err)
+	}
+	userID, err := uuid.Parse(token.Subject())
+	if err != nil {
+		return nil, errors.New("invalid session subject")
+	}
+	claims := token.PrivateClaims()
+	username, _ := claims["username"].(string)
+	machineName, _ := claims["machine"].(string)
+	machineIDStr, _ := claims["machine_id"].(string)
+	machineID, err := uuid.Parse(machineIDStr)
+	if err != nil || username == "" || machineName == "" {
+		return nil, errors.New("invalid session claims")
+	}
+	if s.isRevoked(token.IssuedAt(), userID, machineID) {
+		return nil, ErrSessionRevoked
+	}
+	return &SessionClaims{
+		UserID:      userID,
+		Username:    username,
+		MachineID:   machineID,
+		MachineName: machineName,
+		IssuedAt:    token.IssuedAt(),
+		ExpiresAt:   token.Expiration(),
+	}, nil
+}
+
+// RevokeMachine invalidates every session issued to the machine so far.
+func (s *SessionManager) RevokeMachine(id uuid.UUID) error {
+	return s.revoke(id)
+}
+
+// RevokeUser invalidates every session issued to any of the user's machines so far.
+func (s *SessionManager) RevokeUser(id uuid.UUID) error {
+	return s.revoke(id)
+}
+
+// revoke records the revocation until every session it covers has expired,
+// and shares it with the other server instances.
+func (s *SessionManager) revoke(id uuid.UUID) error {
+	now := time.Now()
+	revocation := models.SessionRevocation{SubjectID: id, RevokedAt: now, ExpiresAt: now.Add(s.ttl)}
+	s.record(revocation)
+	if s.store == nil {
+		return nil
+	}
+	return s.store.SaveSessionRevocation(revocation)
+}
+
+// record keeps the revocation unless a later one of the same subject is
+// already known, and clears out expired revocations.
+func (s *SessionManager) record(revocation models.SessionRevocation) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, known := range s.revoked {
+		if now.After(known.ExpiresAt) {
+			delete(s.revoked, id)
+		}
+	}
+	if known, ok := s.revoked[revocation.SubjectID]; ok && known.RevokedAt.After(revocation.RevokedAt) {
+		return
+	}
+	s.revoked[revocation.SubjectID] = revocation
+}
+
+func (s *SessionManager) isRevoked(issuedAt time.Time, subjectIDs ...uuid.UUID) bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range subjectIDs {
+		revocation, ok := s.revoked[id]
+		if !ok || now.After(revocation.ExpiresAt) {
+			continue
+		}
+		// iat only has second precision, so a token issued in the same second
+		// as the revocation is treated as revoked.
+		if !issuedAt.After(revocation.RevokedAt.Truncate(time.Second)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload records every live revocation in the store.
+func (s *SessionManager) reload() error {
+	revocations, err := s.store.GetSessionRevocations()
+	if err != nil {
+		return err
+	}
+	for _, revocation := range revocations {
+		s.record(revocation)
+	}
+	return nil
+}
+
+// Listen records the revocations saved by other server instances until ctx is
+// done, reconnecting whenever the store is disconnected.
+func (s *SessionManager) Listen(ctx context.Context) {
+	for {
+		err := s.store.ListenSessionRevocations(ctx, func() {
+			// Revocations may have been missed while disconnected.
+			if err := s.reload(); err != nil {
+				log.Err(err).Msg("error reloading session revocations")
+			}
+		}, s.record)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Err(err).Msg("session revocation listener disconnected")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(revocationListenRetryDelay):
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package crypto
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+)
+
+func newTestSession(t *testing.T) (*SessionManager, *models.User, *models.Machine) {
+	t.Helper()
+	sessionManager, err := LoadSessionManager()
+	require.NoError(t, err)
+	user := &models.User{ID: uuid.New(), Username: "user1"}
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "machine1"}
+	return sessionManager, user, machine
+}
+
+func TestSessionManager_IssueAndVerify(t *testing.T) {
+	sessionManager, user, machine := newTestSession(t)
+	token, expiresAt, err := sessionManager.Issue(user, machine)
+	require.NoError(t, err)
+	assert.True(t, IsSessionToken(token))
+	assert.WithinDuration(t, time.Now().Add(defaultSessionTTL), expiresAt, 2*time.Second)
+
+	claims, err := sessionManager.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, claims.UserID)
+	assert.Equal(t, user.Username, claims.Username)
+	assert.Equal(t, machine.ID, claims.MachineID)
+	assert.Equal(t, machine.Name, claims.MachineName)
+}
+
+func TestSessionManager_VerifyOtherServerKey(t *testing.T) {
+	sessionManager, user, machine := newTestSession(t)
+	other, _, _ := newTestSession(t)
+	token, _, err := other.Issue(user, machine)
+	require.NoError(t, err)
+	_, err = sessionManager.Verify(token)
+	assert.Error(t, err)
+}
+
+func TestSessionManager_VerifyExpired(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	sessionManager, err := NewSessionManager(priv, -time.Minute)
+	require.NoError(t, err)
+	token, _, err := sessionManager.Issue(&models.User{ID: uuid.New(), Username: "user1"}, &models.Machine{ID: uuid.New(), Name: "machine1"})
+	require.NoError(t, err)
+	_, err = sessionManager.Verify(token)
+	assert.Error(t, err)
+}
+
+func TestSessionManager_ClientTokenIsNotSession(t *testing.T) {
+	priv, _ := generateECDSAKeyPair(t, elliptic.P256())
+	token := signECDSAJWT(t, priv, jwa.ES256, time.Now().Add(time.Minute))
+	assert.False(t, IsSessionToken(token))
+}
+
+func TestSessionManager_RevokeMachine(t *testing.T) {
+	sessionManager, user, machine := newTestSession(t)
+	token, _, err := sessionManager.Issue(user, machine)
+	require.NoError(t, err)
+	otherMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "machine2"}
+	otherToken, _, err := sessionManager.Issue(user, otherMachine)
+	require.NoError(t, err)
+
+	require.NoError(t, sessionManager.RevokeMachine(machine.ID))
+
+	_, err = sessionManager.Verify(token)
+	assert.ErrorIs(t, err, ErrSessionRevoked)
+	_, err = sessionManager.Verify(otherToken)
+	assert.NoError(t, err)
+}
+
+func TestSessionManager_RevokeUser(t *testing.T) {
+	sessionManager, user, machine := newTestSession(t)
+	token, _, err := sessionManager.Issue(user, machine)
+	require.NoError(t, err)
+
+	require.NoError(t, sessionManager.RevokeUser(user.ID))
+
+	_, err = sessionManager.Verify(token)
+	assert.ErrorIs(t, err, ErrSessionRevoked)
+}
+
+// fakeSessionRevocationStore delivers saved revocations to its listeners, like
+// a database notifying every server instance.
+type fakeSessionRevocationStore struct {
+	mu          sync.Mutex
+	revocations []models.SessionRevocation
+	listeners   []func(models.SessionRevocation)
+}
+
+func (f *fakeSessionRevocationStore) SaveSessionRevocation(revocation models.SessionRevocation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revocations = append(f.revocations, revocation)
+	for _, listener := range f.listeners {
+		listener(revocation)
+	}
+	return nil
+}
+
+func (f *fakeSessionRevocationStore) GetSessionRevocations() ([]models.SessionRevocation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]models.SessionRevocation(nil), f.revocations...), nil
+}
+
+func (f *fakeSessionRevocationStore) ListenSessionRevocations(ctx context.Context, listening func(), revoked func(models.SessionRevocation)) error {
+	f.mu.Lock()
+	f.listeners = append(f.listeners, revoked)
+	f.mu.Unlock()
+	listening()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestSessionManager_SharedRevocations(t *testing.T) {
+	store := &fakeSessionRevocationStore{}
+	first, err := LoadSharedSessionManager(store)
+	require.NoError(t, err)
+	second, err := LoadSharedSessionManager(store)
+	require.NoError(t, err)
+	user := &models.User{ID: uuid.New(), Username: "user1"}
+	token, _, err := first.Issue(user, &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "machine1"})
+	require.NoError(t, err)
+
+	require.NoError(t, second.RevokeUser(user.ID))
+
+	assert.Eventually(t, func() bool {
+		_, err := first.Verify(token)
+		return errors.Is(err, ErrSessionRevoked)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionManager_LoadsRevocations(t *testing.T) {
+	store := &fakeSessionRevocationStore{}
+	first, err := LoadSharedSessionManager(store)
+	require.NoError(t, err)
+	user := &models.User{ID: uuid.New(), Username: "user1"}
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "machine1"}
+	token, _, err := first.Issue(user, machine)
+	require.NoError(t, err)
+	require.NoError(t, first.RevokeMachine(machine.ID))
+
+	// A restarted server instance knows the revocation before listening.
+	restarted, err := LoadSharedSessionManager(&fakeSessionRevocationStore{revocations: store.revocations})
+	require.NoError(t, err)
+	restarted.key, restarted.publicKey = first.key, first.publicKey
+
+	_, err = restarted.Verify(token)
+	assert.ErrorIs(t, err, ErrSessionRevoked)
+}
+
+func TestLoadSessionManager_KeyFile(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	keyFile := filepath.Join(t.TempDir(), "session.pem")
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	t.Setenv("SESSION_SIGNING_KEY_FILE", keyFile)
+	t.Setenv("SESSION_TOKEN_TTL", "5m")
+
+	first, err := LoadSessionManager()
+	require.NoError(t, err)
+	second, err := LoadSessionManager()
+	require.NoError(t, err)
+	user := &models.User{ID: uuid.New(), Username: "user1"}
+	token, expiresAt, err := first.Issue(user, &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "machine1"})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), expiresAt, 2*time.Second)
+	_, err = second.Verify(token)
+	assert.NoError(t, err)
+}
+
+func TestLoadSessionManager_InvalidTTL(t *testing.T) {
+	t.Setenv("SESSION_TOKEN_TTL", "soon")
+	_, err := LoadSessionManager()
+	assert.Error(t, err)
+}
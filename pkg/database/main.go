@@ -21,18 +21,24 @@ type DataAccessorImpl struct {
 }
 
 func (d *DataAccessorImpl) Connect() error {
+	conn, err := Connect(context.Background())
+	if err != nil {
+		return err
+	}
+	d.Connection = conn
+	return nil
+}
+
+// Connect opens a new connection to the configured database, for callers that
+// need one of their own, such as to LISTEN for notifications.
+func Connect(ctx context.Context) (*pgx.Conn, error) {
 	data := url.URL{
 		Scheme: "postgresql",
 		User:   url.UserPassword(os.Getenv("DATABASE_USERNAME"), os.Getenv("DATABASE_PASSWORD")),
 		Host:   os.Getenv("DATABASE_HOST"),
 	}
 	data.Query().Add("database", os.Getenv("DATABASE_NAME"))
-	conn, err := pgx.Connect(context.Background(), data.String())
-	if err != nil {
-		return err
-	}
-	d.Connection = conn
-	return nil
+	return pgx.Connect(ctx, data.String())
 }
 
 func NewDataAccessorService(i *do.Injector) (DataAccessor, error) {
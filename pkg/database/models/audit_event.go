@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// AuditChallengeLookupFailed records an answer to a challenge phrase that
+	// matched no open challenge of the user.
+	AuditChallengeLookupFailed = "challenge_lookup_failed"
+	// AuditChallengeLookupBlocked records an answer refused because of too
+	// many failed lookups.
+	AuditChallengeLookupBlocked = "challenge_lookup_blocked"
+	// AuditRecoveryKeyRegistered records a machine registering a recovery
+	// key for its user.
+	AuditRecoveryKeyRegistered = "recovery_key_registered"
+	// AuditRecoveryKeyUsed records a recovery key enrolling a new machine.
+	AuditRecoveryKeyUsed = "recovery_key_used"
+)
+
+// AuditEvent is a security relevant event kept for later review.
+type AuditEvent struct {
+	ID        uuid.UUID  `db:"id"`
+	Event     string     `db:"event"`
+	UserID    *uuid.UUID `db:"user_id"`
+	MachineID *uuid.UUID `db:"machine_id"`
+	SourceIP  string     `db:"source_ip"`
+	UserAgent string     `db:"user_agent"`
+	Details   string     `db:"details"`
+	CreatedAt time.Time  `db:"created_at"`
+}
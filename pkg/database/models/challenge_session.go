@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ChallengeSession is a pending challenge for adding a machine, shared between
+// server instances. It is keyed by a hash of the challenge phrase and carries
+// the keys exchanged between the new and the existing machine.
+type ChallengeSession struct {
+	ID                 string     `db:"id"`
+	Username           string     `db:"username"`
+	PublicKey          []byte     `db:"public_key"`
+	EncapsulationKey   []byte     `db:"encapsulation_key"`
+	EncryptedMasterKey []byte     `db:"encrypted_master_key"`
+	CreatedAt          time.Time  `db:"created_at"`
+	AcceptedAt         *time.Time `db:"accepted_at"`
+
+	// MachineName, SourceIP and UserAgent describe the new machine to the
+	// existing machine approving it.
+	MachineName string `db:"machine_name"`
+	SourceIP    string `db:"source_ip"`
+	UserAgent   string `db:"user_agent"`
+
+	// DeniedAt is set instead of EncryptedMasterKey when the existing machine
+	// refuses the new one.
+	DeniedAt     *time.Time `db:"denied_at"`
+	DeniedReason *string    `db:"denied_reason"`
+
+	// Quorum is how many distinct machines must approve the new machine.
+	// JoinedBy holds the machines that joined the challenge and ApprovedBy
+	// those that sent the encrypted master key; the first key sent is kept.
+	Quorum     int         `db:"quorum"`
+	JoinedBy   []uuid.UUID `db:"joined_by"`
+	ApprovedBy []uuid.UUID `db:"approved_by"`
+}
+
+// IsApproved reports whether enough machines have sent the master key.
+func (s *ChallengeSession) IsApproved() bool {
+	return len(s.ApprovedBy) >= max(1, s.Quorum)
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeviceAuthorization is a request by a new machine to be added to a user,
+// approved from one of the user's existing machines over plain HTTP instead of
+// the live challenge. The new machine polls with the device code, of which only
+// a hash is stored, until the request is approved.
+type DeviceAuthorization struct {
+	ID               uuid.UUID  `db:"id"`
+	UserID           uuid.UUID  `db:"user_id"`
+	MachineName      string     `db:"machine_name"`
+	PublicKey        []byte     `db:"public_key"`
+	EncapsulationKey []byte     `db:"encapsulation_key"`
+	DeviceCodeHash   string     `db:"device_code_hash"`
+	UserCode         string     `db:"user_code"`
+	CreatedAt        time.Time  `db:"created_at"`
+	ExpiresAt        time.Time  `db:"expires_at"`
+	LastPolledAt     *time.Time `db:"last_polled_at"`
+
+	// EncryptedMasterKey is set, together with ApprovedAt and ApprovedBy, when
+	// an existing machine approves the request.
+	EncryptedMasterKey []byte     `db:"encrypted_master_key"`
+	ApprovedAt         *time.Time `db:"approved_at"`
+	ApprovedBy         *uuid.UUID `db:"approved_by"`
+}
+
+func (a *DeviceAuthorization) IsApproved() bool {
+	return a.ApprovedAt != nil
+}
+
+func (a *DeviceAuthorization) IsExpired(now time.Time) bool {
+	return !now.Before(a.ExpiresAt)
+}
@@ -1,13 +1,62 @@
 package models
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 )
 
 type Machine struct {
-	ID               uuid.UUID `json:"id" db:"id"`
-	UserID           uuid.UUID `json:"user_id" db:"user_id"`
-	Name             string    `json:"name" db:"name"`
-	PublicKey        []byte    `json:"public_key" db:"public_key"`
-	EncapsulationKey []byte    `json:"encapsulation_key,omitempty" db:"encapsulation_key"`
+	ID               uuid.UUID  `json:"id" db:"id"`
+	UserID           uuid.UUID  `json:"user_id" db:"user_id"`
+	Name             string     `json:"name" db:"name"`
+	PublicKey        []byte     `json:"public_key" db:"public_key"`
+	EncapsulationKey []byte     `json:"encapsulation_key,omitempty" db:"encapsulation_key"`
+	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
+	SuspendedAt      *time.Time `json:"suspended_at,omitempty" db:"suspended_at"`
+	SuspendedReason  *string    `json:"suspended_reason,omitempty" db:"suspended_reason"`
+	ReinstatedAt     *time.Time `json:"reinstated_at,omitempty" db:"reinstated_at"`
+	PreviousNames    []string   `json:"previous_names,omitempty" db:"previous_names"`
+	// CompromisedAt is when the machine was reported compromised. Such a
+	// machine stays suspended for good.
+	CompromisedAt *time.Time `json:"compromised_at,omitempty" db:"compromised_at"`
+	// RecoveryKey marks a paper recovery key, which is given the master key
+	// like a machine but can only authenticate to recover the account.
+	RecoveryKey bool `json:"recovery_key,omitempty" db:"recovery_key"`
+	MachineActivity
+}
+
+// MachineActivity is what the server last saw of a machine authenticating.
+type MachineActivity struct {
+	LastSeenAt        *time.Time `json:"last_seen_at,omitempty" db:"last_seen_at"`
+	LastSeenIP        *string    `json:"last_seen_ip,omitempty" db:"last_seen_ip"`
+	LastSeenUserAgent *string    `json:"last_seen_user_agent,omitempty" db:"last_seen_user_agent"`
+	// LastAuthAlgorithm is the JWT algorithm of the last client-signed token.
+	LastAuthAlgorithm *string `json:"last_auth_algorithm,omitempty" db:"last_auth_algorithm"`
+}
+
+func (m *Machine) IsSuspended() bool {
+	return m.SuspendedAt != nil
+}
+
+func (m *Machine) IsCompromised() bool {
+	return m.CompromisedAt != nil
+}
+
+// CanApprove reports whether the machine can approve new machines. Recovery
+// keys cannot, since they do not sign in.
+func (m *Machine) CanApprove() bool {
+	return !m.IsSuspended() && !m.RecoveryKey
+}
+
+// LastActiveAt is the latest of when the machine was created, last seen or last
+// reinstated.
+func (m *Machine) LastActiveAt() time.Time {
+	lastActive := m.CreatedAt
+	for _, t := range []*time.Time{m.LastSeenAt, m.ReinstatedAt} {
+		if t != nil && t.After(lastActive) {
+			lastActive = *t
+		}
+	}
+	return lastActive
 }
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MachineKeyHistory is a public key a machine used before it was replaced.
+type MachineKeyHistory struct {
+	ID         uuid.UUID `db:"id"`
+	MachineID  uuid.UUID `db:"machine_id"`
+	PublicKey  []byte    `db:"public_key"`
+	ReplacedAt time.Time `db:"replaced_at"`
+}
@@ -10,5 +10,14 @@ type MasterKeyRotation struct {
 	ID                 uuid.UUID `db:"id"`
 	MachineID          uuid.UUID `db:"machine_id"`
 	EncryptedMasterKey []byte    `db:"encrypted_master_key"`
+	Epoch              int64     `db:"epoch"`
 	CreatedAt          time.Time `db:"created_at"`
+
+	// AcknowledgedAt is when the machine confirmed it applied the new master
+	// key. The rotation is pending until then.
+	AcknowledgedAt *time.Time `db:"acknowledged_at"`
+}
+
+func (r *MasterKeyRotation) IsPending() bool {
+	return r.AcknowledgedAt == nil
 }
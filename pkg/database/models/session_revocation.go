@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SessionRevocation invalidates the sessions issued to a user or machine up
+// to RevokedAt. It is kept until every session it covers has expired.
+type SessionRevocation struct {
+	SubjectID uuid.UUID `json:"subject_id" db:"subject_id"`
+	RevokedAt time.Time `json:"revoked_at" db:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
@@ -11,5 +11,6 @@ type SshKey struct {
 	UserID    uuid.UUID  `json:"user_id" db:"user_id"`
 	Filename  string     `json:"filename" db:"filename"`
 	Data      []byte     `json:"data" db:"data"`
+	KeyEpoch  int64      `json:"key_epoch" db:"key_epoch"`
 	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -1,14 +1,37 @@
 package models
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 )
 
 type User struct {
-	ID         uuid.UUID   `json:"id" db:"id"`
-	Username   string      `json:"username" db:"username"`
-	Keys       []SshKey    `json:"keys"`
-	Config     []SshConfig `json:"config"`
-	Machines   []Machine   `json:"machines"`
-	KnownHosts []KnownHost `json:"known_hosts"`
+	ID                   uuid.UUID   `json:"id" db:"id"`
+	Username             string      `json:"username" db:"username"`
+	RequireHybridAuth    bool        `json:"require_hybrid_auth" db:"require_hybrid_auth"`
+	AllowedKeyAlgorithms []string    `json:"allowed_key_algorithms" db:"allowed_key_algorithms"`
+	AllowedJWTAlgorithms []string    `json:"allowed_jwt_algorithms" db:"allowed_jwt_algorithms"`
+	ClassicalMigrateBy   *time.Time  `json:"classical_migrate_by" db:"classical_migrate_by"`
+	Keys                 []SshKey    `json:"keys"`
+	Config               []SshConfig `json:"config"`
+	Machines             []Machine   `json:"machines"`
+	KnownHosts           []KnownHost `json:"known_hosts"`
+
+	// MasterKeyEpoch counts the user's master key rotations.
+	MasterKeyEpoch int64 `json:"master_key_epoch" db:"master_key_epoch"`
+	// RotationRequiredAt is set when one of the user's machines is reported
+	// compromised, until a master key rotation covering the remaining machines
+	// has been submitted.
+	RotationRequiredAt     *time.Time `json:"rotation_required_at" db:"rotation_required_at"`
+	RotationRequiredReason *string    `json:"rotation_required_reason" db:"rotation_required_reason"`
+
+	// MachineApprovalQuorum is how many existing machines must approve a new
+	// one. Zero means one.
+	MachineApprovalQuorum int `json:"machine_approval_quorum" db:"machine_approval_quorum"`
+}
+
+// ApprovalQuorum is how many existing machines must approve a new machine.
+func (u *User) ApprovalQuorum() int {
+	return max(1, u.MachineApprovalQuorum)
 }
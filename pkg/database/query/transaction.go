@@ -68,6 +68,9 @@ func (q *QueryServiceTxImpl[T]) Insert(tx pgx.Tx, query string, args ...any) err
 	return err
 }
 
+// RollbackFunc rolls tx back if *err is set and commits it otherwise. A failed
+// commit is stored in *err, so that functions deferred before it can tell
+// whether the transaction committed.
 func RollbackFunc(txQueryService TransactionService, tx pgx.Tx, w http.ResponseWriter, err *error) {
 	rb := func(tx pgx.Tx) {
 		err := txQueryService.Rollback(tx)
@@ -81,6 +84,7 @@ func RollbackFunc(txQueryService TransactionService, tx pgx.Tx, w http.ResponseW
 		internalErr := txQueryService.Commit(tx)
 		if internalErr != nil {
 			log.Err(internalErr).Msg("error committing transaction")
+			*err = internalErr
 			rb(tx)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
@@ -0,0 +1,29 @@
+package repository
+
+//go:generate go run go.uber.org/mock/mockgen -source=audit_event.go -destination=audit_event_mock.go -package=repository
+
+import (
+	"context"
+
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+)
+
+type AuditEventRepository interface {
+	RecordAuditEvent(event *models.AuditEvent) error
+}
+
+type AuditEventRepo struct {
+	Injector *do.Injector
+}
+
+func (repo *AuditEventRepo) RecordAuditEvent(event *models.AuditEvent) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	_, err := q.GetConnection().Exec(
+		context.TODO(),
+		"INSERT INTO audit_events (event, user_id, machine_id, source_ip, user_agent, details) VALUES ($1, $2, $3, $4, $5, $6)",
+		event.Event, event.UserID, event.MachineID, event.SourceIP, event.UserAgent, event.Details,
+	)
+	return err
+}
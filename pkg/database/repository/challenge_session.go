@@ -0,0 +1,129 @@
+package repository
+
+//go:generate go run go.uber.org/mock/mockgen -source=challenge_session.go -destination=challenge_session_mock.go -package=repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+)
+
+// ChallengeSessionChannel is the channel notified with a session's id whenever
+// the session changes.
+const ChallengeSessionChannel = "challenge_sessions"
+
+type ChallengeSessionRepository interface {
+	CreateChallengeSession(session *models.ChallengeSession, expiredBefore time.Time) error
+	ClaimChallengeSession(id, username string, machineID uuid.UUID, createdAfter time.Time) (*models.ChallengeSession, error)
+	GetChallengeSession(id string) (*models.ChallengeSession, error)
+	SetChallengePublicKey(id string, publicKey, encapsulationKey []byte) error
+	SetChallengeEncryptedMasterKey(id string, machineID uuid.UUID, encryptedMasterKey []byte) error
+	DenyChallengeSession(id, reason string) error
+	DeleteChallengeSession(id string) error
+	AbandonChallengeSession(id string, machineID uuid.UUID) error
+}
+
+type ChallengeSessionRepo struct {
+	Injector *do.Injector
+}
+
+// CreateChallengeSession stores a new session, clearing out sessions created
+// before expiredBefore that were never cleaned up.
+func (repo *ChallengeSessionRepo) CreateChallengeSession(session *models.ChallengeSession, expiredBefore time.Time) error {
+	conn := do.MustInvoke[database.DataAccessor](repo.Injector).GetConnection()
+	if _, err := conn.Exec(context.TODO(), "DELETE FROM challenge_sessions WHERE created_at < $1", expiredBefore.UTC()); err != nil {
+		return err
+	}
+	_, err := conn.Exec(
+		context.TODO(),
+		"INSERT INTO challenge_sessions (id, username, machine_name, source_ip, user_agent, quorum, joined_by, approved_by) VALUES ($1, $2, $3, $4, $5, $6, '{}', '{}')",
+		session.ID, session.Username, session.MachineName, session.SourceIP, session.UserAgent, session.Quorum,
+	)
+	return err
+}
+
+// ClaimChallengeSession adds the machine to those that joined the user's
+// session, marking the session as accepted when it is the first. It returns
+// sql.ErrNoRows unless the session exists, belongs to the user, has not been
+// joined by the machine or by as many machines as its quorum, and either was
+// created after createdAfter or has already been accepted.
+func (repo *ChallengeSessionRepo) ClaimChallengeSession(id, username string, machineID uuid.UUID, createdAfter time.Time) (*models.ChallengeSession, error) {
+	q := do.MustInvoke[query.QueryService[models.ChallengeSession]](repo.Injector)
+	session, err := q.QueryOne(
+		`UPDATE challenge_sessions SET accepted_at = coalesce(accepted_at, now() AT TIME ZONE 'UTC'), joined_by = array_append(joined_by, $3)
+		WHERE id = $1 AND username = $2 AND NOT ($3 = ANY(joined_by)) AND cardinality(joined_by) < greatest(quorum, 1)
+		AND (accepted_at IS NOT NULL OR created_at > $4) RETURNING *`,
+		id, username, machineID, createdAfter.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, sql.ErrNoRows
+	}
+	return session, repo.notify(id)
+}
+
+func (repo *ChallengeSessionRepo) GetChallengeSession(id string) (*models.ChallengeSession, error) {
+	q := do.MustInvoke[query.QueryService[models.ChallengeSession]](repo.Injector)
+	session, err := q.QueryOne("SELECT * FROM challenge_sessions WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+func (repo *ChallengeSessionRepo) SetChallengePublicKey(id string, publicKey, encapsulationKey []byte) error {
+	return repo.update("UPDATE challenge_sessions SET public_key = $2, encapsulation_key = $3 WHERE id = $1", id, publicKey, encapsulationKey)
+}
+
+// SetChallengeEncryptedMasterKey records the machine's approval, keeping the
+// first key sent.
+func (repo *ChallengeSessionRepo) SetChallengeEncryptedMasterKey(id string, machineID uuid.UUID, encryptedMasterKey []byte) error {
+	return repo.update(
+		"UPDATE challenge_sessions SET encrypted_master_key = coalesce(encrypted_master_key, $3), approved_by = array_append(approved_by, $2) WHERE id = $1 AND NOT ($2 = ANY(approved_by))",
+		id, machineID, encryptedMasterKey,
+	)
+}
+
+func (repo *ChallengeSessionRepo) DenyChallengeSession(id, reason string) error {
+	return repo.update("UPDATE challenge_sessions SET denied_at = now() AT TIME ZONE 'UTC', denied_reason = $2 WHERE id = $1", id, reason)
+}
+
+func (repo *ChallengeSessionRepo) DeleteChallengeSession(id string) error {
+	return repo.update("DELETE FROM challenge_sessions WHERE id = $1", id)
+}
+
+// AbandonChallengeSession deletes the session unless the machine has already
+// approved it or it was denied, so that the new machine can still collect the
+// answer.
+func (repo *ChallengeSessionRepo) AbandonChallengeSession(id string, machineID uuid.UUID) error {
+	return repo.update("DELETE FROM challenge_sessions WHERE id = $1 AND NOT ($2 = ANY(approved_by)) AND denied_at IS NULL", id, machineID)
+}
+
+func (repo *ChallengeSessionRepo) update(statement, id string, args ...any) error {
+	conn := do.MustInvoke[database.DataAccessor](repo.Injector).GetConnection()
+	tag, err := conn.Exec(context.TODO(), statement, append([]any{id}, args...)...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+	return repo.notify(id)
+}
+
+func (repo *ChallengeSessionRepo) notify(id string) error {
+	conn := do.MustInvoke[database.DataAccessor](repo.Injector).GetConnection()
+	_, err := conn.Exec(context.TODO(), "SELECT pg_notify($1, $2)", ChallengeSessionChannel, id)
+	return err
+}
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+	"go.uber.org/mock/gomock"
+)
+
+func TestClaimChallengeSessionNoRows(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	createdAfter := time.Now().Add(-time.Minute)
+	machineID := uuid.New()
+	mockQuery := query.NewMockQueryService[models.ChallengeSession](ctrl)
+	mockQuery.EXPECT().QueryOne(gomock.Any(), "id", "alice", machineID, createdAfter.UTC()).Return(nil, nil)
+	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.ChallengeSession], error) {
+		return mockQuery, nil
+	})
+
+	repo := &ChallengeSessionRepo{Injector: injector}
+	_, err := repo.ClaimChallengeSession("id", "alice", machineID, createdAfter)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
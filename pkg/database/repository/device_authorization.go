@@ -0,0 +1,121 @@
+package repository
+
+//go:generate go run go.uber.org/mock/mockgen -source=device_authorization.go -destination=device_authorization_mock.go -package=repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+)
+
+type DeviceAuthorizationRepository interface {
+	CreateDeviceAuthorization(auth *models.DeviceAuthorization) (*models.DeviceAuthorization, error)
+	GetDeviceAuthorization(id uuid.UUID) (*models.DeviceAuthorization, error)
+	GetDeviceAuthorizationByDeviceCode(deviceCodeHash string) (*models.DeviceAuthorization, error)
+	GetPendingDeviceAuthorizations(userID uuid.UUID) ([]models.DeviceAuthorization, error)
+	RecordDeviceAuthorizationPoll(id uuid.UUID) error
+	ApproveDeviceAuthorization(id uuid.UUID, encryptedMasterKey []byte, approvedBy uuid.UUID) error
+	ConsumeDeviceAuthorizationTx(tx pgx.Tx, id uuid.UUID) error
+	DeleteDeviceAuthorization(id uuid.UUID) error
+}
+
+type DeviceAuthorizationRepo struct {
+	Injector *do.Injector
+}
+
+// CreateDeviceAuthorization stores a new request, clearing out expired ones
+// that were never collected.
+func (repo *DeviceAuthorizationRepo) CreateDeviceAuthorization(auth *models.DeviceAuthorization) (*models.DeviceAuthorization, error) {
+	conn := do.MustInvoke[database.DataAccessor](repo.Injector).GetConnection()
+	if _, err := conn.Exec(context.TODO(), "DELETE FROM device_authorizations WHERE expires_at < now() AT TIME ZONE 'UTC'"); err != nil {
+		return nil, err
+	}
+	q := do.MustInvoke[query.QueryService[models.DeviceAuthorization]](repo.Injector)
+	return q.QueryOne(
+		"INSERT INTO device_authorizations (user_id, machine_name, public_key, encapsulation_key, device_code_hash, user_code, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING *",
+		auth.UserID, auth.MachineName, auth.PublicKey, auth.EncapsulationKey, auth.DeviceCodeHash, auth.UserCode, auth.ExpiresAt.UTC(),
+	)
+}
+
+func (repo *DeviceAuthorizationRepo) GetDeviceAuthorization(id uuid.UUID) (*models.DeviceAuthorization, error) {
+	return repo.getOne("SELECT * FROM device_authorizations WHERE id = $1", id)
+}
+
+func (repo *DeviceAuthorizationRepo) GetDeviceAuthorizationByDeviceCode(deviceCodeHash string) (*models.DeviceAuthorization, error) {
+	return repo.getOne("SELECT * FROM device_authorizations WHERE device_code_hash = $1", deviceCodeHash)
+}
+
+// GetPendingDeviceAuthorizations returns the user's requests that are neither
+// approved nor expired, oldest first.
+func (repo *DeviceAuthorizationRepo) GetPendingDeviceAuthorizations(userID uuid.UUID) ([]models.DeviceAuthorization, error) {
+	q := do.MustInvoke[query.QueryService[models.DeviceAuthorization]](repo.Injector)
+	return q.Query(
+		"SELECT * FROM device_authorizations WHERE user_id = $1 AND approved_at IS NULL AND expires_at > now() AT TIME ZONE 'UTC' ORDER BY created_at",
+		userID,
+	)
+}
+
+func (repo *DeviceAuthorizationRepo) RecordDeviceAuthorizationPoll(id uuid.UUID) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	_, err := q.GetConnection().Exec(
+		context.TODO(),
+		"UPDATE device_authorizations SET last_polled_at = now() AT TIME ZONE 'UTC' WHERE id = $1",
+		id,
+	)
+	return err
+}
+
+// ApproveDeviceAuthorization hands the encrypted master key to the request.
+// It returns sql.ErrNoRows if the request is gone, expired or already approved.
+func (repo *DeviceAuthorizationRepo) ApproveDeviceAuthorization(id uuid.UUID, encryptedMasterKey []byte, approvedBy uuid.UUID) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	tag, err := q.GetConnection().Exec(
+		context.TODO(),
+		"UPDATE device_authorizations SET encrypted_master_key = $2, approved_by = $3, approved_at = now() AT TIME ZONE 'UTC' WHERE id = $1 AND approved_at IS NULL AND expires_at > now() AT TIME ZONE 'UTC'",
+		id, encryptedMasterKey, approvedBy,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ConsumeDeviceAuthorizationTx deletes an approved request once its machine is
+// created. It returns sql.ErrNoRows if the request was consumed already.
+func (repo *DeviceAuthorizationRepo) ConsumeDeviceAuthorizationTx(tx pgx.Tx, id uuid.UUID) error {
+	tag, err := tx.Exec(context.TODO(), "DELETE FROM device_authorizations WHERE id = $1 AND approved_at IS NOT NULL", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (repo *DeviceAuthorizationRepo) DeleteDeviceAuthorization(id uuid.UUID) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	_, err := q.GetConnection().Exec(context.TODO(), "DELETE FROM device_authorizations WHERE id = $1", id)
+	return err
+}
+
+func (repo *DeviceAuthorizationRepo) getOne(statement string, args ...any) (*models.DeviceAuthorization, error) {
+	q := do.MustInvoke[query.QueryService[models.DeviceAuthorization]](repo.Injector)
+	auth, err := q.QueryOne(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		return nil, sql.ErrNoRows
+	}
+	return auth, nil
+}
@@ -0,0 +1,67 @@
+package repository
+
+//go:generate go run go.uber.org/mock/mockgen -source=key_proof_nonce.go -destination=key_proof_nonce_mock.go -package=repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database"
+)
+
+// KeyProofNonceRepository keeps key proof nonces in the database so a key
+// update can reach a different server instance than the one that issued its
+// nonce. Only a hash of each nonce is stored.
+type KeyProofNonceRepository interface {
+	SaveKeyProofNonce(nonce string, machineID uuid.UUID, expiresAt time.Time) error
+	ConsumeKeyProofNonce(nonce string, machineID uuid.UUID) (*time.Time, error)
+}
+
+type KeyProofNonceRepo struct {
+	Injector *do.Injector
+}
+
+// SaveKeyProofNonce stores a new nonce, clearing out expired ones that were
+// never used.
+func (repo *KeyProofNonceRepo) SaveKeyProofNonce(nonce string, machineID uuid.UUID, expiresAt time.Time) error {
+	conn := do.MustInvoke[database.DataAccessor](repo.Injector).GetConnection()
+	if _, err := conn.Exec(context.TODO(), "DELETE FROM key_proof_nonces WHERE expires_at < now() AT TIME ZONE 'UTC'"); err != nil {
+		return err
+	}
+	_, err := conn.Exec(
+		context.TODO(),
+		"INSERT INTO key_proof_nonces (nonce_hash, machine_id, expires_at) VALUES ($1, $2, $3)",
+		hashKeyProofNonce(nonce), machineID, expiresAt.UTC(),
+	)
+	return err
+}
+
+// ConsumeKeyProofNonce deletes the nonce if it is live and was issued to the
+// machine, returning when it would have expired, or nil otherwise.
+func (repo *KeyProofNonceRepo) ConsumeKeyProofNonce(nonce string, machineID uuid.UUID) (*time.Time, error) {
+	conn := do.MustInvoke[database.DataAccessor](repo.Injector).GetConnection()
+	var expiresAt time.Time
+	err := conn.QueryRow(
+		context.TODO(),
+		"DELETE FROM key_proof_nonces WHERE nonce_hash = $1 AND machine_id = $2 AND expires_at > now() AT TIME ZONE 'UTC' RETURNING expires_at",
+		hashKeyProofNonce(nonce), machineID,
+	).Scan(&expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &expiresAt, nil
+}
+
+func hashKeyProofNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -19,10 +20,19 @@ type MachineRepository interface {
 	DeleteMachine(id uuid.UUID) error
 	GetMachine(id uuid.UUID) (*models.Machine, error)
 	GetMachineByNameAndUser(machineName string, userID uuid.UUID) (*models.Machine, error)
+	RenameMachine(machine *models.Machine, newName string) (*models.Machine, error)
 	CreateMachine(machine *models.Machine) (*models.Machine, error)
 	CreateMachineTx(machine *models.Machine, tx pgx.Tx) (*models.Machine, error)
 	GetUserMachines(id uuid.UUID) ([]models.Machine, error)
+	GetUserMachinesTx(id uuid.UUID, tx pgx.Tx) ([]models.Machine, error)
 	UpdateMachineKeys(id uuid.UUID, publicKey []byte, encapsulationKey []byte) error
+	GetMachineKeyHistory(machineID uuid.UUID) ([]models.MachineKeyHistory, error)
+	SuspendMachine(id uuid.UUID, reason string) error
+	MarkMachineCompromised(id uuid.UUID, reason string) error
+	UpdateMachineActivity(id uuid.UUID, activity models.MachineActivity) error
+	ReinstateMachine(id uuid.UUID) error
+	GetDormantMachines(lastActiveBefore time.Time) ([]models.Machine, error)
+	GetMachinesSuspendedBefore(reason string, suspendedBefore time.Time) ([]models.Machine, error)
 }
 
 type MachineRepo struct {
@@ -60,9 +70,11 @@ func (repo *MachineRepo) GetMachine(id uuid.UUID) (*models.Machine, error) {
 	return machine, nil
 }
 
+// GetMachineByNameAndUser finds a machine by its name or, for clients that have
+// not caught up with a rename, one of its previous names.
 func (repo *MachineRepo) GetMachineByNameAndUser(machineName string, userID uuid.UUID) (*models.Machine, error) {
 	q := do.MustInvoke[query.QueryService[models.Machine]](repo.Injector)
-	machine, err := q.QueryOne("select * from machines where name = $1 and user_id = $2", machineName, userID)
+	machine, err := q.QueryOne("select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", machineName, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -72,16 +84,39 @@ func (repo *MachineRepo) GetMachineByNameAndUser(machineName string, userID uuid
 	return machine, nil
 }
 
+// RenameMachine renames a machine, keeping its current name as an alias. The new
+// name must not be the name or an alias of any other machine of the user.
+func (repo *MachineRepo) RenameMachine(machine *models.Machine, newName string) (*models.Machine, error) {
+	q := do.MustInvoke[query.QueryService[models.Machine]](repo.Injector)
+	existingMachine, err := q.QueryOne("select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", newName, machine.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if existingMachine != nil && existingMachine.ID != machine.ID {
+		return nil, ErrMachineAlreadyExists
+	}
+	renamedMachine, err := q.QueryOne("update machines set previous_names = array_remove(array_append(coalesce(previous_names, '{}'), name), $1), name = $1 where id = $2 returning *", newName, machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	if renamedMachine == nil {
+		return nil, sql.ErrNoRows
+	}
+	return renamedMachine, nil
+}
+
+// CreateMachine adds a machine. Its name must not be the name or an alias of
+// any other machine of the user, since tokens would then match both.
 func (repo *MachineRepo) CreateMachine(machine *models.Machine) (*models.Machine, error) {
 	q := do.MustInvoke[query.QueryService[models.Machine]](repo.Injector)
-	existingMachine, err := q.QueryOne("select * from machines where name = $1 and user_id = $2", machine.Name, machine.UserID)
+	existingMachine, err := q.QueryOne("select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", machine.Name, machine.UserID)
 	if err != nil {
 		return nil, err
 	}
 	if existingMachine != nil {
 		return nil, ErrMachineAlreadyExists
 	}
-	newMachine, err := q.QueryOne("insert into machines (user_id, name, public_key, encapsulation_key) values ($1, $2, $3, $4) returning *", machine.UserID, machine.Name, machine.PublicKey, machine.EncapsulationKey)
+	newMachine, err := q.QueryOne("insert into machines (user_id, name, public_key, encapsulation_key, recovery_key) values ($1, $2, $3, $4, $5) returning *", machine.UserID, machine.Name, machine.PublicKey, machine.EncapsulationKey, machine.RecoveryKey)
 	if err != nil {
 		return nil, err
 	}
@@ -93,14 +128,14 @@ func (repo *MachineRepo) CreateMachine(machine *models.Machine) (*models.Machine
 
 func (repo *MachineRepo) CreateMachineTx(machine *models.Machine, tx pgx.Tx) (*models.Machine, error) {
 	q := do.MustInvoke[query.QueryServiceTx[models.Machine]](repo.Injector)
-	existingMachine, err := q.QueryOne(tx, "select * from machines where name = $1 and user_id = $2", machine.Name, machine.UserID)
+	existingMachine, err := q.QueryOne(tx, "select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", machine.Name, machine.UserID)
 	if err != nil {
 		return nil, err
 	}
 	if existingMachine != nil {
 		return nil, ErrMachineAlreadyExists
 	}
-	newMachine, err := q.QueryOne(tx, "insert into machines (user_id, name, public_key, encapsulation_key) values ($1, $2, $3, $4) returning *", machine.UserID, machine.Name, machine.PublicKey, machine.EncapsulationKey)
+	newMachine, err := q.QueryOne(tx, "insert into machines (user_id, name, public_key, encapsulation_key, recovery_key) values ($1, $2, $3, $4, $5) returning *", machine.UserID, machine.Name, machine.PublicKey, machine.EncapsulationKey, machine.RecoveryKey)
 	if err != nil {
 		return nil, err
 	}
@@ -110,16 +145,107 @@ func (repo *MachineRepo) CreateMachineTx(machine *models.Machine, tx pgx.Tx) (*m
 	return newMachine, nil
 }
 
-func (repo *MachineRepo) UpdateMachineKeys(id uuid.UUID, publicKey []byte, encapsulationKey []byte) error {
+// UpdateMachineKeys replaces the machine's public key, keeping the previous one
+// in the key history.
+func (repo *MachineRepo) UpdateMachineKeys(id uuid.UUID, publicKey []byte, encapsulationKey []byte) (err error) {
 	q := do.MustInvoke[database.DataAccessor](repo.Injector)
-	_, err := q.GetConnection().Exec(
+	tx, err := q.GetConnection().BeginTx(context.TODO(), pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(context.TODO())
+		}
+	}()
+	var previousKey []byte
+	if err = tx.QueryRow(context.TODO(), "select public_key from machines where id = $1 for update", id).Scan(&previousKey); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return sql.ErrNoRows
+		}
+		return err
+	}
+	if _, err = tx.Exec(
+		context.TODO(),
+		"insert into machine_key_history (machine_id, public_key) values ($1, $2)",
+		id, previousKey,
+	); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(
 		context.TODO(),
 		"UPDATE machines SET public_key = $1, encapsulation_key = COALESCE($2, encapsulation_key) WHERE id = $3",
 		publicKey, encapsulationKey, id,
+	); err != nil {
+		return err
+	}
+	err = tx.Commit(context.TODO())
+	return err
+}
+
+func (repo *MachineRepo) GetMachineKeyHistory(machineID uuid.UUID) ([]models.MachineKeyHistory, error) {
+	q := do.MustInvoke[query.QueryService[models.MachineKeyHistory]](repo.Injector)
+	return q.Query("select * from machine_key_history where machine_id = $1 order by replaced_at desc", machineID)
+}
+
+func (repo *MachineRepo) SuspendMachine(id uuid.UUID, reason string) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	_, err := q.GetConnection().Exec(
+		context.TODO(),
+		"UPDATE machines SET suspended_at = now() AT TIME ZONE 'UTC', suspended_reason = $1 WHERE id = $2",
+		reason, id,
 	)
 	return err
 }
 
+// MarkMachineCompromised suspends the machine for good, keeping the time of an
+// earlier suspension.
+func (repo *MachineRepo) MarkMachineCompromised(id uuid.UUID, reason string) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	_, err := q.GetConnection().Exec(
+		context.TODO(),
+		"UPDATE machines SET suspended_at = coalesce(suspended_at, now() AT TIME ZONE 'UTC'), suspended_reason = $1, compromised_at = now() AT TIME ZONE 'UTC' WHERE id = $2",
+		reason, id,
+	)
+	return err
+}
+
+func (repo *MachineRepo) UpdateMachineActivity(id uuid.UUID, activity models.MachineActivity) error {
+	q := do.MustInvoke[query.QueryService[models.Machine]](repo.Injector)
+	var lastSeenAt *time.Time
+	if activity.LastSeenAt != nil {
+		utc := activity.LastSeenAt.UTC()
+		lastSeenAt = &utc
+	}
+	return q.Insert(
+		"UPDATE machines SET last_seen_at = $1, last_seen_ip = $2, last_seen_user_agent = $3, last_auth_algorithm = COALESCE($4, last_auth_algorithm) WHERE id = $5",
+		lastSeenAt, activity.LastSeenIP, activity.LastSeenUserAgent, activity.LastAuthAlgorithm, id,
+	)
+}
+
+func (repo *MachineRepo) ReinstateMachine(id uuid.UUID) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	_, err := q.GetConnection().Exec(
+		context.TODO(),
+		"UPDATE machines SET suspended_at = NULL, suspended_reason = NULL, reinstated_at = now() AT TIME ZONE 'UTC' WHERE id = $1 AND compromised_at IS NULL",
+		id,
+	)
+	return err
+}
+
+// GetDormantMachines returns unsuspended machines that have not been active
+// since lastActiveBefore. Recovery keys are never dormant: they are meant to go
+// unused.
+func (repo *MachineRepo) GetDormantMachines(lastActiveBefore time.Time) ([]models.Machine, error) {
+	q := do.MustInvoke[query.QueryService[models.Machine]](repo.Injector)
+	return q.Query("select * from machines where suspended_at is null and not recovery_key and greatest(created_at, last_seen_at, reinstated_at) < $1", lastActiveBefore.UTC())
+}
+
+func (repo *MachineRepo) GetMachinesSuspendedBefore(reason string, suspendedBefore time.Time) ([]models.Machine, error) {
+	q := do.MustInvoke[query.QueryService[models.Machine]](repo.Injector)
+	return q.Query("select * from machines where suspended_reason = $1 and suspended_at < $2", reason, suspendedBefore.UTC())
+}
+
 func (repo *MachineRepo) GetUserMachines(id uuid.UUID) ([]models.Machine, error) {
 	q := do.MustInvoke[query.QueryService[models.Machine]](repo.Injector)
 	machines, err := q.Query("select * from machines where user_id = $1", id)
@@ -128,3 +254,8 @@ func (repo *MachineRepo) GetUserMachines(id uuid.UUID) ([]models.Machine, error)
 	}
 	return machines, nil
 }
+
+func (repo *MachineRepo) GetUserMachinesTx(id uuid.UUID, tx pgx.Tx) ([]models.Machine, error) {
+	q := do.MustInvoke[query.QueryServiceTx[models.Machine]](repo.Injector)
+	return q.Query(tx, "select * from machines where user_id = $1", id)
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"testing"
+	"time"
 
 	"go.uber.org/mock/gomock"
 	"github.com/google/uuid"
@@ -25,7 +26,7 @@ func TestCreateMachineAlreadyExists(t *testing.T) {
 		PublicKey: []byte("key"),
 	}
 	mockQuery := query.NewMockQueryService[models.Machine](ctrl)
-	mockQuery.EXPECT().QueryOne("select * from machines where name = $1 and user_id = $2", machine.Name, machine.UserID).Return(machine, nil)
+	mockQuery.EXPECT().QueryOne("select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", machine.Name, machine.UserID).Return(machine, nil)
 	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.Machine], error) {
 		return mockQuery, nil
 	})
@@ -35,6 +36,32 @@ func TestCreateMachineAlreadyExists(t *testing.T) {
 	assert.True(t, errors.Is(err, ErrMachineAlreadyExists))
 }
 
+func TestCreateMachineNameIsAlias(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	userID := uuid.New()
+	machine := &models.Machine{ID: uuid.New(), UserID: userID, Name: "laptop"}
+	renamed := &models.Machine{ID: machine.ID, UserID: userID, Name: "work-laptop", PreviousNames: []string{"laptop"}}
+	newMachine := &models.Machine{UserID: userID, Name: "laptop", PublicKey: []byte("key")}
+	mockQuery := query.NewMockQueryService[models.Machine](ctrl)
+	gomock.InOrder(
+		mockQuery.EXPECT().QueryOne("select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", "work-laptop", userID).Return(nil, nil),
+		mockQuery.EXPECT().QueryOne("update machines set previous_names = array_remove(array_append(coalesce(previous_names, '{}'), name), $1), name = $1 where id = $2 returning *", "work-laptop", machine.ID).Return(renamed, nil),
+		mockQuery.EXPECT().QueryOne("select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", "laptop", userID).Return(renamed, nil),
+	)
+	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.Machine], error) {
+		return mockQuery, nil
+	})
+
+	repo := &MachineRepo{Injector: injector}
+	_, err := repo.RenameMachine(machine, "work-laptop")
+	assert.NoError(t, err)
+	_, err = repo.CreateMachine(newMachine)
+	assert.True(t, errors.Is(err, ErrMachineAlreadyExists))
+}
+
 func TestGetMachineNoRows(t *testing.T) {
 	injector := do.New()
 	ctrl := gomock.NewController(t)
@@ -71,3 +98,104 @@ func TestGetMachineSuccess(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, expected, machine)
 }
+
+func TestRenameMachineAlreadyExists(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	machine := &models.Machine{ID: uuid.New(), UserID: uuid.New(), Name: "laptop"}
+	other := &models.Machine{ID: uuid.New(), UserID: machine.UserID, Name: "desktop"}
+	mockQuery := query.NewMockQueryService[models.Machine](ctrl)
+	mockQuery.EXPECT().QueryOne("select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", "desktop", machine.UserID).Return(other, nil)
+	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.Machine], error) {
+		return mockQuery, nil
+	})
+
+	repo := &MachineRepo{Injector: injector}
+	_, err := repo.RenameMachine(machine, "desktop")
+	assert.True(t, errors.Is(err, ErrMachineAlreadyExists))
+}
+
+func TestRenameMachineSuccess(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	machine := &models.Machine{ID: uuid.New(), UserID: uuid.New(), Name: "laptop"}
+	renamed := &models.Machine{ID: machine.ID, UserID: machine.UserID, Name: "work-laptop", PreviousNames: []string{"laptop"}}
+	mockQuery := query.NewMockQueryService[models.Machine](ctrl)
+	mockQuery.EXPECT().QueryOne("select * from machines where (name = $1 or $1 = any(previous_names)) and user_id = $2 order by name = $1 desc", "work-laptop", machine.UserID).Return(nil, nil)
+	mockQuery.EXPECT().QueryOne("update machines set previous_names = array_remove(array_append(coalesce(previous_names, '{}'), name), $1), name = $1 where id = $2 returning *", "work-laptop", machine.ID).Return(renamed, nil)
+	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.Machine], error) {
+		return mockQuery, nil
+	})
+
+	repo := &MachineRepo{Injector: injector}
+	result, err := repo.RenameMachine(machine, "work-laptop")
+	assert.NoError(t, err)
+	assert.Equal(t, renamed, result)
+}
+
+func TestGetMachineKeyHistory(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	machineID := uuid.New()
+	history := []models.MachineKeyHistory{{ID: uuid.New(), MachineID: machineID, PublicKey: []byte("key")}}
+	mockQuery := query.NewMockQueryService[models.MachineKeyHistory](ctrl)
+	mockQuery.EXPECT().Query("select * from machine_key_history where machine_id = $1 order by replaced_at desc", machineID).Return(history, nil)
+	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.MachineKeyHistory], error) {
+		return mockQuery, nil
+	})
+
+	repo := &MachineRepo{Injector: injector}
+	result, err := repo.GetMachineKeyHistory(machineID)
+	assert.NoError(t, err)
+	assert.Equal(t, history, result)
+}
+
+func TestUpdateMachineActivityStoresUTC(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	now := time.Date(2026, 3, 1, 9, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	ip := "203.0.113.7"
+	userAgent := "ssh-sync/1.0"
+	utc := now.UTC()
+	mockQuery := query.NewMockQueryService[models.Machine](ctrl)
+	mockQuery.EXPECT().Insert(
+		"UPDATE machines SET last_seen_at = $1, last_seen_ip = $2, last_seen_user_agent = $3, last_auth_algorithm = COALESCE($4, last_auth_algorithm) WHERE id = $5",
+		&utc, &ip, &userAgent, nil, id,
+	).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.Machine], error) {
+		return mockQuery, nil
+	})
+
+	repo := &MachineRepo{Injector: injector}
+	err := repo.UpdateMachineActivity(id, models.MachineActivity{LastSeenAt: &now, LastSeenIP: &ip, LastSeenUserAgent: &userAgent})
+	assert.NoError(t, err)
+}
+
+func TestGetDormantMachinesUsesUTC(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cutoff := time.Date(2026, 3, 1, 9, 30, 0, 0, time.FixedZone("UTC-5", -5*60*60))
+	mockQuery := query.NewMockQueryService[models.Machine](ctrl)
+	mockQuery.EXPECT().Query("select * from machines where suspended_at is null and not recovery_key and greatest(created_at, last_seen_at, reinstated_at) < $1", cutoff.UTC()).Return(nil, nil)
+	mockQuery.EXPECT().Query("select * from machines where suspended_reason = $1 and suspended_at < $2", "dormant", cutoff.UTC()).Return(nil, nil)
+	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.Machine], error) {
+		return mockQuery, nil
+	})
+
+	repo := &MachineRepo{Injector: injector}
+	_, err := repo.GetDormantMachines(cutoff)
+	assert.NoError(t, err)
+	_, err = repo.GetMachinesSuspendedBefore("dormant", cutoff)
+	assert.NoError(t, err)
+}
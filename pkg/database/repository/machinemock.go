@@ -11,6 +11,7 @@ package repository
 
 import (
 	reflect "reflect"
+	time "time"
 
 	uuid "github.com/google/uuid"
 	pgx "github.com/jackc/pgx/v5"
@@ -86,6 +87,21 @@ func (mr *MockMachineRepositoryMockRecorder) DeleteMachine(id any) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMachine", reflect.TypeOf((*MockMachineRepository)(nil).DeleteMachine), id)
 }
 
+// GetDormantMachines mocks base method.
+func (m *MockMachineRepository) GetDormantMachines(lastActiveBefore time.Time) ([]models.Machine, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDormantMachines", lastActiveBefore)
+	ret0, _ := ret[0].([]models.Machine)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDormantMachines indicates an expected call of GetDormantMachines.
+func (mr *MockMachineRepositoryMockRecorder) GetDormantMachines(lastActiveBefore any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDormantMachines", reflect.TypeOf((*MockMachineRepository)(nil).GetDormantMachines), lastActiveBefore)
+}
+
 // GetMachine mocks base method.
 func (m *MockMachineRepository) GetMachine(id uuid.UUID) (*models.Machine, error) {
 	m.ctrl.T.Helper()
@@ -116,6 +132,36 @@ func (mr *MockMachineRepositoryMockRecorder) GetMachineByNameAndUser(machineName
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMachineByNameAndUser", reflect.TypeOf((*MockMachineRepository)(nil).GetMachineByNameAndUser), machineName, userID)
 }
 
+// GetMachineKeyHistory mocks base method.
+func (m *MockMachineRepository) GetMachineKeyHistory(machineID uuid.UUID) ([]models.MachineKeyHistory, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMachineKeyHistory", machineID)
+	ret0, _ := ret[0].([]models.MachineKeyHistory)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMachineKeyHistory indicates an expected call of GetMachineKeyHistory.
+func (mr *MockMachineRepositoryMockRecorder) GetMachineKeyHistory(machineID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMachineKeyHistory", reflect.TypeOf((*MockMachineRepository)(nil).GetMachineKeyHistory), machineID)
+}
+
+// GetMachinesSuspendedBefore mocks base method.
+func (m *MockMachineRepository) GetMachinesSuspendedBefore(reason string, suspendedBefore time.Time) ([]models.Machine, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMachinesSuspendedBefore", reason, suspendedBefore)
+	ret0, _ := ret[0].([]models.Machine)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMachinesSuspendedBefore indicates an expected call of GetMachinesSuspendedBefore.
+func (mr *MockMachineRepositoryMockRecorder) GetMachinesSuspendedBefore(reason, suspendedBefore any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMachinesSuspendedBefore", reflect.TypeOf((*MockMachineRepository)(nil).GetMachinesSuspendedBefore), reason, suspendedBefore)
+}
+
 // GetUserMachines mocks base method.
 func (m *MockMachineRepository) GetUserMachines(id uuid.UUID) ([]models.Machine, error) {
 	m.ctrl.T.Helper()
@@ -131,6 +177,92 @@ func (mr *MockMachineRepositoryMockRecorder) GetUserMachines(id any) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserMachines", reflect.TypeOf((*MockMachineRepository)(nil).GetUserMachines), id)
 }
 
+// GetUserMachinesTx mocks base method.
+func (m *MockMachineRepository) GetUserMachinesTx(id uuid.UUID, tx pgx.Tx) ([]models.Machine, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserMachinesTx", id, tx)
+	ret0, _ := ret[0].([]models.Machine)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserMachinesTx indicates an expected call of GetUserMachinesTx.
+func (mr *MockMachineRepositoryMockRecorder) GetUserMachinesTx(id, tx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserMachinesTx", reflect.TypeOf((*MockMachineRepository)(nil).GetUserMachinesTx), id, tx)
+}
+
+// MarkMachineCompromised mocks base method.
+func (m *MockMachineRepository) MarkMachineCompromised(id uuid.UUID, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkMachineCompromised", id, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkMachineCompromised indicates an expected call of MarkMachineCompromised.
+func (mr *MockMachineRepositoryMockRecorder) MarkMachineCompromised(id, reason any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkMachineCompromised", reflect.TypeOf((*MockMachineRepository)(nil).MarkMachineCompromised), id, reason)
+}
+
+// ReinstateMachine mocks base method.
+func (m *MockMachineRepository) ReinstateMachine(id uuid.UUID) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReinstateMachine", id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReinstateMachine indicates an expected call of ReinstateMachine.
+func (mr *MockMachineRepositoryMockRecorder) ReinstateMachine(id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReinstateMachine", reflect.TypeOf((*MockMachineRepository)(nil).ReinstateMachine), id)
+}
+
+// RenameMachine mocks base method.
+func (m *MockMachineRepository) RenameMachine(machine *models.Machine, newName string) (*models.Machine, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RenameMachine", machine, newName)
+	ret0, _ := ret[0].(*models.Machine)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RenameMachine indicates an expected call of RenameMachine.
+func (mr *MockMachineRepositoryMockRecorder) RenameMachine(machine, newName any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenameMachine", reflect.TypeOf((*MockMachineRepository)(nil).RenameMachine), machine, newName)
+}
+
+// SuspendMachine mocks base method.
+func (m *MockMachineRepository) SuspendMachine(id uuid.UUID, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SuspendMachine", id, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SuspendMachine indicates an expected call of SuspendMachine.
+func (mr *MockMachineRepositoryMockRecorder) SuspendMachine(id, reason any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SuspendMachine", reflect.TypeOf((*MockMachineRepository)(nil).SuspendMachine), id, reason)
+}
+
+// UpdateMachineActivity mocks base method.
+func (m *MockMachineRepository) UpdateMachineActivity(id uuid.UUID, activity models.MachineActivity) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateMachineActivity", id, activity)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateMachineActivity indicates an expected call of UpdateMachineActivity.
+func (mr *MockMachineRepositoryMockRecorder) UpdateMachineActivity(id, activity any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMachineActivity", reflect.TypeOf((*MockMachineRepository)(nil).UpdateMachineActivity), id, activity)
+}
+
 // UpdateMachineKeys mocks base method.
 func (m *MockMachineRepository) UpdateMachineKeys(id uuid.UUID, publicKey, encapsulationKey []byte) error {
 	m.ctrl.T.Helper()
@@ -5,6 +5,7 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -15,27 +16,34 @@ import (
 )
 
 type MasterKeyRotationRepository interface {
-	UpsertRotationTx(tx pgx.Tx, machineID uuid.UUID, encKey []byte) error
+	UpsertRotationTx(tx pgx.Tx, machineID uuid.UUID, encKey []byte, epoch int64) error
 	GetRotationForMachine(machineID uuid.UUID) (*models.MasterKeyRotation, error)
+	GetRotationsForUser(userID uuid.UUID) ([]models.MasterKeyRotation, error)
+	AcknowledgeRotationForMachine(machineID uuid.UUID) error
 	DeleteRotationForMachine(machineID uuid.UUID) error
+	DeleteRotationsPendingSince(before time.Time) (int64, error)
 }
 
 type MasterKeyRotationRepo struct {
 	Injector *do.Injector
 }
 
-const upsertRotationSQL = `INSERT INTO master_key_rotations (machine_id, encrypted_master_key)
-	 VALUES ($1, $2)
-	 ON CONFLICT (machine_id) DO UPDATE SET encrypted_master_key = EXCLUDED.encrypted_master_key, created_at = now() AT TIME ZONE 'UTC'`
+// A rotation is only replaced by one of a newer epoch, which is pending again.
+const upsertRotationSQL = `INSERT INTO master_key_rotations (machine_id, encrypted_master_key, epoch)
+	 VALUES ($1, $2, $3)
+	 ON CONFLICT (machine_id) DO UPDATE SET encrypted_master_key = EXCLUDED.encrypted_master_key, epoch = EXCLUDED.epoch, created_at = now() AT TIME ZONE 'UTC', acknowledged_at = NULL
+	 WHERE master_key_rotations.epoch < EXCLUDED.epoch`
 
-func (repo *MasterKeyRotationRepo) UpsertRotationTx(tx pgx.Tx, machineID uuid.UUID, encKey []byte) error {
-	_, err := tx.Exec(context.TODO(), upsertRotationSQL, machineID, encKey)
+func (repo *MasterKeyRotationRepo) UpsertRotationTx(tx pgx.Tx, machineID uuid.UUID, encKey []byte, epoch int64) error {
+	_, err := tx.Exec(context.TODO(), upsertRotationSQL, machineID, encKey, epoch)
 	return err
 }
 
+// GetRotationForMachine returns the machine's pending rotation, or
+// sql.ErrNoRows if it has none.
 func (repo *MasterKeyRotationRepo) GetRotationForMachine(machineID uuid.UUID) (*models.MasterKeyRotation, error) {
 	q := do.MustInvoke[query.QueryService[models.MasterKeyRotation]](repo.Injector)
-	rotation, err := q.QueryOne("SELECT * FROM master_key_rotations WHERE machine_id = $1", machineID)
+	rotation, err := q.QueryOne("SELECT * FROM master_key_rotations WHERE machine_id = $1 AND acknowledged_at IS NULL", machineID)
 	if err != nil {
 		return nil, err
 	}
@@ -45,6 +53,23 @@ func (repo *MasterKeyRotationRepo) GetRotationForMachine(machineID uuid.UUID) (*
 	return rotation, nil
 }
 
+// GetRotationsForUser returns the latest rotation of each of the user's
+// machines, whether pending or acknowledged.
+func (repo *MasterKeyRotationRepo) GetRotationsForUser(userID uuid.UUID) ([]models.MasterKeyRotation, error) {
+	q := do.MustInvoke[query.QueryService[models.MasterKeyRotation]](repo.Injector)
+	return q.Query("SELECT r.* FROM master_key_rotations r JOIN machines m ON m.id = r.machine_id WHERE m.user_id = $1", userID)
+}
+
+func (repo *MasterKeyRotationRepo) AcknowledgeRotationForMachine(machineID uuid.UUID) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	_, err := q.GetConnection().Exec(
+		context.TODO(),
+		"UPDATE master_key_rotations SET acknowledged_at = now() AT TIME ZONE 'UTC' WHERE machine_id = $1 AND acknowledged_at IS NULL",
+		machineID,
+	)
+	return err
+}
+
 func (repo *MasterKeyRotationRepo) DeleteRotationForMachine(machineID uuid.UUID) error {
 	q := do.MustInvoke[database.DataAccessor](repo.Injector)
 	_, err := q.GetConnection().Exec(
@@ -54,3 +79,19 @@ func (repo *MasterKeyRotationRepo) DeleteRotationForMachine(machineID uuid.UUID)
 	)
 	return err
 }
+
+// DeleteRotationsPendingSince deletes rotations created before the given time
+// that were never acknowledged, returning how many were deleted. Recovery keys
+// never acknowledge theirs, which hold their copy of the master key.
+func (repo *MasterKeyRotationRepo) DeleteRotationsPendingSince(before time.Time) (int64, error) {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	tag, err := q.GetConnection().Exec(
+		context.TODO(),
+		"DELETE FROM master_key_rotations WHERE acknowledged_at IS NULL AND created_at < $1 AND machine_id NOT IN (SELECT id FROM machines WHERE recovery_key)",
+		before.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -11,6 +11,7 @@ package repository
 
 import (
 	reflect "reflect"
+	time "time"
 
 	uuid "github.com/google/uuid"
 	pgx "github.com/jackc/pgx/v5"
@@ -42,6 +43,20 @@ func (m *MockMasterKeyRotationRepository) EXPECT() *MockMasterKeyRotationReposit
 	return m.recorder
 }
 
+// AcknowledgeRotationForMachine mocks base method.
+func (m *MockMasterKeyRotationRepository) AcknowledgeRotationForMachine(machineID uuid.UUID) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AcknowledgeRotationForMachine", machineID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AcknowledgeRotationForMachine indicates an expected call of AcknowledgeRotationForMachine.
+func (mr *MockMasterKeyRotationRepositoryMockRecorder) AcknowledgeRotationForMachine(machineID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcknowledgeRotationForMachine", reflect.TypeOf((*MockMasterKeyRotationRepository)(nil).AcknowledgeRotationForMachine), machineID)
+}
+
 // DeleteRotationForMachine mocks base method.
 func (m *MockMasterKeyRotationRepository) DeleteRotationForMachine(machineID uuid.UUID) error {
 	m.ctrl.T.Helper()
@@ -56,6 +71,21 @@ func (mr *MockMasterKeyRotationRepositoryMockRecorder) DeleteRotationForMachine(
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteRotationForMachine", reflect.TypeOf((*MockMasterKeyRotationRepository)(nil).DeleteRotationForMachine), machineID)
 }
 
+// DeleteRotationsPendingSince mocks base method.
+func (m *MockMasterKeyRotationRepository) DeleteRotationsPendingSince(before time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteRotationsPendingSince", before)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteRotationsPendingSince indicates an expected call of DeleteRotationsPendingSince.
+func (mr *MockMasterKeyRotationRepositoryMockRecorder) DeleteRotationsPendingSince(before any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteRotationsPendingSince", reflect.TypeOf((*MockMasterKeyRotationRepository)(nil).DeleteRotationsPendingSince), before)
+}
+
 // GetRotationForMachine mocks base method.
 func (m *MockMasterKeyRotationRepository) GetRotationForMachine(machineID uuid.UUID) (*models.MasterKeyRotation, error) {
 	m.ctrl.T.Helper()
@@ -71,16 +101,31 @@ func (mr *MockMasterKeyRotationRepositoryMockRecorder) GetRotationForMachine(mac
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRotationForMachine", reflect.TypeOf((*MockMasterKeyRotationRepository)(nil).GetRotationForMachine), machineID)
 }
 
+// GetRotationsForUser mocks base method.
+func (m *MockMasterKeyRotationRepository) GetRotationsForUser(userID uuid.UUID) ([]models.MasterKeyRotation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRotationsForUser", userID)
+	ret0, _ := ret[0].([]models.MasterKeyRotation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRotationsForUser indicates an expected call of GetRotationsForUser.
+func (mr *MockMasterKeyRotationRepositoryMockRecorder) GetRotationsForUser(userID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRotationsForUser", reflect.TypeOf((*MockMasterKeyRotationRepository)(nil).GetRotationsForUser), userID)
+}
+
 // UpsertRotationTx mocks base method.
-func (m *MockMasterKeyRotationRepository) UpsertRotationTx(tx pgx.Tx, machineID uuid.UUID, encKey []byte) error {
+func (m *MockMasterKeyRotationRepository) UpsertRotationTx(tx pgx.Tx, machineID uuid.UUID, encKey []byte, epoch int64) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpsertRotationTx", tx, machineID, encKey)
+	ret := m.ctrl.Call(m, "UpsertRotationTx", tx, machineID, encKey, epoch)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UpsertRotationTx indicates an expected call of UpsertRotationTx.
-func (mr *MockMasterKeyRotationRepositoryMockRecorder) UpsertRotationTx(tx, machineID, encKey any) *gomock.Call {
+func (mr *MockMasterKeyRotationRepositoryMockRecorder) UpsertRotationTx(tx, machineID, encKey, epoch any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpsertRotationTx", reflect.TypeOf((*MockMasterKeyRotationRepository)(nil).UpsertRotationTx), tx, machineID, encKey)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpsertRotationTx", reflect.TypeOf((*MockMasterKeyRotationRepository)(nil).UpsertRotationTx), tx, machineID, encKey, epoch)
 }
@@ -0,0 +1,88 @@
+package repository
+
+//go:generate go run go.uber.org/mock/mockgen -source=session_revocation.go -destination=session_revocation_mock.go -package=repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+)
+
+// SessionRevocationChannel is the channel saved session revocations are
+// notified on.
+const SessionRevocationChannel = "session_revocations"
+
+// SessionRevocationRepository keeps session revocations in the database so
+// that a session revoked on one server instance is refused by all of them.
+type SessionRevocationRepository interface {
+	SaveSessionRevocation(revocation models.SessionRevocation) error
+	GetSessionRevocations() ([]models.SessionRevocation, error)
+	ListenSessionRevocations(ctx context.Context, listening func(), revoked func(models.SessionRevocation)) error
+}
+
+type SessionRevocationRepo struct {
+	Injector *do.Injector
+}
+
+// SaveSessionRevocation records the revocation of a user's or machine's
+// sessions, replacing an earlier one, clears out expired revocations and
+// notifies the server instances listening for revocations.
+func (repo *SessionRevocationRepo) SaveSessionRevocation(revocation models.SessionRevocation) error {
+	conn := do.MustInvoke[database.DataAccessor](repo.Injector).GetConnection()
+	if _, err := conn.Exec(context.TODO(), "DELETE FROM session_revocations WHERE expires_at < now() AT TIME ZONE 'UTC'"); err != nil {
+		return err
+	}
+	revocation.RevokedAt = revocation.RevokedAt.UTC()
+	revocation.ExpiresAt = revocation.ExpiresAt.UTC()
+	if _, err := conn.Exec(
+		context.TODO(),
+		`INSERT INTO session_revocations (subject_id, revoked_at, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (subject_id) DO UPDATE SET revoked_at = EXCLUDED.revoked_at, expires_at = EXCLUDED.expires_at`,
+		revocation.SubjectID, revocation.RevokedAt, revocation.ExpiresAt,
+	); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(context.TODO(), "SELECT pg_notify($1, $2)", SessionRevocationChannel, string(payload))
+	return err
+}
+
+// GetSessionRevocations returns every revocation that has not expired.
+func (repo *SessionRevocationRepo) GetSessionRevocations() ([]models.SessionRevocation, error) {
+	q := do.MustInvoke[query.QueryService[models.SessionRevocation]](repo.Injector)
+	return q.Query("SELECT * FROM session_revocations WHERE expires_at > now() AT TIME ZONE 'UTC'")
+}
+
+// ListenSessionRevocations listens for saved revocations on a connection of its
+// own, calling listening once it does and revoked for every notification,
+// until ctx is done or the connection drops.
+func (repo *SessionRevocationRepo) ListenSessionRevocations(ctx context.Context, listening func(), revoked func(models.SessionRevocation)) error {
+	conn, err := database.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+SessionRevocationChannel); err != nil {
+		return err
+	}
+	listening()
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var revocation models.SessionRevocation
+		if err := json.Unmarshal([]byte(notification.Payload), &revocation); err != nil {
+			return fmt.Errorf("invalid session revocation notification: %w", err)
+		}
+		revoked(revocation)
+	}
+}
@@ -21,7 +21,7 @@ type SshKeyRepo struct {
 
 func (repo *SshKeyRepo) CreateSshKey(sshKey *models.SshKey) (*models.SshKey, error) {
 	q := do.MustInvoke[query.QueryService[models.SshKey]](repo.Injector)
-	key, err := q.QueryOne("INSERT INTO ssh_keys (user_id, filename, data, updated_at) VALUES ($1, $2, $3, (now() AT TIME ZONE 'UTC')) RETURNING *", sshKey.UserID, sshKey.Filename, sshKey.Data)
+	key, err := q.QueryOne("INSERT INTO ssh_keys (user_id, filename, data, key_epoch, updated_at) VALUES ($1, $2, $3, $4, (now() AT TIME ZONE 'UTC')) RETURNING *", sshKey.UserID, sshKey.Filename, sshKey.Data, sshKey.KeyEpoch)
 	if err != nil {
 		return nil, err
 	}
@@ -31,7 +31,7 @@ func (repo *SshKeyRepo) CreateSshKey(sshKey *models.SshKey) (*models.SshKey, err
 
 func (repo *SshKeyRepo) UpsertSshKey(sshKey *models.SshKey) (*models.SshKey, error) {
 	q := do.MustInvoke[query.QueryService[models.SshKey]](repo.Injector)
-	key, err := q.QueryOne("INSERT INTO ssh_keys (user_id, filename, data, updated_at) VALUES ($1, $2, $3, (now() AT TIME ZONE 'UTC')) ON CONFLICT (user_id, filename) DO UPDATE SET data = $3, updated_at = (now() AT TIME ZONE 'UTC') RETURNING *", sshKey.UserID, sshKey.Filename, sshKey.Data)
+	key, err := q.QueryOne("INSERT INTO ssh_keys (user_id, filename, data, key_epoch, updated_at) VALUES ($1, $2, $3, $4, (now() AT TIME ZONE 'UTC')) ON CONFLICT (user_id, filename) DO UPDATE SET data = $3, key_epoch = $4, updated_at = (now() AT TIME ZONE 'UTC') RETURNING *", sshKey.UserID, sshKey.Filename, sshKey.Data, sshKey.KeyEpoch)
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +40,7 @@ func (repo *SshKeyRepo) UpsertSshKey(sshKey *models.SshKey) (*models.SshKey, err
 
 func (repo *SshKeyRepo) UpsertSshKeyTx(sshKey *models.SshKey, tx pgx.Tx) (*models.SshKey, error) {
 	q := do.MustInvoke[query.QueryServiceTx[models.SshKey]](repo.Injector)
-	key, err := q.QueryOne(tx, "INSERT INTO ssh_keys (user_id, filename, data, updated_at) VALUES ($1, $2, $3, (now() AT TIME ZONE 'UTC')) ON CONFLICT (user_id, filename) DO UPDATE SET data = $3, updated_at = (now() AT TIME ZONE 'UTC') RETURNING *", sshKey.UserID, sshKey.Filename, sshKey.Data)
+	key, err := q.QueryOne(tx, "INSERT INTO ssh_keys (user_id, filename, data, key_epoch, updated_at) VALUES ($1, $2, $3, $4, (now() AT TIME ZONE 'UTC')) ON CONFLICT (user_id, filename) DO UPDATE SET data = $3, key_epoch = $4, updated_at = (now() AT TIME ZONE 'UTC') RETURNING *", sshKey.UserID, sshKey.Filename, sshKey.Data, sshKey.KeyEpoch)
 	if err != nil {
 		return nil, err
 	}
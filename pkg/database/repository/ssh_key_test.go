@@ -23,11 +23,12 @@ func TestUpsertSshKeyTx(t *testing.T) {
 		UserID:   uuid.New(),
 		Filename: "id_rsa",
 		Data:     []byte("ssh-rsa"),
+		KeyEpoch: 2,
 	}
 
 	mockQuery := query.NewMockQueryServiceTx[models.SshKey](ctrl)
 	mockQuery.EXPECT().
-		QueryOne(tx, gomock.Any(), key.UserID, key.Filename, key.Data).
+		QueryOne(tx, gomock.Any(), key.UserID, key.Filename, key.Data, key.KeyEpoch).
 		Return(key, nil)
 	do.Provide(injector, func(i *do.Injector) (query.QueryServiceTx[models.SshKey], error) {
 		return mockQuery, nil
@@ -6,6 +6,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -23,6 +24,7 @@ type UserRepository interface {
 	CreateUser(user *models.User) (*models.User, error)
 	CreateUserTx(user *models.User, tx pgx.Tx) (*models.User, error)
 	DeleteUser(id uuid.UUID) error
+	DeleteUserTx(id uuid.UUID, tx pgx.Tx) (map[string]int64, error)
 	GetUserConfig(id uuid.UUID) ([]models.SshConfig, error)
 	GetUserKeys(id uuid.UUID) ([]models.SshKey, error)
 	GetUserKey(userId uuid.UUID, keyId uuid.UUID) (*models.SshKey, error)
@@ -33,6 +35,10 @@ type UserRepository interface {
 	AddAndUpdateConfigTx(user *models.User, tx pgx.Tx) error
 	AddAndUpdateKnownHostsTx(user *models.User, tx pgx.Tx) error
 	DeleteUserKeyTx(user *models.User, id uuid.UUID, tx pgx.Tx) error
+	UpdateUserPolicy(user *models.User) error
+	RequireMasterKeyRotation(id uuid.UUID, reason string) error
+	ClearMasterKeyRotationRequirementTx(id uuid.UUID, seen time.Time, tx pgx.Tx) error
+	AdvanceMasterKeyEpochTx(id uuid.UUID, epoch int64, tx pgx.Tx) error
 }
 
 type UserRepo struct {
@@ -41,6 +47,8 @@ type UserRepo struct {
 
 var ErrUserAlreadyExists = errors.New("user already exists")
 
+var ErrStaleMasterKeyEpoch = errors.New("master key epoch is not newer than the current one")
+
 func (repo *UserRepo) GetUser(userId uuid.UUID) (*models.User, error) {
 	q := do.MustInvoke[query.QueryService[models.User]](repo.Injector)
 	user, err := q.QueryOne("select * from users where id = $1", userId)
@@ -105,6 +113,7 @@ func (repo *UserRepo) CreateUserTx(user *models.User, tx pgx.Tx) (*models.User,
 	return newUser, nil
 }
 
+// DeleteUser deletes the user and all of their rows; see DeleteUserTx.
 func (repo *UserRepo) DeleteUser(id uuid.UUID) error {
 	q := do.MustInvoke[database.DataAccessor](repo.Injector)
 	tx, err := q.GetConnection().BeginTx(context.TODO(), pgx.TxOptions{})
@@ -116,23 +125,48 @@ func (repo *UserRepo) DeleteUser(id uuid.UUID) error {
 			tx.Rollback(context.TODO())
 		}
 	}()
-	if _, err := tx.Exec(context.TODO(), "delete from ssh_keys where user_id = $1", id); err != nil {
-		return err
-	}
-	if _, err := tx.Exec(context.TODO(), "delete from ssh_configs where user_id = $1", id); err != nil {
+	if _, err = repo.DeleteUserTx(id, tx); err != nil {
 		return err
 	}
-	if _, err := tx.Exec(context.TODO(), "delete from known_hosts where user_id = $1", id); err != nil {
-		return err
+	return tx.Commit(context.TODO())
+}
+
+// userDeletions removes a user's rows, dependents first, keyed by table.
+// Challenge sessions only know the username.
+var userDeletions = []struct {
+	table string
+	query string
+}{
+	{"master_key_rotations", "delete from master_key_rotations where machine_id in (select id from machines where user_id = $1)"},
+	{"machine_key_history", "delete from machine_key_history where machine_id in (select id from machines where user_id = $1)"},
+	{"challenge_sessions", "delete from challenge_sessions where username = (select username from users where id = $1)"},
+	{"device_authorizations", "delete from device_authorizations where user_id = $1"},
+	{"ssh_keys", "delete from ssh_keys where user_id = $1"},
+	{"ssh_configs", "delete from ssh_configs where user_id = $1"},
+	{"known_hosts", "delete from known_hosts where user_id = $1"},
+	{"machines", "delete from machines where user_id = $1"},
+	{"users", "delete from users where id = $1"},
+}
+
+// DeleteUserTx deletes the user and every row that belongs to them, and
+// returns how many rows were deleted from each table. Audit events are kept
+// for security review, with their user and machine IDs cleared.
+func (repo *UserRepo) DeleteUserTx(id uuid.UUID, tx pgx.Tx) (map[string]int64, error) {
+	if _, err := tx.Exec(context.TODO(), "update audit_events set user_id = null, machine_id = null where user_id = $1", id); err != nil {
+		return nil, err
 	}
-	if _, err := tx.Exec(context.TODO(), "delete from machines where user_id = $1", id); err != nil {
-		return err
+	deleted := make(map[string]int64, len(userDeletions))
+	for _, deletion := range userDeletions {
+		tag, err := tx.Exec(context.TODO(), deletion.query, id)
+		if err != nil {
+			return nil, err
+		}
+		deleted[deletion.table] = tag.RowsAffected()
 	}
-	if _, err := tx.Exec(context.TODO(), "delete from users where id = $1", id); err != nil {
-		return err
+	if deleted["users"] == 0 {
+		return nil, sql.ErrNoRows
 	}
-	err = tx.Commit(context.TODO())
-	return nil
+	return deleted, nil
 }
 
 func (repo *UserRepo) GetUserConfig(id uuid.UUID) ([]models.SshConfig, error) {
@@ -243,3 +277,50 @@ func (repo *UserRepo) DeleteUserKeyTx(user *models.User, id uuid.UUID, tx pgx.Tx
 	_, err := tx.Exec(context.TODO(), "delete from ssh_keys where user_id = $1 and id = $2", user.ID, id)
 	return err
 }
+
+func (repo *UserRepo) UpdateUserPolicy(user *models.User) error {
+	q := do.MustInvoke[query.QueryService[models.User]](repo.Injector)
+	var classicalMigrateBy *time.Time
+	if user.ClassicalMigrateBy != nil {
+		utc := user.ClassicalMigrateBy.UTC()
+		classicalMigrateBy = &utc
+	}
+	return q.Insert(
+		"update users set require_hybrid_auth = $1, allowed_key_algorithms = $2, allowed_jwt_algorithms = $3, classical_migrate_by = $4, machine_approval_quorum = $5 where id = $6",
+		user.RequireHybridAuth, user.AllowedKeyAlgorithms, user.AllowedJWTAlgorithms, classicalMigrateBy, user.MachineApprovalQuorum, user.ID,
+	)
+}
+
+// RequireMasterKeyRotation marks the user as needing a master key rotation. A
+// later report moves the timestamp forward, so that a rotation submitted
+// before it does not clear it.
+func (repo *UserRepo) RequireMasterKeyRotation(id uuid.UUID, reason string) error {
+	q := do.MustInvoke[database.DataAccessor](repo.Injector)
+	_, err := q.GetConnection().Exec(
+		context.TODO(),
+		"update users set rotation_required_at = now() AT TIME ZONE 'UTC', rotation_required_reason = $1 where id = $2",
+		reason, id,
+	)
+	return err
+}
+
+// ClearMasterKeyRotationRequirementTx clears the requirement seen by the
+// rotation, leaving one raised since in place.
+func (repo *UserRepo) ClearMasterKeyRotationRequirementTx(id uuid.UUID, seen time.Time, tx pgx.Tx) error {
+	_, err := tx.Exec(context.TODO(), "update users set rotation_required_at = null, rotation_required_reason = null where id = $1 and rotation_required_at <= $2", id, seen)
+	return err
+}
+
+// AdvanceMasterKeyEpochTx moves the user to a new master key epoch. It fails
+// with ErrStaleMasterKeyEpoch unless epoch is newer than the current one, so
+// of two racing rotations only one can succeed.
+func (repo *UserRepo) AdvanceMasterKeyEpochTx(id uuid.UUID, epoch int64, tx pgx.Tx) error {
+	tag, err := tx.Exec(context.TODO(), "update users set master_key_epoch = $1 where id = $2 and master_key_epoch < $1", epoch, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrStaleMasterKeyEpoch
+	}
+	return nil
+}
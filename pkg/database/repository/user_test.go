@@ -1,17 +1,22 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"go.uber.org/mock/gomock"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/samber/do"
 	"github.com/stretchr/testify/assert"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+	pgxmock "github.com/therealpaulgg/ssh-sync-server/test/pgx"
 )
 
 type stubConfigRepo struct {
@@ -131,3 +136,64 @@ func TestAddAndUpdateConfigError(t *testing.T) {
 	err := repo.AddAndUpdateConfig(user)
 	assert.Error(t, err)
 }
+
+func TestDeleteUserTx(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	id := uuid.New()
+	tx := pgxmock.NewMockTx(ctrl)
+	var tables []string
+	var updated []string
+	tx.EXPECT().Exec(gomock.Any(), gomock.Any(), id).DoAndReturn(func(_ context.Context, statement string, _ ...any) (pgconn.CommandTag, error) {
+		fields := strings.Fields(statement)
+		if fields[0] == "update" {
+			updated = append(updated, fields[1])
+			return pgconn.NewCommandTag("UPDATE 1"), nil
+		}
+		tables = append(tables, fields[2])
+		return pgconn.NewCommandTag("DELETE 1"), nil
+	}).Times(len(userDeletions) + 1)
+
+	repo := &UserRepo{Injector: do.New()}
+	deleted, err := repo.DeleteUserTx(id, tx)
+
+	assert.NoError(t, err)
+	assert.Contains(t, tables, "master_key_rotations")
+	assert.Equal(t, "users", tables[len(tables)-1], "the user is deleted last")
+	assert.Equal(t, int64(1), deleted["master_key_rotations"])
+	assert.NotContains(t, tables, "audit_events")
+	assert.Equal(t, []string{"audit_events"}, updated, "audit events are anonymized, not deleted")
+}
+
+func TestDeleteUserTxNoUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tx := pgxmock.NewMockTx(ctrl)
+	tx.EXPECT().Exec(gomock.Any(), gomock.Any(), gomock.Any()).Return(pgconn.NewCommandTag("DELETE 0"), nil).AnyTimes()
+
+	repo := &UserRepo{Injector: do.New()}
+	_, err := repo.DeleteUserTx(uuid.New(), tx)
+
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestUpdateUserPolicyStoresUTC(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	migrateBy := time.Date(2026, 6, 1, 0, 0, 0, 0, time.FixedZone("UTC+9", 9*60*60))
+	utc := migrateBy.UTC()
+	user := &models.User{ID: uuid.New(), ClassicalMigrateBy: &migrateBy, MachineApprovalQuorum: 1}
+	mockQuery := query.NewMockQueryService[models.User](ctrl)
+	mockQuery.EXPECT().Insert(
+		"update users set require_hybrid_auth = $1, allowed_key_algorithms = $2, allowed_jwt_algorithms = $3, classical_migrate_by = $4, machine_approval_quorum = $5 where id = $6",
+		false, user.AllowedKeyAlgorithms, user.AllowedJWTAlgorithms, &utc, 1, user.ID,
+	).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.QueryService[models.User], error) {
+		return mockQuery, nil
+	})
+
+	repo := &UserRepo{Injector: injector}
+	assert.NoError(t, repo.UpdateUserPolicy(user))
+}
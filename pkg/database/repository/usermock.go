@@ -11,6 +11,7 @@ package repository
 
 import (
 	reflect "reflect"
+	time "time"
 
 	uuid "github.com/google/uuid"
 	pgx "github.com/jackc/pgx/v5"
@@ -112,6 +113,34 @@ func (mr *MockUserRepositoryMockRecorder) AddAndUpdateKnownHostsTx(user, tx any)
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAndUpdateKnownHostsTx", reflect.TypeOf((*MockUserRepository)(nil).AddAndUpdateKnownHostsTx), user, tx)
 }
 
+// AdvanceMasterKeyEpochTx mocks base method.
+func (m *MockUserRepository) AdvanceMasterKeyEpochTx(id uuid.UUID, epoch int64, tx pgx.Tx) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AdvanceMasterKeyEpochTx", id, epoch, tx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AdvanceMasterKeyEpochTx indicates an expected call of AdvanceMasterKeyEpochTx.
+func (mr *MockUserRepositoryMockRecorder) AdvanceMasterKeyEpochTx(id, epoch, tx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AdvanceMasterKeyEpochTx", reflect.TypeOf((*MockUserRepository)(nil).AdvanceMasterKeyEpochTx), id, epoch, tx)
+}
+
+// ClearMasterKeyRotationRequirementTx mocks base method.
+func (m *MockUserRepository) ClearMasterKeyRotationRequirementTx(id uuid.UUID, seen time.Time, tx pgx.Tx) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClearMasterKeyRotationRequirementTx", id, seen, tx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClearMasterKeyRotationRequirementTx indicates an expected call of ClearMasterKeyRotationRequirementTx.
+func (mr *MockUserRepositoryMockRecorder) ClearMasterKeyRotationRequirementTx(id, seen, tx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearMasterKeyRotationRequirementTx", reflect.TypeOf((*MockUserRepository)(nil).ClearMasterKeyRotationRequirementTx), id, seen, tx)
+}
+
 // CreateUser mocks base method.
 func (m *MockUserRepository) CreateUser(user *models.User) (*models.User, error) {
 	m.ctrl.T.Helper()
@@ -170,6 +199,21 @@ func (mr *MockUserRepositoryMockRecorder) DeleteUserKeyTx(user, id, tx any) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUserKeyTx", reflect.TypeOf((*MockUserRepository)(nil).DeleteUserKeyTx), user, id, tx)
 }
 
+// DeleteUserTx mocks base method.
+func (m *MockUserRepository) DeleteUserTx(id uuid.UUID, tx pgx.Tx) (map[string]int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUserTx", id, tx)
+	ret0, _ := ret[0].(map[string]int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteUserTx indicates an expected call of DeleteUserTx.
+func (mr *MockUserRepositoryMockRecorder) DeleteUserTx(id, tx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUserTx", reflect.TypeOf((*MockUserRepository)(nil).DeleteUserTx), id, tx)
+}
+
 // GetUser mocks base method.
 func (m *MockUserRepository) GetUser(id uuid.UUID) (*models.User, error) {
 	m.ctrl.T.Helper()
@@ -259,3 +303,31 @@ func (mr *MockUserRepositoryMockRecorder) GetUserKnownHosts(id any) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserKnownHosts", reflect.TypeOf((*MockUserRepository)(nil).GetUserKnownHosts), id)
 }
+
+// RequireMasterKeyRotation mocks base method.
+func (m *MockUserRepository) RequireMasterKeyRotation(id uuid.UUID, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequireMasterKeyRotation", id, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RequireMasterKeyRotation indicates an expected call of RequireMasterKeyRotation.
+func (mr *MockUserRepositoryMockRecorder) RequireMasterKeyRotation(id, reason any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequireMasterKeyRotation", reflect.TypeOf((*MockUserRepository)(nil).RequireMasterKeyRotation), id, reason)
+}
+
+// UpdateUserPolicy mocks base method.
+func (m *MockUserRepository) UpdateUserPolicy(user *models.User) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateUserPolicy", user)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateUserPolicy indicates an expected call of UpdateUserPolicy.
+func (mr *MockUserRepositoryMockRecorder) UpdateUserPolicy(user any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUserPolicy", reflect.TypeOf((*MockUserRepository)(nil).UpdateUserPolicy), user)
+}
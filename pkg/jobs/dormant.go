@@ -0,0 +1,177 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+)
+
+// DormantSuspendReason marks machines suspended by the dormancy job, so that
+// only those are deleted later on, never machines suspended by hand.
+const DormantSuspendReason = "automatically suspended after inactivity"
+
+const defaultDormancyCheckInterval = time.Hour
+
+// DormancyPolicy describes when inactive machines are suspended and when
+// machines suspended for inactivity are deleted. A zero duration disables that
+// step.
+type DormancyPolicy struct {
+	SuspendAfter time.Duration
+	DeleteAfter  time.Duration
+}
+
+// LoadDormancyPolicy reads MACHINE_DORMANT_SUSPEND_AFTER and
+// MACHINE_DORMANT_DELETE_AFTER. Both accept Go durations or a number of days
+// such as "90d"; DeleteAfter counts from the automatic suspension.
+func LoadDormancyPolicy() (DormancyPolicy, error) {
+	var policy DormancyPolicy
+	for _, setting := range []struct {
+		env      string
+		duration *time.Duration
+	}{
+		{"MACHINE_DORMANT_SUSPEND_AFTER", &policy.SuspendAfter},
+		{"MACHINE_DORMANT_DELETE_AFTER", &policy.DeleteAfter},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
+		}
+		duration, err := parseDays(value)
+		if err != nil || duration <= 0 {
+			return DormancyPolicy{}, fmt.Errorf("invalid %s: %q", setting.env, value)
+		}
+		*setting.duration = duration
+	}
+	return policy, nil
+}
+
+func (p DormancyPolicy) Enabled() bool {
+	return p.SuspendAfter > 0 || p.DeleteAfter > 0
+}
+
+// SuspendsAt returns when an unsuspended machine will be suspended for
+// inactivity.
+func (p DormancyPolicy) SuspendsAt(machine *models.Machine) *time.Time {
+	if p.SuspendAfter == 0 || machine.IsSuspended() || machine.RecoveryKey {
+		return nil
+	}
+	t := machine.LastActiveAt().Add(p.SuspendAfter)
+	return &t
+}
+
+// DeletesAt returns when a machine suspended for inactivity will be deleted.
+func (p DormancyPolicy) DeletesAt(machine *models.Machine) *time.Time {
+	if p.DeleteAfter == 0 || !isDormantSuspended(machine) {
+		return nil
+	}
+	t := machine.SuspendedAt.Add(p.DeleteAfter)
+	return &t
+}
+
+func isDormantSuspended(machine *models.Machine) bool {
+	return machine.IsSuspended() && machine.SuspendedReason != nil && *machine.SuspendedReason == DormantSuspendReason
+}
+
+func parseDays(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// DormantMachineExpirer periodically applies the dormancy policy.
+type DormantMachineExpirer struct {
+	injector *do.Injector
+	policy   DormancyPolicy
+	interval time.Duration
+}
+
+func NewDormantMachineExpirer(i *do.Injector, policy DormancyPolicy, interval time.Duration) *DormantMachineExpirer {
+	return &DormantMachineExpirer{injector: i, policy: policy, interval: interval}
+}
+
+// LoadDormantMachineExpirer creates the job from the dormancy policy and
+// MACHINE_DORMANCY_CHECK_INTERVAL (a Go duration, 1h by default).
+func LoadDormantMachineExpirer(i *do.Injector) (*DormantMachineExpirer, error) {
+	policy, err := LoadDormancyPolicy()
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultDormancyCheckInterval
+	if value := os.Getenv("MACHINE_DORMANCY_CHECK_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid MACHINE_DORMANCY_CHECK_INTERVAL: %q", value)
+		}
+		interval = parsed
+	}
+	return NewDormantMachineExpirer(i, policy, interval), nil
+}
+
+// Run applies the policy immediately and then on every interval until ctx is
+// done. It returns straight away when the policy is disabled.
+func (e *DormantMachineExpirer) Run(ctx context.Context) {
+	if !e.policy.Enabled() {
+		return
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.RunOnce(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce suspends machines that have been inactive for too long and deletes
+// machines that have stayed suspended for inactivity for too long. Running it
+// concurrently on several servers is safe.
+func (e *DormantMachineExpirer) RunOnce(now time.Time) {
+	machineRepo := do.MustInvoke[repository.MachineRepository](e.injector)
+	if e.policy.SuspendAfter > 0 {
+		machines, err := machineRepo.GetDormantMachines(now.Add(-e.policy.SuspendAfter))
+		if err != nil {
+			log.Err(err).Msg("error fetching dormant machines")
+		}
+		for _, machine := range machines {
+			if err := machineRepo.SuspendMachine(machine.ID, DormantSuspendReason); err != nil {
+				log.Err(err).Str("machine_id", machine.ID.String()).Msg("error suspending dormant machine")
+				continue
+			}
+			if err := do.MustInvoke[*crypto.SessionManager](e.injector).RevokeMachine(machine.ID); err != nil {
+				log.Err(err).Str("machine_id", machine.ID.String()).Msg("error revoking machine sessions")
+			}
+			log.Info().Str("machine_id", machine.ID.String()).Time("last_active_at", machine.LastActiveAt()).Msg("suspended dormant machine")
+		}
+	}
+	if e.policy.DeleteAfter > 0 {
+		machines, err := machineRepo.GetMachinesSuspendedBefore(DormantSuspendReason, now.Add(-e.policy.DeleteAfter))
+		if err != nil {
+			log.Err(err).Msg("error fetching expired dormant machines")
+		}
+		for _, machine := range machines {
+			if err := machineRepo.DeleteMachine(machine.ID); err != nil {
+				log.Err(err).Str("machine_id", machine.ID.String()).Msg("error deleting dormant machine")
+				continue
+			}
+			do.MustInvoke[*crypto.PublicKeyCache](e.injector).Invalidate(machine.ID)
+			log.Info().Str("machine_id", machine.ID.String()).Msg("deleted dormant machine")
+		}
+	}
+}
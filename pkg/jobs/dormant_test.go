@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"go.uber.org/mock/gomock"
+)
+
+func TestLoadDormancyPolicy(t *testing.T) {
+	t.Setenv("MACHINE_DORMANT_SUSPEND_AFTER", "90d")
+	t.Setenv("MACHINE_DORMANT_DELETE_AFTER", "720h")
+	policy, err := LoadDormancyPolicy()
+	require.NoError(t, err)
+	assert.Equal(t, 90*24*time.Hour, policy.SuspendAfter)
+	assert.Equal(t, 30*24*time.Hour, policy.DeleteAfter)
+	assert.True(t, policy.Enabled())
+
+	t.Setenv("MACHINE_DORMANT_SUSPEND_AFTER", "-1d")
+	_, err = LoadDormancyPolicy()
+	assert.Error(t, err)
+}
+
+func TestLoadDormancyPolicy_Disabled(t *testing.T) {
+	policy, err := LoadDormancyPolicy()
+	require.NoError(t, err)
+	assert.False(t, policy.Enabled())
+	assert.Nil(t, policy.SuspendsAt(&models.Machine{}))
+}
+
+func TestDormancyPolicy_Deadlines(t *testing.T) {
+	policy := DormancyPolicy{SuspendAfter: 90 * 24 * time.Hour, DeleteAfter: 30 * 24 * time.Hour}
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lastSeen := created.Add(10 * 24 * time.Hour)
+	machine := &models.Machine{CreatedAt: created, MachineActivity: models.MachineActivity{LastSeenAt: &lastSeen}}
+	assert.Equal(t, lastSeen.Add(policy.SuspendAfter), *policy.SuspendsAt(machine))
+	assert.Nil(t, policy.DeletesAt(machine))
+
+	suspendedAt := lastSeen.Add(policy.SuspendAfter)
+	reason := DormantSuspendReason
+	machine.SuspendedAt = &suspendedAt
+	machine.SuspendedReason = &reason
+	assert.Nil(t, policy.SuspendsAt(machine))
+	assert.Equal(t, suspendedAt.Add(policy.DeleteAfter), *policy.DeletesAt(machine))
+
+	manualReason := "lost"
+	machine.SuspendedReason = &manualReason
+	assert.Nil(t, policy.DeletesAt(machine))
+
+	recoveryKey := &models.Machine{CreatedAt: created, RecoveryKey: true}
+	assert.Nil(t, policy.SuspendsAt(recoveryKey), "recovery keys are never used until needed")
+}
+
+func TestDormantMachineExpirer_RunOnce(t *testing.T) {
+	// Arrange
+	i := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	sessionManager, err := crypto.LoadSessionManager()
+	require.NoError(t, err)
+	do.ProvideValue(i, sessionManager)
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+	now := time.Now()
+	policy := DormancyPolicy{SuspendAfter: 90 * 24 * time.Hour, DeleteAfter: 30 * 24 * time.Hour}
+	dormant := models.Machine{ID: uuid.New(), UserID: uuid.New(), Name: "old-vm"}
+	expired := models.Machine{ID: uuid.New(), UserID: uuid.New(), Name: "older-vm"}
+	token, _, err := sessionManager.Issue(&models.User{ID: dormant.UserID, Username: "user"}, &dormant)
+	require.NoError(t, err)
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetDormantMachines(now.Add(-policy.SuspendAfter)).Return([]models.Machine{dormant}, nil)
+	mockMachineRepo.EXPECT().SuspendMachine(dormant.ID, DormantSuspendReason).Return(nil)
+	mockMachineRepo.EXPECT().GetMachinesSuspendedBefore(DormantSuspendReason, now.Add(-policy.DeleteAfter)).Return([]models.Machine{expired}, nil)
+	mockMachineRepo.EXPECT().DeleteMachine(expired.ID).Return(nil)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	NewDormantMachineExpirer(i, policy, time.Hour).RunOnce(now)
+
+	// Assert
+	_, err = sessionManager.Verify(token)
+	assert.ErrorIs(t, err, crypto.ErrSessionRevoked)
+}
+
+func TestDormantMachineExpirer_SuspendOnly(t *testing.T) {
+	// Arrange
+	i := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	now := time.Now()
+	policy := DormancyPolicy{SuspendAfter: 90 * 24 * time.Hour}
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetDormantMachines(now.Add(-policy.SuspendAfter)).Return(nil, nil)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	NewDormantMachineExpirer(i, policy, time.Hour).RunOnce(now)
+
+	// Assert: gomock fails on any deletion query.
+}
@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+)
+
+const defaultRotationExpiryCheckInterval = time.Hour
+
+// RotationExpiryPolicy describes how long a master key rotation may stay
+// unacknowledged before it is deleted. A zero duration disables expiry.
+type RotationExpiryPolicy struct {
+	PendingFor time.Duration
+}
+
+// LoadRotationExpiryPolicy reads KEY_ROTATION_PENDING_TTL, which accepts a Go
+// duration or a number of days such as "14d".
+func LoadRotationExpiryPolicy() (RotationExpiryPolicy, error) {
+	value := os.Getenv("KEY_ROTATION_PENDING_TTL")
+	if value == "" {
+		return RotationExpiryPolicy{}, nil
+	}
+	duration, err := parseDays(value)
+	if err != nil || duration <= 0 {
+		return RotationExpiryPolicy{}, fmt.Errorf("invalid KEY_ROTATION_PENDING_TTL: %q", value)
+	}
+	return RotationExpiryPolicy{PendingFor: duration}, nil
+}
+
+func (p RotationExpiryPolicy) Enabled() bool {
+	return p.PendingFor > 0
+}
+
+// ExpiresAt returns when a pending rotation will be deleted.
+func (p RotationExpiryPolicy) ExpiresAt(rotation *models.MasterKeyRotation) *time.Time {
+	if !p.Enabled() || !rotation.IsPending() {
+		return nil
+	}
+	t := rotation.CreatedAt.Add(p.PendingFor)
+	return &t
+}
+
+// PendingRotationExpirer periodically deletes rotations that have been pending
+// for longer than the policy allows.
+type PendingRotationExpirer struct {
+	injector *do.Injector
+	policy   RotationExpiryPolicy
+	interval time.Duration
+}
+
+func NewPendingRotationExpirer(i *do.Injector, policy RotationExpiryPolicy, interval time.Duration) *PendingRotationExpirer {
+	return &PendingRotationExpirer{injector: i, policy: policy, interval: interval}
+}
+
+// LoadPendingRotationExpirer creates the job from the expiry policy and
+// KEY_ROTATION_EXPIRY_CHECK_INTERVAL (a Go duration, 1h by default).
+func LoadPendingRotationExpirer(i *do.Injector) (*PendingRotationExpirer, error) {
+	policy, err := LoadRotationExpiryPolicy()
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultRotationExpiryCheckInterval
+	if value := os.Getenv("KEY_ROTATION_EXPIRY_CHECK_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid KEY_ROTATION_EXPIRY_CHECK_INTERVAL: %q", value)
+		}
+		interval = parsed
+	}
+	return NewPendingRotationExpirer(i, policy, interval), nil
+}
+
+// Run deletes expired rotations immediately and then on every interval until
+// ctx is done. It returns straight away when expiry is disabled.
+func (e *PendingRotationExpirer) Run(ctx context.Context) {
+	if !e.policy.Enabled() {
+		return
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.RunOnce(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce deletes rotations that were created more than the allowed time
+// before now and never acknowledged.
+func (e *PendingRotationExpirer) RunOnce(now time.Time) {
+	rotationRepo := do.MustInvoke[repository.MasterKeyRotationRepository](e.injector)
+	deleted, err := rotationRepo.DeleteRotationsPendingSince(now.Add(-e.policy.PendingFor))
+	if err != nil {
+		log.Err(err).Msg("error deleting expired master key rotations")
+		return
+	}
+	if deleted > 0 {
+		log.Info().Int64("count", deleted).Msg("deleted expired master key rotations")
+	}
+}
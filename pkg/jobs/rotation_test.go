@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"go.uber.org/mock/gomock"
+)
+
+func TestLoadRotationExpiryPolicy(t *testing.T) {
+	policy, err := LoadRotationExpiryPolicy()
+	require.NoError(t, err)
+	assert.False(t, policy.Enabled())
+
+	t.Setenv("KEY_ROTATION_PENDING_TTL", "14d")
+	policy, err = LoadRotationExpiryPolicy()
+	require.NoError(t, err)
+	assert.Equal(t, 14*24*time.Hour, policy.PendingFor)
+
+	t.Setenv("KEY_ROTATION_PENDING_TTL", "soon")
+	_, err = LoadRotationExpiryPolicy()
+	assert.Error(t, err)
+}
+
+func TestRotationExpiryPolicy_ExpiresAt(t *testing.T) {
+	policy := RotationExpiryPolicy{PendingFor: 7 * 24 * time.Hour}
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rotation := &models.MasterKeyRotation{CreatedAt: created}
+	assert.Equal(t, created.Add(policy.PendingFor), *policy.ExpiresAt(rotation))
+
+	acknowledged := created.Add(time.Hour)
+	rotation.AcknowledgedAt = &acknowledged
+	assert.Nil(t, policy.ExpiresAt(rotation))
+	assert.Nil(t, RotationExpiryPolicy{}.ExpiresAt(&models.MasterKeyRotation{CreatedAt: created}))
+}
+
+func TestPendingRotationExpirer_RunOnce(t *testing.T) {
+	// Arrange
+	i := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	now := time.Now()
+	policy := RotationExpiryPolicy{PendingFor: 7 * 24 * time.Hour}
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().DeleteRotationsPendingSince(now.Add(-policy.PendingFor)).Return(int64(2), nil)
+	do.Provide(i, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	NewPendingRotationExpirer(i, policy, time.Hour).RunOnce(now)
+
+	// Assert: gomock verifies the cutoff.
+}
@@ -0,0 +1,193 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
+)
+
+var (
+	// eventWriteTimeout bounds sending one event, so that a stalled client
+	// does not hold on to its subscription.
+	eventWriteTimeout = 10 * time.Second
+	// eventKeepAliveInterval is how often an idle Server-Sent Events stream
+	// gets a comment, so that proxies do not close it.
+	eventKeepAliveInterval = 30 * time.Second
+)
+
+// EventStream pushes the user's change events to the requesting machine over
+// a websocket, or as Server-Sent Events if the request does not ask to
+// upgrade. The stream ends once the machine itself, or the whole account, is
+// removed.
+func EventStream(i *do.Injector, r *http.Request, w http.ResponseWriter) error {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return ServerSentEventsHandler(i, r, w)
+	}
+	conn, err := upgradeWebsocket(i, r, w)
+	if err != nil || conn == nil {
+		return err
+	}
+	go EventWebsocketHandler(i, r, w, &conn)
+	return nil
+}
+
+func eventStreamContext(r *http.Request) (*models.User, *models.Machine, error) {
+	user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+	if !ok {
+		return nil, nil, errors.New("could not get user from context")
+	}
+	machine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+	if !ok {
+		return nil, nil, errors.New("could not get machine from context")
+	}
+	return user, machine, nil
+}
+
+func endsStream(event Event, machine *models.Machine) bool {
+	if event.Type == EventAccountDeleted {
+		return true
+	}
+	return event.Type == EventMachineRemoved && event.MachineID != nil && *event.MachineID == machine.ID
+}
+
+// EventWebsocketHandler closes the websocket with StatusGoingAway when the
+// server shuts down, so that the client reconnects to another instance.
+func EventWebsocketHandler(i *do.Injector, r *http.Request, w http.ResponseWriter, c *net.Conn) {
+	defer (*c).Close()
+	user, machine, err := eventStreamContext(r)
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not start event stream")
+		return
+	}
+	connections := do.MustInvoke[*Connections](i)
+	conn := connections.keepAlive(*c)
+	shutdown, done, ok := connections.track()
+	defer done()
+	if !ok {
+		conn.closeWith(ws.StatusGoingAway, shutdownMessage)
+		return
+	}
+	ctx, cancel := context.WithCancel(shutdown)
+	defer cancel()
+	go conn.pingUntil(ctx)
+	subscription := do.MustInvoke[EventBroker](i).Subscribe(user.ID)
+	defer subscription.Close()
+	// Clients send nothing on this websocket; reading only tells us when they
+	// leave or stop answering pings, and answers their own pings.
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		for {
+			if _, _, err := wsutil.ReadClientData(conn); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-left:
+			return
+		case <-ctx.Done():
+			if err := conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout)); err == nil {
+				conn.closeWith(ws.StatusGoingAway, shutdownMessage)
+			}
+			return
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+			if !event.concerns(machine.ID) {
+				continue
+			}
+			if err := conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout)); err != nil {
+				return
+			}
+			if err := writeMessage(conn, event); err != nil {
+				log.Debug().Err(err).Msg("Error writing event")
+				return
+			}
+			if endsStream(event, machine) {
+				return
+			}
+		}
+	}
+}
+
+// ServerSentEventsHandler returns an error only if the stream could not be
+// started. The stream ends when the server shuts down.
+func ServerSentEventsHandler(i *do.Injector, r *http.Request, w http.ResponseWriter) error {
+	user, machine, err := eventStreamContext(r)
+	if err != nil {
+		return err
+	}
+	shutdown, done, ok := do.MustInvoke[*Connections](i).track()
+	defer done()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil
+	}
+	controller := http.NewResponseController(w)
+	subscription := do.MustInvoke[EventBroker](i).Subscribe(user.ID)
+	defer subscription.Close()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		log.Err(err).Msg("Could not flush event stream")
+		return nil
+	}
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	// The server does not reset deadlines set here for later requests on the
+	// same connection.
+	defer controller.SetWriteDeadline(time.Time{})
+	for {
+		var message string
+		last := false
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-shutdown.Done():
+			return nil
+		case <-keepAlive.C:
+			message = ": keep-alive\n\n"
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return nil
+			}
+			if !event.concerns(machine.ID) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Err(err).Msg("Error encoding event")
+				return nil
+			}
+			message = fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, data)
+			last = endsStream(event, machine)
+		}
+		// Not every ResponseWriter supports deadlines; the keep-alive catches
+		// stalled clients either way.
+		controller.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := fmt.Fprint(w, message); err != nil {
+			return nil
+		}
+		if err := controller.Flush(); err != nil || last {
+			return nil
+		}
+	}
+}
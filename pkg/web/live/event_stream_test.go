@@ -0,0 +1,134 @@
+package live
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/wsutils"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
+)
+
+func newEventStreamRequest(ctx context.Context, user *models.User, machine *models.Machine) *http.Request {
+	req := httptest.NewRequestWithContext(ctx, "GET", "/", nil)
+	req = testutils.AddUserContext(req, user)
+	return testutils.AddMachineContext(req, machine)
+}
+
+// waitSubscribed waits until the handler has subscribed to the user's events.
+func waitSubscribed(t *testing.T, broker *MemoryEventBroker, userID uuid.UUID) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return len(broker.subscriptions[userID]) > 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestEventWebsocketHandler(t *testing.T) {
+	// Arrange
+	injector := do.New()
+	broker := NewMemoryEventBroker()
+	do.ProvideValue[EventBroker](injector, broker)
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
+	user := testutils.GenerateUser()
+	machine := testutils.GenerateMachine()
+	other := testutils.GenerateMachine()
+	other.UserID = user.ID
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		EventWebsocketHandler(injector, newEventStreamRequest(context.Background(), user, machine), httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+	waitSubscribed(t, broker, user.ID)
+
+	// Act
+	keyEvent := NewEvent(EventKeyUpdated, user.ID, &other.ID)
+	keyEvent.Name = "id_ed25519"
+	require.NoError(t, broker.Publish(keyEvent))
+	otherRotation := NewEvent(EventRotationPending, user.ID, nil)
+	otherRotation.MachineID = &other.ID
+	require.NoError(t, broker.Publish(otherRotation))
+	require.NoError(t, broker.Publish(NewMachineEvent(EventMachineRemoved, &models.Machine{ID: machine.ID, UserID: user.ID}, &other.ID)))
+
+	// Assert
+	received, err := wsutils.ReadServerMessage[Event](&clientConn)
+	require.NoError(t, err)
+	assert.Equal(t, EventKeyUpdated, received.Data.Type)
+	assert.Equal(t, "id_ed25519", received.Data.Name)
+	assert.Equal(t, &other.ID, received.Data.SourceMachineID)
+	// The other machine's rotation is skipped.
+	received, err = wsutils.ReadServerMessage[Event](&clientConn)
+	require.NoError(t, err)
+	assert.Equal(t, EventMachineRemoved, received.Data.Type)
+	// Removing the machine ends its stream.
+	waitDone(t, done)
+}
+
+func TestEventWebsocketHandler_ClientLeaves(t *testing.T) {
+	injector := do.New()
+	broker := NewMemoryEventBroker()
+	do.ProvideValue[EventBroker](injector, broker)
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
+	user := testutils.GenerateUser()
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		EventWebsocketHandler(injector, newEventStreamRequest(context.Background(), user, testutils.GenerateMachine()), httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+	waitSubscribed(t, broker, user.ID)
+
+	require.NoError(t, clientConn.Close())
+
+	waitDone(t, done)
+	assert.Empty(t, broker.subscriptions)
+}
+
+func TestServerSentEventsHandler(t *testing.T) {
+	// Arrange
+	injector := do.New()
+	broker := NewMemoryEventBroker()
+	do.ProvideValue[EventBroker](injector, broker)
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
+	user := testutils.GenerateUser()
+	machine := testutils.GenerateMachine()
+	rr := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- ServerSentEventsHandler(injector, newEventStreamRequest(ctx, user, machine), rr)
+	}()
+	waitSubscribed(t, broker, user.ID)
+
+	// Act
+	require.NoError(t, broker.Publish(NewEvent(EventConfigUpdated, user.ID, nil)))
+	cancel()
+
+	// Assert
+	require.NoError(t, <-done)
+	assert.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(rr.Body.String(), "event: config.updated\ndata: {\"type\":\"config.updated\""), rr.Body.String())
+	assert.Empty(t, broker.subscriptions)
+}
+
+func TestEndsStream(t *testing.T) {
+	machine := testutils.GenerateMachine()
+	other := testutils.GenerateMachine()
+
+	assert.True(t, endsStream(NewMachineEvent(EventMachineRemoved, machine, nil), machine))
+	assert.False(t, endsStream(NewMachineEvent(EventMachineRemoved, other, nil), machine))
+	assert.True(t, endsStream(NewEvent(EventAccountDeleted, machine.UserID, &other.ID), machine))
+}
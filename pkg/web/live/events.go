@@ -0,0 +1,178 @@
+package live
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+)
+
+// Change events pushed to a user's connected machines so that they can sync
+// without waiting for the user to run a download. Uploads replace the SSH
+// config and known hosts as a whole, so their events cover deletions too.
+const (
+	EventKeyUpdated        = "key.updated"
+	EventKeyDeleted        = "key.deleted"
+	EventConfigUpdated     = "config.updated"
+	EventKnownHostsUpdated = "known_hosts.updated"
+	EventMachineAdded      = "machine.added"
+	EventMachineRemoved    = "machine.removed"
+	EventRotationPending   = "rotation.pending"
+	EventRotationRequired  = "rotation.required"
+	EventAccountDeleted    = "account.deleted"
+)
+
+// eventSubscriptionBuffer is how many events a subscriber may fall behind.
+const eventSubscriptionBuffer = 32
+
+// Event is a change to a user's data or machines.
+type Event struct {
+	Type string `json:"type"`
+	// Name is the key file or machine name the event is about.
+	Name string `json:"name,omitempty"`
+	// MachineID is the machine a machine or rotation event is about.
+	MachineID *uuid.UUID `json:"machine_id,omitempty"`
+	// SourceMachineID is the machine whose request caused the event, so that
+	// it can skip its own changes.
+	SourceMachineID *uuid.UUID `json:"source_machine_id,omitempty"`
+	// Epoch is the master key epoch of a pending rotation.
+	Epoch int64     `json:"epoch,omitempty"`
+	At    time.Time `json:"at"`
+
+	UserID uuid.UUID `json:"-"`
+}
+
+// NewEvent creates an event of the given type for the user, caused by source
+// if it is not nil.
+func NewEvent(eventType string, userID uuid.UUID, source *uuid.UUID) Event {
+	return Event{Type: eventType, UserID: userID, SourceMachineID: source, At: time.Now().UTC()}
+}
+
+// NewMachineEvent creates an event about machine.
+func NewMachineEvent(eventType string, machine *models.Machine, source *uuid.UUID) Event {
+	event := NewEvent(eventType, machine.UserID, source)
+	event.Name = machine.Name
+	event.MachineID = &machine.ID
+	return event
+}
+
+// concerns reports whether the event should be sent to machine. Rotations are
+// only of interest to the machine that has to apply them.
+func (e Event) concerns(machineID uuid.UUID) bool {
+	return e.Type != EventRotationPending || (e.MachineID != nil && *e.MachineID == machineID)
+}
+
+// EventBroker passes change events to the connections of the user's machines.
+// With a shared broker the connections may be served by other server
+// instances than the one the change was made on.
+type EventBroker interface {
+	// Publish sends the event to the user's subscriptions. Call it only once
+	// the change has been committed.
+	Publish(event Event) error
+	Subscribe(userID uuid.UUID) *EventSubscription
+}
+
+// EventSubscription receives a user's events on Events. The channel is closed
+// when the subscriber falls too far behind, or the broker can no longer
+// guarantee delivery, so that the client reconnects and syncs in full.
+type EventSubscription struct {
+	Events <-chan Event
+
+	events chan Event
+	userID uuid.UUID
+	broker *MemoryEventBroker
+}
+
+func (s *EventSubscription) Close() {
+	s.broker.unsubscribe(s)
+}
+
+// MemoryEventBroker delivers events to subscriptions in this process.
+type MemoryEventBroker struct {
+	mu            sync.Mutex
+	subscriptions map[uuid.UUID]map[*EventSubscription]struct{}
+}
+
+func NewMemoryEventBroker() *MemoryEventBroker {
+	return &MemoryEventBroker{subscriptions: make(map[uuid.UUID]map[*EventSubscription]struct{})}
+}
+
+func (b *MemoryEventBroker) Publish(event Event) error {
+	b.deliver(event)
+	return nil
+}
+
+func (b *MemoryEventBroker) Subscribe(userID uuid.UUID) *EventSubscription {
+	events := make(chan Event, eventSubscriptionBuffer)
+	s := &EventSubscription{Events: events, events: events, userID: userID, broker: b}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscriptions[userID] == nil {
+		b.subscriptions[userID] = make(map[*EventSubscription]struct{})
+	}
+	b.subscriptions[userID][s] = struct{}{}
+	return s
+}
+
+func (b *MemoryEventBroker) deliver(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscriptions[event.UserID] {
+		select {
+		case s.events <- event:
+		default:
+			// Dropping a single event would leave the client out of sync.
+			b.remove(s)
+		}
+	}
+}
+
+func (b *MemoryEventBroker) unsubscribe(s *EventSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(s)
+}
+
+// closeAll ends every subscription, for when events may have been missed.
+func (b *MemoryEventBroker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subscriptions := range b.subscriptions {
+		for s := range subscriptions {
+			b.remove(s)
+		}
+	}
+}
+
+// remove must be called with b.mu held.
+func (b *MemoryEventBroker) remove(s *EventSubscription) {
+	if _, ok := b.subscriptions[s.userID][s]; !ok {
+		return
+	}
+	delete(b.subscriptions[s.userID], s)
+	if len(b.subscriptions[s.userID]) == 0 {
+		delete(b.subscriptions, s.userID)
+	}
+	close(s.events)
+}
+
+// LoadEventBroker creates the broker selected by EVENT_BROKER: "memory" (the
+// default) only reaches connections to this server instance, "postgres"
+// relays events between instances through LISTEN/NOTIFY.
+func LoadEventBroker(i *do.Injector) (EventBroker, error) {
+	switch broker := os.Getenv("EVENT_BROKER"); broker {
+	case "", "memory":
+		return NewMemoryEventBroker(), nil
+	case "postgres":
+		b := NewPostgresEventBroker(i)
+		go b.Listen(context.Background())
+		return b, nil
+	default:
+		return nil, fmt.Errorf("invalid EVENT_BROKER: %q", broker)
+	}
+}
@@ -0,0 +1,53 @@
+package live
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryEventBroker_DeliversToUser(t *testing.T) {
+	broker := NewMemoryEventBroker()
+	alice, bob := uuid.New(), uuid.New()
+	laptop := broker.Subscribe(alice)
+	defer laptop.Close()
+	desktop := broker.Subscribe(alice)
+	defer desktop.Close()
+	other := broker.Subscribe(bob)
+	defer other.Close()
+
+	require.NoError(t, broker.Publish(NewEvent(EventConfigUpdated, alice, nil)))
+
+	assert.Equal(t, EventConfigUpdated, (<-laptop.Events).Type)
+	assert.Equal(t, EventConfigUpdated, (<-desktop.Events).Type)
+	assert.Empty(t, other.Events)
+}
+
+func TestMemoryEventBroker_ClosesSlowSubscriber(t *testing.T) {
+	broker := NewMemoryEventBroker()
+	user := uuid.New()
+	subscription := broker.Subscribe(user)
+
+	for range eventSubscriptionBuffer + 1 {
+		require.NoError(t, broker.Publish(NewEvent(EventKeyUpdated, user, nil)))
+	}
+
+	received := 0
+	for range subscription.Events {
+		received++
+	}
+	assert.Equal(t, eventSubscriptionBuffer, received, "the subscription is closed instead of dropping events")
+	subscription.Close()
+}
+
+func TestEvent_Concerns(t *testing.T) {
+	machine, other := uuid.New(), uuid.New()
+	rotation := NewEvent(EventRotationPending, uuid.New(), nil)
+	rotation.MachineID = &other
+
+	assert.True(t, NewEvent(EventKeyDeleted, uuid.New(), nil).concerns(machine))
+	assert.False(t, rotation.concerns(machine))
+	assert.True(t, rotation.concerns(other))
+}
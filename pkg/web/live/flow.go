@@ -0,0 +1,177 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/rs/zerolog/log"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/wsutils"
+)
+
+// errClientDisconnected is the cancellation cause of a flow whose websocket
+// was closed by the client.
+var errClientDisconnected = errors.New("client disconnected")
+
+// failureWriteTimeout bounds telling the client why its flow failed, which
+// may happen after the step's own deadline has passed.
+const failureWriteTimeout = 5 * time.Second
+
+// challengeState names a step of a challenge flow, for logs and timeout
+// messages.
+type challengeState string
+
+// challengeStep is one state of a challenge flow. run has until timeout to
+// finish, and is cancelled early if the client disconnects. Steps whose
+// deadline depends on earlier steps set timeoutFunc instead, which is called
+// when the step starts.
+type challengeStep struct {
+	state       challengeState
+	timeout     time.Duration
+	timeoutFunc func() time.Duration
+	run         func(ctx context.Context) error
+}
+
+// challengeError is a step failure with a message meant for the client.
+type challengeError struct {
+	message string
+	err     error
+}
+
+func (e *challengeError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *challengeError) Unwrap() error {
+	return e.err
+}
+
+func clientError(message string, err error) error {
+	return &challengeError{message: message, err: err}
+}
+
+// challengeFlow runs the steps of one side of a challenge over its websocket.
+// Its context is cancelled as soon as a read shows that the client has gone,
+// so that a flow waiting on the other machine does not outlive its socket, and
+// when the server shuts down.
+type challengeFlow struct {
+	connections *Connections
+	conn        *keepAliveConn
+	ctx         context.Context
+	cancel      context.CancelCauseFunc
+	writeError  func(conn *net.Conn, message string) error
+}
+
+func newChallengeFlow(connections *Connections, conn net.Conn, writeError func(conn *net.Conn, message string) error) *challengeFlow {
+	ctx, cancel := context.WithCancelCause(connections.ctx)
+	return &challengeFlow{connections: connections, conn: connections.keepAlive(conn), ctx: ctx, cancel: cancel, writeError: writeError}
+}
+
+// run executes the steps in order and stops at the first failure, telling the
+// client why unless it has disconnected.
+func (f *challengeFlow) run(steps ...challengeStep) error {
+	defer f.cancel(nil)
+	_, done, _ := f.connections.track()
+	defer done()
+	go f.conn.pingUntil(f.ctx)
+	for _, step := range steps {
+		if err := context.Cause(f.ctx); err != nil {
+			f.fail(step, err, false)
+			return err
+		}
+		timeout := step.timeout
+		if step.timeoutFunc != nil {
+			timeout = step.timeoutFunc()
+		}
+		deadline := time.Now().Add(timeout)
+		if err := f.conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithDeadline(f.ctx, deadline)
+		err := step.run(ctx)
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
+		if err != nil {
+			f.fail(step, err, timedOut)
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *challengeFlow) fail(step challengeStep, err error, timedOut bool) {
+	if cause := context.Cause(f.ctx); errors.Is(cause, errClientDisconnected) {
+		log.Debug().Err(cause).Str("state", string(step.state)).Msg("Client left the challenge")
+		return
+	}
+	var message string
+	var ce *challengeError
+	switch {
+	case errors.Is(context.Cause(f.ctx), ErrServerShuttingDown):
+		message = shutdownMessage
+	case errors.As(err, &ce):
+		message = ce.message
+	case timedOut:
+		message = fmt.Sprintf("Challenge timed out %s", step.state)
+	default:
+		message = "Internal server error"
+	}
+	log.Debug().Err(err).Str("state", string(step.state)).Msg("Challenge failed")
+	if err := f.conn.SetWriteDeadline(time.Now().Add(failureWriteTimeout)); err != nil {
+		log.Err(err).Msg("Error setting write deadline")
+		return
+	}
+	if err := f.conn.write(func(conn *net.Conn) error { return f.writeError(conn, message) }); err != nil {
+		log.Err(err).Msg("Error writing server error")
+	}
+}
+
+// readAsync reads the next client message in the background. If the read
+// fails the client is treated as gone and the flow is cancelled; otherwise
+// the message is delivered on the returned channel. Only one read may be in
+// flight at a time.
+func readAsync[T any](f *challengeFlow) <-chan T {
+	ch := make(chan T, 1)
+	go func() {
+		var conn net.Conn = f.conn
+		msg, err := wsutils.ReadClientMessage[T](&conn)
+		if err != nil {
+			if isDisconnect(err) {
+				err = fmt.Errorf("%w: %v", errClientDisconnected, err)
+			}
+			f.cancel(err)
+			return
+		}
+		ch <- msg.Data
+	}()
+	return ch
+}
+
+// receive waits for a message started by readAsync.
+func receive[T any](ctx context.Context, ch <-chan T) (T, error) {
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-ctx.Done():
+		var zero T
+		if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, errClientDisconnected) && !errors.Is(cause, context.DeadlineExceeded) && !errors.Is(cause, ErrServerShuttingDown) {
+			return zero, clientError("Invalid message", cause)
+		}
+		return zero, ctx.Err()
+	}
+}
+
+// isDisconnect reports whether a read failed because the client has gone. A
+// client that has stopped answering pings counts as gone.
+func isDisconnect(err error) bool {
+	var closed wsutil.ClosedError
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &closed)
+}
@@ -0,0 +1,207 @@
+package live
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	minChallengeWords = 3
+	maxChallengeWords = 12
+
+	challengeGuardPruneEvery = time.Minute
+)
+
+// ChallengeConfig sets how strong challenge phrases are and how hard they are
+// to guess. A user or source IP that fails MaxFailuresPerUser or
+// MaxFailuresPerIP challenge lookups within LockoutDuration is refused further
+// lookups until LockoutDuration has passed since the last failure.
+//
+// QuorumTimeout is how long a new machine of a user whose policy requires
+// several machines to approve it waits for all of them.
+type ChallengeConfig struct {
+	Words              int
+	AcceptTimeout      time.Duration
+	QuorumTimeout      time.Duration
+	MaxFailuresPerUser int
+	MaxFailuresPerIP   int
+	LockoutDuration    time.Duration
+	MaxPendingPerUser  int
+}
+
+func DefaultChallengeConfig() ChallengeConfig {
+	return ChallengeConfig{
+		Words:              3,
+		AcceptTimeout:      30 * time.Second,
+		QuorumTimeout:      5 * time.Minute,
+		MaxFailuresPerUser: 5,
+		MaxFailuresPerIP:   20,
+		LockoutDuration:    15 * time.Minute,
+		MaxPendingPerUser:  3,
+	}
+}
+
+// LoadChallengeConfig reads CHALLENGE_WORDS, CHALLENGE_TIMEOUT,
+// CHALLENGE_QUORUM_TIMEOUT, CHALLENGE_USER_FAILURE_LIMIT,
+// CHALLENGE_IP_FAILURE_LIMIT, CHALLENGE_LOCKOUT_DURATION and
+// CHALLENGE_MAX_PENDING_PER_USER, falling back to DefaultChallengeConfig.
+func LoadChallengeConfig() (ChallengeConfig, error) {
+	config := DefaultChallengeConfig()
+	for _, setting := range []struct {
+		env   string
+		value *int
+		min   int
+		max   int
+	}{
+		{"CHALLENGE_WORDS", &config.Words, minChallengeWords, maxChallengeWords},
+		{"CHALLENGE_USER_FAILURE_LIMIT", &config.MaxFailuresPerUser, 1, 0},
+		{"CHALLENGE_IP_FAILURE_LIMIT", &config.MaxFailuresPerIP, 1, 0},
+		{"CHALLENGE_MAX_PENDING_PER_USER", &config.MaxPendingPerUser, 1, 0},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < setting.min || (setting.max > 0 && n > setting.max) {
+			return ChallengeConfig{}, fmt.Errorf("invalid %s: %q", setting.env, value)
+		}
+		*setting.value = n
+	}
+	for _, setting := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"CHALLENGE_TIMEOUT", &config.AcceptTimeout},
+		{"CHALLENGE_QUORUM_TIMEOUT", &config.QuorumTimeout},
+		{"CHALLENGE_LOCKOUT_DURATION", &config.LockoutDuration},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return ChallengeConfig{}, fmt.Errorf("invalid %s: %q", setting.env, value)
+		}
+		*setting.value = duration
+	}
+	return config, nil
+}
+
+// ChallengeGuard enforces a ChallengeConfig. Like the authentication limiter,
+// it keeps its state in memory for this server process.
+type ChallengeGuard struct {
+	Config ChallengeConfig
+
+	mu        sync.Mutex
+	failures  map[string]*challengeFailures
+	pending   map[string]int
+	lastPrune time.Time
+}
+
+type challengeFailures struct {
+	count       int
+	lastFailure time.Time
+}
+
+func LoadChallengeGuard() (*ChallengeGuard, error) {
+	config, err := LoadChallengeConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewChallengeGuard(config), nil
+}
+
+func NewChallengeGuard(config ChallengeConfig) *ChallengeGuard {
+	return &ChallengeGuard{
+		Config:   config,
+		failures: make(map[string]*challengeFailures),
+		pending:  make(map[string]int),
+	}
+}
+
+func userGuardKey(username string) string {
+	return "user:" + username
+}
+
+func ipGuardKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Blocked reports whether the user or the source IP has failed too many
+// lookups, and how long until it may try again.
+func (g *ChallengeGuard) Blocked(now time.Time, username, ip string) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var wait time.Duration
+	for _, check := range []struct {
+		key   string
+		limit int
+	}{
+		{userGuardKey(username), g.Config.MaxFailuresPerUser},
+		{ipGuardKey(ip), g.Config.MaxFailuresPerIP},
+	} {
+		entry, ok := g.failures[check.key]
+		if !ok || entry.count < check.limit {
+			continue
+		}
+		if until := entry.lastFailure.Add(g.Config.LockoutDuration); now.Before(until) {
+			wait = max(wait, until.Sub(now))
+		}
+	}
+	return wait, wait > 0
+}
+
+func (g *ChallengeGuard) RecordFailure(now time.Time, username, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune(now)
+	for _, key := range []string{userGuardKey(username), ipGuardKey(ip)} {
+		entry, ok := g.failures[key]
+		if !ok || now.Sub(entry.lastFailure) > g.Config.LockoutDuration {
+			entry = &challengeFailures{}
+			g.failures[key] = entry
+		}
+		entry.count++
+		entry.lastFailure = now
+	}
+}
+
+// Acquire counts a new pending challenge of the user, failing if the user
+// already has MaxPendingPerUser of them. Each successful Acquire must be
+// followed by a Release.
+func (g *ChallengeGuard) Acquire(username string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending[username] >= g.Config.MaxPendingPerUser {
+		return false
+	}
+	g.pending[username]++
+	return true
+}
+
+func (g *ChallengeGuard) Release(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending[username] <= 1 {
+		delete(g.pending, username)
+		return
+	}
+	g.pending[username]--
+}
+
+func (g *ChallengeGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < challengeGuardPruneEvery {
+		return
+	}
+	g.lastPrune = now
+	for key, entry := range g.failures {
+		if now.Sub(entry.lastFailure) > g.Config.LockoutDuration {
+			delete(g.failures, key)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package live
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChallengeGuard_Blocked(t *testing.T) {
+	config := DefaultChallengeConfig()
+	config.MaxFailuresPerUser = 2
+	config.MaxFailuresPerIP = 3
+	guard := NewChallengeGuard(config)
+	now := time.Now()
+
+	guard.RecordFailure(now, "alice", "192.0.2.1")
+	_, blocked := guard.Blocked(now, "alice", "192.0.2.1")
+	assert.False(t, blocked)
+	guard.RecordFailure(now, "alice", "192.0.2.1")
+	wait, blocked := guard.Blocked(now, "alice", "192.0.2.2")
+	assert.True(t, blocked, "the user is blocked from any address")
+	assert.Equal(t, config.LockoutDuration, wait)
+
+	guard.RecordFailure(now, "bob", "192.0.2.1")
+	_, blocked = guard.Blocked(now, "carol", "192.0.2.1")
+	assert.True(t, blocked, "the address is blocked for any user")
+
+	_, blocked = guard.Blocked(now.Add(config.LockoutDuration), "alice", "192.0.2.2")
+	assert.False(t, blocked)
+}
+
+func TestChallengeGuard_Pending(t *testing.T) {
+	config := DefaultChallengeConfig()
+	config.MaxPendingPerUser = 2
+	guard := NewChallengeGuard(config)
+
+	assert.True(t, guard.Acquire("alice"))
+	assert.True(t, guard.Acquire("alice"))
+	assert.False(t, guard.Acquire("alice"))
+	assert.True(t, guard.Acquire("bob"))
+	guard.Release("alice")
+	assert.True(t, guard.Acquire("alice"))
+}
+
+func TestLoadChallengeConfig(t *testing.T) {
+	t.Setenv("CHALLENGE_WORDS", "5")
+	t.Setenv("CHALLENGE_TIMEOUT", "2m")
+	config, err := LoadChallengeConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 5, config.Words)
+	assert.Equal(t, 2*time.Minute, config.AcceptTimeout)
+
+	t.Setenv("CHALLENGE_WORDS", "2")
+	_, err = LoadChallengeConfig()
+	assert.Error(t, err, "phrases may not be weaker than three words")
+}
@@ -1,81 +1,113 @@
 package live
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/gobwas/ws"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"github.com/samber/do"
+	"github.com/samber/lo"
 	"github.com/sethvargo/go-diceware/diceware"
 	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
 	"github.com/therealpaulgg/ssh-sync-common/pkg/wsutils"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
 )
 
-// Computer A creates a live connection.
-// Computer A sends challenge response to the server.
-// This challenge is sent to the challenge response channel.
-// Main worker thread looks at the challenge response channel.
-// Gets the challenge, looks in dict to find a matching connection
-// If a matching connection is found, notify that connection that a challenge has been accepted.
-// So each connection will need its own channel.
+// Computer B, the new machine, opens a challenge and shows its phrase.
+// Computer A, an existing machine, answers with the phrase on its own connection.
+// The challenge store pairs the two connections, which may be served by
+// different server instances, and carries B's public key to A and the master
+// key encrypted by A back to B.
+//
+// Before encrypting the master key, A is shown what the server knows about B so
+// that the user can deny a machine they do not recognize.
+//
+// A user's policy may require several existing machines to approve B. Each of
+// them joins with the same phrase and sends the master key encrypted for B,
+// and the server hands B a key and creates it only once the quorum is met.
+//
+// Each side runs as a sequence of steps with its own deadline. When either
+// websocket closes, that side's flow is cancelled and its session closed, so
+// the other side fails its current step with a message instead of waiting.
+// When the server shuts down, both sides are told so.
 
-type ChallengeResponse struct {
-	Challenge       string
-	ResponseChannel chan bool
-}
-
-type ChallengeSession struct {
-	Username          string
-	ChallengeAccepted chan bool
-	ChallengerChannel chan *dto.PublicKeyDto
-	ResponderChannel  chan []byte
-}
+var (
+	// challengeReadTimeout bounds reading the request that starts a flow. How
+	// long the new machine waits for the phrase to be entered on an existing
+	// machine is ChallengeConfig.AcceptTimeout.
+	challengeReadTimeout = 30 * time.Second
+	// challengeExchangeTimeout bounds each key exchange step once accepted.
+	challengeExchangeTimeout = time.Minute
+)
 
-type SafeChallengeResponseDict struct {
-	mux  sync.Mutex
-	dict map[string]ChallengeSession
-}
+const (
+	stateReadChallengeResponse challengeState = "reading the challenge response"
+	stateJoinChallenge         challengeState = "joining the challenge"
+	stateAwaitPublicKey        challengeState = "waiting for the new machine's public key"
+	stateHandOverMasterKey     challengeState = "handing over the encrypted master key"
 
-// Utility method for safely writing to the dict
-func (c *SafeChallengeResponseDict) WriteChallenge(challengePhrase string, data ChallengeSession) {
-	c.mux.Lock()
-	c.dict[challengePhrase] = data
-	c.mux.Unlock()
-}
+	stateReadMachineRequest challengeState = "reading the new machine's request"
+	stateOpenChallenge      challengeState = "opening the challenge"
+	stateAwaitAcceptance    challengeState = "waiting for the phrase to be entered on an existing machine"
+	stateReadPublicKey      challengeState = "reading the new machine's public key"
+	stateAwaitMasterKey     challengeState = "waiting for the encrypted master key"
+)
 
-// Utility method for safely reading from the dict
-func (c *SafeChallengeResponseDict) ReadChallenge(challengePhrase string) (ChallengeSession, bool) {
-	c.mux.Lock()
-	data, exists := c.dict[challengePhrase]
-	c.mux.Unlock()
-	return data, exists
+// ChallengeDetailsDto extends dto.ChallengeSuccessEncryptedKeyDto with what the
+// server knows about the machine asking to be added.
+type ChallengeDetailsDto struct {
+	dto.ChallengeSuccessEncryptedKeyDto
+	MachineName    string    `json:"machine_name"`
+	SourceIP       string    `json:"source_ip"`
+	UserAgent      string    `json:"user_agent"`
+	RequestedAt    time.Time `json:"requested_at"`
+	Algorithm      string    `json:"algorithm"`
+	KeyFingerprint string    `json:"key_fingerprint"`
 }
 
-var ChallengeResponseChannel = make(chan ChallengeResponse)
-var ChallengeResponseDict = SafeChallengeResponseDict{
-	dict: make(map[string]ChallengeSession),
+// ChallengeDecisionDto extends dto.EncryptedMasterKeyDto so that the existing
+// machine can deny the new machine instead of sending the master key.
+type ChallengeDecisionDto struct {
+	dto.EncryptedMasterKeyDto
+	Deny   bool   `json:"deny,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
 func MachineChallengeResponse(i *do.Injector, r *http.Request, w http.ResponseWriter) error {
-	conn, _, _, err := ws.UpgradeHTTP(r, w)
-	if err != nil {
+	conn, err := upgradeWebsocket(i, r, w)
+	if err != nil || conn == nil {
 		return err
 	}
 	go MachineChallengeResponseHandler(i, r, w, &conn)
 	return nil
 }
 
+// challengeResponse is Computer A's side of a challenge.
+type challengeResponse struct {
+	injector  *do.Injector
+	flow      *challengeFlow
+	user      *models.User
+	machine   *models.Machine
+	sourceIP  string
+	userAgent string
+
+	phrase   string
+	session  ResponderSession
+	decision <-chan ChallengeDecisionDto
+}
+
 func MachineChallengeResponseHandler(i *do.Injector, r *http.Request, w http.ResponseWriter, c *net.Conn) {
 	conn := *c
 	defer conn.Close()
@@ -85,211 +117,329 @@ func MachineChallengeResponseHandler(i *do.Injector, r *http.Request, w http.Res
 		log.Warn().Msg("Could not get user from context")
 		return
 	}
-	foo, err := wsutils.ReadClientMessage[dto.ChallengeResponseDto](&conn)
-	if err != nil {
-		log.Err(err).Msg("Error reading client message")
+	machine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+	if !ok {
+		log.Warn().Msg("Could not get machine from context")
 		return
 	}
-	chalChan, ok := ChallengeResponseDict.ReadChallenge(foo.Data.Challenge)
-	if !ok {
-		log.Warn().Msg("Could not find challenge in dict")
-		if err := wsutils.WriteServerError[dto.ChallengeSuccessEncryptedKeyDto](&conn, "Invalid challenge response."); err != nil {
-			log.Err(err).Msg("Error writing server error")
+	cr := &challengeResponse{
+		injector:  i,
+		flow:      newChallengeFlow(do.MustInvoke[*Connections](i), conn, wsutils.WriteServerError[dto.ChallengeSuccessEncryptedKeyDto]),
+		user:      user,
+		machine:   machine,
+		sourceIP:  middleware.ClientIP(r),
+		userAgent: r.UserAgent(),
+	}
+	defer func() {
+		if cr.session != nil {
+			cr.session.Close()
 		}
-		return
+	}()
+	cr.flow.run(
+		challengeStep{state: stateReadChallengeResponse, timeout: challengeReadTimeout, run: cr.readChallengeResponse},
+		challengeStep{state: stateJoinChallenge, timeout: challengeExchangeTimeout, run: cr.joinChallenge},
+		challengeStep{state: stateAwaitPublicKey, timeout: challengeExchangeTimeout, run: cr.forwardPublicKey},
+		challengeStep{state: stateHandOverMasterKey, timeout: challengeExchangeTimeout, run: cr.handOverMasterKey},
+	)
+}
+
+func (cr *challengeResponse) readChallengeResponse(ctx context.Context) error {
+	response, err := receive(ctx, readAsync[dto.ChallengeResponseDto](cr.flow))
+	if err != nil {
+		return err
 	}
-	if user.Username != chalChan.Username {
-		log.Warn().Msg("Usernames do not match. Uh oh...")
-		return
+	cr.phrase = response.Challenge
+	return nil
+}
+
+// joinChallenge looks up the challenge by its phrase. Failed lookups count
+// against the user and the source IP, which are refused further lookups once
+// they have failed too often.
+func (cr *challengeResponse) joinChallenge(ctx context.Context) error {
+	guard := do.MustInvoke[*ChallengeGuard](cr.injector)
+	if wait, blocked := guard.Blocked(time.Now(), cr.user.Username, cr.sourceIP); blocked {
+		cr.audit(models.AuditChallengeLookupBlocked)
+		return clientError(fmt.Sprintf("Too many failed challenge attempts, try again in %s.", wait.Round(time.Second)), nil)
+	}
+	store := do.MustInvoke[ChallengeStore](cr.injector)
+	session, err := store.Join(ctx, cr.phrase, cr.user.Username, cr.machine.ID)
+	if errors.Is(err, ErrChallengeNotFound) {
+		log.Warn().Str("username", cr.user.Username).Str("ip", cr.sourceIP).Msg("Could not find challenge")
+		guard.RecordFailure(time.Now(), cr.user.Username, cr.sourceIP)
+		cr.audit(models.AuditChallengeLookupFailed)
+		return clientError("Invalid challenge response.", err)
+	}
+	if err != nil {
+		return clientError("Error responding to challenge.", err)
 	}
-	chalChan.ChallengeAccepted <- true
+	cr.session = session
+	// Computer A sends nothing until it has the public key, so reading its
+	// next message early tells us if it disconnects in the meantime.
+	cr.decision = readAsync[ChallengeDecisionDto](cr.flow)
+	return nil
+}
 
-	// need a channel that both threads can access so that machine B can send public key to machine A
-	// and machine A can send back encrypted master key
-	key := <-chalChan.ChallengerChannel
-	if key == nil {
-		log.Debug().Msg("Response from challenger channel - key is nil. Exiting.")
-		if err := wsutils.WriteServerError[dto.ChallengeSuccessEncryptedKeyDto](&conn, "Error responding to challenge - client abruptly closed connection."); err != nil {
-			log.Err(err).Msg("Error writing server error")
-		}
-		return
+func (cr *challengeResponse) audit(event string) {
+	entry := &models.AuditEvent{
+		Event:     event,
+		UserID:    &cr.user.ID,
+		MachineID: &cr.machine.ID,
+		SourceIP:  cr.sourceIP,
+		UserAgent: cr.userAgent,
 	}
-	keys := dto.ChallengeSuccessEncryptedKeyDto{
-		PublicKey:        key.PublicKey,
-		EncapsulationKey: key.EncapsulationKey,
+	if err := do.MustInvoke[repository.AuditEventRepository](cr.injector).RecordAuditEvent(entry); err != nil {
+		log.Err(err).Str("event", event).Msg("Error recording audit event")
 	}
-	if err := wsutils.WriteServerMessage(&conn, keys); err != nil {
-		log.Err(err).Msg("Error writing server message")
-		return
+}
+
+func (cr *challengeResponse) forwardPublicKey(ctx context.Context) error {
+	key, err := cr.session.WaitPublicKey(ctx)
+	if errors.Is(err, ErrChallengeClosed) {
+		return clientError("Error responding to challenge - client abruptly closed connection.", err)
 	}
-	encMasterKeyDto, err := wsutils.ReadClientMessage[dto.EncryptedMasterKeyDto](&conn)
 	if err != nil {
-		log.Err(err).Msg("Error reading client message")
-		return
+		return err
 	}
-	chalChan.ResponderChannel <- encMasterKeyDto.Data.EncryptedMasterKey
+	request := cr.session.Request()
+	return writeMessage(cr.flow.conn, ChallengeDetailsDto{
+		ChallengeSuccessEncryptedKeyDto: dto.ChallengeSuccessEncryptedKeyDto{
+			PublicKey:        key.PublicKey,
+			EncapsulationKey: key.EncapsulationKey,
+		},
+		MachineName:    request.MachineName,
+		SourceIP:       request.SourceIP,
+		UserAgent:      request.UserAgent,
+		RequestedAt:    request.RequestedAt,
+		Algorithm:      crypto.DetectKeyType(key.PublicKey).String(),
+		KeyFingerprint: crypto.PublicKeyFingerprint(key.PublicKey),
+	})
 }
 
-func NewMachineChallenge(i *do.Injector, r *http.Request, w http.ResponseWriter) error {
-	conn, _, _, err := ws.UpgradeHTTP(r, w)
+// handOverMasterKey passes on Computer A's answer: the master key encrypted for
+// Computer B, or a denial.
+func (cr *challengeResponse) handOverMasterKey(ctx context.Context) error {
+	decision, err := receive(ctx, cr.decision)
 	if err != nil {
 		return err
 	}
+	if decision.Deny {
+		log.Info().Str("username", cr.user.Username).Str("machine_name", cr.session.Request().MachineName).Msg("New machine denied")
+		err = cr.session.Deny(ctx, decision.Reason)
+	} else {
+		err = cr.session.SendEncryptedMasterKey(ctx, decision.EncryptedMasterKey)
+	}
+	if errors.Is(err, ErrChallengeClosed) {
+		return clientError("Error responding to challenge - client abruptly closed connection.", err)
+	}
+	return err
+}
+
+func NewMachineChallenge(i *do.Injector, r *http.Request, w http.ResponseWriter) error {
+	conn, err := upgradeWebsocket(i, r, w)
+	if err != nil || conn == nil {
+		return err
+	}
 	go NewMachineChallengeHandler(i, r, w, &conn)
 	return nil
 }
 
+// newMachineChallenge is Computer B's side of a challenge.
+type newMachineChallenge struct {
+	injector *do.Injector
+	flow     *challengeFlow
+	guard    *ChallengeGuard
+	request  ChallengeRequest
+
+	user      *models.User
+	machine   *models.Machine
+	session   ChallengerSession
+	publicKey <-chan dto.PublicKeyDto
+}
+
 func NewMachineChallengeHandler(i *do.Injector, r *http.Request, w http.ResponseWriter, c *net.Conn) {
 	conn := *c
 	defer conn.Close()
+	nc := &newMachineChallenge{
+		injector: i,
+		flow:     newChallengeFlow(do.MustInvoke[*Connections](i), conn, wsutils.WriteServerError[dto.MessageDto]),
+		guard:    do.MustInvoke[*ChallengeGuard](i),
+		request: ChallengeRequest{
+			SourceIP:    middleware.ClientIP(r),
+			UserAgent:   r.UserAgent(),
+			RequestedAt: time.Now(),
+		},
+	}
+	defer func() {
+		if nc.session != nil {
+			nc.session.Close()
+			nc.guard.Release(nc.request.Username)
+		}
+	}()
+	nc.flow.run(
+		challengeStep{state: stateReadMachineRequest, timeout: challengeReadTimeout, run: nc.readMachineRequest},
+		challengeStep{state: stateOpenChallenge, timeout: challengeExchangeTimeout, run: nc.openChallenge},
+		challengeStep{state: stateAwaitAcceptance, timeout: nc.guard.Config.AcceptTimeout, run: nc.awaitAcceptance},
+		challengeStep{state: stateReadPublicKey, timeout: challengeExchangeTimeout, run: nc.readPublicKey},
+		challengeStep{state: stateAwaitMasterKey, timeoutFunc: nc.masterKeyTimeout, run: nc.awaitMasterKey},
+	)
+}
+
+// readMachineRequest reads the user and machine name, checking that the
+// machine does not exist yet and that the user has enough machines to approve
+// it.
+func (nc *newMachineChallenge) readMachineRequest(ctx context.Context) error {
 	// first message sent should be JSON payload
-	userMachine, err := wsutils.ReadClientMessage[dto.UserMachineDto](&conn)
+	userMachine, err := receive(ctx, readAsync[dto.UserMachineDto](nc.flow))
 	if err != nil {
-		log.Err(err).Msg("Error reading client message")
-		return
+		return err
 	}
-	userRepo := do.MustInvoke[repository.UserRepository](i)
-	user, err := userRepo.GetUserByUsername(userMachine.Data.Username)
-	if errors.Is(err, sql.ErrNoRows) || user == nil {
-		if err := wsutils.WriteServerError[dto.MessageDto](&conn, "User not found"); err != nil {
-			log.Err(err).Msg("Error writing server error")
-		}
-		return
+	userRepo := do.MustInvoke[repository.UserRepository](nc.injector)
+	user, err := userRepo.GetUserByUsername(userMachine.Username)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && user == nil) {
+		return clientError("User not found", err)
 	}
 	if err != nil {
 		log.Err(err).Msg("Error getting user by username")
-		return
+		return err
 	}
-	machineRepo := do.MustInvoke[repository.MachineRepository](i)
-	machine, err := machineRepo.GetMachineByNameAndUser(userMachine.Data.MachineName, user.ID)
+	machineRepo := do.MustInvoke[repository.MachineRepository](nc.injector)
+	machine, err := machineRepo.GetMachineByNameAndUser(userMachine.MachineName, user.ID)
 	// if the machine already exists, reject
 	if err == nil && machine.ID != uuid.Nil {
-		if err = wsutils.WriteServerError[dto.MessageDto](&conn, "Machine already exists"); err != nil {
-			log.Err(err).Msg("Error writing server error")
-		}
-		return
+		return clientError("Machine already exists", nil)
 	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		log.Err(err).Msg("Error getting machine by name and user")
-		return
+		return err
+	}
+	if quorum := user.ApprovalQuorum(); quorum > 1 {
+		machines, err := machineRepo.GetUserMachines(user.ID)
+		if err != nil {
+			log.Err(err).Msg("Error getting user machines")
+			return err
+		}
+		if approvers := lo.CountBy(machines, func(m models.Machine) bool { return m.CanApprove() }); approvers < quorum {
+			return clientError(fmt.Sprintf("This account requires %d machines to approve new machines, but only %d can", quorum, approvers), nil)
+		}
 	}
-	machine = &models.Machine{}
-	machine.Name = userMachine.Data.MachineName
-	machine.UserID = user.ID
-	// We are in an acceptable state, generate a challenge
-	// The server will generate a phrase, sending it back to Computer B. The user will need to type this phrase into Computer A.
-	words, err := diceware.GenerateWithWordList(3, diceware.WordListEffLarge())
+	nc.user = user
+	nc.machine = &models.Machine{Name: userMachine.MachineName, UserID: user.ID}
+	nc.request.Username = user.Username
+	nc.request.MachineName = userMachine.MachineName
+	nc.request.Quorum = user.ApprovalQuorum()
+	return nil
+}
+
+// openChallenge generates a phrase, which the user will need to type into
+// Computer A, and registers it before showing it to Computer B.
+func (nc *newMachineChallenge) openChallenge(ctx context.Context) error {
+	words, err := diceware.GenerateWithWordList(nc.guard.Config.Words, diceware.WordListEffLarge())
 	if err != nil {
 		log.Err(err).Msg("Error generating diceware")
-		if err := wsutils.WriteServerError[dto.MessageDto](&conn, "Error generating diceware"); err != nil {
-			log.Err(err).Msg("Error writing server error")
-		}
-		return
+		return clientError("Error generating diceware", err)
 	}
 	challengePhrase := strings.Join(words, "-")
-	if err := wsutils.WriteServerMessage(&conn, dto.MessageDto{Message: challengePhrase}); err != nil {
-		log.Err(err).Msg("Error writing challenge phrase")
-		return
+	if !nc.guard.Acquire(nc.request.Username) {
+		return clientError("Too many pending challenges for this user, finish or cancel one first.", nil)
 	}
-	// The server will save this current WS connection into a map corresponding to this challenge phrase
-	// Computer A starts its own connection (auth & jwt required to start this one)
-	// It will send the challenge phrase to the server. Assuming it is valid, the server will send a message to Computer B to continue.
-	// Computer B will then generate a pub/priv keypair, sending the public key to the server.
-	// Computer A will receive the public key, decrypt the master key, encrypt the master key with the public key, and send it back to the server.
-	// At this point Computer B will be able to communicate freely.
-
-	ChallengeResponseDict.WriteChallenge(challengePhrase, ChallengeSession{
-		Username:          user.Username,
-		ChallengeAccepted: make(chan bool),
-		ChallengerChannel: make(chan *dto.PublicKeyDto),
-		ResponderChannel:  make(chan []byte),
-	})
-	defer func() {
-		ChallengeResponseDict.mux.Lock()
-		defer ChallengeResponseDict.mux.Unlock()
-		item, exists := ChallengeResponseDict.dict[challengePhrase]
-		if exists {
-			close(item.ChallengeAccepted)
-			close(item.ChallengerChannel)
-			close(item.ResponderChannel)
-			delete(ChallengeResponseDict.dict, challengePhrase)
-		}
-	}()
-	timer := time.NewTimer(30 * time.Second)
-	challengeResponse := make(chan bool)
-	go func() {
-		var challengeAcceptedChan chan bool
+	store := do.MustInvoke[ChallengeStore](nc.injector)
+	session, err := store.Open(ctx, challengePhrase, nc.request)
+	if err != nil {
+		nc.guard.Release(nc.request.Username)
+		log.Err(err).Msg("Error opening challenge")
+		return clientError("Error creating challenge", err)
+	}
+	nc.session = session
+	if err := writeMessage(nc.flow.conn, dto.MessageDto{Message: challengePhrase}); err != nil {
+		return err
+	}
+	// Computer B sends its public key only once accepted, so reading it early
+	// tells us if it disconnects while the user is typing the phrase.
+	nc.publicKey = readAsync[dto.PublicKeyDto](nc.flow)
+	return nil
+}
 
-		// Lock before accessing ChallengeResponseDict
-		ChallengeResponseDict.mux.Lock()
-		if item, exists := ChallengeResponseDict.dict[challengePhrase]; exists {
-			challengeAcceptedChan = item.ChallengeAccepted
-		}
-		ChallengeResponseDict.mux.Unlock()
+func (nc *newMachineChallenge) awaitAcceptance(ctx context.Context) error {
+	if err := nc.session.WaitAccepted(ctx); err != nil {
+		return err
+	}
+	return writeMessage(nc.flow.conn, dto.MessageDto{Message: "Challenge accepted!"})
+}
 
-		// If the channel does not exist, return to avoid a nil channel operation
-		if challengeAcceptedChan == nil {
-			return
+// readPublicKey checks Computer B's new keys against the user's policy and
+// hands them to Computer A.
+func (nc *newMachineChallenge) readPublicKey(ctx context.Context) error {
+	pubkey, err := receive(ctx, nc.publicKey)
+	if err != nil {
+		return err
+	}
+	keyType, err := crypto.ValidatePublicKey(pubkey.PublicKey)
+	if err != nil {
+		log.Err(err).Msg("Invalid public key format in challenge flow")
+		return clientError("Invalid public key format", err)
+	}
+	policy, err := crypto.PolicyForUser(nc.user)
+	if err != nil {
+		log.Err(err).Msg("Error loading algorithm policy")
+		return err
+	}
+	if err := policy.CheckKeyType(keyType, time.Now()); err != nil {
+		return clientError(err.Error(), err)
+	}
+	if len(pubkey.EncapsulationKey) > 0 {
+		if _, err := crypto.ValidateEncapsulationKey(pubkey.EncapsulationKey); err != nil {
+			log.Err(err).Msg("Invalid encapsulation key in challenge flow")
+			return clientError(err.Error(), err)
 		}
+	}
+	nc.machine.PublicKey = pubkey.PublicKey
+	nc.machine.EncapsulationKey = pubkey.EncapsulationKey
+	if err := nc.session.SendPublicKey(ctx, &pubkey); err != nil {
+		return err
+	}
+	// Computer B has nothing more to send; keep reading only to notice it
+	// leaving while Computer A encrypts the master key.
+	readAsync[json.RawMessage](nc.flow)
+	return nil
+}
 
-		for {
-			select {
-			case <-timer.C:
-				challengeResponse <- false
-				return
-			case chalWon := <-challengeAcceptedChan:
-				log.Debug().Msg("Gorountine received challenge response")
-				if chalWon {
-					timer.Stop()
-				}
-				challengeResponse <- chalWon
-				return
-			}
-		}
-	}()
-	cha, ok := ChallengeResponseDict.ReadChallenge(challengePhrase)
-	if !ok {
-		log.Err(err).Msg("Error getting challenge from dict")
-		return
+// masterKeyTimeout gives the machines approving Computer B more time when the
+// user's policy requires several of them.
+func (nc *newMachineChallenge) masterKeyTimeout() time.Duration {
+	if nc.request.quorum() > 1 {
+		return nc.guard.Config.QuorumTimeout
 	}
-	challengeResult := <-challengeResponse
+	return challengeExchangeTimeout
+}
 
-	if !challengeResult {
-		if err := wsutils.WriteServerError[dto.MessageDto](&conn, "Challenge timed out"); err != nil {
-			log.Err(err).Msg("Error writing server error")
+// awaitMasterKey creates the machine once the quorum of existing machines has
+// sent the master key encrypted for it, and passes the key on.
+func (nc *newMachineChallenge) awaitMasterKey(ctx context.Context) error {
+	encryptedMasterKey, err := nc.session.WaitEncryptedMasterKey(ctx)
+	var denied *ChallengeDeniedError
+	if errors.As(err, &denied) {
+		message := "An existing machine denied adding this machine"
+		if denied.Reason != "" {
+			message += ": " + denied.Reason
 		}
-		return
+		return clientError(message, err)
 	}
-	if err := wsutils.WriteServerMessage(&conn, dto.MessageDto{Message: "Challenge accepted!"}); err != nil {
-		log.Err(err).Msg("Error writing challenge accepted")
-		return
+	if errors.Is(err, ErrChallengeClosed) {
+		return clientError("An existing machine disconnected before sending the master key", err)
 	}
-	pubkey, err := wsutils.ReadClientMessage[dto.PublicKeyDto](&conn)
 	if err != nil {
-		log.Err(err).Msg("Error reading client message")
-		return
-	}
-
-	if _, err := crypto.ValidatePublicKey(pubkey.Data.PublicKey); err != nil {
-		log.Err(err).Msg("Invalid public key format in challenge flow")
-		if err := wsutils.WriteServerError[dto.MessageDto](&conn, "Invalid public key format"); err != nil {
-			log.Err(err).Msg("Error writing server error")
-		}
-		return
+		return err
 	}
-	cha.ChallengerChannel <- &pubkey.Data
-	encryptedMasterKey := <-cha.ResponderChannel
-	machine.PublicKey = pubkey.Data.PublicKey
-	machine.EncapsulationKey = pubkey.Data.EncapsulationKey
-	if _, err = machineRepo.CreateMachine(machine); err != nil {
+	machineRepo := do.MustInvoke[repository.MachineRepository](nc.injector)
+	machine, err := machineRepo.CreateMachine(nc.machine)
+	if err != nil {
 		log.Err(err).Msg("Error creating machine")
-		return
+		return err
 	}
-	if err := wsutils.WriteServerMessage(&conn, dto.EncryptedMasterKeyDto{EncryptedMasterKey: encryptedMasterKey}); err != nil {
-		log.Err(err).Msg("Error writing encrypted master key")
-		return
+	if err := do.MustInvoke[EventBroker](nc.injector).Publish(NewMachineEvent(EventMachineAdded, machine, nil)); err != nil {
+		log.Err(err).Msg("Error publishing event")
 	}
-	if err := wsutils.WriteServerMessage(&conn, dto.MessageDto{Message: "Everything is done, you can now use ssh-sync"}); err != nil {
-		log.Err(err).Msg("Error writing final message")
-		return
+	if err := writeMessage(nc.flow.conn, dto.EncryptedMasterKeyDto{EncryptedMasterKey: encryptedMasterKey}); err != nil {
+		return err
 	}
+	return writeMessage(nc.flow.conn, dto.MessageDto{Message: "Everything is done, you can now use ssh-sync"})
 }
@@ -1,11 +1,13 @@
 package live
 
 import (
+	"context"
 	"database/sql"
 	"net"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"go.uber.org/mock/gomock"
 	"github.com/google/uuid"
@@ -13,17 +15,39 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
 	"github.com/therealpaulgg/ssh-sync-common/pkg/wsutils"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
 )
 
+// expectAudit provides an audit repository expecting the given events in order.
+func expectAudit(t *testing.T, injector *do.Injector, events ...string) {
+	t.Helper()
+	mockAuditRepo := repository.NewMockAuditEventRepository(gomock.NewController(t))
+	var calls []any
+	for _, event := range events {
+		calls = append(calls, mockAuditRepo.EXPECT().RecordAuditEvent(gomock.Any()).DoAndReturn(func(entry *models.AuditEvent) error {
+			require.Equal(t, event, entry.Event)
+			return nil
+		}))
+	}
+	gomock.InOrder(calls...)
+	do.Provide(injector, func(i *do.Injector) (repository.AuditEventRepository, error) {
+		return mockAuditRepo, nil
+	})
+}
+
 func TestMachineChallengeResponseHandler_InvalidChallenge(t *testing.T) {
-	ChallengeResponseDict = SafeChallengeResponseDict{dict: make(map[string]ChallengeSession)}
 	injector := do.New()
+	do.ProvideValue[ChallengeStore](injector, NewMemoryChallengeStore())
+	do.ProvideValue(injector, NewChallengeGuard(DefaultChallengeConfig()))
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
+	expectAudit(t, injector, models.AuditChallengeLookupFailed)
 	user := testutils.GenerateUser()
 	req := httptest.NewRequest("GET", "/", nil)
 	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, testutils.GenerateMachine())
 
 	serverConn, clientConn := net.Pipe()
 	defer serverConn.Close()
@@ -43,8 +67,10 @@ func TestMachineChallengeResponseHandler_InvalidChallenge(t *testing.T) {
 }
 
 func TestNewMachineChallengeHandler_UserNotFound(t *testing.T) {
-	ChallengeResponseDict = SafeChallengeResponseDict{dict: make(map[string]ChallengeSession)}
 	injector := do.New()
+	do.ProvideValue[ChallengeStore](injector, NewMemoryChallengeStore())
+	do.ProvideValue(injector, NewChallengeGuard(DefaultChallengeConfig()))
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
@@ -75,8 +101,10 @@ func TestNewMachineChallengeHandler_UserNotFound(t *testing.T) {
 }
 
 func TestNewMachineChallengeHandler_MachineExists(t *testing.T) {
-	ChallengeResponseDict = SafeChallengeResponseDict{dict: make(map[string]ChallengeSession)}
 	injector := do.New()
+	do.ProvideValue[ChallengeStore](injector, NewMemoryChallengeStore())
+	do.ProvideValue(injector, NewChallengeGuard(DefaultChallengeConfig()))
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -113,20 +141,17 @@ func TestNewMachineChallengeHandler_MachineExists(t *testing.T) {
 }
 
 func TestMachineChallenge_GoldenPath(t *testing.T) {
-	ChallengeResponseDict = SafeChallengeResponseDict{dict: make(map[string]ChallengeSession)}
 	injector := do.New()
+	store := NewMemoryChallengeStore()
+	do.ProvideValue[ChallengeStore](injector, store)
+	do.ProvideValue(injector, NewChallengeGuard(DefaultChallengeConfig()))
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
 	user := testutils.GenerateUser()
 	challengePhrase := "alpha-bravo-charlie"
 
-	acceptChan := make(chan bool, 1)
-	challengerChan := make(chan *dto.PublicKeyDto, 1)
-	responderChan := make(chan []byte, 1)
-	ChallengeResponseDict.WriteChallenge(challengePhrase, ChallengeSession{
-		Username:          user.Username,
-		ChallengeAccepted: acceptChan,
-		ChallengerChannel: challengerChan,
-		ResponderChannel:  responderChan,
-	})
+	challenger, err := store.Open(context.Background(), challengePhrase, ChallengeRequest{Username: user.Username})
+	require.NoError(t, err)
+	defer challenger.Close()
 
 	serverConn, clientConn := net.Pipe()
 	defer serverConn.Close()
@@ -134,6 +159,7 @@ func TestMachineChallenge_GoldenPath(t *testing.T) {
 
 	req := httptest.NewRequest("GET", "/", nil)
 	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, testutils.GenerateMachine())
 
 	done := make(chan struct{})
 	go func() {
@@ -145,10 +171,13 @@ func TestMachineChallenge_GoldenPath(t *testing.T) {
 	require.NoError(t, wsutils.WriteClientMessage(&clientConn, dto.ChallengeResponseDto{
 		Challenge: challengePhrase,
 	}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, challenger.WaitAccepted(ctx))
 
 	// Provide challenger key for server to forward
 	challengerKey := &dto.PublicKeyDto{PublicKey: []byte("pub"), EncapsulationKey: []byte("enc")}
-	challengerChan <- challengerKey
+	require.NoError(t, challenger.SendPublicKey(ctx, challengerKey))
 
 	// Read success response
 	successMsg, err := wsutils.ReadServerMessage[dto.ChallengeSuccessEncryptedKeyDto](&clientConn)
@@ -162,8 +191,422 @@ func TestMachineChallenge_GoldenPath(t *testing.T) {
 		EncryptedMasterKey: masterKey,
 	}))
 
-	// Ensure master key delivered to responder channel
-	delivered := <-responderChan
+	// Ensure master key delivered to the challenger
+	delivered, err := challenger.WaitEncryptedMasterKey(ctx)
+	require.NoError(t, err)
 	require.Equal(t, masterKey, delivered)
 	<-done
 }
+
+func TestMachineChallengeResponseHandler_OtherUsersChallenge(t *testing.T) {
+	injector := do.New()
+	store := NewMemoryChallengeStore()
+	do.ProvideValue[ChallengeStore](injector, store)
+	do.ProvideValue(injector, NewChallengeGuard(DefaultChallengeConfig()))
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
+	expectAudit(t, injector, models.AuditChallengeLookupFailed)
+	challenger, err := store.Open(context.Background(), "alpha-bravo-charlie", ChallengeRequest{Username: "someone-else"})
+	require.NoError(t, err)
+	defer challenger.Close()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req = testutils.AddUserContext(req, testutils.GenerateUser())
+	req = testutils.AddMachineContext(req, testutils.GenerateMachine())
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		MachineChallengeResponseHandler(injector, req, httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+
+	require.NoError(t, wsutils.WriteClientMessage(&clientConn, dto.ChallengeResponseDto{Challenge: "alpha-bravo-charlie"}))
+	_, err = wsutils.ReadServerMessage[dto.ChallengeSuccessEncryptedKeyDto](&clientConn)
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "Invalid challenge response."))
+	<-done
+}
+
+func TestMachineChallengeResponseHandler_ChallengerLeft(t *testing.T) {
+	injector := do.New()
+	store := NewMemoryChallengeStore()
+	do.ProvideValue[ChallengeStore](injector, store)
+	do.ProvideValue(injector, NewChallengeGuard(DefaultChallengeConfig()))
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
+	user := testutils.GenerateUser()
+	challenger, err := store.Open(context.Background(), "alpha-bravo-charlie", ChallengeRequest{Username: user.Username})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, testutils.GenerateMachine())
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		MachineChallengeResponseHandler(injector, req, httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+
+	require.NoError(t, wsutils.WriteClientMessage(&clientConn, dto.ChallengeResponseDto{Challenge: "alpha-bravo-charlie"}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, challenger.WaitAccepted(ctx))
+	require.NoError(t, challenger.Close())
+
+	_, err = wsutils.ReadServerMessage[dto.ChallengeSuccessEncryptedKeyDto](&clientConn)
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "client abruptly closed connection"))
+	<-done
+}
+
+// challengePair wires both sides of a challenge to one memory store, with the
+// repositories the new machine's side needs.
+type challengePair struct {
+	injector    *do.Injector
+	store       *MemoryChallengeStore
+	user        *models.User
+	machineRepo *repository.MockMachineRepository
+}
+
+func newChallengePair(t *testing.T) *challengePair {
+	return newChallengePairWithConfig(t, DefaultChallengeConfig())
+}
+
+func newChallengePairWithConfig(t *testing.T, config ChallengeConfig) *challengePair {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+	injector := do.New()
+	store := NewMemoryChallengeStore()
+	do.ProvideValue[ChallengeStore](injector, store)
+	do.ProvideValue(injector, NewChallengeGuard(config))
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
+	do.ProvideValue[EventBroker](injector, NewMemoryEventBroker())
+	user := testutils.GenerateUser()
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser("laptop", user.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	return &challengePair{injector: injector, store: store, user: user, machineRepo: mockMachineRepo}
+}
+
+// startNewMachine runs the new machine's handler and returns the client end
+// of its websocket once the challenge phrase has been shown.
+func (p *challengePair) startNewMachine(t *testing.T) (net.Conn, string, chan struct{}) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	done := make(chan struct{})
+	go func() {
+		NewMachineChallengeHandler(p.injector, httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+	require.NoError(t, wsutils.WriteClientMessage(&clientConn, dto.UserMachineDto{Username: p.user.Username, MachineName: "laptop"}))
+	phrase, err := wsutils.ReadServerMessage[dto.MessageDto](&clientConn)
+	require.NoError(t, err)
+	return clientConn, phrase.Data.Message, done
+}
+
+// startExistingMachine runs the existing machine's handler and answers the
+// challenge.
+func (p *challengePair) startExistingMachine(t *testing.T, phrase string) (net.Conn, chan struct{}) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	req := testutils.AddUserContext(httptest.NewRequest("GET", "/", nil), p.user)
+	req = testutils.AddMachineContext(req, testutils.GenerateMachine())
+	done := make(chan struct{})
+	go func() {
+		MachineChallengeResponseHandler(p.injector, req, httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+	require.NoError(t, wsutils.WriteClientMessage(&clientConn, dto.ChallengeResponseDto{Challenge: phrase}))
+	return clientConn, done
+}
+
+func newMachinePublicKey(t *testing.T) dto.PublicKeyDto {
+	t.Helper()
+	priv, pub, err := testutils.GenerateTestKeys()
+	require.NoError(t, err)
+	pubPEM, _, err := testutils.EncodeToPem(priv, pub)
+	require.NoError(t, err)
+	return dto.PublicKeyDto{PublicKey: pubPEM}
+}
+
+func waitDone(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return")
+	}
+}
+
+func TestChallenge_EndToEnd(t *testing.T) {
+	p := newChallengePair(t)
+	publicKey := newMachinePublicKey(t)
+	p.machineRepo.EXPECT().CreateMachine(gomock.Any()).DoAndReturn(func(machine *models.Machine) (*models.Machine, error) {
+		require.Equal(t, "laptop", machine.Name)
+		require.Equal(t, publicKey.PublicKey, machine.PublicKey)
+		return machine, nil
+	})
+
+	newConn, phrase, newDone := p.startNewMachine(t)
+	existingConn, existingDone := p.startExistingMachine(t, phrase)
+
+	accepted, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+	require.Equal(t, "Challenge accepted!", accepted.Data.Message)
+	require.NoError(t, wsutils.WriteClientMessage(&newConn, publicKey))
+
+	details, err := wsutils.ReadServerMessage[ChallengeDetailsDto](&existingConn)
+	require.NoError(t, err)
+	require.Equal(t, publicKey.PublicKey, details.Data.PublicKey)
+	require.Equal(t, "laptop", details.Data.MachineName)
+	require.Equal(t, crypto.PublicKeyFingerprint(publicKey.PublicKey), details.Data.KeyFingerprint)
+	require.NotEmpty(t, details.Data.SourceIP)
+	require.NoError(t, wsutils.WriteClientMessage(&existingConn, dto.EncryptedMasterKeyDto{EncryptedMasterKey: []byte("master")}))
+	waitDone(t, existingDone)
+
+	masterKey, err := wsutils.ReadServerMessage[dto.EncryptedMasterKeyDto](&newConn)
+	require.NoError(t, err)
+	require.Equal(t, []byte("master"), masterKey.Data.EncryptedMasterKey)
+	_, err = wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+	waitDone(t, newDone)
+}
+
+func TestChallenge_Denied(t *testing.T) {
+	p := newChallengePair(t)
+	newConn, phrase, newDone := p.startNewMachine(t)
+	existingConn, existingDone := p.startExistingMachine(t, phrase)
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+	require.NoError(t, wsutils.WriteClientMessage(&newConn, newMachinePublicKey(t)))
+	_, err = wsutils.ReadServerMessage[ChallengeDetailsDto](&existingConn)
+	require.NoError(t, err)
+
+	require.NoError(t, wsutils.WriteClientMessage(&existingConn, ChallengeDecisionDto{Deny: true, Reason: "not my laptop"}))
+	waitDone(t, existingDone)
+
+	// gomock fails if the machine is created.
+	_, err = wsutils.ReadServerMessage[dto.EncryptedMasterKeyDto](&newConn)
+	require.ErrorContains(t, err, "denied adding this machine: not my laptop")
+	waitDone(t, newDone)
+}
+
+func TestMachineChallengeResponseHandler_TooManyFailures(t *testing.T) {
+	injector := do.New()
+	do.ProvideValue[ChallengeStore](injector, NewMemoryChallengeStore())
+	config := DefaultChallengeConfig()
+	config.MaxFailuresPerUser = 2
+	do.ProvideValue(injector, NewChallengeGuard(config))
+	do.ProvideValue(injector, NewConnections(DefaultWebsocketConfig()))
+	expectAudit(t, injector, models.AuditChallengeLookupFailed, models.AuditChallengeLookupFailed, models.AuditChallengeLookupBlocked)
+	user := testutils.GenerateUser()
+
+	for _, expected := range []string{"Invalid challenge response.", "Invalid challenge response.", "Too many failed challenge attempts"} {
+		req := testutils.AddUserContext(httptest.NewRequest("GET", "/", nil), user)
+		req = testutils.AddMachineContext(req, testutils.GenerateMachine())
+		serverConn, clientConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			MachineChallengeResponseHandler(injector, req, httptest.NewRecorder(), &serverConn)
+			close(done)
+		}()
+		require.NoError(t, wsutils.WriteClientMessage(&clientConn, dto.ChallengeResponseDto{Challenge: "wrong-guess-here"}))
+		_, err := wsutils.ReadServerMessage[ChallengeDetailsDto](&clientConn)
+		require.ErrorContains(t, err, expected)
+		<-done
+		clientConn.Close()
+	}
+}
+
+func TestNewMachineChallengeHandler_TooManyPending(t *testing.T) {
+	config := DefaultChallengeConfig()
+	config.MaxPendingPerUser = 1
+	p := newChallengePairWithConfig(t, config)
+	require.True(t, do.MustInvoke[*ChallengeGuard](p.injector).Acquire(p.user.Username))
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		NewMachineChallengeHandler(p.injector, httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+	require.NoError(t, wsutils.WriteClientMessage(&clientConn, dto.UserMachineDto{Username: p.user.Username, MachineName: "laptop"}))
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&clientConn)
+	require.ErrorContains(t, err, "Too many pending challenges")
+	waitDone(t, done)
+}
+
+func TestChallenge_NewMachineDisconnectsBeforeAcceptance(t *testing.T) {
+	p := newChallengePair(t)
+	newConn, phrase, newDone := p.startNewMachine(t)
+
+	require.NoError(t, newConn.Close())
+
+	waitDone(t, newDone)
+	_, err := p.store.Join(context.Background(), phrase, p.user.Username, uuid.New())
+	require.ErrorIs(t, err, ErrChallengeNotFound)
+}
+
+func TestChallenge_NewMachineDisconnectsAfterAcceptance(t *testing.T) {
+	p := newChallengePair(t)
+	newConn, phrase, newDone := p.startNewMachine(t)
+	existingConn, existingDone := p.startExistingMachine(t, phrase)
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+
+	require.NoError(t, newConn.Close())
+
+	waitDone(t, newDone)
+	_, err = wsutils.ReadServerMessage[dto.ChallengeSuccessEncryptedKeyDto](&existingConn)
+	require.ErrorContains(t, err, "client abruptly closed connection")
+	waitDone(t, existingDone)
+}
+
+func TestChallenge_ExistingMachineDisconnectsBeforePublicKey(t *testing.T) {
+	p := newChallengePair(t)
+	newConn, phrase, newDone := p.startNewMachine(t)
+	existingConn, existingDone := p.startExistingMachine(t, phrase)
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+
+	require.NoError(t, existingConn.Close())
+	waitDone(t, existingDone)
+
+	require.NoError(t, wsutils.WriteClientMessage(&newConn, newMachinePublicKey(t)))
+	_, err = wsutils.ReadServerMessage[dto.EncryptedMasterKeyDto](&newConn)
+	require.ErrorContains(t, err, "existing machine disconnected")
+	waitDone(t, newDone)
+}
+
+func TestChallenge_ExistingMachineDisconnectsBeforeMasterKey(t *testing.T) {
+	p := newChallengePair(t)
+	newConn, phrase, newDone := p.startNewMachine(t)
+	existingConn, existingDone := p.startExistingMachine(t, phrase)
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+	require.NoError(t, wsutils.WriteClientMessage(&newConn, newMachinePublicKey(t)))
+	_, err = wsutils.ReadServerMessage[dto.ChallengeSuccessEncryptedKeyDto](&existingConn)
+	require.NoError(t, err)
+
+	require.NoError(t, existingConn.Close())
+	waitDone(t, existingDone)
+
+	// gomock fails if the machine is created.
+	_, err = wsutils.ReadServerMessage[dto.EncryptedMasterKeyDto](&newConn)
+	require.ErrorContains(t, err, "existing machine disconnected")
+	waitDone(t, newDone)
+}
+
+func TestChallenge_NotAcceptedInTime(t *testing.T) {
+	config := DefaultChallengeConfig()
+	config.AcceptTimeout = 20 * time.Millisecond
+	p := newChallengePairWithConfig(t, config)
+	newConn, phrase, newDone := p.startNewMachine(t)
+
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.ErrorContains(t, err, "Challenge timed out")
+	waitDone(t, newDone)
+	_, err = p.store.Join(context.Background(), phrase, p.user.Username, uuid.New())
+	require.ErrorIs(t, err, ErrChallengeNotFound)
+}
+
+// approveChallenge has an existing machine approve the challenge once the new
+// machine's public key has reached it.
+func (p *challengePair) approveChallenge(t *testing.T, phrase string) {
+	t.Helper()
+	existingConn, existingDone := p.startExistingMachine(t, phrase)
+	_, err := wsutils.ReadServerMessage[ChallengeDetailsDto](&existingConn)
+	require.NoError(t, err)
+	require.NoError(t, wsutils.WriteClientMessage(&existingConn, dto.EncryptedMasterKeyDto{EncryptedMasterKey: []byte("master")}))
+	waitDone(t, existingDone)
+}
+
+func TestChallenge_Quorum(t *testing.T) {
+	p := newChallengePair(t)
+	p.user.MachineApprovalQuorum = 2
+	p.machineRepo.EXPECT().GetUserMachines(p.user.ID).Return([]models.Machine{*testutils.GenerateMachine(), *testutils.GenerateMachine()}, nil)
+	p.machineRepo.EXPECT().CreateMachine(gomock.Any()).DoAndReturn(func(machine *models.Machine) (*models.Machine, error) {
+		return machine, nil
+	})
+	newConn, phrase, newDone := p.startNewMachine(t)
+	existingConn, existingDone := p.startExistingMachine(t, phrase)
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+	require.NoError(t, wsutils.WriteClientMessage(&newConn, newMachinePublicKey(t)))
+	_, err = wsutils.ReadServerMessage[ChallengeDetailsDto](&existingConn)
+	require.NoError(t, err)
+	require.NoError(t, wsutils.WriteClientMessage(&existingConn, dto.EncryptedMasterKeyDto{EncryptedMasterKey: []byte("master")}))
+	waitDone(t, existingDone)
+
+	select {
+	case <-newDone:
+		t.Fatal("the new machine was released before the quorum was met")
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.approveChallenge(t, phrase)
+
+	masterKey, err := wsutils.ReadServerMessage[dto.EncryptedMasterKeyDto](&newConn)
+	require.NoError(t, err)
+	require.Equal(t, []byte("master"), masterKey.Data.EncryptedMasterKey)
+	_, err = wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+	waitDone(t, newDone)
+}
+
+func TestChallenge_QuorumNotMetInTime(t *testing.T) {
+	config := DefaultChallengeConfig()
+	config.QuorumTimeout = 50 * time.Millisecond
+	p := newChallengePairWithConfig(t, config)
+	p.user.MachineApprovalQuorum = 2
+	p.machineRepo.EXPECT().GetUserMachines(p.user.ID).Return([]models.Machine{*testutils.GenerateMachine(), *testutils.GenerateMachine()}, nil)
+	newConn, phrase, newDone := p.startNewMachine(t)
+	existingConn, existingDone := p.startExistingMachine(t, phrase)
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.NoError(t, err)
+	require.NoError(t, wsutils.WriteClientMessage(&newConn, newMachinePublicKey(t)))
+	_, err = wsutils.ReadServerMessage[ChallengeDetailsDto](&existingConn)
+	require.NoError(t, err)
+	require.NoError(t, wsutils.WriteClientMessage(&existingConn, dto.EncryptedMasterKeyDto{EncryptedMasterKey: []byte("master")}))
+	waitDone(t, existingDone)
+
+	// gomock fails if the machine is created.
+	_, err = wsutils.ReadServerMessage[dto.EncryptedMasterKeyDto](&newConn)
+	require.ErrorContains(t, err, "Challenge timed out waiting for the encrypted master key")
+	waitDone(t, newDone)
+}
+
+func TestNewMachineChallengeHandler_QuorumUnreachable(t *testing.T) {
+	p := newChallengePair(t)
+	p.user.MachineApprovalQuorum = 3
+	suspended := testutils.GenerateMachine()
+	suspendedAt := time.Now()
+	suspended.SuspendedAt = &suspendedAt
+	p.machineRepo.EXPECT().GetUserMachines(p.user.ID).Return([]models.Machine{*testutils.GenerateMachine(), *testutils.GenerateMachine(), *suspended}, nil)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		NewMachineChallengeHandler(p.injector, httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+	require.NoError(t, wsutils.WriteClientMessage(&clientConn, dto.UserMachineDto{Username: p.user.Username, MachineName: "laptop"}))
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&clientConn)
+	require.ErrorContains(t, err, "requires 3 machines to approve new machines, but only 2 can")
+	waitDone(t, done)
+}
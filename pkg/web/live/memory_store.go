@@ -0,0 +1,213 @@
+package live
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+)
+
+// MemoryChallengeStore keeps challenges in the process, so both machines have
+// to reach the same server instance.
+type MemoryChallengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]*memoryChallenge
+}
+
+// memoryChallenge is guarded by the store's mutex, except for its channels.
+type memoryChallenge struct {
+	request ChallengeRequest
+	// joined holds the machines that joined the challenge, approvals how many
+	// of them sent the master key. The first key sent is handed over.
+	joined             map[uuid.UUID]bool
+	approvals          int
+	publicKey          *dto.PublicKeyDto
+	encryptedMasterKey []byte
+
+	// accepted is closed when the first machine joins, publicKeySent when the
+	// public key arrives and approved once the quorum has sent the master key.
+	accepted      chan struct{}
+	publicKeySent chan struct{}
+	approved      chan struct{}
+	denied        chan string
+	// closed is closed when the challenger leaves, abandoned when a responder
+	// leaves without answering.
+	closed      chan struct{}
+	abandoned   chan struct{}
+	closeOnce   sync.Once
+	abandonOnce sync.Once
+}
+
+func NewMemoryChallengeStore() *MemoryChallengeStore {
+	return &MemoryChallengeStore{challenges: make(map[string]*memoryChallenge)}
+}
+
+func (s *MemoryChallengeStore) Open(ctx context.Context, phrase string, request ChallengeRequest) (ChallengerSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.challenges[phrase]; exists {
+		return nil, ErrChallengeInUse
+	}
+	c := &memoryChallenge{
+		request:       request,
+		joined:        make(map[uuid.UUID]bool),
+		accepted:      make(chan struct{}),
+		publicKeySent: make(chan struct{}),
+		approved:      make(chan struct{}),
+		denied:        make(chan string, 1),
+		closed:        make(chan struct{}),
+		abandoned:     make(chan struct{}),
+	}
+	s.challenges[phrase] = c
+	return &memoryChallenger{store: s, phrase: phrase, challenge: c}, nil
+}
+
+func (s *MemoryChallengeStore) Join(ctx context.Context, phrase, username string, machineID uuid.UUID) (ResponderSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, exists := s.challenges[phrase]
+	if !exists || c.request.Username != username || c.joined[machineID] || len(c.joined) >= c.request.quorum() {
+		return nil, ErrChallengeNotFound
+	}
+	c.joined[machineID] = true
+	if len(c.joined) == 1 {
+		close(c.accepted)
+	}
+	return &memoryResponder{store: s, challenge: c}, nil
+}
+
+type memoryChallenger struct {
+	store     *MemoryChallengeStore
+	phrase    string
+	challenge *memoryChallenge
+}
+
+func (c *memoryChallenger) WaitAccepted(ctx context.Context) error {
+	select {
+	case <-c.challenge.accepted:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *memoryChallenger) SendPublicKey(ctx context.Context, key *dto.PublicKeyDto) error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	if c.challenge.publicKey == nil {
+		c.challenge.publicKey = key
+		close(c.challenge.publicKeySent)
+	}
+	return nil
+}
+
+func (c *memoryChallenger) WaitEncryptedMasterKey(ctx context.Context) ([]byte, error) {
+	// A denial wins over approvals that arrived at the same time.
+	select {
+	case reason := <-c.challenge.denied:
+		return nil, &ChallengeDeniedError{Reason: reason}
+	default:
+	}
+	select {
+	case <-c.challenge.approved:
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		return c.challenge.encryptedMasterKey, nil
+	case reason := <-c.challenge.denied:
+		return nil, &ChallengeDeniedError{Reason: reason}
+	case <-c.challenge.abandoned:
+		return nil, ErrChallengeClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *memoryChallenger) Close() error {
+	c.store.mu.Lock()
+	if c.store.challenges[c.phrase] == c.challenge {
+		delete(c.store.challenges, c.phrase)
+	}
+	c.store.mu.Unlock()
+	c.challenge.closeOnce.Do(func() { close(c.challenge.closed) })
+	return nil
+}
+
+type memoryResponder struct {
+	store     *MemoryChallengeStore
+	challenge *memoryChallenge
+	answered  bool
+}
+
+func (r *memoryResponder) Request() ChallengeRequest {
+	return r.challenge.request
+}
+
+func (r *memoryResponder) WaitPublicKey(ctx context.Context) (*dto.PublicKeyDto, error) {
+	select {
+	case <-r.challenge.publicKeySent:
+		r.store.mu.Lock()
+		defer r.store.mu.Unlock()
+		return r.challenge.publicKey, nil
+	case <-r.challenge.closed:
+		return nil, ErrChallengeClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *memoryResponder) SendEncryptedMasterKey(ctx context.Context, encryptedMasterKey []byte) error {
+	if err := r.answer(); err != nil {
+		return err
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	c := r.challenge
+	if c.approvals == 0 {
+		c.encryptedMasterKey = encryptedMasterKey
+	}
+	c.approvals++
+	if c.approvals == c.request.quorum() {
+		close(c.approved)
+	}
+	return nil
+}
+
+func (r *memoryResponder) Deny(ctx context.Context, reason string) error {
+	if err := r.answer(); err != nil {
+		return err
+	}
+	// Only the first denial is passed on.
+	select {
+	case r.challenge.denied <- reason:
+	default:
+	}
+	return nil
+}
+
+// answer records that the responder sent its one answer, unless the
+// challenger has left or this responder already answered.
+func (r *memoryResponder) answer() error {
+	select {
+	case <-r.challenge.closed:
+		return ErrChallengeClosed
+	default:
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if r.answered {
+		return ErrChallengeClosed
+	}
+	r.answered = true
+	return nil
+}
+
+func (r *memoryResponder) Close() error {
+	r.store.mu.Lock()
+	answered := r.answered
+	r.store.mu.Unlock()
+	if !answered {
+		r.challenge.abandonOnce.Do(func() { close(r.challenge.abandoned) })
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package live
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+)
+
+func TestMemoryChallengeStore_Exchange(t *testing.T) {
+	store := NewMemoryChallengeStore()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	challenger, err := store.Open(ctx, "alpha-bravo-charlie", ChallengeRequest{Username: "alice", MachineName: "laptop"})
+	require.NoError(t, err)
+	defer challenger.Close()
+	_, err = store.Open(ctx, "alpha-bravo-charlie", ChallengeRequest{Username: "alice", MachineName: "laptop"})
+	assert.ErrorIs(t, err, ErrChallengeInUse)
+
+	_, err = store.Join(ctx, "alpha-bravo-charlie", "mallory", uuid.New())
+	assert.ErrorIs(t, err, ErrChallengeNotFound)
+	responder, err := store.Join(ctx, "alpha-bravo-charlie", "alice", uuid.New())
+	require.NoError(t, err)
+	defer responder.Close()
+	assert.Equal(t, "laptop", responder.Request().MachineName)
+	_, err = store.Join(ctx, "alpha-bravo-charlie", "alice", uuid.New())
+	assert.ErrorIs(t, err, ErrChallengeNotFound, "a challenge can only be answered once")
+
+	require.NoError(t, challenger.WaitAccepted(ctx))
+	require.NoError(t, challenger.SendPublicKey(ctx, &dto.PublicKeyDto{PublicKey: []byte("pub")}))
+	key, err := responder.WaitPublicKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("pub"), key.PublicKey)
+	require.NoError(t, responder.SendEncryptedMasterKey(ctx, []byte("master")))
+	// Leaving after handing over the key does not take it back.
+	require.NoError(t, responder.Close())
+	masterKey, err := challenger.WaitEncryptedMasterKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("master"), masterKey)
+}
+
+func TestMemoryChallengeStore_NotAccepted(t *testing.T) {
+	store := NewMemoryChallengeStore()
+	challenger, err := store.Open(context.Background(), "alpha-bravo-charlie", ChallengeRequest{Username: "alice"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, challenger.WaitAccepted(ctx), context.DeadlineExceeded)
+
+	require.NoError(t, challenger.Close())
+	_, err = store.Join(context.Background(), "alpha-bravo-charlie", "alice", uuid.New())
+	assert.ErrorIs(t, err, ErrChallengeNotFound)
+}
+
+func TestMemoryChallengeStore_ResponderLeft(t *testing.T) {
+	store := NewMemoryChallengeStore()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	challenger, err := store.Open(ctx, "alpha-bravo-charlie", ChallengeRequest{Username: "alice", MachineName: "laptop"})
+	require.NoError(t, err)
+	defer challenger.Close()
+	responder, err := store.Join(ctx, "alpha-bravo-charlie", "alice", uuid.New())
+	require.NoError(t, err)
+
+	require.NoError(t, responder.Close())
+	_, err = challenger.WaitEncryptedMasterKey(ctx)
+	assert.ErrorIs(t, err, ErrChallengeClosed)
+}
+
+func TestMemoryChallengeStore_Denied(t *testing.T) {
+	store := NewMemoryChallengeStore()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	challenger, err := store.Open(ctx, "alpha-bravo-charlie", ChallengeRequest{Username: "alice"})
+	require.NoError(t, err)
+	defer challenger.Close()
+	responder, err := store.Join(ctx, "alpha-bravo-charlie", "alice", uuid.New())
+	require.NoError(t, err)
+
+	require.NoError(t, responder.Deny(ctx, "not my laptop"))
+	assert.ErrorIs(t, responder.SendEncryptedMasterKey(ctx, []byte("master")), ErrChallengeClosed, "a challenge is answered only once")
+	require.NoError(t, responder.Close())
+
+	_, err = challenger.WaitEncryptedMasterKey(ctx)
+	var denied *ChallengeDeniedError
+	require.ErrorAs(t, err, &denied)
+	assert.Equal(t, "not my laptop", denied.Reason)
+}
+
+func TestMemoryChallengeStore_Quorum(t *testing.T) {
+	store := NewMemoryChallengeStore()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	challenger, err := store.Open(ctx, "alpha-bravo-charlie", ChallengeRequest{Username: "alice", Quorum: 2})
+	require.NoError(t, err)
+	defer challenger.Close()
+	first, second := uuid.New(), uuid.New()
+	firstResponder, err := store.Join(ctx, "alpha-bravo-charlie", "alice", first)
+	require.NoError(t, err)
+	defer firstResponder.Close()
+	_, err = store.Join(ctx, "alpha-bravo-charlie", "alice", first)
+	assert.ErrorIs(t, err, ErrChallengeNotFound, "approvals must come from distinct machines")
+	require.NoError(t, challenger.WaitAccepted(ctx))
+	require.NoError(t, challenger.SendPublicKey(ctx, &dto.PublicKeyDto{PublicKey: []byte("pub")}))
+	_, err = firstResponder.WaitPublicKey(ctx)
+	require.NoError(t, err)
+	require.NoError(t, firstResponder.SendEncryptedMasterKey(ctx, []byte("master")))
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer waitCancel()
+	_, err = challenger.WaitEncryptedMasterKey(waitCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "one approval is not enough")
+
+	secondResponder, err := store.Join(ctx, "alpha-bravo-charlie", "alice", second)
+	require.NoError(t, err)
+	defer secondResponder.Close()
+	_, err = store.Join(ctx, "alpha-bravo-charlie", "alice", uuid.New())
+	assert.ErrorIs(t, err, ErrChallengeNotFound, "the quorum is already joined")
+	key, err := secondResponder.WaitPublicKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("pub"), key.PublicKey)
+	require.NoError(t, secondResponder.SendEncryptedMasterKey(ctx, []byte("master")))
+
+	masterKey, err := challenger.WaitEncryptedMasterKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("master"), masterKey)
+}
@@ -0,0 +1,86 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database"
+)
+
+// EventChannel is the channel events are relayed on between server instances.
+const EventChannel = "user_events"
+
+// postgresEvent is an Event with the user it belongs to, as sent in a
+// notification payload.
+type postgresEvent struct {
+	UserID uuid.UUID `json:"user_id"`
+	Event  Event     `json:"event"`
+}
+
+// PostgresEventBroker publishes events with NOTIFY and delivers those of every
+// server instance to its own subscriptions as they arrive on LISTEN.
+type PostgresEventBroker struct {
+	*MemoryEventBroker
+	injector *do.Injector
+}
+
+func NewPostgresEventBroker(i *do.Injector) *PostgresEventBroker {
+	return &PostgresEventBroker{MemoryEventBroker: NewMemoryEventBroker(), injector: i}
+}
+
+func (b *PostgresEventBroker) Publish(event Event) error {
+	payload, err := json.Marshal(postgresEvent{UserID: event.UserID, Event: event})
+	if err != nil {
+		return err
+	}
+	conn := do.MustInvoke[database.DataAccessor](b.injector).GetConnection()
+	_, err = conn.Exec(context.TODO(), "SELECT pg_notify($1, $2)", EventChannel, string(payload))
+	return err
+}
+
+// Listen delivers notified events until ctx is done, reconnecting whenever the
+// connection drops.
+func (b *PostgresEventBroker) Listen(ctx context.Context) {
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Err(err).Msg("event listener disconnected")
+		// Events may have been missed, so have every client sync again.
+		b.closeAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (b *PostgresEventBroker) listen(ctx context.Context) error {
+	conn, err := database.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+EventChannel); err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var relayed postgresEvent
+		if err := json.Unmarshal([]byte(notification.Payload), &relayed); err != nil {
+			log.Err(err).Msg("invalid event notification")
+			continue
+		}
+		relayed.Event.UserID = relayed.UserID
+		b.deliver(relayed.Event)
+	}
+}
@@ -0,0 +1,280 @@
+package live
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/samber/lo"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+)
+
+const (
+	// challengeSessionTTL is how long abandoned sessions are kept before the
+	// next challenge clears them out.
+	challengeSessionTTL = 10 * time.Minute
+	listenRetryDelay    = 5 * time.Second
+)
+
+// PostgresChallengeStore keeps challenges in the challenge_sessions table and
+// learns about changes made by other server instances through LISTEN/NOTIFY.
+type PostgresChallengeStore struct {
+	injector      *do.Injector
+	acceptTimeout time.Duration
+
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+// NewPostgresChallengeStore creates a store whose challenges can only be
+// joined within acceptTimeout of being opened.
+func NewPostgresChallengeStore(i *do.Injector, acceptTimeout time.Duration) *PostgresChallengeStore {
+	return &PostgresChallengeStore{
+		injector:      i,
+		acceptTimeout: acceptTimeout,
+		waiters:       make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+// Listen relays notifications about challenge sessions to the waiting
+// handlers until ctx is done, reconnecting whenever the connection drops.
+func (s *PostgresChallengeStore) Listen(ctx context.Context) {
+	for {
+		err := s.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Err(err).Msg("challenge session listener disconnected")
+		// Notifications may have been missed, so have every waiter look again.
+		s.wakeAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (s *PostgresChallengeStore) listen(ctx context.Context) error {
+	conn, err := database.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+repository.ChallengeSessionChannel); err != nil {
+		return err
+	}
+	s.wakeAll()
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		s.wake(notification)
+	}
+}
+
+func (s *PostgresChallengeStore) subscribe(id string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.waiters[id] == nil {
+		s.waiters[id] = make(map[chan struct{}]struct{})
+	}
+	s.waiters[id][ch] = struct{}{}
+	return ch
+}
+
+func (s *PostgresChallengeStore) unsubscribe(id string, ch chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.waiters[id], ch)
+	if len(s.waiters[id]) == 0 {
+		delete(s.waiters, id)
+	}
+}
+
+func (s *PostgresChallengeStore) wake(notification *pgconn.Notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.waiters[notification.Payload] {
+		signal(ch)
+	}
+}
+
+func (s *PostgresChallengeStore) wakeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, chans := range s.waiters {
+		for ch := range chans {
+			signal(ch)
+		}
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// await re-reads the session whenever it is notified of a change until ready
+// accepts it. A deleted session yields ErrChallengeClosed.
+func (s *PostgresChallengeStore) await(ctx context.Context, id string, ready func(*models.ChallengeSession) bool) (*models.ChallengeSession, error) {
+	wake := s.subscribe(id)
+	defer s.unsubscribe(id, wake)
+	repo := do.MustInvoke[repository.ChallengeSessionRepository](s.injector)
+	for {
+		session, err := repo.GetChallengeSession(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrChallengeClosed
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ready(session) {
+			return session, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (s *PostgresChallengeStore) Open(ctx context.Context, phrase string, request ChallengeRequest) (ChallengerSession, error) {
+	id := challengeID(phrase)
+	repo := do.MustInvoke[repository.ChallengeSessionRepository](s.injector)
+	session := &models.ChallengeSession{
+		ID:          id,
+		Username:    request.Username,
+		MachineName: request.MachineName,
+		SourceIP:    request.SourceIP,
+		UserAgent:   request.UserAgent,
+		Quorum:      request.quorum(),
+	}
+	if err := repo.CreateChallengeSession(session, time.Now().Add(-challengeSessionTTL)); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrChallengeInUse
+		}
+		return nil, err
+	}
+	return &postgresChallenger{store: s, id: id}, nil
+}
+
+func (s *PostgresChallengeStore) Join(ctx context.Context, phrase, username string, machineID uuid.UUID) (ResponderSession, error) {
+	id := challengeID(phrase)
+	repo := do.MustInvoke[repository.ChallengeSessionRepository](s.injector)
+	session, err := repo.ClaimChallengeSession(id, username, machineID, time.Now().Add(-s.acceptTimeout))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrChallengeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	request := ChallengeRequest{
+		Username:    session.Username,
+		MachineName: session.MachineName,
+		SourceIP:    session.SourceIP,
+		UserAgent:   session.UserAgent,
+		RequestedAt: session.CreatedAt,
+		Quorum:      session.Quorum,
+	}
+	return &postgresResponder{store: s, id: id, machineID: machineID, request: request}, nil
+}
+
+type postgresChallenger struct {
+	store *PostgresChallengeStore
+	id    string
+}
+
+func (c *postgresChallenger) WaitAccepted(ctx context.Context) error {
+	_, err := c.store.await(ctx, c.id, func(session *models.ChallengeSession) bool {
+		return session.AcceptedAt != nil
+	})
+	return err
+}
+
+func (c *postgresChallenger) SendPublicKey(ctx context.Context, key *dto.PublicKeyDto) error {
+	repo := do.MustInvoke[repository.ChallengeSessionRepository](c.store.injector)
+	return repo.SetChallengePublicKey(c.id, key.PublicKey, key.EncapsulationKey)
+}
+
+func (c *postgresChallenger) WaitEncryptedMasterKey(ctx context.Context) ([]byte, error) {
+	session, err := c.store.await(ctx, c.id, func(session *models.ChallengeSession) bool {
+		return session.IsApproved() || session.DeniedAt != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if session.DeniedAt != nil {
+		return nil, &ChallengeDeniedError{Reason: lo.FromPtr(session.DeniedReason)}
+	}
+	return session.EncryptedMasterKey, nil
+}
+
+func (c *postgresChallenger) Close() error {
+	return do.MustInvoke[repository.ChallengeSessionRepository](c.store.injector).DeleteChallengeSession(c.id)
+}
+
+type postgresResponder struct {
+	store     *PostgresChallengeStore
+	id        string
+	machineID uuid.UUID
+	request   ChallengeRequest
+}
+
+func (r *postgresResponder) Request() ChallengeRequest {
+	return r.request
+}
+
+func (r *postgresResponder) WaitPublicKey(ctx context.Context) (*dto.PublicKeyDto, error) {
+	session, err := r.store.await(ctx, r.id, func(session *models.ChallengeSession) bool {
+		return session.PublicKey != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dto.PublicKeyDto{PublicKey: session.PublicKey, EncapsulationKey: session.EncapsulationKey}, nil
+}
+
+func (r *postgresResponder) SendEncryptedMasterKey(ctx context.Context, encryptedMasterKey []byte) error {
+	repo := do.MustInvoke[repository.ChallengeSessionRepository](r.store.injector)
+	if err := r.checkOpen(repo); err != nil {
+		return err
+	}
+	return repo.SetChallengeEncryptedMasterKey(r.id, r.machineID, encryptedMasterKey)
+}
+
+func (r *postgresResponder) Deny(ctx context.Context, reason string) error {
+	repo := do.MustInvoke[repository.ChallengeSessionRepository](r.store.injector)
+	if err := r.checkOpen(repo); err != nil {
+		return err
+	}
+	return repo.DenyChallengeSession(r.id, reason)
+}
+
+func (r *postgresResponder) checkOpen(repo repository.ChallengeSessionRepository) error {
+	if _, err := repo.GetChallengeSession(r.id); errors.Is(err, sql.ErrNoRows) {
+		return ErrChallengeClosed
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *postgresResponder) Close() error {
+	return do.MustInvoke[repository.ChallengeSessionRepository](r.store.injector).AbandonChallengeSession(r.id, r.machineID)
+}
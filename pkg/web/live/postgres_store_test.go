@@ -0,0 +1,140 @@
+package live
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"go.uber.org/mock/gomock"
+)
+
+func TestPostgresChallengeStore_WaitAcceptedOnNotification(t *testing.T) {
+	// Arrange
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	id := challengeID("alpha-bravo-charlie")
+	acceptedAt := time.Now()
+	checked := make(chan struct{})
+	mockRepo := repository.NewMockChallengeSessionRepository(ctrl)
+	mockRepo.EXPECT().CreateChallengeSession(&models.ChallengeSession{ID: id, Username: "alice", MachineName: "laptop", Quorum: 1}, gomock.Any()).Return(nil)
+	gomock.InOrder(
+		mockRepo.EXPECT().GetChallengeSession(id).DoAndReturn(func(string) (*models.ChallengeSession, error) {
+			close(checked)
+			return &models.ChallengeSession{ID: id, Username: "alice"}, nil
+		}),
+		mockRepo.EXPECT().GetChallengeSession(id).Return(&models.ChallengeSession{ID: id, Username: "alice", AcceptedAt: &acceptedAt}, nil),
+	)
+	do.Provide(injector, func(i *do.Injector) (repository.ChallengeSessionRepository, error) {
+		return mockRepo, nil
+	})
+	store := NewPostgresChallengeStore(injector, DefaultChallengeConfig().AcceptTimeout)
+	challenger, err := store.Open(context.Background(), "alpha-bravo-charlie", ChallengeRequest{Username: "alice", MachineName: "laptop"})
+	require.NoError(t, err)
+
+	// Act
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	accepted := make(chan error, 1)
+	go func() { accepted <- challenger.WaitAccepted(ctx) }()
+	<-checked
+	// Another instance claimed the session and notified about it.
+	store.wake(&pgconn.Notification{Channel: repository.ChallengeSessionChannel, Payload: id})
+
+	// Assert
+	assert.NoError(t, <-accepted)
+}
+
+func TestPostgresChallengeStore_JoinUnknown(t *testing.T) {
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := repository.NewMockChallengeSessionRepository(ctrl)
+	mockRepo.EXPECT().ClaimChallengeSession(challengeID("alpha-bravo-charlie"), "alice", gomock.Any(), gomock.Any()).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.ChallengeSessionRepository, error) {
+		return mockRepo, nil
+	})
+
+	_, err := NewPostgresChallengeStore(injector, DefaultChallengeConfig().AcceptTimeout).Join(context.Background(), "alpha-bravo-charlie", "alice", uuid.New())
+	assert.ErrorIs(t, err, ErrChallengeNotFound)
+}
+
+func TestPostgresChallengeStore_Denied(t *testing.T) {
+	// Arrange
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	id := challengeID("alpha-bravo-charlie")
+	deniedAt := time.Now()
+	reason := "not my laptop"
+	mockRepo := repository.NewMockChallengeSessionRepository(ctrl)
+	mockRepo.EXPECT().CreateChallengeSession(gomock.Any(), gomock.Any()).Return(nil)
+	mockRepo.EXPECT().GetChallengeSession(id).Return(&models.ChallengeSession{ID: id, DeniedAt: &deniedAt, DeniedReason: &reason}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.ChallengeSessionRepository, error) {
+		return mockRepo, nil
+	})
+	challenger, err := NewPostgresChallengeStore(injector, DefaultChallengeConfig().AcceptTimeout).Open(context.Background(), "alpha-bravo-charlie", ChallengeRequest{Username: "alice"})
+	require.NoError(t, err)
+
+	// Act
+	_, err = challenger.WaitEncryptedMasterKey(context.Background())
+
+	// Assert
+	var denied *ChallengeDeniedError
+	require.ErrorAs(t, err, &denied)
+	assert.Equal(t, reason, denied.Reason)
+}
+
+func TestPostgresChallengeStore_WaitsForQuorum(t *testing.T) {
+	// Arrange
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	id := challengeID("alpha-bravo-charlie")
+	first, second := uuid.New(), uuid.New()
+	checked := make(chan struct{})
+	mockRepo := repository.NewMockChallengeSessionRepository(ctrl)
+	mockRepo.EXPECT().CreateChallengeSession(&models.ChallengeSession{ID: id, Username: "alice", Quorum: 2}, gomock.Any()).Return(nil)
+	gomock.InOrder(
+		mockRepo.EXPECT().GetChallengeSession(id).DoAndReturn(func(string) (*models.ChallengeSession, error) {
+			close(checked)
+			return &models.ChallengeSession{ID: id, Quorum: 2, EncryptedMasterKey: []byte("master"), ApprovedBy: []uuid.UUID{first}}, nil
+		}),
+		mockRepo.EXPECT().GetChallengeSession(id).Return(&models.ChallengeSession{ID: id, Quorum: 2, EncryptedMasterKey: []byte("master"), ApprovedBy: []uuid.UUID{first, second}}, nil),
+	)
+	do.Provide(injector, func(i *do.Injector) (repository.ChallengeSessionRepository, error) {
+		return mockRepo, nil
+	})
+	store := NewPostgresChallengeStore(injector, DefaultChallengeConfig().AcceptTimeout)
+	challenger, err := store.Open(context.Background(), "alpha-bravo-charlie", ChallengeRequest{Username: "alice", Quorum: 2})
+	require.NoError(t, err)
+
+	// Act
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	type result struct {
+		key []byte
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		key, err := challenger.WaitEncryptedMasterKey(ctx)
+		results <- result{key, err}
+	}()
+	<-checked
+	// The second machine approved on another instance.
+	store.wake(&pgconn.Notification{Channel: repository.ChallengeSessionChannel, Payload: id})
+
+	// Assert
+	r := <-results
+	require.NoError(t, r.err)
+	assert.Equal(t, []byte("master"), r.key)
+}
@@ -0,0 +1,113 @@
+package live
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+)
+
+var (
+	ErrChallengeNotFound = errors.New("challenge not found")
+	ErrChallengeClosed   = errors.New("challenge session closed")
+	ErrChallengeInUse    = errors.New("challenge phrase already in use")
+)
+
+// ChallengeDeniedError is returned to the new machine when an existing machine
+// refused to hand over the master key.
+type ChallengeDeniedError struct {
+	Reason string
+}
+
+func (e *ChallengeDeniedError) Error() string {
+	if e.Reason == "" {
+		return "challenge denied"
+	}
+	return "challenge denied: " + e.Reason
+}
+
+// ChallengeRequest describes the new machine to the existing machine that is
+// asked to approve it.
+type ChallengeRequest struct {
+	Username    string
+	MachineName string
+	SourceIP    string
+	UserAgent   string
+	RequestedAt time.Time
+	// Quorum is how many distinct existing machines must approve the new
+	// machine. Zero means one.
+	Quorum int
+}
+
+func (r ChallengeRequest) quorum() int {
+	return max(1, r.Quorum)
+}
+
+// ChallengeStore pairs the websocket of a new machine with those of the
+// existing machines answering its challenge phrase. With a shared store the
+// websockets may be served by different server instances.
+type ChallengeStore interface {
+	// Open registers a challenge phrase for a new machine of request.Username.
+	Open(ctx context.Context, phrase string, request ChallengeRequest) (ChallengerSession, error)
+	// Join claims one of the request's Quorum approvals for an existing machine
+	// of the same user. It returns ErrChallengeNotFound for unknown or expired
+	// phrases, phrases of another user, phrases the machine has already joined
+	// and phrases joined by enough machines.
+	Join(ctx context.Context, phrase, username string, machineID uuid.UUID) (ResponderSession, error)
+}
+
+// ChallengerSession is the new machine's side of a challenge.
+type ChallengerSession interface {
+	// WaitAccepted blocks until the first existing machine has joined the
+	// challenge.
+	WaitAccepted(ctx context.Context) error
+	SendPublicKey(ctx context.Context, key *dto.PublicKeyDto) error
+	// WaitEncryptedMasterKey blocks until Quorum machines have sent the
+	// encrypted master key. It returns a *ChallengeDeniedError as soon as one
+	// of them denies the request.
+	WaitEncryptedMasterKey(ctx context.Context) ([]byte, error)
+	// Close ends the challenge. A responder still waiting for the public key
+	// gets ErrChallengeClosed.
+	Close() error
+}
+
+// ResponderSession is the existing machine's side of a challenge.
+type ResponderSession interface {
+	Request() ChallengeRequest
+	WaitPublicKey(ctx context.Context) (*dto.PublicKeyDto, error)
+	SendEncryptedMasterKey(ctx context.Context, encryptedMasterKey []byte) error
+	// Deny refuses the request instead of sending the master key.
+	Deny(ctx context.Context, reason string) error
+	// Close releases the session. If the responder has not answered, a
+	// challenger still waiting for the master key gets ErrChallengeClosed.
+	Close() error
+}
+
+// LoadChallengeStore creates the store selected by CHALLENGE_STORE: "memory"
+// (the default) keeps challenges in the process, "postgres" shares them between
+// server instances through the database.
+func LoadChallengeStore(i *do.Injector) (ChallengeStore, error) {
+	switch store := os.Getenv("CHALLENGE_STORE"); store {
+	case "", "memory":
+		return NewMemoryChallengeStore(), nil
+	case "postgres":
+		s := NewPostgresChallengeStore(i, do.MustInvoke[*ChallengeGuard](i).Config.AcceptTimeout)
+		go s.Listen(context.Background())
+		return s, nil
+	default:
+		return nil, fmt.Errorf("invalid CHALLENGE_STORE: %q", store)
+	}
+}
+
+// challengeID identifies a challenge without revealing its phrase.
+func challengeID(phrase string) string {
+	sum := sha256.Sum256([]byte(phrase))
+	return hex.EncodeToString(sum[:])
+}
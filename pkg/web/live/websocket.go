@@ -0,0 +1,320 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/samber/lo"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/wsutils"
+)
+
+const (
+	// ProtocolVersion is the newest version of the websocket protocol this
+	// server speaks. Clients announce the versions they speak as
+	// "ssh-sync.v<N>" subprotocols, and the server selects the newest one it
+	// supports.
+	ProtocolVersion = 2
+	// legacyProtocolVersion is assumed for clients that do not announce a
+	// version.
+	legacyProtocolVersion = 1
+
+	protocolPrefix = "ssh-sync.v"
+
+	// pingWriteTimeout bounds writing a ping, independently of the deadline
+	// of the message being exchanged.
+	pingWriteTimeout = 5 * time.Second
+	// refusalWriteTimeout bounds telling a client why its websocket is refused.
+	refusalWriteTimeout = 5 * time.Second
+)
+
+// ErrServerShuttingDown is the cancellation cause of live connections that are
+// ended because the server is shutting down.
+var ErrServerShuttingDown = errors.New("server shutting down")
+
+const shutdownMessage = "The server is shutting down, please try again"
+
+// WebsocketConfig sets how websockets are kept alive and which clients may
+// open them. The server pings every websocket each PingInterval and closes
+// those it has received nothing from, not even a pong, for IdleTimeout.
+// Clients that speak a protocol version older than MinProtocolVersion are
+// refused with a message asking them to update.
+type WebsocketConfig struct {
+	PingInterval       time.Duration
+	IdleTimeout        time.Duration
+	MinProtocolVersion int
+}
+
+func DefaultWebsocketConfig() WebsocketConfig {
+	return WebsocketConfig{
+		PingInterval:       20 * time.Second,
+		IdleTimeout:        time.Minute,
+		MinProtocolVersion: legacyProtocolVersion,
+	}
+}
+
+// LoadWebsocketConfig reads WEBSOCKET_PING_INTERVAL, WEBSOCKET_IDLE_TIMEOUT
+// and WEBSOCKET_MIN_PROTOCOL_VERSION, falling back to DefaultWebsocketConfig.
+func LoadWebsocketConfig() (WebsocketConfig, error) {
+	config := DefaultWebsocketConfig()
+	for _, setting := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"WEBSOCKET_PING_INTERVAL", &config.PingInterval},
+		{"WEBSOCKET_IDLE_TIMEOUT", &config.IdleTimeout},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return WebsocketConfig{}, fmt.Errorf("invalid %s: %q", setting.env, value)
+		}
+		*setting.value = duration
+	}
+	if config.IdleTimeout <= config.PingInterval {
+		return WebsocketConfig{}, errors.New("WEBSOCKET_IDLE_TIMEOUT must be longer than WEBSOCKET_PING_INTERVAL")
+	}
+	if value := os.Getenv("WEBSOCKET_MIN_PROTOCOL_VERSION"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < legacyProtocolVersion || n > ProtocolVersion {
+			return WebsocketConfig{}, fmt.Errorf("invalid WEBSOCKET_MIN_PROTOCOL_VERSION: %q", value)
+		}
+		config.MinProtocolVersion = n
+	}
+	return config, nil
+}
+
+// Connections keeps track of the live connections of this package: the
+// challenge and event websockets, and event streams. http.Server.Shutdown
+// neither waits for hijacked connections nor ends streaming responses, so
+// they are told about the shutdown and waited for here instead.
+type Connections struct {
+	Config WebsocketConfig
+
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	active sync.WaitGroup
+}
+
+func LoadConnections() (*Connections, error) {
+	config, err := LoadWebsocketConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewConnections(config), nil
+}
+
+func NewConnections(config WebsocketConfig) *Connections {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &Connections{Config: config, ctx: ctx, cancel: cancel}
+}
+
+// track registers a live connection, which must call done once it has ended.
+// The returned context is cancelled with ErrServerShuttingDown when the server
+// shuts down. Once it has, connections are no longer registered and ok is
+// false.
+func (c *Connections) track() (ctx context.Context, done func(), ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		return c.ctx, func() {}, false
+	}
+	c.active.Add(1)
+	return c.ctx, c.active.Done, true
+}
+
+// Shutdown tells every live connection that the server is shutting down. It
+// does not wait for them; see Wait.
+func (c *Connections) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancel(ErrServerShuttingDown)
+}
+
+// Wait waits until every live connection has ended, or ctx is done.
+func (c *Connections) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// keepAliveConn is the server side of a websocket that pings the client, and
+// fails reads once nothing has been received for IdleTimeout. Messages must be
+// written through write, so that they do not interleave with pings.
+type keepAliveConn struct {
+	net.Conn
+	config WebsocketConfig
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+func (c *Connections) keepAlive(conn net.Conn) *keepAliveConn {
+	return &keepAliveConn{Conn: conn, config: c.Config}
+}
+
+// Read pushes the read deadline back whenever a read starts. Control frames
+// are read too, so a client answering pings is not idle.
+func (c *keepAliveConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.config.IdleTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// SetWriteDeadline sets the deadline for writing messages, which pings leave
+// in place.
+func (c *keepAliveConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// write runs fn, which writes whole messages to the connection, without
+// pings being written in between.
+func (c *keepAliveConn) write(fn func(conn *net.Conn) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn := c.Conn
+	return fn(&conn)
+}
+
+func writeMessage[T any](c *keepAliveConn, data T) error {
+	return c.write(func(conn *net.Conn) error {
+		return wsutils.WriteServerMessage(conn, data)
+	})
+}
+
+// closeWith sends a close frame, for clients that are told to reconnect.
+func (c *keepAliveConn) closeWith(code ws.StatusCode, reason string) error {
+	return c.write(func(conn *net.Conn) error {
+		return wsutil.WriteServerMessage(*conn, ws.OpClose, ws.NewCloseFrameBody(code, reason))
+	})
+}
+
+func (c *keepAliveConn) ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(pingWriteTimeout)); err != nil {
+		return err
+	}
+	_, err := c.Conn.Write(ws.CompiledPing)
+	if resetErr := c.Conn.SetWriteDeadline(c.writeDeadline); err == nil {
+		err = resetErr
+	}
+	return err
+}
+
+// pingUntil pings the client every PingInterval until ctx is done. A client
+// that stops answering is caught by the idle timeout of the next read.
+func (c *keepAliveConn) pingUntil(ctx context.Context) {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.ping(); err != nil {
+				log.Debug().Err(err).Msg("Error pinging websocket")
+				return
+			}
+		}
+	}
+}
+
+// negotiateProtocolVersion picks the newest protocol version announced by the
+// client that the server supports. If there is none, refusal tells the client
+// why.
+func negotiateProtocolVersion(r *http.Request, config WebsocketConfig) (version int, announced bool, refusal string) {
+	var offered []int
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if !strings.HasPrefix(protocol, protocolPrefix) {
+				continue
+			}
+			if n, err := strconv.Atoi(strings.TrimPrefix(protocol, protocolPrefix)); err == nil {
+				offered = append(offered, n)
+			}
+		}
+	}
+	announced = len(offered) > 0
+	if !announced {
+		offered = []int{legacyProtocolVersion}
+	}
+	for _, n := range offered {
+		if n >= config.MinProtocolVersion && n <= ProtocolVersion {
+			version = max(version, n)
+		}
+	}
+	if version > 0 {
+		return version, announced, ""
+	}
+	if lo.Max(offered) < config.MinProtocolVersion {
+		return 0, announced, fmt.Sprintf("This version of ssh-sync is no longer supported by the server, please update it (protocol version %d or newer is required)", config.MinProtocolVersion)
+	}
+	return 0, announced, fmt.Sprintf("This version of ssh-sync is newer than the server, which supports protocol versions up to %d", ProtocolVersion)
+}
+
+// upgradeWebsocket upgrades the request to a websocket once the client's
+// protocol version has been agreed on. A client whose version is not
+// supported is told why and disconnected, and the returned connection is nil.
+func upgradeWebsocket(i *do.Injector, r *http.Request, w http.ResponseWriter) (net.Conn, error) {
+	config := do.MustInvoke[*Connections](i).Config
+	version, announced, refusal := negotiateProtocolVersion(r, config)
+	var upgrader ws.HTTPUpgrader
+	if announced && refusal == "" {
+		upgrader.Protocol = func(protocol string) bool {
+			return strings.TrimSpace(protocol) == protocolPrefix+strconv.Itoa(version)
+		}
+	}
+	conn, _, _, err := upgrader.Upgrade(r, w)
+	if err != nil {
+		return nil, err
+	}
+	if refusal != "" {
+		go refuseWebsocket(conn, refusal)
+		return nil, nil
+	}
+	return conn, nil
+}
+
+// refuseWebsocket sends the client a message it shows as an error, whatever
+// it was about to read, and closes the websocket.
+func refuseWebsocket(conn net.Conn, message string) {
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(refusalWriteTimeout)); err != nil {
+		return
+	}
+	if err := wsutils.WriteServerError[dto.MessageDto](&conn, message); err != nil {
+		log.Debug().Err(err).Msg("Error refusing websocket")
+		return
+	}
+	wsutil.WriteServerMessage(conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusProtocolError, "unsupported protocol version"))
+}
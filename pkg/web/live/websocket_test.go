@@ -0,0 +1,245 @@
+package live
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/wsutils"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
+)
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	strict := DefaultWebsocketConfig()
+	strict.MinProtocolVersion = ProtocolVersion
+	for _, tc := range []struct {
+		name      string
+		protocols string
+		config    WebsocketConfig
+		version   int
+		announced bool
+		refusal   string
+	}{
+		{name: "legacy client", config: DefaultWebsocketConfig(), version: legacyProtocolVersion},
+		{name: "newest shared version", protocols: "ssh-sync.v1, ssh-sync.v2, ssh-sync.v9", config: DefaultWebsocketConfig(), version: 2, announced: true},
+		{name: "other subprotocols ignored", protocols: "chat, ssh-sync.v1", config: DefaultWebsocketConfig(), version: 1, announced: true},
+		{name: "legacy client refused", config: strict, refusal: "no longer supported"},
+		{name: "old client refused", protocols: "ssh-sync.v1", config: strict, announced: true, refusal: "no longer supported"},
+		{name: "newer client refused", protocols: "ssh-sync.v9", config: DefaultWebsocketConfig(), announced: true, refusal: "newer than the server"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.protocols != "" {
+				req.Header.Set("Sec-WebSocket-Protocol", tc.protocols)
+			}
+
+			version, announced, refusal := negotiateProtocolVersion(req, tc.config)
+
+			assert.Equal(t, tc.version, version)
+			assert.Equal(t, tc.announced, announced)
+			if tc.refusal == "" {
+				assert.Empty(t, refusal)
+			} else {
+				assert.Contains(t, refusal, tc.refusal)
+			}
+		})
+	}
+}
+
+func TestLoadWebsocketConfig(t *testing.T) {
+	t.Setenv("WEBSOCKET_PING_INTERVAL", "10s")
+	t.Setenv("WEBSOCKET_IDLE_TIMEOUT", "30s")
+	t.Setenv("WEBSOCKET_MIN_PROTOCOL_VERSION", "2")
+	config, err := LoadWebsocketConfig()
+	require.NoError(t, err)
+	assert.Equal(t, WebsocketConfig{PingInterval: 10 * time.Second, IdleTimeout: 30 * time.Second, MinProtocolVersion: 2}, config)
+
+	t.Setenv("WEBSOCKET_IDLE_TIMEOUT", "5s")
+	_, err = LoadWebsocketConfig()
+	assert.Error(t, err, "the idle timeout must leave time to answer a ping")
+
+	t.Setenv("WEBSOCKET_IDLE_TIMEOUT", "30s")
+	t.Setenv("WEBSOCKET_MIN_PROTOCOL_VERSION", "99")
+	_, err = LoadWebsocketConfig()
+	assert.Error(t, err)
+}
+
+// bufferedConn reads what the dialer buffered after the handshake first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func dialEvents(t *testing.T, config WebsocketConfig, protocols ...string) (net.Conn, ws.Handshake) {
+	t.Helper()
+	injector := do.New()
+	do.ProvideValue[EventBroker](injector, NewMemoryEventBroker())
+	do.ProvideValue(injector, NewConnections(config))
+	user := testutils.GenerateUser()
+	machine := testutils.GenerateMachine()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = testutils.AddMachineContext(testutils.AddUserContext(r, user), machine)
+		if err := EventStream(injector, r, w); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+	dialer := ws.Dialer{Protocols: protocols}
+	conn, reader, handshake, err := dialer.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	if reader != nil {
+		return &bufferedConn{Conn: conn, reader: reader}, handshake
+	}
+	return conn, handshake
+}
+
+func TestUpgradeWebsocket_SelectsProtocolVersion(t *testing.T) {
+	_, handshake := dialEvents(t, DefaultWebsocketConfig(), "ssh-sync.v1", "ssh-sync.v2")
+
+	assert.Equal(t, "ssh-sync.v2", handshake.Protocol)
+}
+
+func TestUpgradeWebsocket_RefusesUnsupportedVersion(t *testing.T) {
+	config := DefaultWebsocketConfig()
+	config.MinProtocolVersion = ProtocolVersion
+	conn, handshake := dialEvents(t, config)
+
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&conn)
+
+	assert.Empty(t, handshake.Protocol)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no longer supported")
+}
+
+func TestEventWebsocketHandler_Pings(t *testing.T) {
+	// Arrange
+	injector := do.New()
+	broker := NewMemoryEventBroker()
+	do.ProvideValue[EventBroker](injector, broker)
+	config := DefaultWebsocketConfig()
+	config.PingInterval = 10 * time.Millisecond
+	do.ProvideValue(injector, NewConnections(config))
+	user := testutils.GenerateUser()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		EventWebsocketHandler(injector, newEventStreamRequest(context.Background(), user, testutils.GenerateMachine()), httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+
+	// Act
+	header, err := ws.ReadHeader(clientConn)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpPing, header.OpCode)
+	require.NoError(t, clientConn.Close())
+	waitDone(t, done)
+}
+
+func TestEventWebsocketHandler_IdleTimeout(t *testing.T) {
+	injector := do.New()
+	do.ProvideValue[EventBroker](injector, NewMemoryEventBroker())
+	config := DefaultWebsocketConfig()
+	config.PingInterval = time.Minute
+	config.IdleTimeout = 50 * time.Millisecond
+	do.ProvideValue(injector, NewConnections(config))
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		EventWebsocketHandler(injector, newEventStreamRequest(context.Background(), testutils.GenerateUser(), testutils.GenerateMachine()), httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+
+	// The client never sends anything, not even pongs.
+	waitDone(t, done)
+}
+
+func TestEventWebsocketHandler_ServerShutdown(t *testing.T) {
+	// Arrange
+	injector := do.New()
+	broker := NewMemoryEventBroker()
+	do.ProvideValue[EventBroker](injector, broker)
+	connections := NewConnections(DefaultWebsocketConfig())
+	do.ProvideValue(injector, connections)
+	user := testutils.GenerateUser()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		EventWebsocketHandler(injector, newEventStreamRequest(context.Background(), user, testutils.GenerateMachine()), httptest.NewRecorder(), &serverConn)
+		close(done)
+	}()
+	waitSubscribed(t, broker, user.ID)
+
+	// Act
+	connections.Shutdown()
+
+	// Assert
+	frame, err := ws.ReadFrame(clientConn)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpClose, frame.Header.OpCode)
+	code, _ := ws.ParseCloseFrameData(frame.Payload)
+	assert.Equal(t, ws.StatusGoingAway, code)
+	waitDone(t, done)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, connections.Wait(ctx))
+}
+
+func TestServerSentEventsHandler_ServerShutdown(t *testing.T) {
+	injector := do.New()
+	broker := NewMemoryEventBroker()
+	do.ProvideValue[EventBroker](injector, broker)
+	connections := NewConnections(DefaultWebsocketConfig())
+	do.ProvideValue(injector, connections)
+	user := testutils.GenerateUser()
+	done := make(chan error, 1)
+	go func() {
+		done <- ServerSentEventsHandler(injector, newEventStreamRequest(context.Background(), user, testutils.GenerateMachine()), httptest.NewRecorder())
+	}()
+	waitSubscribed(t, broker, user.ID)
+
+	connections.Shutdown()
+
+	require.NoError(t, <-done)
+	rr := httptest.NewRecorder()
+	require.NoError(t, ServerSentEventsHandler(injector, newEventStreamRequest(context.Background(), user, testutils.GenerateMachine()), rr))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "streams are refused once shutting down")
+}
+
+func TestChallenge_ServerShutdown(t *testing.T) {
+	p := newChallengePair(t)
+	connections := do.MustInvoke[*Connections](p.injector)
+	newConn, _, newDone := p.startNewMachine(t)
+
+	connections.Shutdown()
+
+	_, err := wsutils.ReadServerMessage[dto.MessageDto](&newConn)
+	require.Error(t, err)
+	assert.Equal(t, shutdownMessage, err.Error())
+	waitDone(t, newDone)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, connections.Wait(ctx))
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	assert.Empty(t, p.store.challenges, "the challenge is closed")
+}
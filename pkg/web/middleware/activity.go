@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+)
+
+const defaultActivityFlushInterval = time.Minute
+
+// ActivityTracker records when and from where machines authenticate. Activity
+// is collected in memory and written out at most once per flush interval per
+// machine, so authenticating does not cost a database write on every request.
+type ActivityTracker struct {
+	injector      *do.Injector
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	pending map[uuid.UUID]models.MachineActivity
+}
+
+// LoadActivityTracker creates the tracker using MACHINE_ACTIVITY_FLUSH_INTERVAL
+// (a Go duration, 1m by default).
+func LoadActivityTracker(i *do.Injector) (*ActivityTracker, error) {
+	interval := defaultActivityFlushInterval
+	if value := os.Getenv("MACHINE_ACTIVITY_FLUSH_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid MACHINE_ACTIVITY_FLUSH_INTERVAL: %q", value)
+		}
+		interval = parsed
+	}
+	return NewActivityTracker(i, interval), nil
+}
+
+func NewActivityTracker(i *do.Injector, flushInterval time.Duration) *ActivityTracker {
+	return &ActivityTracker{
+		injector:      i,
+		flushInterval: flushInterval,
+		pending:       make(map[uuid.UUID]models.MachineActivity),
+	}
+}
+
+// Record notes the latest activity of a machine. A nil LastAuthAlgorithm keeps
+// the previously recorded one.
+func (t *ActivityTracker) Record(machineID uuid.UUID, activity models.MachineActivity) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if activity.LastAuthAlgorithm == nil {
+		activity.LastAuthAlgorithm = t.pending[machineID].LastAuthAlgorithm
+	}
+	t.pending[machineID] = activity
+}
+
+// Run flushes recorded activity every flush interval until ctx is done, then
+// flushes once more.
+func (t *ActivityTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.Flush()
+			return
+		case <-ticker.C:
+			t.Flush()
+		}
+	}
+}
+
+// Flush writes all pending activity to the database.
+func (t *ActivityTracker) Flush() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[uuid.UUID]models.MachineActivity)
+	t.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	machineRepo := do.MustInvoke[repository.MachineRepository](t.injector)
+	for machineID, activity := range pending {
+		if err := machineRepo.UpdateMachineActivity(machineID, activity); err != nil {
+			log.Err(err).Str("machine_id", machineID.String()).Msg("error recording machine activity")
+		}
+	}
+}
+
+func requestActivity(now time.Time, ip, userAgent string, alg *string) models.MachineActivity {
+	return models.MachineActivity{
+		LastSeenAt:        &now,
+		LastSeenIP:        &ip,
+		LastSeenUserAgent: &userAgent,
+		LastAuthAlgorithm: alg,
+	}
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"go.uber.org/mock/gomock"
+)
+
+func TestActivityTracker_CoalescesWrites(t *testing.T) {
+	// Arrange
+	i := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	machineID := uuid.New()
+	first := time.Now()
+	second := first.Add(time.Second)
+	alg := "ML-DSA-65"
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().UpdateMachineActivity(machineID, requestActivity(second, "192.0.2.2", "ssh-sync/2.0", &alg)).Return(nil)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	tracker := NewActivityTracker(i, time.Minute)
+
+	// Act
+	tracker.Record(machineID, requestActivity(first, "192.0.2.1", "ssh-sync/1.0", &alg))
+	tracker.Record(machineID, requestActivity(second, "192.0.2.2", "ssh-sync/2.0", nil))
+	tracker.Flush()
+	tracker.Flush()
+
+	// Assert: gomock verifies a single write with the latest activity.
+}
+
+func TestActivityTracker_RunFlushesOnStop(t *testing.T) {
+	// Arrange
+	i := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	machineID := uuid.New()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().UpdateMachineActivity(machineID, gomock.Any()).Return(nil)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	tracker := NewActivityTracker(i, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tracker.Run(ctx)
+		close(done)
+	}()
+
+	// Act
+	tracker.Record(machineID, models.MachineActivity{})
+	cancel()
+
+	// Assert
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	assert.Empty(t, tracker.pending)
+}
@@ -8,13 +8,16 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"filippo.io/mldsa"
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/rs/zerolog/log"
 	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
 )
@@ -41,29 +44,123 @@ func extractAuthClaims(tokenString, alg string) (username, machine string, err e
 			return "", "", errors.New("missing machine claim")
 		}
 	case mldsa.MLDSA44().String(), mldsa.MLDSA65().String(), mldsa.MLDSA87().String():
-		parts := strings.SplitN(tokenString, ".", 3)
-		if len(parts) != 3 {
-			return "", "", errors.New("invalid JWT format")
-		}
-		payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
-		if err != nil {
-			return "", "", err
-		}
-		var claims authClaims
-		if err := json.Unmarshal(payloadBytes, &claims); err != nil {
-			return "", "", err
-		}
-		username, machine = claims.Username, claims.Machine
-		if username == "" || machine == "" {
-			return "", "", errors.New("missing username or machine claim")
-		}
+		return extractUnverifiedClaims(tokenString)
 	default:
-		return "", "", errors.New("unsupported algorithm")
+		if !crypto.IsCompositeAlgorithm(alg) {
+			return "", "", errors.New("unsupported algorithm")
+		}
+		return extractUnverifiedClaims(tokenString)
 	}
 	return
 }
 
+// decodeJWTPayload decodes the claims of a token without verifying it.
+func decodeJWTPayload(tokenString string, claims any) error {
+	parts := strings.SplitN(tokenString, ".", 3)
+	if len(parts) != 3 {
+		return errors.New("invalid JWT format")
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payloadBytes, claims)
+}
+
+func extractUnverifiedClaims(tokenString string) (username, machine string, err error) {
+	var claims authClaims
+	if err := decodeJWTPayload(tokenString, &claims); err != nil {
+		return "", "", err
+	}
+	if claims.Username == "" || claims.Machine == "" {
+		return "", "", errors.New("missing username or machine claim")
+	}
+	return claims.Username, claims.Machine, nil
+}
+
+const MachineSuspendedMessage = "this machine has been suspended; reinstate it from another machine to use it again"
+
+const (
+	RecoveryKeyMessage    = "recovery keys can only be used to recover the account through POST /api/v1/recovery"
+	NotRecoveryKeyMessage = "only a recovery key can recover the account"
+)
+
+// RequestBoundTokenMaxAge is how far from now the issue time of a
+// request-bound token may be.
+const RequestBoundTokenMaxAge = time.Minute
+
+const RequestBoundTokenMessage = "this request needs a token issued within the last minute, with its method and path in the \"method\" and \"path\" claims"
+
+// requestBoundClaims tie a token to the one request it was signed for.
+type requestBoundClaims struct {
+	IssuedAt int64  `json:"iat"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+}
+
+// checkRequestBound checks that a verified token was issued for r within
+// RequestBoundTokenMaxAge of now.
+func checkRequestBound(tokenString string, r *http.Request, now time.Time) error {
+	var claims requestBoundClaims
+	if err := decodeJWTPayload(tokenString, &claims); err != nil {
+		return err
+	}
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if claims.IssuedAt == 0 || now.Sub(issuedAt).Abs() > RequestBoundTokenMaxAge {
+		return errors.New("token is not fresh")
+	}
+	if claims.Method != r.Method || claims.Path != r.URL.Path {
+		return errors.New("token was signed for another request")
+	}
+	return nil
+}
+
+type authOptions struct {
+	allowKeyMigration bool
+	allowSession      bool
+	// recoveryKey only accepts recovery keys, which are refused everywhere
+	// else.
+	recoveryKey bool
+	// requestBound only accepts tokens signed for this very request, for
+	// actions that cannot be undone.
+	requestBound bool
+}
+
+// ConfigureAuth accepts either a client-signed token or a server-issued
+// session token. Requests authenticated by a session token only carry the user
+// and machine IDs and names in their context.
 func ConfigureAuth(i *do.Injector) func(http.Handler) http.Handler {
+	return configureAuth(i, authOptions{allowSession: true})
+}
+
+// ConfigureSignedAuth only accepts client-signed tokens, and puts the full user
+// and machine records in the request context.
+func ConfigureSignedAuth(i *do.Injector) func(http.Handler) http.Handler {
+	return configureAuth(i, authOptions{})
+}
+
+// ConfigureKeyMigrationAuth authenticates like ConfigureSignedAuth but lets
+// machines whose key or JWT algorithm is no longer permitted by policy through,
+// so that they can still rotate to a permitted key.
+func ConfigureKeyMigrationAuth(i *do.Injector) func(http.Handler) http.Handler {
+	return configureAuth(i, authOptions{allowKeyMigration: true})
+}
+
+// ConfigureRecoveryAuth authenticates like ConfigureSignedAuth, but only
+// recovery keys.
+func ConfigureRecoveryAuth(i *do.Injector) func(http.Handler) http.Handler {
+	return configureAuth(i, authOptions{recoveryKey: true})
+}
+
+// ConfigureRequestBoundAuth authenticates like ConfigureSignedAuth, but only
+// accepts tokens issued within RequestBoundTokenMaxAge whose "method" and
+// "path" claims match the request, so that a token captured elsewhere cannot
+// be replayed against it.
+func ConfigureRequestBoundAuth(i *do.Injector) func(http.Handler) http.Handler {
+	return configureAuth(i, authOptions{requestBound: true})
+}
+
+func configureAuth(i *do.Injector, opts authOptions) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -78,23 +175,88 @@ func ConfigureAuth(i *do.Injector) func(http.Handler) http.Handler {
 			}
 			tokenString := submatches[1]
 
+			limiter := do.MustInvoke[*AuthLimiter](i)
+			now := time.Now()
+			clientIP := ClientIP(r)
+			ipKey := ipLimitKey(clientIP)
+			if wait, blocked := limiter.Blocked(now, ipKey); blocked {
+				writeTooManyAttempts(w, wait)
+				return
+			}
+			// fail rejects a presented credential and counts it against the source
+			// IP and, once known, the claimed username and machine.
+			fail := func(keys ...authLimitKey) {
+				limiter.RecordFailure(now, append(keys, ipKey)...)
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+
+			if crypto.IsSessionToken(tokenString) {
+				if !opts.allowSession {
+					log.Debug().Msg("session token used on a route requiring a client-signed token")
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				sessionManager := do.MustInvoke[*crypto.SessionManager](i)
+				claims, err := sessionManager.Verify(tokenString)
+				if err != nil {
+					log.Debug().Err(err).Msg("session token verification failed")
+					fail()
+					return
+				}
+				// Suspending, compromising, deleting or re-keying a machine and
+				// changing its user's policy revoke its sessions, so the claims
+				// can be trusted until the token expires.
+				user := &models.User{ID: claims.UserID, Username: claims.Username}
+				m := &models.Machine{ID: claims.MachineID, UserID: claims.UserID, Name: claims.MachineName}
+				do.MustInvoke[*ActivityTracker](i).Record(m.ID, requestActivity(now, clientIP, r.UserAgent(), nil))
+				ctx := context.WithValue(r.Context(), context_keys.UserContextKey, user)
+				ctx = context.WithValue(ctx, context_keys.MachineContextKey, m)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
 			alg, err := crypto.DetectJWTAlgorithm(tokenString)
 			if err != nil {
 				log.Debug().Err(err).Msg("failed to detect JWT algorithm")
-				w.WriteHeader(http.StatusUnauthorized)
+				fail()
 				return
 			}
 			username, machine, err := extractAuthClaims(tokenString, alg)
 			if err != nil {
 				log.Debug().Err(err).Msg("failed to extract JWT claims")
-				w.WriteHeader(http.StatusUnauthorized)
+				fail()
 				return
 			}
+			// The claims are not verified yet, so anyone can fail in this identity's
+			// name. Its lockout only applies to tokens that do not verify, and a
+			// validly signed token always gets through.
+			identityKey := identityLimitKey(username, machine)
+			failIdentity := func() {
+				if wait, blocked := limiter.Blocked(now, identityKey); blocked {
+					limiter.RecordFailure(now, ipKey)
+					writeTooManyAttempts(w, wait)
+					return
+				}
+				fail(identityKey)
+			}
 
 			userRepo := do.MustInvoke[repository.UserRepository](i)
 			user, err := userRepo.GetUserByUsername(username)
 			if err != nil {
 				log.Debug().Err(err).Msg("couldnt get user")
+				failIdentity()
+				return
+			}
+			policy, err := crypto.PolicyForUser(user)
+			if err != nil {
+				log.Err(err).Msg("error loading algorithm policy")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			// Policy rejections are not counted as failures: the credential itself
+			// may well be valid.
+			if err := policy.CheckJWTAlgorithm(alg); err != nil && !opts.allowKeyMigration {
+				log.Debug().Err(err).Str("alg", alg).Msg("JWT algorithm rejected by policy")
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
@@ -102,19 +264,78 @@ func ConfigureAuth(i *do.Injector) func(http.Handler) http.Handler {
 			m, err := machineRepo.GetMachineByNameAndUser(machine, user.ID)
 			if err != nil {
 				log.Debug().Err(err).Msg("couldnt get machine")
-				w.WriteHeader(http.StatusUnauthorized)
+				failIdentity()
 				return
 			}
 
-			if err := crypto.VerifyJWT(tokenString, alg, m.PublicKey); err != nil {
+			publicKey, err := do.MustInvoke[*crypto.PublicKeyCache](i).Get(m.ID, m.PublicKey)
+			if err != nil {
+				log.Debug().Err(err).Msg("couldnt parse machine public key")
+				failIdentity()
+				return
+			}
+			if err := publicKey.VerifyJWT(tokenString, alg); err != nil {
 				log.Debug().Err(err).Msg("JWT verification failed")
-				w.WriteHeader(http.StatusUnauthorized)
+				failIdentity()
 				return
 			}
 
+			limiter.RecordSuccess(identityKey)
+			if opts.requestBound {
+				if err := checkRequestBound(tokenString, r, now); err != nil {
+					log.Debug().Err(err).Msg("token is not bound to this request")
+					w.WriteHeader(http.StatusUnauthorized)
+					json.NewEncoder(w).Encode(dto.MessageDto{Message: RequestBoundTokenMessage})
+					return
+				}
+			}
+			if !authorizeMachine(w, opts, m, policy, publicKey.Type, now) {
+				return
+			}
+			do.MustInvoke[*ActivityTracker](i).Record(m.ID, requestActivity(now, clientIP, r.UserAgent(), &alg))
+
 			ctx := context.WithValue(r.Context(), context_keys.UserContextKey, user)
 			ctx = context.WithValue(ctx, context_keys.MachineContextKey, m)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// authorizeMachine checks that an authenticated machine may use the route,
+// writing the response if it may not.
+func authorizeMachine(w http.ResponseWriter, opts authOptions, m *models.Machine, policy crypto.AlgorithmPolicy, keyType crypto.KeyType, now time.Time) bool {
+	if m.IsSuspended() {
+		log.Debug().Str("machine_id", m.ID.String()).Msg("suspended machine rejected")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(dto.MessageDto{Message: MachineSuspendedMessage})
+		return false
+	}
+	if m.RecoveryKey != opts.recoveryKey {
+		log.Debug().Str("machine_id", m.ID.String()).Bool("recovery_key", m.RecoveryKey).Msg("machine rejected on this route")
+		message := NotRecoveryKeyMessage
+		if m.RecoveryKey {
+			message = RecoveryKeyMessage
+		}
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(dto.MessageDto{Message: message})
+		return false
+	}
+	if err := policy.CheckKeyType(keyType, now); err != nil && !opts.allowKeyMigration {
+		log.Debug().Err(err).Str("key_type", keyType.String()).Msg("machine key rejected by policy")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(dto.MessageDto{Message: keyMigrationMessage(err)})
+		return false
+	}
+	if deadline, pending := policy.PendingMigration(keyType, now); pending {
+		// RFC 8594: tell clients when their classical key stops being accepted.
+		w.Header().Set("Sunset", deadline.UTC().Format(http.TimeFormat))
+	}
+	return true
+}
+
+func keyMigrationMessage(err error) string {
+	if errors.Is(err, crypto.ErrClassicalKeyMigrationDue) {
+		return err.Error()
+	}
+	return "this machine's key algorithm is not allowed by account policy; rotate it via PUT /api/v1/machines/key"
+}
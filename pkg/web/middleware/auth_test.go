@@ -14,8 +14,10 @@ import (
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/samber/do"
 	"github.com/stretchr/testify/assert"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
 )
 
@@ -40,6 +42,9 @@ func GenerateTestToken(username, machine string, key jwk.Key) (string, error) {
 func TestConfigureAuth(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -97,6 +102,9 @@ func TestConfigureAuth(t *testing.T) {
 func TestConfigureAuthNoUser(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -148,6 +156,9 @@ func TestConfigureAuthNoUser(t *testing.T) {
 func TestConfigureAuthNoMachine(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -205,6 +216,9 @@ func TestConfigureAuthNoMachine(t *testing.T) {
 func TestConfigureAuthUnsignedToken(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -246,6 +260,9 @@ func TestConfigureAuthUnsignedToken(t *testing.T) {
 func TestConfigureAuthNoAuthHeader(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 
 	// Mock http request without Authorization header
 	req, err := http.NewRequest("GET", "/", nil)
@@ -268,6 +285,9 @@ func TestConfigureAuthNoAuthHeader(t *testing.T) {
 func TestConfigureAuthBearerKeywordOnly(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 
 	// Mock http request without Authorization header
 	req, err := http.NewRequest("GET", "/", nil)
@@ -291,6 +311,9 @@ func TestConfigureAuthBearerKeywordOnly(t *testing.T) {
 func TestConfigureAuthBearerKeywordWithSpace(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 
 	// Mock http request without Authorization header
 	req, err := http.NewRequest("GET", "/", nil)
@@ -314,6 +337,9 @@ func TestConfigureAuthBearerKeywordWithSpace(t *testing.T) {
 func TestConfigureAuthFakeToken(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 
 	// Mock http request without Authorization header
 	req, err := http.NewRequest("GET", "/", nil)
@@ -337,6 +363,9 @@ func TestConfigureAuthFakeToken(t *testing.T) {
 func TestConfigureAuth_MLDSA(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -388,6 +417,9 @@ func TestConfigureAuth_MLDSA(t *testing.T) {
 func TestConfigureAuth_MLDSA_WrongKey(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -446,6 +478,9 @@ func TestConfigureAuth_MLDSA_WrongKey(t *testing.T) {
 func TestConfigureAuth_MLDSA_Expired(t *testing.T) {
 	// Arrange
 	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -493,3 +528,763 @@ func TestConfigureAuth_MLDSA_Expired(t *testing.T) {
 	// Assert
 	assert.Equal(t, http.StatusUnauthorized, rr.Code)
 }
+
+func TestConfigureAuth_Hybrid(t *testing.T) {
+	// Arrange
+	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ecPriv, ecPub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mldsaPub, mldsaPriv, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := testutils.EncodeHybridToPem(ecPub, mldsaPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &models.User{ID: uuid.New(), Username: "testuser", RequireHybridAuth: true}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubPEM}
+	token, err := testutils.GenerateHybridTestToken(user.Username, machine.Name, ecPriv, mldsaPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil).Times(1)
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil).Times(1)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Act
+	rr := httptest.NewRecorder()
+	f := ConfigureAuth(i)
+	f(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestConfigureAuth_HybridRequired_SingleAlgRejected(t *testing.T) {
+	// Arrange
+	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	_, mldsaPriv, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &models.User{ID: uuid.New(), Username: "testuser", RequireHybridAuth: true}
+	token, err := testutils.GenerateMLDSATestToken(user.Username, "testmachine", mldsaPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil).Times(1)
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Act
+	rr := httptest.NewRecorder()
+	f := ConfigureAuth(i)
+	f(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestConfigureAuth_ClassicalKeyMigrationDue(t *testing.T) {
+	// Arrange
+	t.Setenv("CLASSICAL_KEY_MIGRATE_BY", time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	priv, pub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, privBytes, err := testutils.EncodeToPem(priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.ParseKey(privBytes, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: uuid.New(), Username: "testuser"}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubBytes}
+
+	for _, tc := range []struct {
+		name       string
+		middleware func(*do.Injector) func(http.Handler) http.Handler
+		want       int
+	}{
+		{"regular route", ConfigureAuth, http.StatusForbidden},
+		{"key migration route", ConfigureKeyMigrationAuth, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i := do.New()
+			do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+			do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+			do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			token, err := GenerateTestToken(user.Username, machine.Name, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mockUserRepo := repository.NewMockUserRepository(ctrl)
+			mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+			do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+				return mockUserRepo, nil
+			})
+			mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+			mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil)
+			do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+				return mockMachineRepo, nil
+			})
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			// Act
+			rr := httptest.NewRecorder()
+			tc.middleware(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(rr, req)
+
+			// Assert
+			assert.Equal(t, tc.want, rr.Code)
+		})
+	}
+}
+
+func TestConfigureAuth_ClassicalKeyMigrationPending(t *testing.T) {
+	// Arrange
+	deadline := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	t.Setenv("CLASSICAL_KEY_MIGRATE_BY", deadline.Format(time.RFC3339))
+	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	priv, pub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, privBytes, err := testutils.EncodeToPem(priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.ParseKey(privBytes, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: uuid.New(), Username: "testuser"}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubBytes}
+	token, err := GenerateTestToken(user.Username, machine.Name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Act
+	rr := httptest.NewRecorder()
+	ConfigureAuth(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, deadline.Format(http.TimeFormat), rr.Header().Get("Sunset"))
+}
+
+func TestConfigureAuth_SessionToken(t *testing.T) {
+	// Arrange
+	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	// No repository expectations: session tokens are verified without the database.
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return repository.NewMockUserRepository(ctrl), nil
+	})
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return repository.NewMockMachineRepository(ctrl), nil
+	})
+	user := &models.User{ID: uuid.New(), Username: "testuser"}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID}
+	sessionManager, err := testutils.ProvideSessionManager(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := sessionManager.Issue(user, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Act
+	rr := httptest.NewRecorder()
+	var ctxUser *models.User
+	var ctxMachine *models.Machine
+	ConfigureAuth(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxUser, _ = r.Context().Value(context_keys.UserContextKey).(*models.User)
+		ctxMachine, _ = r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	if assert.NotNil(t, ctxUser) && assert.NotNil(t, ctxMachine) {
+		assert.Equal(t, user.ID, ctxUser.ID)
+		assert.Equal(t, user.Username, ctxUser.Username)
+		assert.Equal(t, machine.ID, ctxMachine.ID)
+		assert.Equal(t, machine.Name, ctxMachine.Name)
+	}
+}
+
+func TestConfigureAuth_SessionTokenRejected(t *testing.T) {
+	user := &models.User{ID: uuid.New(), Username: "testuser"}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID}
+	for _, tc := range []struct {
+		name       string
+		middleware func(*do.Injector) func(http.Handler) http.Handler
+		setup      func(*crypto.SessionManager)
+	}{
+		{"signed route", ConfigureSignedAuth, func(*crypto.SessionManager) {}},
+		{"key migration route", ConfigureKeyMigrationAuth, func(*crypto.SessionManager) {}},
+		{"revoked machine", ConfigureAuth, func(sm *crypto.SessionManager) { sm.RevokeMachine(machine.ID) }},
+		{"revoked user", ConfigureAuth, func(sm *crypto.SessionManager) { sm.RevokeUser(user.ID) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+			i := do.New()
+			do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+			do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+			do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+			sessionManager, err := testutils.ProvideSessionManager(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, _, err := sessionManager.Issue(user, machine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.setup(sessionManager)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			// Act
+			rr := httptest.NewRecorder()
+			tc.middleware(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(rr, req)
+
+			// Assert
+			assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		})
+	}
+}
+
+func TestConfigureAuth_CachesPublicKey(t *testing.T) {
+	// Arrange
+	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	cache := crypto.NewPublicKeyCache(time.Minute)
+	do.ProvideValue(i, cache)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	priv, pub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, privBytes, err := testutils.EncodeToPem(priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.ParseKey(privBytes, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: uuid.New(), Username: "testuser"}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubBytes}
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil).Times(2)
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil).Times(2)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	handler := ConfigureAuth(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Act
+	for range 2 {
+		token, err := GenerateTestToken(user.Username, machine.Name, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	// Assert
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+}
+
+func TestConfigureAuth_FailedAttemptsBackOff(t *testing.T) {
+	// Arrange
+	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(AuthLimiterConfig{
+		IP:              AuthLimitThresholds{BackoffAfter: 100, LockoutAfter: 100},
+		Identity:        AuthLimitThresholds{BackoffAfter: 2, LockoutAfter: 10},
+		LockoutDuration: time.Hour,
+	}))
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	priv, _, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.FromRaw(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername("testuser").Return(nil, sql.ErrNoRows).Times(3)
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	handler := ConfigureAuth(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Act
+	codes := []int{}
+	var retryAfter string
+	for range 3 {
+		token, err := GenerateTestToken("testuser", "testmachine", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		codes = append(codes, rr.Code)
+		retryAfter = rr.Header().Get("Retry-After")
+	}
+
+	// Assert
+	assert.Equal(t, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}, codes)
+	assert.Equal(t, "1", retryAfter)
+}
+
+func TestConfigureAuth_LockoutSparesValidSignature(t *testing.T) {
+	// Arrange
+	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(AuthLimiterConfig{
+		IP:              AuthLimitThresholds{BackoffAfter: 100, LockoutAfter: 100},
+		Identity:        AuthLimitThresholds{BackoffAfter: 2, LockoutAfter: 3},
+		LockoutDuration: time.Hour,
+	}))
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	priv, pub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, privBytes, err := testutils.EncodeToPem(priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.ParseKey(privBytes, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attackerPriv, _, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attackerKey, err := jwk.FromRaw(attackerPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: uuid.New(), Username: "testuser"}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubBytes}
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil).Times(5)
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil).Times(5)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	handler := ConfigureAuth(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(signingKey jwk.Key) int {
+		token, err := GenerateTestToken(user.Username, machine.Name, signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Act
+	codes := []int{}
+	for range 4 {
+		codes = append(codes, send(attackerKey))
+	}
+	validCode := send(key)
+
+	// Assert
+	assert.Equal(t, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusTooManyRequests}, codes)
+	assert.Equal(t, http.StatusOK, validCode)
+}
+
+func TestConfigureAuth_SuspendedMachine(t *testing.T) {
+	// Arrange
+	i := do.New()
+	do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	priv, pub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, privBytes, err := testutils.EncodeToPem(priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.ParseKey(privBytes, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suspendedAt := time.Now()
+	user := &models.User{ID: uuid.New(), Username: "testuser"}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubBytes, SuspendedAt: &suspendedAt}
+	token, err := GenerateTestToken(user.Username, machine.Name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil)
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Act
+	rr := httptest.NewRecorder()
+	ConfigureAuth(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), MachineSuspendedMessage)
+}
+
+func TestConfigureAuth_RecordsActivity(t *testing.T) {
+	// Arrange
+	i := do.New()
+	do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+	do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+	tracker := NewActivityTracker(i, time.Minute)
+	do.ProvideValue(i, tracker)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	priv, pub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, privBytes, err := testutils.EncodeToPem(priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.ParseKey(privBytes, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: uuid.New(), Username: "testuser"}
+	machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubBytes}
+	token, err := GenerateTestToken(user.Username, machine.Name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+	do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	var recorded models.MachineActivity
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil)
+	mockMachineRepo.EXPECT().UpdateMachineActivity(machine.ID, gomock.Any()).DoAndReturn(func(_ uuid.UUID, activity models.MachineActivity) error {
+		recorded = activity
+		return nil
+	})
+	do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", "ssh-sync/1.2.3")
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	// Act
+	rr := httptest.NewRecorder()
+	ConfigureAuth(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+	tracker.Flush()
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	if assert.NotNil(t, recorded.LastSeenAt) {
+		assert.WithinDuration(t, time.Now(), *recorded.LastSeenAt, time.Minute)
+	}
+	assert.Equal(t, "192.0.2.1", *recorded.LastSeenIP)
+	assert.Equal(t, "ssh-sync/1.2.3", *recorded.LastSeenUserAgent)
+	assert.Equal(t, "ES512", *recorded.LastAuthAlgorithm)
+}
+
+func TestConfigureAuth_RecoveryKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		configure   func(*do.Injector) func(http.Handler) http.Handler
+		recoveryKey bool
+		code        int
+		message     string
+	}{
+		{name: "recovery key refused", configure: ConfigureAuth, recoveryKey: true, code: http.StatusForbidden, message: RecoveryKeyMessage},
+		{name: "recovery key on recovery route", configure: ConfigureRecoveryAuth, recoveryKey: true, code: http.StatusOK},
+		{name: "machine on recovery route", configure: ConfigureRecoveryAuth, code: http.StatusForbidden, message: NotRecoveryKeyMessage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+			i := do.New()
+			do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+			do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+			do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			priv, pub, err := testutils.GenerateTestKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pubBytes, privBytes, err := testutils.EncodeToPem(priv, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := jwk.ParseKey(privBytes, jwk.WithPEM(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := &models.User{ID: uuid.New(), Username: "testuser"}
+			machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubBytes, RecoveryKey: tc.recoveryKey}
+			token, err := GenerateTestToken(user.Username, machine.Name, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mockUserRepo := repository.NewMockUserRepository(ctrl)
+			mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+			do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+				return mockUserRepo, nil
+			})
+			mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+			mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil)
+			do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+				return mockMachineRepo, nil
+			})
+			req := httptest.NewRequest("POST", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			// Act
+			rr := httptest.NewRecorder()
+			tc.configure(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(rr, req)
+
+			// Assert
+			assert.Equal(t, tc.code, rr.Code)
+			if tc.message != "" {
+				assert.Contains(t, rr.Body.String(), tc.message)
+			}
+		})
+	}
+}
+
+func generateRequestBoundToken(username, machine, method, path string, issuedAt time.Time, key jwk.Key) (string, error) {
+	builder := jwt.NewBuilder()
+	builder.Issuer("github.com/therealpaulgg/ssh-sync")
+	builder.IssuedAt(issuedAt)
+	builder.Expiration(time.Now().Add(time.Hour))
+	builder.Claim("username", username)
+	builder.Claim("machine", machine)
+	if method != "" {
+		builder.Claim("method", method)
+		builder.Claim("path", path)
+	}
+	tok, err := builder.Build()
+	if err != nil {
+		return "", err
+	}
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.ES512, key))
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+func TestConfigureRequestBoundAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		issuedAt time.Duration
+		code     int
+	}{
+		{name: "bound to the request", method: "DELETE", path: "/api/v1/users/me", code: http.StatusOK},
+		{name: "unbound", code: http.StatusUnauthorized},
+		{name: "other path", method: "DELETE", path: "/api/v1/machines/", code: http.StatusUnauthorized},
+		{name: "other method", method: "GET", path: "/api/v1/users/me", code: http.StatusUnauthorized},
+		{name: "stale", method: "DELETE", path: "/api/v1/users/me", issuedAt: -2 * RequestBoundTokenMaxAge, code: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+			i := do.New()
+			do.ProvideValue(i, NewActivityTracker(i, time.Minute))
+			do.ProvideValue(i, crypto.NewPublicKeyCache(time.Minute))
+			do.ProvideValue(i, NewAuthLimiter(DefaultAuthLimiterConfig()))
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			priv, pub, err := testutils.GenerateTestKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pubBytes, privBytes, err := testutils.EncodeToPem(priv, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := jwk.ParseKey(privBytes, jwk.WithPEM(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := &models.User{ID: uuid.New(), Username: "testuser"}
+			machine := &models.Machine{ID: uuid.New(), Name: "testmachine", UserID: user.ID, PublicKey: pubBytes}
+			token, err := generateRequestBoundToken(user.Username, machine.Name, tc.method, tc.path, time.Now().Add(tc.issuedAt), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mockUserRepo := repository.NewMockUserRepository(ctrl)
+			mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+			do.Provide(i, func(i *do.Injector) (repository.UserRepository, error) {
+				return mockUserRepo, nil
+			})
+			mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+			mockMachineRepo.EXPECT().GetMachineByNameAndUser(machine.Name, user.ID).Return(machine, nil)
+			do.Provide(i, func(i *do.Injector) (repository.MachineRepository, error) {
+				return mockMachineRepo, nil
+			})
+			req := httptest.NewRequest("DELETE", "/api/v1/users/me", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			// Act
+			rr := httptest.NewRecorder()
+			ConfigureRequestBoundAuth(i)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(rr, req)
+
+			// Assert
+			assert.Equal(t, tc.code, rr.Code)
+			if tc.code != http.StatusOK {
+				assert.Contains(t, rr.Body.String(), "method")
+			}
+		})
+	}
+}
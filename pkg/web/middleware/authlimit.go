@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	authLimitKindIP       = "ip"
+	authLimitKindIdentity = "identity"
+
+	authBackoffBase = time.Second
+	authPruneEvery  = time.Minute
+)
+
+// AuthLimitThresholds configures how one kind of counter reacts to failures:
+// from BackoffAfter consecutive failures on, each further attempt has to wait
+// an exponentially growing delay, and at LockoutAfter failures the key is locked
+// out for LockoutDuration.
+type AuthLimitThresholds struct {
+	BackoffAfter int
+	LockoutAfter int
+}
+
+type AuthLimiterConfig struct {
+	IP       AuthLimitThresholds
+	Identity AuthLimitThresholds
+	// LockoutDuration is also how long failures are remembered.
+	LockoutDuration time.Duration
+}
+
+// LockedIdentity is a source IP or (username, machine) pair that is currently
+// locked out.
+type LockedIdentity struct {
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// AuthLimiter tracks failed authentication attempts per source IP and per
+// (username, machine) pair. State is kept in memory for this server process.
+type AuthLimiter struct {
+	config AuthLimiterConfig
+
+	mu        sync.Mutex
+	entries   map[authLimitKey]*authLimitEntry
+	lastPrune time.Time
+}
+
+type authLimitKey struct {
+	kind string
+	key  string
+}
+
+type authLimitEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool
+}
+
+func DefaultAuthLimiterConfig() AuthLimiterConfig {
+	return AuthLimiterConfig{
+		IP:              AuthLimitThresholds{BackoffAfter: 20, LockoutAfter: 100},
+		Identity:        AuthLimitThresholds{BackoffAfter: 3, LockoutAfter: 10},
+		LockoutDuration: 15 * time.Minute,
+	}
+}
+
+// LoadAuthLimiter creates the limiter from AUTH_IP_LOCKOUT_THRESHOLD,
+// AUTH_LOCKOUT_THRESHOLD (per username and machine) and AUTH_LOCKOUT_DURATION,
+// falling back to DefaultAuthLimiterConfig. Backoff starts at a fifth of
+// the lockout threshold.
+func LoadAuthLimiter() (*AuthLimiter, error) {
+	config := DefaultAuthLimiterConfig()
+	for _, setting := range []struct {
+		env        string
+		thresholds *AuthLimitThresholds
+	}{
+		{"AUTH_IP_LOCKOUT_THRESHOLD", &config.IP},
+		{"AUTH_LOCKOUT_THRESHOLD", &config.Identity},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
+		}
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold < 1 {
+			return nil, fmt.Errorf("invalid %s: %q", setting.env, value)
+		}
+		*setting.thresholds = AuthLimitThresholds{BackoffAfter: max(1, threshold/5), LockoutAfter: threshold}
+	}
+	if value := os.Getenv("AUTH_LOCKOUT_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid AUTH_LOCKOUT_DURATION: %q", value)
+		}
+		config.LockoutDuration = duration
+	}
+	return NewAuthLimiter(config), nil
+}
+
+func NewAuthLimiter(config AuthLimiterConfig) *AuthLimiter {
+	return &AuthLimiter{
+		config:  config,
+		entries: make(map[authLimitKey]*authLimitEntry),
+	}
+}
+
+func ipLimitKey(ip string) authLimitKey {
+	return authLimitKey{kind: authLimitKindIP, key: ip}
+}
+
+func identityLimitKey(username, machine string) authLimitKey {
+	return authLimitKey{kind: authLimitKindIdentity, key: username + "/" + machine}
+}
+
+// Blocked reports whether any of the keys must wait before trying again, and
+// for how long.
+func (l *AuthLimiter) Blocked(now time.Time, keys ...authLimitKey) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if entry, ok := l.entries[key]; ok && now.Before(entry.blockedUntil) {
+			wait = max(wait, entry.blockedUntil.Sub(now))
+		}
+	}
+	return wait, wait > 0
+}
+
+func (l *AuthLimiter) RecordFailure(now time.Time, keys ...authLimitKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	for _, key := range keys {
+		entry, ok := l.entries[key]
+		if !ok || now.Sub(entry.lastFailure) > l.config.LockoutDuration {
+			entry = &authLimitEntry{}
+			l.entries[key] = entry
+		}
+		entry.failures++
+		entry.lastFailure = now
+		thresholds := l.thresholds(key.kind)
+		switch {
+		case entry.failures >= thresholds.LockoutAfter:
+			entry.locked = true
+			entry.blockedUntil = now.Add(l.config.LockoutDuration)
+		case entry.failures >= thresholds.BackoffAfter:
+			// Compare in float, since the delay overflows a Duration long
+			// before it could exceed a lockout.
+			exponent := float64(entry.failures - thresholds.BackoffAfter)
+			delay := l.config.LockoutDuration
+			if d := float64(authBackoffBase) * math.Pow(2, exponent); d < float64(delay) {
+				delay = time.Duration(d)
+			}
+			entry.blockedUntil = now.Add(delay)
+		}
+	}
+}
+
+// RecordSuccess forgets the failures of the given keys.
+func (l *AuthLimiter) RecordSuccess(keys ...authLimitKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
+
+// Locked lists the currently locked out IPs and identities, soonest unlocked
+// first.
+func (l *AuthLimiter) Locked(now time.Time) []LockedIdentity {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	locked := []LockedIdentity{}
+	for key, entry := range l.entries {
+		if entry.locked && now.Before(entry.blockedUntil) {
+			locked = append(locked, LockedIdentity{
+				Kind:        key.kind,
+				Key:         key.key,
+				Failures:    entry.failures,
+				LockedUntil: entry.blockedUntil,
+			})
+		}
+	}
+	sort.Slice(locked, func(a, b int) bool {
+		return locked[a].LockedUntil.Before(locked[b].LockedUntil)
+	})
+	return locked
+}
+
+func (l *AuthLimiter) thresholds(kind string) AuthLimitThresholds {
+	if kind == authLimitKindIP {
+		return l.config.IP
+	}
+	return l.config.Identity
+}
+
+func (l *AuthLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < authPruneEvery {
+		return
+	}
+	l.lastPrune = now
+	for key, entry := range l.entries {
+		if now.Sub(entry.lastFailure) > l.config.LockoutDuration && !now.Before(entry.blockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
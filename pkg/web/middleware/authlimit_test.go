@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAuthLimiter() *AuthLimiter {
+	return NewAuthLimiter(AuthLimiterConfig{
+		IP:              AuthLimitThresholds{BackoffAfter: 5, LockoutAfter: 10},
+		Identity:        AuthLimitThresholds{BackoffAfter: 2, LockoutAfter: 4},
+		LockoutDuration: time.Hour,
+	})
+}
+
+func TestAuthLimiter_ExponentialBackoff(t *testing.T) {
+	limiter := testAuthLimiter()
+	key := identityLimitKey("user", "machine")
+	now := time.Now()
+
+	limiter.RecordFailure(now, key)
+	_, blocked := limiter.Blocked(now, key)
+	assert.False(t, blocked)
+
+	limiter.RecordFailure(now, key)
+	wait, blocked := limiter.Blocked(now, key)
+	assert.True(t, blocked)
+	assert.Equal(t, time.Second, wait)
+
+	limiter.RecordFailure(now, key)
+	wait, _ = limiter.Blocked(now, key)
+	assert.Equal(t, 2*time.Second, wait)
+
+	_, blocked = limiter.Blocked(now.Add(3*time.Second), key)
+	assert.False(t, blocked)
+	assert.Empty(t, limiter.Locked(now))
+}
+
+func TestAuthLimiter_LongBackoffCapped(t *testing.T) {
+	limiter := NewAuthLimiter(AuthLimiterConfig{
+		IP:              AuthLimitThresholds{BackoffAfter: 1, LockoutAfter: 1000},
+		Identity:        AuthLimitThresholds{BackoffAfter: 1, LockoutAfter: 1000},
+		LockoutDuration: time.Hour,
+	})
+	key := ipLimitKey("192.0.2.1")
+	now := time.Now()
+	for range 100 {
+		limiter.RecordFailure(now, key)
+	}
+
+	wait, blocked := limiter.Blocked(now, key)
+	assert.True(t, blocked)
+	assert.Equal(t, time.Hour, wait)
+}
+
+func TestAuthLimiter_Lockout(t *testing.T) {
+	limiter := testAuthLimiter()
+	key := identityLimitKey("user", "machine")
+	now := time.Now()
+	for range 4 {
+		limiter.RecordFailure(now, key)
+	}
+
+	wait, blocked := limiter.Blocked(now, key)
+	assert.True(t, blocked)
+	assert.Equal(t, time.Hour, wait)
+	locked := limiter.Locked(now)
+	require.Len(t, locked, 1)
+	assert.Equal(t, "identity", locked[0].Kind)
+	assert.Equal(t, "user/machine", locked[0].Key)
+	assert.Equal(t, 4, locked[0].Failures)
+
+	assert.Empty(t, limiter.Locked(now.Add(2*time.Hour)))
+	_, blocked = limiter.Blocked(now.Add(2*time.Hour), key)
+	assert.False(t, blocked)
+}
+
+func TestAuthLimiter_SeparateThresholds(t *testing.T) {
+	limiter := testAuthLimiter()
+	ip := ipLimitKey("192.0.2.1")
+	now := time.Now()
+	for _, machine := range []string{"a", "b", "c", "d"} {
+		limiter.RecordFailure(now, identityLimitKey("user", machine), ip)
+	}
+	_, blocked := limiter.Blocked(now, ip)
+	assert.False(t, blocked)
+	_, blocked = limiter.Blocked(now, identityLimitKey("user", "e"))
+	assert.False(t, blocked)
+}
+
+func TestAuthLimiter_SuccessResets(t *testing.T) {
+	limiter := testAuthLimiter()
+	key := identityLimitKey("user", "machine")
+	now := time.Now()
+	limiter.RecordFailure(now, key)
+	limiter.RecordSuccess(key)
+	limiter.RecordFailure(now, key)
+	_, blocked := limiter.Blocked(now, key)
+	assert.False(t, blocked)
+}
+
+func TestAuthLimiter_FailuresForgotten(t *testing.T) {
+	limiter := testAuthLimiter()
+	key := identityLimitKey("user", "machine")
+	now := time.Now()
+	limiter.RecordFailure(now, key)
+	later := now.Add(2 * time.Hour)
+	limiter.RecordFailure(later, key)
+	_, blocked := limiter.Blocked(later, key)
+	assert.False(t, blocked)
+}
+
+func TestLoadAuthLimiter(t *testing.T) {
+	t.Setenv("AUTH_LOCKOUT_THRESHOLD", "20")
+	t.Setenv("AUTH_LOCKOUT_DURATION", "5m")
+	limiter, err := LoadAuthLimiter()
+	require.NoError(t, err)
+	assert.Equal(t, AuthLimitThresholds{BackoffAfter: 4, LockoutAfter: 20}, limiter.config.Identity)
+	assert.Equal(t, DefaultAuthLimiterConfig().IP, limiter.config.IP)
+	assert.Equal(t, 5*time.Minute, limiter.config.LockoutDuration)
+
+	t.Setenv("AUTH_IP_LOCKOUT_THRESHOLD", "0")
+	_, err = LoadAuthLimiter()
+	assert.Error(t, err)
+}
@@ -1,30 +1,116 @@
 package middleware
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// DefaultTrustedProxies trusts only proxies on the same host.
+var DefaultTrustedProxies = TrustedProxies{
+	{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+}
+
+// TrustedProxies are the reverse proxies whose X-Forwarded-For and X-Real-IP
+// headers are believed. Anyone else could put any address there.
+type TrustedProxies []*net.IPNet
+
+var trustedProxies = DefaultTrustedProxies
+
+// LoadTrustedProxies reads TRUSTED_PROXIES, a comma-separated list of IPs and
+// CIDR ranges, falling back to DefaultTrustedProxies. "none" trusts no proxy.
+func LoadTrustedProxies() (TrustedProxies, error) {
+	value := os.Getenv("TRUSTED_PROXIES")
+	switch value {
+	case "":
+		return DefaultTrustedProxies, nil
+	case "none":
+		return TrustedProxies{}, nil
+	}
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// SetTrustedProxies replaces the proxies trusted by ClientIP. Call it before
+// the server starts.
+func SetTrustedProxies(proxies TrustedProxies) {
+	trustedProxies = proxies
+}
+
+func (p TrustedProxies) contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getUserIP returns the peer's address unless the peer is a trusted proxy. Then
+// it is the rightmost X-Forwarded-For entry that is not itself a trusted proxy,
+// since entries to the left of it may have come from the client.
 func getUserIP(req *http.Request) net.IP {
-	var userIP string
-	if len(req.Header.Get("X-Forwarded-For")) > 1 {
-		userIP = req.Header.Get("X-Forwarded-For")
-		return net.ParseIP(userIP)
-	} else if len(req.Header.Get("X-Real-IP")) > 1 {
-		userIP = req.Header.Get("X-Real-IP")
-		return net.ParseIP(userIP)
-	} else {
-		userIP = req.RemoteAddr
-		if strings.Contains(userIP, ":") {
-			return net.ParseIP(strings.Split(userIP, ":")[0])
-		} else {
-			return net.ParseIP(userIP)
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxies.contains(ip) {
+		return ip
+	}
+	if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for idx := len(hops) - 1; idx >= 0; idx-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[idx]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !trustedProxies.contains(hop) {
+				break
+			}
 		}
+		return ip
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP
+	}
+	return ip
+}
+
+// ClientIP is the address the request came from, as reported by a trusted
+// reverse proxy if there is one.
+func ClientIP(req *http.Request) string {
+	if ip := getUserIP(req); ip != nil {
+		return ip.String()
 	}
+	return req.RemoteAddr
 }
 
 // Log is a middleware that logs the request and response
@@ -35,7 +121,7 @@ func Log(next http.Handler) http.Handler {
 		log.Info().
 			Str("method", r.Method).
 			Str("path", r.URL.Path).
-			Str("remote_addr", getUserIP(r).String()).
+			Str("remote_addr", ClientIP(r)).
 			Dur("duration", time.Since(start)).
 			Msg("Request")
 	})
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"bytes"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -17,6 +18,7 @@ func TestLog(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.RemoteAddr = "127.0.0.1:41000"
 	req.Header.Set("X-Forwarded-For", "192.0.2.1")
 
 	rec := httptest.NewRecorder()
@@ -40,6 +42,7 @@ func TestLogRealIp(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.RemoteAddr = "127.0.0.1:41000"
 	req.Header.Set("X-Real-Ip", "192.0.2.1")
 
 	rec := httptest.NewRecorder()
@@ -103,3 +106,52 @@ func TestLogRemoteAddrPort(t *testing.T) {
 	assert.Contains(t, logLine, `"remote_addr":"192.0.2.1"`)
 	assert.True(t, strings.Contains(logLine, `"duration"`))
 }
+
+func TestClientIP_UntrustedForwardedFor(t *testing.T) {
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "198.51.100.7:41000"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	req.Header.Set("X-Real-Ip", "192.0.2.1")
+
+	assert.Equal(t, "198.51.100.7", ClientIP(req))
+}
+
+func TestClientIP_MultipleHops(t *testing.T) {
+	SetTrustedProxies(TrustedProxies{
+		{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)},
+	})
+	t.Cleanup(func() { SetTrustedProxies(DefaultTrustedProxies) })
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "10.0.0.2:41000"
+	// The client made up the first entry; the second was added by the outer
+	// proxy at 10.0.0.1.
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 192.0.2.1, 10.0.0.1")
+
+	assert.Equal(t, "192.0.2.1", ClientIP(req))
+}
+
+func TestClientIP_IPv6RemoteAddr(t *testing.T) {
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "[2001:db8::1]:41000"
+
+	assert.Equal(t, "2001:db8::1", ClientIP(req))
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.10, ::1")
+	proxies, err := LoadTrustedProxies()
+	assert.NoError(t, err)
+	assert.True(t, proxies.contains(net.ParseIP("10.1.2.3")))
+	assert.True(t, proxies.contains(net.ParseIP("192.0.2.10")))
+	assert.False(t, proxies.contains(net.ParseIP("192.0.2.11")))
+	assert.True(t, proxies.contains(net.ParseIP("::1")))
+
+	t.Setenv("TRUSTED_PROXIES", "none")
+	proxies, err = LoadTrustedProxies()
+	assert.NoError(t, err)
+	assert.Empty(t, proxies)
+
+	t.Setenv("TRUSTED_PROXIES", "proxy.internal")
+	_, err = LoadTrustedProxies()
+	assert.Error(t, err)
+}
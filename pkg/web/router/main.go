@@ -20,11 +20,14 @@ func Router(i *do.Injector) chi.Router {
 	apiV1Router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "Hello, world!")
 	})
+	apiV1Router.Mount("/auth", routes.AuthRoutes(i))
 	apiV1Router.Mount("/users", routes.UserRoutes(i))
 	apiV1Router.Mount("/setup", routes.SetupRoutes(i))
 	apiV1Router.Mount("/machines", routes.MachineRoutes(i))
 	apiV1Router.Mount("/data", routes.DataRoutes(i))
 	apiV1Router.Mount("/key-rotation", routes.KeyRotationRoutes(i))
+	apiV1Router.Mount("/events", routes.EventRoutes(i))
+	apiV1Router.Mount("/recovery", routes.RecoveryRoutes(i))
 	baseRouter.Mount("/api/v1", apiV1Router)
 	return baseRouter
 }
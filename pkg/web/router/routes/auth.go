@@ -0,0 +1,52 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
+)
+
+type SessionTokenDto struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func createSession(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		machine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Str("machine_name", machine.Name).Msg("createSession: request received")
+		sessionManager := do.MustInvoke[*crypto.SessionManager](i)
+		token, expiresAt, err := sessionManager.Issue(user, machine)
+		if err != nil {
+			log.Err(err).Msg("createSession: error issuing session token")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(SessionTokenDto{Token: token, ExpiresAt: expiresAt})
+	}
+}
+
+func AuthRoutes(i *do.Injector) chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.ConfigureSignedAuth(i))
+	r.Post("/session", createSession(i))
+	return r
+}
@@ -0,0 +1,51 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
+)
+
+func TestCreateSession(t *testing.T) {
+	// Arrange
+	req, err := http.NewRequest("POST", "/session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := testutils.GenerateUser()
+	machine := testutils.GenerateMachine()
+	machine.UserID = user.ID
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, machine)
+
+	injector := do.New()
+	sessionManager, err := testutils.ProvideSessionManager(injector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/session", createSession(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var session SessionTokenDto
+	if err := json.NewDecoder(rr.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, session.ExpiresAt.IsZero())
+	claims, err := sessionManager.Verify(session.Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, user.ID, claims.UserID)
+		assert.Equal(t, machine.ID, claims.MachineID)
+	}
+}
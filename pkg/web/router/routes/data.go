@@ -5,8 +5,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"strconv"
 
 	"github.com/go-chi/chi"
 	"github.com/google/uuid"
@@ -18,10 +21,49 @@ import (
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
 )
 
+// StaleKeyCountHeader is set on data downloads to the number of key files
+// still encrypted under a master key that has since been rotated away.
+const StaleKeyCountHeader = "X-Stale-Key-Count"
+
+// KeyDto extends dto.KeyDto with the master key epoch the data was encrypted
+// under.
+type KeyDto struct {
+	dto.KeyDto
+	KeyEpoch int64 `json:"key_epoch"`
+}
+
+// DataDto extends dto.DataDto with the user's current master key epoch. Its
+// Keys field takes the place of the embedded one when encoded.
+type DataDto struct {
+	dto.DataDto
+	Keys           []KeyDto `json:"keys"`
+	MasterKeyEpoch int64    `json:"master_key_epoch"`
+	// StaleKeys are the files still encrypted under a retired master key. When
+	// BLOCK_STALE_KEY_DOWNLOADS is set their data is left out of Keys.
+	StaleKeys []string `json:"stale_keys"`
+}
+
+func blockStaleKeyDownloads() bool {
+	return os.Getenv("BLOCK_STALE_KEY_DOWNLOADS") == "1"
+}
+
+// staleKeyFilenames returns the files encrypted under an epoch older than the
+// current one.
+func staleKeyFilenames(keys []models.SshKey, epoch int64) []string {
+	stale := []string{}
+	for _, key := range keys {
+		if key.KeyEpoch < epoch {
+			stale = append(stale, key.Filename)
+		}
+	}
+	return stale
+}
+
 func getData(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
@@ -32,6 +74,12 @@ func getData(i *do.Injector) http.HandlerFunc {
 		}
 		log.Debug().Str("username", user.Username).Msg("getData: request received")
 		userRepo := do.MustInvoke[repository.UserRepository](i)
+		current, err := userRepo.GetUser(user.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		setRotationRequiredHeader(w, current)
 		keys, err := userRepo.GetUserKeys(user.ID)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -52,18 +100,29 @@ func getData(i *do.Injector) http.HandlerFunc {
 			return
 		}
 		user.KnownHosts = knownHosts
-		dto := dto.DataDto{
-			ID:       user.ID,
-			Username: user.Username,
-			Keys: lo.Map(user.Keys, func(key models.SshKey, index int) dto.KeyDto {
-				return dto.KeyDto{
+		staleKeys := staleKeyFilenames(user.Keys, current.MasterKeyEpoch)
+		w.Header().Set(StaleKeyCountHeader, strconv.Itoa(len(staleKeys)))
+		blockStale := blockStaleKeyDownloads()
+		keyDtos := []KeyDto{}
+		for _, key := range user.Keys {
+			if blockStale && key.KeyEpoch < current.MasterKeyEpoch {
+				continue
+			}
+			keyDtos = append(keyDtos, KeyDto{
+				KeyDto: dto.KeyDto{
 					ID:        key.ID,
 					UserID:    key.UserID,
 					Filename:  key.Filename,
 					Data:      key.Data,
 					UpdatedAt: key.UpdatedAt,
-				}
-			}),
+				},
+				KeyEpoch: key.KeyEpoch,
+			})
+		}
+		log.Debug().Int("stale_keys_count", len(staleKeys)).Bool("blocked", blockStale).Msg("getData: checked key epochs")
+		data := dto.DataDto{
+			ID:       user.ID,
+			Username: user.Username,
 			SshConfig: lo.Map(user.Config, func(conf models.SshConfig, index int) dto.SshConfigDto {
 				return dto.SshConfigDto{
 					Host:          conf.Host,
@@ -81,7 +140,12 @@ func getData(i *do.Injector) http.HandlerFunc {
 			}),
 		}
 		log.Debug().Msg("getData: responding with user data")
-		json.NewEncoder(w).Encode(dto)
+		json.NewEncoder(w).Encode(DataDto{
+			DataDto:        data,
+			Keys:           keyDtos,
+			MasterKeyEpoch: current.MasterKeyEpoch,
+			StaleKeys:      staleKeys,
+		})
 	}
 }
 
@@ -111,36 +175,27 @@ func addData(i *do.Injector) http.HandlerFunc {
 		}
 		log.Debug().Str("username", user.Username).Msg("addData: request received")
 		userRepo := do.MustInvoke[repository.UserRepository](i)
-		err := r.ParseMultipartForm(32 << 20)
+		current, err := userRepo.GetUser(user.ID)
 		if err != nil {
-			log.Err(err).Msg("could not parse multipart form")
-			w.WriteHeader(http.StatusBadRequest)
+			log.Err(err).Msg("addData: error fetching user")
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		log.Debug().Msg("addData: parsed multipart form")
-		m := r.MultipartForm
-		sshConfigDataRaw := r.FormValue("ssh_config")
-		if sshConfigDataRaw == "" {
-			log.Debug().Msg("ssh config is empty")
-			w.WriteHeader(http.StatusBadRequest)
+		if current.RotationRequiredAt != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: rotationRequiredMessage(current)})
 			return
 		}
-		var sshConfig []dto.SshConfigDto
-		if err := json.NewDecoder(bytes.NewBufferString(sshConfigDataRaw)).Decode(&sshConfig); err != nil {
-			log.Debug().Err(err).Msg("could not decode ssh config")
+		err = r.ParseMultipartForm(32 << 20)
+		if err != nil {
+			log.Err(err).Msg("could not parse multipart form")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		log.Debug().Int("ssh_config_count", len(sshConfig)).Msg("addData: decoded ssh config")
-		sshConfigData := lo.Map(sshConfig, func(conf dto.SshConfigDto, i int) models.SshConfig {
-			return models.SshConfig{
-				UserID:        user.ID,
-				Host:          conf.Host,
-				Values:        conf.Values,
-				IdentityFiles: conf.IdentityFiles,
-			}
-		})
-		user.Config = sshConfigData
+		log.Debug().Msg("addData: parsed multipart form")
+		if !parseUploadedData(w, r, user, current.MasterKeyEpoch) {
+			return
+		}
 		txQueryService := do.MustInvoke[query.TransactionService](i)
 		tx, err := txQueryService.StartTx(pgx.TxOptions{})
 		if err != nil {
@@ -149,67 +204,17 @@ func addData(i *do.Injector) http.HandlerFunc {
 			return
 		}
 		log.Debug().Msg("addData: transaction started")
-		defer query.RollbackFunc(txQueryService, tx, w, &err)
-		if err = userRepo.AddAndUpdateConfigTx(user, tx); err != nil {
-			log.Err(err).Msg("could not add config")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		log.Debug().Int("ssh_config_count", len(user.Config)).Msg("addData: stored ssh config")
-		knownHostsRaw := r.FormValue("known_hosts")
-		if knownHostsRaw != "" {
-			var knownHostDtos []dto.KnownHostDto
-			if err = json.NewDecoder(bytes.NewBufferString(knownHostsRaw)).Decode(&knownHostDtos); err != nil {
-				log.Debug().Err(err).Msg("could not decode known_hosts")
-				w.WriteHeader(http.StatusBadRequest)
-				return
+		// Deferred before the commit so that it runs after it.
+		defer func() {
+			if err == nil {
+				publishEvents(i, uploadEvents(user, &machine.ID)...)
 			}
-			user.KnownHosts = lo.Map(knownHostDtos, func(kh dto.KnownHostDto, _ int) models.KnownHost {
-				return models.KnownHost{
-					UserID:      user.ID,
-					HostPattern: kh.HostPattern,
-					KeyType:     kh.KeyType,
-					KeyData:     kh.KeyData,
-					Marker:      kh.Marker,
-				}
-			})
-			if err = userRepo.AddAndUpdateKnownHostsTx(user, tx); err != nil {
-				log.Err(err).Msg("could not add known_hosts")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Debug().Int("known_hosts_count", len(user.KnownHosts)).Msg("addData: stored known hosts")
-		var files []*multipart.FileHeader
-		for _, filelist := range m.File {
-			files = append(files, filelist...)
-		}
-		for i := range files {
-			file, err := files[i].Open()
-			if err != nil {
-				log.Err(err).Msg("could not open file")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			defer file.Close()
-			log.Debug().Str("filename", files[i].Filename).Msg("addData: processing key file")
-			user.Keys = append(user.Keys, models.SshKey{
-				UserID:   user.ID,
-				Filename: files[i].Filename,
-				Data:     make([]byte, files[i].Size),
-			})
-			if _, err = file.Read(user.Keys[i].Data); err != nil {
-				log.Err(err).Msg("could not open file")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			log.Debug().Str("filename", files[i].Filename).Msg("addData: read key file")
-		}
-		if err = userRepo.AddAndUpdateKeysTx(user, tx); err != nil {
+		}()
+		defer query.RollbackFunc(txQueryService, tx, w, &err)
+		if err = storeUploadedData(userRepo, user, tx); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		log.Debug().Int("keys_count", len(user.Keys)).Msg("addData: stored keys")
 		responseKeys := lo.Map(user.Keys, func(key models.SshKey, _ int) dto.KeyDto {
 			return dto.KeyDto{
 				Filename:  key.Filename,
@@ -220,6 +225,113 @@ func addData(i *do.Injector) http.HandlerFunc {
 	}
 }
 
+// parseUploadedData reads the SSH config, known hosts and key files of a data
+// upload from the parsed multipart form into user, tagging the keys with the
+// master key epoch they are encrypted under. An optional key_epoch field lets
+// the client state that epoch, which must then match. It writes the error
+// response itself when it returns false.
+func parseUploadedData(w http.ResponseWriter, r *http.Request, user *models.User, epoch int64) bool {
+	if keyEpochRaw := r.FormValue("key_epoch"); keyEpochRaw != "" {
+		keyEpoch, err := strconv.ParseInt(keyEpochRaw, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		if keyEpoch != epoch {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: fmt.Sprintf("the data is encrypted under master key epoch %d, but the current epoch is %d", keyEpoch, epoch)})
+			return false
+		}
+	}
+	sshConfigDataRaw := r.FormValue("ssh_config")
+	if sshConfigDataRaw == "" {
+		log.Debug().Msg("ssh config is empty")
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	var sshConfig []dto.SshConfigDto
+	if err := json.NewDecoder(bytes.NewBufferString(sshConfigDataRaw)).Decode(&sshConfig); err != nil {
+		log.Debug().Err(err).Msg("could not decode ssh config")
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	log.Debug().Int("ssh_config_count", len(sshConfig)).Msg("parseUploadedData: decoded ssh config")
+	user.Config = lo.Map(sshConfig, func(conf dto.SshConfigDto, i int) models.SshConfig {
+		return models.SshConfig{
+			UserID:        user.ID,
+			Host:          conf.Host,
+			Values:        conf.Values,
+			IdentityFiles: conf.IdentityFiles,
+		}
+	})
+	if knownHostsRaw := r.FormValue("known_hosts"); knownHostsRaw != "" {
+		var knownHostDtos []dto.KnownHostDto
+		if err := json.NewDecoder(bytes.NewBufferString(knownHostsRaw)).Decode(&knownHostDtos); err != nil {
+			log.Debug().Err(err).Msg("could not decode known_hosts")
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		user.KnownHosts = lo.Map(knownHostDtos, func(kh dto.KnownHostDto, _ int) models.KnownHost {
+			return models.KnownHost{
+				UserID:      user.ID,
+				HostPattern: kh.HostPattern,
+				KeyType:     kh.KeyType,
+				KeyData:     kh.KeyData,
+				Marker:      kh.Marker,
+			}
+		})
+	}
+	var files []*multipart.FileHeader
+	for _, filelist := range r.MultipartForm.File {
+		files = append(files, filelist...)
+	}
+	for i := range files {
+		file, err := files[i].Open()
+		if err != nil {
+			log.Err(err).Msg("could not open file")
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		defer file.Close()
+		log.Debug().Str("filename", files[i].Filename).Msg("parseUploadedData: processing key file")
+		user.Keys = append(user.Keys, models.SshKey{
+			UserID:   user.ID,
+			Filename: files[i].Filename,
+			Data:     make([]byte, files[i].Size),
+			KeyEpoch: epoch,
+		})
+		if _, err = file.Read(user.Keys[i].Data); err != nil {
+			log.Err(err).Msg("could not open file")
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+// storeUploadedData writes the data read by parseUploadedData. Known hosts are
+// only replaced when the upload included them.
+func storeUploadedData(userRepo repository.UserRepository, user *models.User, tx pgx.Tx) error {
+	if err := userRepo.AddAndUpdateConfigTx(user, tx); err != nil {
+		log.Err(err).Msg("could not add config")
+		return err
+	}
+	log.Debug().Int("ssh_config_count", len(user.Config)).Msg("storeUploadedData: stored ssh config")
+	if user.KnownHosts != nil {
+		if err := userRepo.AddAndUpdateKnownHostsTx(user, tx); err != nil {
+			log.Err(err).Msg("could not add known_hosts")
+			return err
+		}
+		log.Debug().Int("known_hosts_count", len(user.KnownHosts)).Msg("storeUploadedData: stored known hosts")
+	}
+	if err := userRepo.AddAndUpdateKeysTx(user, tx); err != nil {
+		log.Err(err).Msg("could not add keys")
+		return err
+	}
+	log.Debug().Int("keys_count", len(user.Keys)).Msg("storeUploadedData: stored keys")
+	return nil
+}
+
 func deleteData(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
@@ -253,6 +365,13 @@ func deleteData(i *do.Injector) http.HandlerFunc {
 			return
 		}
 		log.Debug().Msg("deleteData: transaction started")
+		defer func() {
+			if err == nil {
+				event := live.NewEvent(live.EventKeyDeleted, user.ID, requestMachineID(r))
+				event.Name = key.Filename
+				publishEvents(i, event)
+			}
+		}()
 		defer query.RollbackFunc(txQueryService, tx, w, &err)
 		if err = userRepo.DeleteUserKeyTx(user, key.ID, tx); err != nil {
 			log.Err(err).Msg("could not delete key")
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi"
 	"go.uber.org/mock/gomock"
@@ -21,6 +22,7 @@ import (
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
 	"github.com/therealpaulgg/ssh-sync-server/test/pgx"
 )
@@ -43,6 +45,7 @@ func TestAddData_PendingRotation(t *testing.T) {
 	req = testutils.AddMachineContext(req, machine)
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -71,6 +74,52 @@ func TestAddData_PendingRotation(t *testing.T) {
 	assert.Equal(t, http.StatusConflict, rr.Code)
 }
 
+func TestAddData_RotationRequired(t *testing.T) {
+	// Arrange
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.Close()
+
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	user := testutils.GenerateUser()
+	machine := testutils.GenerateMachine()
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, machine)
+	requiredAt := time.Now()
+	reason := `machine "stolen" was reported compromised`
+	storedUser := &models.User{ID: user.ID, Username: user.Username, RotationRequiredAt: &requiredAt, RotationRequiredReason: &reason}
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(storedUser, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(machine.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(addData(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "stolen")
+}
+
 func TestGetData(t *testing.T) {
 	// Arrange
 	req, err := http.NewRequest("GET", "/", nil)
@@ -92,6 +141,7 @@ func TestGetData(t *testing.T) {
 		Data:     bytes,
 	}}
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
 	mockUserRepo.EXPECT().GetUserKeys(user.ID).Return(data, nil)
 	mockUserRepo.EXPECT().GetUserConfig(user.ID).Return(nil, nil)
 	mockUserRepo.EXPECT().GetUserKnownHosts(user.ID).Return(nil, nil)
@@ -124,6 +174,56 @@ func TestGetData(t *testing.T) {
 	assert.Equal(t, 0, len(dataDto.SshConfig))
 }
 
+func TestGetData_StaleKeys(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		t.Run(fmt.Sprintf("block=%v", block), func(t *testing.T) {
+			// Arrange
+			if block {
+				t.Setenv("BLOCK_STALE_KEY_DOWNLOADS", "1")
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			user := testutils.GenerateUser()
+			user.MasterKeyEpoch = 2
+			req = testutils.AddUserContext(req, user)
+
+			injector := do.New()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockUserRepo := repository.NewMockUserRepository(ctrl)
+			mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+			mockUserRepo.EXPECT().GetUserKeys(user.ID).Return([]models.SshKey{
+				{ID: uuid.New(), UserID: user.ID, Filename: "id_ed25519", Data: []byte("new"), KeyEpoch: 2},
+				{ID: uuid.New(), UserID: user.ID, Filename: "id_rsa", Data: []byte("old"), KeyEpoch: 1},
+			}, nil)
+			mockUserRepo.EXPECT().GetUserConfig(user.ID).Return(nil, nil)
+			mockUserRepo.EXPECT().GetUserKnownHosts(user.ID).Return(nil, nil)
+			do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+				return mockUserRepo, nil
+			})
+
+			// Act
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(getData(injector))
+			handler.ServeHTTP(rr, req)
+
+			// Assert
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "1", rr.Header().Get(StaleKeyCountHeader))
+			var dataDto DataDto
+			assert.NoError(t, json.NewDecoder(rr.Body).Decode(&dataDto))
+			assert.Equal(t, int64(2), dataDto.MasterKeyEpoch)
+			assert.Equal(t, []string{"id_rsa"}, dataDto.StaleKeys)
+			if block {
+				assert.Len(t, dataDto.Keys, 1)
+			} else {
+				assert.Len(t, dataDto.Keys, 2)
+				assert.Equal(t, int64(1), dataDto.Keys[1].KeyEpoch)
+			}
+			assert.Equal(t, int64(2), dataDto.Keys[0].KeyEpoch)
+		})
+	}
+}
+
 func TestGetDataError(t *testing.T) {
 	// Arrange
 	req, err := http.NewRequest("GET", "/", nil)
@@ -137,6 +237,7 @@ func TestGetDataError(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
 	mockUserRepo.EXPECT().GetUserKeys(user.ID).Return(nil, errors.New("You are bad"))
 	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
 		return mockUserRepo, nil
@@ -187,10 +288,15 @@ func TestAddData(t *testing.T) {
 	req = testutils.AddMachineContext(req, machine)
 
 	injector := do.New()
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	txMock := pgx.NewMockTx(ctrl)
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
 	mockUserRepo.EXPECT().AddAndUpdateConfigTx(gomock.Any(), txMock).Return(nil)
 	mockUserRepo.EXPECT().AddAndUpdateKeysTx(gomock.Any(), txMock).Return(nil)
 	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
@@ -219,6 +325,182 @@ func TestAddData(t *testing.T) {
 		t.Errorf("addData returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
+	configEvent := <-subscription.Events
+	assert.Equal(t, live.EventConfigUpdated, configEvent.Type)
+	assert.Equal(t, &machine.ID, configEvent.SourceMachineID)
+	keyEvent := <-subscription.Events
+	assert.Equal(t, live.EventKeyUpdated, keyEvent.Type)
+	assert.Equal(t, "test", keyEvent.Name)
+	assert.Empty(t, subscription.Events)
+}
+
+func TestAddData_CommitFailed(t *testing.T) {
+	// Arrange
+	// request needs to have multipart form data (generate fake bytes and add to request)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	// file
+	fakeFileBytes := make([]byte, 1024) // Adjust the size as needed
+	_, _ = rand.Read(fakeFileBytes)
+	part, err := writer.CreateFormFile("file", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write(fakeFileBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = writer.WriteField("ssh_config", `[{"host":"test"}]`)
+	writer.Close()
+
+	req, err := http.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := testutils.GenerateUser()
+	machine := testutils.GenerateMachine()
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, machine)
+
+	injector := do.New()
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	txMock := pgx.NewMockTx(ctrl)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	mockUserRepo.EXPECT().AddAndUpdateConfigTx(gomock.Any(), txMock).Return(nil)
+	mockUserRepo.EXPECT().AddAndUpdateKeysTx(gomock.Any(), txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockTransactionService := query.NewMockTransactionService(ctrl)
+	mockTransactionService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTransactionService.EXPECT().Commit(txMock).Return(errors.New("connection lost"))
+	mockTransactionService.EXPECT().Rollback(txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTransactionService, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(machine.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(addData(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Empty(t, subscription.Events, "nothing is published unless the upload committed")
+}
+
+func TestAddData_TagsKeyEpoch(t *testing.T) {
+	// Arrange
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "id_ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write([]byte("encrypted")); err != nil {
+		t.Fatal(err)
+	}
+	_ = writer.WriteField("ssh_config", `[{"host":"test"}]`)
+	_ = writer.WriteField("key_epoch", "3")
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	user := testutils.GenerateUser()
+	user.MasterKeyEpoch = 3
+	machine := testutils.GenerateMachine()
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, machine)
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	txMock := pgx.NewMockTx(ctrl)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	mockUserRepo.EXPECT().AddAndUpdateConfigTx(gomock.Any(), txMock).Return(nil)
+	mockUserRepo.EXPECT().AddAndUpdateKeysTx(gomock.Any(), txMock).DoAndReturn(func(u *models.User, _ any) error {
+		assert.Len(t, u.Keys, 1)
+		assert.Equal(t, int64(3), u.Keys[0].KeyEpoch)
+		return nil
+	})
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockTransactionService := query.NewMockTransactionService(ctrl)
+	mockTransactionService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTransactionService.EXPECT().Commit(txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTransactionService, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(machine.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(addData(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestAddData_RetiredKeyEpoch(t *testing.T) {
+	// Arrange
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("ssh_config", `[{"host":"test"}]`)
+	_ = writer.WriteField("key_epoch", "1")
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	user := testutils.GenerateUser()
+	user.MasterKeyEpoch = 2
+	machine := testutils.GenerateMachine()
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, machine)
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(machine.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(addData(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "current epoch is 2")
 }
 
 func TestAddDataBadRequest(t *testing.T) {
@@ -235,9 +517,11 @@ func TestAddDataBadRequest(t *testing.T) {
 	req = testutils.AddUserContext(req, user)
 	req = testutils.AddMachineContext(req, machine)
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
 	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
 		return mockUserRepo, nil
 	})
@@ -291,9 +575,11 @@ func TestAddDataError(t *testing.T) {
 	req = testutils.AddMachineContext(req, machine)
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
 	txMock := pgx.NewMockTx(ctrl)
 	mockUserRepo.EXPECT().AddAndUpdateConfigTx(gomock.Any(), txMock).Return(nil)
 	mockUserRepo.EXPECT().AddAndUpdateKeysTx(gomock.Any(), txMock).Return(errors.New("error"))
@@ -337,6 +623,7 @@ func TestDeleteKey(t *testing.T) {
 	}
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
@@ -376,6 +663,7 @@ func TestDeleteKeyError(t *testing.T) {
 	}
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
@@ -412,6 +700,7 @@ func TestDeleteKeyBadID(t *testing.T) {
 	req = testutils.AddUserContext(req, user)
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockUserRepo := repository.NewMockUserRepository(ctrl)
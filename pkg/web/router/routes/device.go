@@ -0,0 +1,404 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
+)
+
+// The device authorization flow adds a machine without the live challenge,
+// after RFC 8628: the new machine posts its keys and shows the returned user
+// code, an existing machine of the user approves the request by its user code
+// with the master key encrypted for the new machine, and the new machine polls
+// with its device code until the machine is created and the key handed over.
+
+const (
+	deviceAuthorizationTTL          = 10 * time.Minute
+	deviceAuthorizationPollInterval = 5 * time.Second
+)
+
+// Device access token errors, as defined by RFC 8628 section 3.5.
+const (
+	deviceErrorAuthorizationPending = "authorization_pending"
+	deviceErrorSlowDown             = "slow_down"
+	deviceErrorExpiredToken         = "expired_token"
+	deviceErrorAccessDenied         = "access_denied"
+	deviceErrorInvalidGrant         = "invalid_grant"
+)
+
+type DeviceAuthorizationDto struct {
+	DeviceCode string `json:"device_code"`
+	UserCode   string `json:"user_code"`
+	ExpiresIn  int    `json:"expires_in"`
+	Interval   int    `json:"interval"`
+}
+
+type DeviceTokenRequest struct {
+	DeviceCode string `json:"device_code"`
+}
+
+type DeviceTokenErrorDto struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// PendingDeviceAuthorizationDto is a request waiting for approval, with the
+// keys the approving machine encrypts the master key for.
+type PendingDeviceAuthorizationDto struct {
+	ID               uuid.UUID `json:"id"`
+	MachineName      string    `json:"machine_name"`
+	PublicKey        []byte    `json:"public_key"`
+	EncapsulationKey []byte    `json:"encapsulation_key,omitempty"`
+	Algorithm        string    `json:"algorithm"`
+	KeyFingerprint   string    `json:"key_fingerprint"`
+	CreatedAt        time.Time `json:"created_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+type DeviceApprovalRequest struct {
+	UserCode           string `json:"user_code"`
+	EncryptedMasterKey []byte `json:"encrypted_master_key"`
+}
+
+func writeDeviceTokenError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(DeviceTokenErrorDto{Error: code, ErrorDescription: description})
+}
+
+// startDeviceAuthorization takes the same form as initialSetup, for a user that
+// already exists.
+func startDeviceAuthorization(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug().Msg("startDeviceAuthorization: request received")
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		username := r.FormValue("username")
+		machineName := r.FormValue("machine_name")
+		if username == "" || machineName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("key")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		publicKey, err := io.ReadAll(file)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var encapsulationKey []byte
+		if ekFile, _, err := r.FormFile("encapsulation_key"); err == nil {
+			defer ekFile.Close()
+			encapsulationKey, err = io.ReadAll(ekFile)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		user, err := userRepo.GetUserByUsername(username)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && user == nil) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Err(err).Msg("startDeviceAuthorization: error getting user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		if machine, err := machineRepo.GetMachineByNameAndUser(machineName, user.ID); err == nil && machine.ID != uuid.Nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Err(err).Msg("startDeviceAuthorization: error getting machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		keyType, err := crypto.ValidatePublicKey(publicKey)
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid public key")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		policy, err := crypto.PolicyForUser(user)
+		if err != nil {
+			log.Err(err).Msg("error loading algorithm policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := policy.CheckKeyType(keyType, time.Now()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+			return
+		}
+		if len(encapsulationKey) > 0 {
+			if _, err := crypto.ValidateEncapsulationKey(encapsulationKey); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+				return
+			}
+		}
+
+		deviceCode, err := crypto.NewDeviceCode()
+		if err != nil {
+			log.Err(err).Msg("startDeviceAuthorization: error generating device code")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		userCode, err := crypto.NewUserCode()
+		if err != nil {
+			log.Err(err).Msg("startDeviceAuthorization: error generating user code")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		authRepo := do.MustInvoke[repository.DeviceAuthorizationRepository](i)
+		_, err = authRepo.CreateDeviceAuthorization(&models.DeviceAuthorization{
+			UserID:           user.ID,
+			MachineName:      machineName,
+			PublicKey:        publicKey,
+			EncapsulationKey: encapsulationKey,
+			DeviceCodeHash:   crypto.HashDeviceCode(deviceCode),
+			UserCode:         userCode,
+			ExpiresAt:        time.Now().Add(deviceAuthorizationTTL),
+		})
+		if err != nil {
+			log.Err(err).Msg("startDeviceAuthorization: error creating device authorization")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", username).Str("machine_name", machineName).Msg("startDeviceAuthorization: device authorization created")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(DeviceAuthorizationDto{
+			DeviceCode: deviceCode,
+			UserCode:   userCode,
+			ExpiresIn:  int(deviceAuthorizationTTL.Seconds()),
+			Interval:   int(deviceAuthorizationPollInterval.Seconds()),
+		})
+	}
+}
+
+// pollDeviceAuthorization is polled by the new machine with its device code.
+// Once the request is approved it creates the machine and returns the
+// encrypted master key, after which the device code is used up.
+func pollDeviceAuthorization(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DeviceTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DeviceCode == "" {
+			writeDeviceTokenError(w, deviceErrorInvalidGrant, "")
+			return
+		}
+		authRepo := do.MustInvoke[repository.DeviceAuthorizationRepository](i)
+		auth, err := authRepo.GetDeviceAuthorizationByDeviceCode(crypto.HashDeviceCode(req.DeviceCode))
+		if errors.Is(err, sql.ErrNoRows) {
+			writeDeviceTokenError(w, deviceErrorInvalidGrant, "unknown device code")
+			return
+		} else if err != nil {
+			log.Err(err).Msg("pollDeviceAuthorization: error getting device authorization")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		if !auth.IsApproved() && auth.IsExpired(now) {
+			if err := authRepo.DeleteDeviceAuthorization(auth.ID); err != nil {
+				log.Err(err).Msg("pollDeviceAuthorization: error deleting expired device authorization")
+			}
+			writeDeviceTokenError(w, deviceErrorExpiredToken, "")
+			return
+		}
+		if err := authRepo.RecordDeviceAuthorizationPoll(auth.ID); err != nil {
+			log.Err(err).Msg("pollDeviceAuthorization: error recording poll")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if auth.LastPolledAt != nil && now.Sub(*auth.LastPolledAt) < deviceAuthorizationPollInterval {
+			writeDeviceTokenError(w, deviceErrorSlowDown, "")
+			return
+		}
+		if !auth.IsApproved() {
+			writeDeviceTokenError(w, deviceErrorAuthorizationPending, "")
+			return
+		}
+
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		user, err := userRepo.GetUser(auth.UserID)
+		if err != nil {
+			log.Err(err).Msg("pollDeviceAuthorization: error getting user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		txQueryService := do.MustInvoke[query.TransactionService](i)
+		tx, err := txQueryService.StartTx(pgx.TxOptions{})
+		if err != nil {
+			log.Err(err).Msg("pollDeviceAuthorization: error starting transaction")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var machine *models.Machine
+		// Deferred before the commit so that it runs after it.
+		defer func() {
+			if err == nil && machine != nil {
+				publishEvents(i, live.NewMachineEvent(live.EventMachineAdded, machine, auth.ApprovedBy))
+			}
+		}()
+		defer query.RollbackFunc(txQueryService, tx, w, &err)
+		// Consuming the request first makes a concurrent poll with the same
+		// device code fail instead of creating the machine twice.
+		if err = authRepo.ConsumeDeviceAuthorizationTx(tx, auth.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeDeviceTokenError(w, deviceErrorInvalidGrant, "unknown device code")
+				return
+			}
+			log.Err(err).Msg("pollDeviceAuthorization: error consuming device authorization")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		machine, err = machineRepo.CreateMachineTx(&models.Machine{
+			UserID:           auth.UserID,
+			Name:             auth.MachineName,
+			PublicKey:        auth.PublicKey,
+			EncapsulationKey: auth.EncapsulationKey,
+		}, tx)
+		if err != nil {
+			if errors.Is(err, repository.ErrMachineAlreadyExists) {
+				writeDeviceTokenError(w, deviceErrorAccessDenied, "a machine with this name was added in the meantime")
+				return
+			}
+			log.Err(err).Msg("pollDeviceAuthorization: error creating machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("machine_name", auth.MachineName).Msg("pollDeviceAuthorization: machine created")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(EncryptedMasterKeyDto{
+			EncryptedMasterKeyDto: dto.EncryptedMasterKeyDto{EncryptedMasterKey: auth.EncryptedMasterKey},
+			Epoch:                 user.MasterKeyEpoch,
+		})
+	}
+}
+
+func getDeviceAuthorizations(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		authRepo := do.MustInvoke[repository.DeviceAuthorizationRepository](i)
+		auths, err := authRepo.GetPendingDeviceAuthorizations(user.ID)
+		if err != nil {
+			log.Err(err).Msg("getDeviceAuthorizations: error getting device authorizations")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		pending := make([]PendingDeviceAuthorizationDto, 0, len(auths))
+		for _, auth := range auths {
+			pending = append(pending, PendingDeviceAuthorizationDto{
+				ID:               auth.ID,
+				MachineName:      auth.MachineName,
+				PublicKey:        auth.PublicKey,
+				EncapsulationKey: auth.EncapsulationKey,
+				Algorithm:        crypto.DetectKeyType(auth.PublicKey).String(),
+				KeyFingerprint:   crypto.PublicKeyFingerprint(auth.PublicKey),
+				CreatedAt:        auth.CreatedAt,
+				ExpiresAt:        auth.ExpiresAt,
+			})
+		}
+		json.NewEncoder(w).Encode(pending)
+	}
+}
+
+// approveDeviceAuthorization hands the master key, encrypted for the new
+// machine, to the request. The user code shown on the new machine has to be
+// entered so that the user approves the machine in front of them. Users whose
+// policy requires several machines to approve new ones must use the live
+// challenge, which collects their approvals.
+func approveDeviceAuthorization(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// The quorum is read from the database, not from whatever user record
+		// the authentication left in the context.
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		current, err := userRepo.GetUser(user.ID)
+		if err != nil {
+			log.Err(err).Msg("approveDeviceAuthorization: error fetching user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if quorum := current.ApprovalQuorum(); quorum > 1 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: fmt.Sprintf("this account requires %d machines to approve new machines, add the machine with the live challenge instead", quorum)})
+			return
+		}
+		approver, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		id, err := uuid.Parse(chi.URLParam(r, "requestId"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req DeviceApprovalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.EncryptedMasterKey) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		authRepo := do.MustInvoke[repository.DeviceAuthorizationRepository](i)
+		auth, err := authRepo.GetDeviceAuthorization(id)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && (auth.UserID != user.ID || auth.IsApproved() || auth.IsExpired(time.Now()))) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Err(err).Msg("approveDeviceAuthorization: error getting device authorization")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !crypto.UserCodesMatch(auth.UserCode, req.UserCode) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "the user code does not match the one shown on the new machine"})
+			return
+		}
+		if err := authRepo.ApproveDeviceAuthorization(auth.ID, req.EncryptedMasterKey, approver.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			log.Err(err).Msg("approveDeviceAuthorization: error approving device authorization")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("machine_name", auth.MachineName).Str("approved_by", approver.Name).Msg("approveDeviceAuthorization: device authorization approved")
+	}
+}
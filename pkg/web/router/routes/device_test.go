@@ -0,0 +1,336 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
+	"github.com/therealpaulgg/ssh-sync-server/test/pgx"
+	"go.uber.org/mock/gomock"
+)
+
+func newDeviceAuthorizationRequest(t *testing.T, username, machineName string) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("username", username))
+	require.NoError(t, writer.WriteField("machine_name", machineName))
+	priv, pub, err := testutils.GenerateTestKeys()
+	require.NoError(t, err)
+	pubBytes, _, err := testutils.EncodeToPem(priv, pub)
+	require.NoError(t, err)
+	part, err := writer.CreateFormFile("key", "key")
+	require.NoError(t, err)
+	_, err = part.Write(pubBytes)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func newDeviceTokenRequest(t *testing.T, deviceCode string) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	require.NoError(t, json.NewEncoder(body).Encode(DeviceTokenRequest{DeviceCode: deviceCode}))
+	return httptest.NewRequest("POST", "/token", body)
+}
+
+func TestStartDeviceAuthorization(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	req := newDeviceAuthorizationRequest(t, user.Username, "laptop")
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser("laptop", user.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	var stored *models.DeviceAuthorization
+	mockAuthRepo := repository.NewMockDeviceAuthorizationRepository(ctrl)
+	mockAuthRepo.EXPECT().CreateDeviceAuthorization(gomock.Any()).DoAndReturn(func(auth *models.DeviceAuthorization) (*models.DeviceAuthorization, error) {
+		stored = auth
+		return auth, nil
+	})
+	do.Provide(injector, func(i *do.Injector) (repository.DeviceAuthorizationRepository, error) {
+		return mockAuthRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	startDeviceAuthorization(injector).ServeHTTP(rr, req)
+
+	// Assert
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp DeviceAuthorizationDto
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, stored.UserCode, resp.UserCode)
+	assert.Equal(t, crypto.HashDeviceCode(resp.DeviceCode), stored.DeviceCodeHash)
+	assert.Equal(t, user.ID, stored.UserID)
+	assert.Equal(t, "laptop", stored.MachineName)
+	assert.Equal(t, int(deviceAuthorizationTTL.Seconds()), resp.ExpiresIn)
+}
+
+func TestStartDeviceAuthorization_MachineExists(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	req := newDeviceAuthorizationRequest(t, user.Username, "laptop")
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUserByUsername(user.Username).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachineByNameAndUser("laptop", user.ID).Return(&models.Machine{ID: uuid.New(), Name: "laptop"}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	startDeviceAuthorization(injector).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestPollDeviceAuthorization(t *testing.T) {
+	deviceCode := "device-code"
+	polledAt := time.Now().Add(-time.Minute)
+	approvedAt := time.Now()
+	tests := []struct {
+		name  string
+		auth  models.DeviceAuthorization
+		error string
+	}{
+		{"pending", models.DeviceAuthorization{ExpiresAt: time.Now().Add(time.Minute), LastPolledAt: &polledAt}, deviceErrorAuthorizationPending},
+		{"polled too fast", models.DeviceAuthorization{ExpiresAt: time.Now().Add(time.Minute), LastPolledAt: &approvedAt}, deviceErrorSlowDown},
+		{"expired", models.DeviceAuthorization{ExpiresAt: time.Now().Add(-time.Second)}, deviceErrorExpiredToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			auth := tt.auth
+			auth.ID = uuid.New()
+			injector := do.New()
+			do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+			ctrl := gomock.NewController(t)
+			mockAuthRepo := repository.NewMockDeviceAuthorizationRepository(ctrl)
+			mockAuthRepo.EXPECT().GetDeviceAuthorizationByDeviceCode(crypto.HashDeviceCode(deviceCode)).Return(&auth, nil)
+			mockAuthRepo.EXPECT().RecordDeviceAuthorizationPoll(auth.ID).Return(nil).AnyTimes()
+			mockAuthRepo.EXPECT().DeleteDeviceAuthorization(auth.ID).Return(nil).AnyTimes()
+			do.Provide(injector, func(i *do.Injector) (repository.DeviceAuthorizationRepository, error) {
+				return mockAuthRepo, nil
+			})
+
+			// Act
+			rr := httptest.NewRecorder()
+			pollDeviceAuthorization(injector).ServeHTTP(rr, newDeviceTokenRequest(t, deviceCode))
+
+			// Assert
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+			var resp DeviceTokenErrorDto
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+			assert.Equal(t, tt.error, resp.Error)
+		})
+	}
+}
+
+func TestPollDeviceAuthorization_Approved(t *testing.T) {
+	// Arrange
+	deviceCode := "device-code"
+	user := testutils.GenerateUser()
+	user.MasterKeyEpoch = 3
+	approvedAt := time.Now().Add(-time.Minute)
+	auth := &models.DeviceAuthorization{
+		ID:                 uuid.New(),
+		UserID:             user.ID,
+		MachineName:        "laptop",
+		PublicKey:          []byte("public key"),
+		ExpiresAt:          time.Now().Add(time.Minute),
+		EncryptedMasterKey: []byte("master key"),
+		ApprovedAt:         &approvedAt,
+	}
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	mockAuthRepo := repository.NewMockDeviceAuthorizationRepository(ctrl)
+	mockAuthRepo.EXPECT().GetDeviceAuthorizationByDeviceCode(crypto.HashDeviceCode(deviceCode)).Return(auth, nil)
+	mockAuthRepo.EXPECT().RecordDeviceAuthorizationPoll(auth.ID).Return(nil)
+	mockTx := pgx.NewMockTx(ctrl)
+	mockAuthRepo.EXPECT().ConsumeDeviceAuthorizationTx(mockTx, auth.ID).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.DeviceAuthorizationRepository, error) {
+		return mockAuthRepo, nil
+	})
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockTransactionService := query.NewMockTransactionService(ctrl)
+	mockTransactionService.EXPECT().StartTx(gomock.Any()).Return(mockTx, nil)
+	mockTransactionService.EXPECT().Commit(mockTx).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTransactionService, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().CreateMachineTx(gomock.Any(), mockTx).DoAndReturn(func(machine *models.Machine, tx any) (*models.Machine, error) {
+		assert.Equal(t, "laptop", machine.Name)
+		assert.Equal(t, auth.PublicKey, machine.PublicKey)
+		return machine, nil
+	})
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	pollDeviceAuthorization(injector).ServeHTTP(rr, newDeviceTokenRequest(t, deviceCode))
+
+	// Assert
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp EncryptedMasterKeyDto
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, []byte("master key"), resp.EncryptedMasterKey)
+	assert.Equal(t, int64(3), resp.Epoch)
+}
+
+func TestApproveDeviceAuthorization(t *testing.T) {
+	user := testutils.GenerateUser()
+	approver := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"}
+	tests := []struct {
+		name     string
+		auth     models.DeviceAuthorization
+		userCode string
+		status   int
+	}{
+		{"approved", models.DeviceAuthorization{UserID: user.ID, UserCode: "WDJB-MJHT", ExpiresAt: time.Now().Add(time.Minute)}, "wdjbmjht", http.StatusOK},
+		{"wrong user code", models.DeviceAuthorization{UserID: user.ID, UserCode: "WDJB-MJHT", ExpiresAt: time.Now().Add(time.Minute)}, "WDJB-MJHB", http.StatusForbidden},
+		{"other user", models.DeviceAuthorization{UserID: uuid.New(), UserCode: "WDJB-MJHT", ExpiresAt: time.Now().Add(time.Minute)}, "WDJB-MJHT", http.StatusNotFound},
+		{"expired", models.DeviceAuthorization{UserID: user.ID, UserCode: "WDJB-MJHT", ExpiresAt: time.Now().Add(-time.Second)}, "WDJB-MJHT", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			auth := tt.auth
+			auth.ID = uuid.New()
+			body := &bytes.Buffer{}
+			require.NoError(t, json.NewEncoder(body).Encode(DeviceApprovalRequest{UserCode: tt.userCode, EncryptedMasterKey: []byte("master key")}))
+			req := httptest.NewRequest("POST", fmt.Sprintf("/requests/%s/approve", auth.ID), body)
+			req = testutils.AddUserContext(req, user)
+			req = testutils.AddMachineContext(req, approver)
+			injector := do.New()
+			ctrl := gomock.NewController(t)
+			mockUserRepo := repository.NewMockUserRepository(ctrl)
+			mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+			do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+				return mockUserRepo, nil
+			})
+			mockAuthRepo := repository.NewMockDeviceAuthorizationRepository(ctrl)
+			mockAuthRepo.EXPECT().GetDeviceAuthorization(auth.ID).Return(&auth, nil)
+			if tt.status == http.StatusOK {
+				mockAuthRepo.EXPECT().ApproveDeviceAuthorization(auth.ID, []byte("master key"), approver.ID).Return(nil)
+			}
+			do.Provide(injector, func(i *do.Injector) (repository.DeviceAuthorizationRepository, error) {
+				return mockAuthRepo, nil
+			})
+
+			// Act
+			rr := httptest.NewRecorder()
+			router := chi.NewRouter()
+			router.Post("/requests/{requestId}/approve", approveDeviceAuthorization(injector))
+			router.ServeHTTP(rr, req)
+
+			// Assert
+			assert.Equal(t, tt.status, rr.Code)
+		})
+	}
+}
+
+func TestApproveDeviceAuthorization_QuorumRequired(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	quorumUser := *user
+	quorumUser.MachineApprovalQuorum = 2
+	body := &bytes.Buffer{}
+	require.NoError(t, json.NewEncoder(body).Encode(DeviceApprovalRequest{UserCode: "WDJB-MJHT", EncryptedMasterKey: []byte("master key")}))
+	req := httptest.NewRequest("POST", fmt.Sprintf("/requests/%s/approve", uuid.New()), body)
+	// The context user may be stale, the quorum has to come from the database.
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"})
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(&quorumUser, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/requests/{requestId}/approve", approveDeviceAuthorization(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestApproveDeviceAuthorization_QuorumRequiredSessionToken(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	user.MachineApprovalQuorum = 2
+	approver := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"}
+	injector := do.New()
+	do.ProvideValue(injector, middleware.NewActivityTracker(injector, time.Minute))
+	do.ProvideValue(injector, middleware.NewAuthLimiter(middleware.DefaultAuthLimiterConfig()))
+	sessionManager, err := testutils.ProvideSessionManager(injector)
+	require.NoError(t, err)
+	token, _, err := sessionManager.Issue(user, approver)
+	require.NoError(t, err)
+	ctrl := gomock.NewController(t)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	body := &bytes.Buffer{}
+	require.NoError(t, json.NewEncoder(body).Encode(DeviceApprovalRequest{UserCode: "WDJB-MJHT", EncryptedMasterKey: []byte("master key")}))
+	req := httptest.NewRequest("POST", fmt.Sprintf("/requests/%s/approve", uuid.New()), body)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.With(middleware.ConfigureAuth(injector)).Post("/requests/{requestId}/approve", approveDeviceAuthorization(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
+)
+
+// publishEvents tells the user's connected machines about committed changes.
+// The changes are already stored, so a failure is only logged.
+func publishEvents(i *do.Injector, events ...live.Event) {
+	broker := do.MustInvoke[live.EventBroker](i)
+	for _, event := range events {
+		if err := broker.Publish(event); err != nil {
+			log.Err(err).Str("event", event.Type).Msg("error publishing event")
+		}
+	}
+}
+
+// requestMachineID is the ID of the machine making the request, if known.
+func requestMachineID(r *http.Request) *uuid.UUID {
+	machine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+	if !ok {
+		return nil
+	}
+	return &machine.ID
+}
+
+// uploadEvents describes the data stored by storeUploadedData.
+func uploadEvents(user *models.User, source *uuid.UUID) []live.Event {
+	events := []live.Event{live.NewEvent(live.EventConfigUpdated, user.ID, source)}
+	if user.KnownHosts != nil {
+		events = append(events, live.NewEvent(live.EventKnownHostsUpdated, user.ID, source))
+	}
+	for _, key := range user.Keys {
+		event := live.NewEvent(live.EventKeyUpdated, user.ID, source)
+		event.Name = key.Filename
+		events = append(events, event)
+	}
+	return events
+}
+
+func streamEvents(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug().Msg("streamEvents: request received")
+		if err := live.EventStream(i, r, w); err != nil {
+			log.Err(err).Msg("error starting event stream")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func EventRoutes(i *do.Injector) chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.ConfigureAuth(i))
+	r.Get("/", streamEvents(i))
+	return r
+}
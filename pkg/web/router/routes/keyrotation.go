@@ -4,9 +4,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/rs/zerolog/log"
 	"github.com/samber/do"
@@ -14,10 +18,86 @@ import (
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/jobs"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
 )
 
+// RotationRequiredHeader is set on data downloads while the user has to rotate
+// their master key, holding when that became required.
+const RotationRequiredHeader = "X-Master-Key-Rotation-Required"
+
+func setRotationRequiredHeader(w http.ResponseWriter, user *models.User) {
+	if user.RotationRequiredAt != nil {
+		w.Header().Set(RotationRequiredHeader, user.RotationRequiredAt.UTC().Format(time.RFC3339))
+	}
+}
+
+func rotationRequiredMessage(user *models.User) string {
+	reason := "a machine was reported compromised"
+	if user.RotationRequiredReason != nil {
+		reason = *user.RotationRequiredReason
+	}
+	return fmt.Sprintf("a master key rotation is required because %s; submit one covering all remaining machines before uploading", reason)
+}
+
+// forbiddenRotationKey reports an entry in keys for a machine that is not one of
+// the user's or that is suspended, and so must not receive the new master key.
+func forbiddenRotationKey(machines []models.Machine, keys []dto.PerMachineMasterKeyDto) (string, bool) {
+	byID := make(map[uuid.UUID]*models.Machine, len(machines))
+	for idx := range machines {
+		byID[machines[idx].ID] = &machines[idx]
+	}
+	for _, entry := range keys {
+		m, ok := byID[entry.MachineID]
+		if !ok {
+			return "the rotation names a machine that is not yours", true
+		}
+		if m.IsSuspended() {
+			return fmt.Sprintf("machine %s is suspended and must not receive the new master key", m.Name), true
+		}
+	}
+	return "", false
+}
+
+// uncoveredMachines lists the machines that a rotation must cover but that have
+// no entry in keys. Suspended machines must not receive the new master key, and
+// the submitting machine already has it.
+func uncoveredMachines(machines []models.Machine, keys []dto.PerMachineMasterKeyDto, submitter *models.Machine) []string {
+	covered := make(map[uuid.UUID]bool, len(keys))
+	for _, entry := range keys {
+		covered[entry.MachineID] = true
+	}
+	var missing []string
+	for _, m := range machines {
+		if m.IsSuspended() || covered[m.ID] || (submitter != nil && m.ID == submitter.ID) {
+			continue
+		}
+		missing = append(missing, m.Name)
+	}
+	return missing
+}
+
+// MasterKeyRotationRequestDto extends dto.MasterKeyRotationRequestDto with the
+// epoch of the new master key, which must be newer than the user's current one.
+type MasterKeyRotationRequestDto struct {
+	dto.MasterKeyRotationRequestDto
+	Epoch int64 `json:"epoch"`
+}
+
+// EncryptedMasterKeyDto extends dto.EncryptedMasterKeyDto with the epoch of the
+// master key.
+type EncryptedMasterKeyDto struct {
+	dto.EncryptedMasterKeyDto
+	Epoch int64 `json:"epoch"`
+}
+
+// postKeyRotation hands a new master key to every other machine of the user.
+// The body is either the rotation as JSON, or a multipart form with the
+// rotation in its "rotation" field alongside a data upload re-encrypted with the
+// new master key, as accepted by addData. Either way the rotation and the data
+// are stored atomically.
 func postKeyRotation(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
@@ -25,12 +105,34 @@ func postKeyRotation(i *do.Injector) http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		submitter, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
-		var req dto.MasterKeyRotationRequestDto
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var req MasterKeyRotationRequestDto
+		withData := false
+		if err := r.ParseMultipartForm(32 << 20); err == nil {
+			if err := json.Unmarshal([]byte(r.FormValue("rotation")), &req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if withData = r.FormValue("ssh_config") != ""; withData && !parseUploadedData(w, r, user, req.Epoch) {
+				return
+			}
+		} else if !errors.Is(err, http.ErrNotMultipart) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if req.Epoch <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "the rotation must carry a positive epoch"})
+			return
+		}
 
 		machineRepo := do.MustInvoke[repository.MachineRepository](i)
 		machines, err := machineRepo.GetUserMachines(user.ID)
@@ -39,16 +141,39 @@ func postKeyRotation(i *do.Injector) http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		machineIDSet := make(map[string]bool, len(machines))
-		for _, m := range machines {
-			machineIDSet[m.ID.String()] = true
+		if message, forbidden := forbiddenRotationKey(machines, req.Keys); forbidden {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: message})
+			return
 		}
 
-		for _, entry := range req.Keys {
-			if !machineIDSet[entry.MachineID.String()] {
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
+		// A machine that has not applied the latest rotation would otherwise
+		// rotate away from a master key it does not hold.
+		rotationRepo := do.MustInvoke[repository.MasterKeyRotationRepository](i)
+		if _, err := rotationRepo.GetRotationForMachine(submitter.ID); err == nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "a master key rotation is pending; run 'ssh-sync download' to apply it before rotating"})
+			return
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			log.Err(err).Msg("postKeyRotation: error checking pending rotation")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		current, err := userRepo.GetUser(user.ID)
+		if err != nil {
+			log.Err(err).Msg("postKeyRotation: error fetching user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if req.Epoch <= current.MasterKeyEpoch {
+			writeStaleEpoch(w, current.MasterKeyEpoch)
+			return
+		}
+		if missing := uncoveredMachines(machines, req.Keys, submitter); len(missing) > 0 {
+			writeUncoveredMachines(w, missing)
+			return
 		}
 
 		txQueryService := do.MustInvoke[query.TransactionService](i)
@@ -58,19 +183,87 @@ func postKeyRotation(i *do.Injector) http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		// Deferred before the commit so that it runs after it.
+		defer func() {
+			if err != nil {
+				return
+			}
+			var events []live.Event
+			for _, entry := range req.Keys {
+				event := live.NewEvent(live.EventRotationPending, user.ID, &submitter.ID)
+				event.MachineID = &entry.MachineID
+				event.Epoch = req.Epoch
+				events = append(events, event)
+			}
+			if withData {
+				events = append(events, uploadEvents(user, &submitter.ID)...)
+			}
+			publishEvents(i, events...)
+		}()
 		defer query.RollbackFunc(txQueryService, tx, w, &err)
 
-		rotationRepo := do.MustInvoke[repository.MasterKeyRotationRepository](i)
+		// Machines may have been added or suspended since they were listed.
+		machines, err = machineRepo.GetUserMachinesTx(user.ID, tx)
+		if err != nil {
+			log.Err(err).Msg("postKeyRotation: error fetching machines")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if message, forbidden := forbiddenRotationKey(machines, req.Keys); forbidden {
+			err = errors.New(message)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: message})
+			return
+		}
+		if missing := uncoveredMachines(machines, req.Keys, submitter); len(missing) > 0 {
+			err = fmt.Errorf("rotation does not cover %s", strings.Join(missing, ", "))
+			writeUncoveredMachines(w, missing)
+			return
+		}
+
+		if err = userRepo.AdvanceMasterKeyEpochTx(user.ID, req.Epoch, tx); err != nil {
+			if errors.Is(err, repository.ErrStaleMasterKeyEpoch) {
+				writeStaleEpoch(w, current.MasterKeyEpoch)
+				return
+			}
+			log.Err(err).Msg("postKeyRotation: error advancing master key epoch")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		for _, entry := range req.Keys {
-			if err = rotationRepo.UpsertRotationTx(tx, entry.MachineID, entry.EncryptedMasterKey); err != nil {
+			if err = rotationRepo.UpsertRotationTx(tx, entry.MachineID, entry.EncryptedMasterKey, req.Epoch); err != nil {
 				log.Err(err).Msg("postKeyRotation: error upserting rotation")
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 		}
+		if current.RotationRequiredAt != nil {
+			if err = userRepo.ClearMasterKeyRotationRequirementTx(user.ID, *current.RotationRequiredAt, tx); err != nil {
+				log.Err(err).Msg("postKeyRotation: error clearing rotation requirement")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if withData {
+			if err = storeUploadedData(userRepo, user, tx); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		log.Debug().Int64("epoch", req.Epoch).Bool("with_data", withData).Msg("postKeyRotation: rotation stored")
 	}
 }
 
+func writeUncoveredMachines(w http.ResponseWriter, missing []string) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(dto.MessageDto{Message: fmt.Sprintf("the rotation must cover all remaining machines; missing: %s", strings.Join(missing, ", "))})
+}
+
+func writeStaleEpoch(w http.ResponseWriter, currentEpoch int64) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(dto.MessageDto{Message: fmt.Sprintf("the rotation's epoch must be newer than the current epoch %d", currentEpoch)})
+}
+
 func getKeyRotation(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		machine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
@@ -91,10 +284,15 @@ func getKeyRotation(i *do.Injector) http.HandlerFunc {
 			return
 		}
 
-		json.NewEncoder(w).Encode(dto.EncryptedMasterKeyDto{EncryptedMasterKey: rotation.EncryptedMasterKey})
+		json.NewEncoder(w).Encode(EncryptedMasterKeyDto{
+			EncryptedMasterKeyDto: dto.EncryptedMasterKeyDto{EncryptedMasterKey: rotation.EncryptedMasterKey},
+			Epoch:                 rotation.Epoch,
+		})
 	}
 }
 
+// deleteKeyRotation acknowledges the machine's pending rotation once it has
+// applied the new master key. The rotation is kept for the status report.
 func deleteKeyRotation(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		machine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
@@ -104,8 +302,8 @@ func deleteKeyRotation(i *do.Injector) http.HandlerFunc {
 		}
 
 		rotationRepo := do.MustInvoke[repository.MasterKeyRotationRepository](i)
-		if err := rotationRepo.DeleteRotationForMachine(machine.ID); err != nil {
-			log.Err(err).Msg("deleteKeyRotation: error deleting rotation")
+		if err := rotationRepo.AcknowledgeRotationForMachine(machine.ID); err != nil {
+			log.Err(err).Msg("deleteKeyRotation: error acknowledging rotation")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -114,11 +312,124 @@ func deleteKeyRotation(i *do.Injector) http.HandlerFunc {
 	}
 }
 
+// Rotation states reported by the status endpoint. A machine has no rotation
+// if it submitted the latest one, joined after it, or let it expire. A
+// recovery key never acknowledges its rotation but holds it until the next
+// one, which does not expire.
+const (
+	RotationStatusPending      = "pending"
+	RotationStatusAcknowledged = "acknowledged"
+	RotationStatusNone         = "none"
+	RotationStatusHeld         = "held"
+)
+
+type MachineRotationStatusDto struct {
+	MachineID      uuid.UUID  `json:"machine_id"`
+	MachineName    string     `json:"machine_name"`
+	Status         string     `json:"status"`
+	Epoch          int64      `json:"epoch,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	RecoveryKey    bool       `json:"recovery_key,omitempty"`
+}
+
+type KeyRotationStatusDto struct {
+	Epoch    int64                      `json:"epoch"`
+	Machines []MachineRotationStatusDto `json:"machines"`
+	// StaleKeys are the key files not yet re-encrypted under the current
+	// master key.
+	StaleKeys []string `json:"stale_keys"`
+}
+
+func newMachineRotationStatusDto(machine models.Machine, rotation *models.MasterKeyRotation, expiry jobs.RotationExpiryPolicy) MachineRotationStatusDto {
+	status := MachineRotationStatusDto{MachineID: machine.ID, MachineName: machine.Name, Status: RotationStatusNone, RecoveryKey: machine.RecoveryKey}
+	if rotation == nil {
+		return status
+	}
+	status.Status = RotationStatusPending
+	if !rotation.IsPending() {
+		status.Status = RotationStatusAcknowledged
+	}
+	status.Epoch = rotation.Epoch
+	status.CreatedAt = &rotation.CreatedAt
+	status.AcknowledgedAt = rotation.AcknowledgedAt
+	if machine.RecoveryKey {
+		status.Status = RotationStatusHeld
+		return status
+	}
+	status.ExpiresAt = expiry.ExpiresAt(rotation)
+	return status
+}
+
+// getKeyRotationStatus reports, for each of the user's machines, whether it has
+// fetched and applied its copy of the latest master key, and which key files
+// are still encrypted under an older one.
+func getKeyRotationStatus(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		expiry, err := jobs.LoadRotationExpiryPolicy()
+		if err != nil {
+			log.Err(err).Msg("getKeyRotationStatus: error loading rotation expiry policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		current, err := userRepo.GetUser(user.ID)
+		if err != nil {
+			log.Err(err).Msg("getKeyRotationStatus: error fetching user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		machines, err := machineRepo.GetUserMachines(user.ID)
+		if err != nil {
+			log.Err(err).Msg("getKeyRotationStatus: error fetching machines")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rotationRepo := do.MustInvoke[repository.MasterKeyRotationRepository](i)
+		rotations, err := rotationRepo.GetRotationsForUser(user.ID)
+		if err != nil {
+			log.Err(err).Msg("getKeyRotationStatus: error fetching rotations")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		byMachine := make(map[uuid.UUID]*models.MasterKeyRotation, len(rotations))
+		for idx := range rotations {
+			byMachine[rotations[idx].MachineID] = &rotations[idx]
+		}
+
+		keys, err := userRepo.GetUserKeys(user.ID)
+		if err != nil {
+			log.Err(err).Msg("getKeyRotationStatus: error fetching keys")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		status := KeyRotationStatusDto{
+			Epoch:     current.MasterKeyEpoch,
+			Machines:  []MachineRotationStatusDto{},
+			StaleKeys: staleKeyFilenames(keys, current.MasterKeyEpoch),
+		}
+		for _, machine := range machines {
+			status.Machines = append(status.Machines, newMachineRotationStatusDto(machine, byMachine[machine.ID], expiry))
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
 func KeyRotationRoutes(i *do.Injector) chi.Router {
 	r := chi.NewRouter()
 	r.Use(middleware.ConfigureAuth(i))
 	r.Post("/", postKeyRotation(i))
 	r.Get("/", getKeyRotation(i))
 	r.Delete("/", deleteKeyRotation(i))
+	r.Get("/status", getKeyRotationStatus(i))
 	return r
 }
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -18,34 +19,59 @@ import (
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/jobs"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
 	pgxmock "github.com/therealpaulgg/ssh-sync-server/test/pgx"
 )
 
+func newKeyRotationRequest(t *testing.T, user *models.User, submitter *models.Machine, rotation MasterKeyRotationRequestDto) *http.Request {
+	t.Helper()
+	body, err := json.Marshal(rotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = testutils.AddUserContext(req, user)
+	return testutils.AddMachineContext(req, submitter)
+}
+
+func rotationKeys(entries ...dto.PerMachineMasterKeyDto) dto.MasterKeyRotationRequestDto {
+	return dto.MasterKeyRotationRequestDto{Keys: entries}
+}
+
 func TestPostKeyRotation(t *testing.T) {
 	// Arrange
 	user := testutils.GenerateUser()
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "submitter"}
 	machine1 := testutils.GenerateMachine()
 	machine2 := testutils.GenerateMachine()
 
-	reqBody := dto.MasterKeyRotationRequestDto{
-		Keys: []dto.PerMachineMasterKeyDto{
-			{MachineID: machine1.ID, EncryptedMasterKey: []byte("enc-key-1")},
-			{MachineID: machine2.ID, EncryptedMasterKey: []byte("enc-key-2")},
-		},
-	}
-	body, _ := json.Marshal(reqBody)
-
-	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	req = testutils.AddUserContext(req, user)
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(
+			dto.PerMachineMasterKeyDto{MachineID: machine1.ID, EncryptedMasterKey: []byte("enc-key-1")},
+			dto.PerMachineMasterKeyDto{MachineID: machine2.ID, EncryptedMasterKey: []byte("enc-key-2")},
+		),
+		Epoch: 1,
+	})
 
 	injector := do.New()
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
 	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{
+		*submitter,
+		{ID: machine1.ID, UserID: user.ID, Name: machine1.Name, PublicKey: machine1.PublicKey},
+		{ID: machine2.ID, UserID: user.ID, Name: machine2.Name, PublicKey: machine2.PublicKey},
+	}, nil)
+	mockMachineRepo.EXPECT().GetUserMachinesTx(user.ID, gomock.Any()).Return([]models.Machine{
+		*submitter,
 		{ID: machine1.ID, UserID: user.ID, Name: machine1.Name, PublicKey: machine1.PublicKey},
 		{ID: machine2.ID, UserID: user.ID, Name: machine2.Name, PublicKey: machine2.PublicKey},
 	}, nil)
@@ -54,6 +80,13 @@ func TestPostKeyRotation(t *testing.T) {
 	})
 
 	txMock := pgxmock.NewMockTx(ctrl)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	mockUserRepo.EXPECT().AdvanceMasterKeyEpochTx(user.ID, int64(1), txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+
 	mockTxService := query.NewMockTransactionService(ctrl)
 	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
 	mockTxService.EXPECT().Commit(txMock).Return(nil)
@@ -62,8 +95,9 @@ func TestPostKeyRotation(t *testing.T) {
 	})
 
 	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
-	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, machine1.ID, []byte("enc-key-1")).Return(nil)
-	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, machine2.ID, []byte("enc-key-2")).Return(nil)
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(nil, sql.ErrNoRows)
+	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, machine1.ID, []byte("enc-key-1"), int64(1)).Return(nil)
+	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, machine2.ID, []byte("enc-key-2"), int64(1)).Return(nil)
 	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
 		return mockRotationRepo, nil
 	})
@@ -75,6 +109,12 @@ func TestPostKeyRotation(t *testing.T) {
 
 	// Assert
 	assert.Equal(t, http.StatusOK, rr.Code)
+	for _, machine := range []*models.Machine{machine1, machine2} {
+		event := <-subscription.Events
+		assert.Equal(t, live.EventRotationPending, event.Type)
+		assert.Equal(t, &machine.ID, event.MachineID)
+		assert.Equal(t, int64(1), event.Epoch)
+	}
 }
 
 func TestPostKeyRotation_BadRequest(t *testing.T) {
@@ -82,8 +122,29 @@ func TestPostKeyRotation_BadRequest(t *testing.T) {
 	user := testutils.GenerateUser()
 	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("not json")))
 	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, testutils.GenerateMachine())
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestPostKeyRotation_MissingEpoch(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	req := newKeyRotationRequest(t, user, testutils.GenerateMachine(), MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: uuid.New(), EncryptedMasterKey: []byte("enc-key")}),
+	})
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 
 	// Act
 	rr := httptest.NewRecorder()
@@ -99,18 +160,13 @@ func TestPostKeyRotation_ForbiddenMachineID(t *testing.T) {
 	user := testutils.GenerateUser()
 	foreignMachineID := uuid.New() // belongs to a different user
 
-	reqBody := dto.MasterKeyRotationRequestDto{
-		Keys: []dto.PerMachineMasterKeyDto{
-			{MachineID: foreignMachineID, EncryptedMasterKey: []byte("enc-key")},
-		},
-	}
-	body, _ := json.Marshal(reqBody)
-
-	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	req = testutils.AddUserContext(req, user)
+	req := newKeyRotationRequest(t, user, testutils.GenerateMachine(), MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: foreignMachineID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       1,
+	})
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -133,25 +189,26 @@ func TestPostKeyRotation_ForbiddenMachineID(t *testing.T) {
 func TestPostKeyRotation_UpsertError(t *testing.T) {
 	// Arrange
 	user := testutils.GenerateUser()
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "submitter"}
 	machine := testutils.GenerateMachine()
 
-	reqBody := dto.MasterKeyRotationRequestDto{
-		Keys: []dto.PerMachineMasterKeyDto{
-			{MachineID: machine.ID, EncryptedMasterKey: []byte("enc-key")},
-		},
-	}
-	body, _ := json.Marshal(reqBody)
-
-	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	req = testutils.AddUserContext(req, user)
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: machine.ID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       1,
+	})
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
 	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{
+		*submitter,
+		{ID: machine.ID, UserID: user.ID, Name: machine.Name, PublicKey: machine.PublicKey},
+	}, nil)
+	mockMachineRepo.EXPECT().GetUserMachinesTx(user.ID, gomock.Any()).Return([]models.Machine{
+		*submitter,
 		{ID: machine.ID, UserID: user.ID, Name: machine.Name, PublicKey: machine.PublicKey},
 	}, nil)
 	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
@@ -159,6 +216,13 @@ func TestPostKeyRotation_UpsertError(t *testing.T) {
 	})
 
 	txMock := pgxmock.NewMockTx(ctrl)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	mockUserRepo.EXPECT().AdvanceMasterKeyEpochTx(user.ID, int64(1), txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+
 	mockTxService := query.NewMockTransactionService(ctrl)
 	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
 	mockTxService.EXPECT().Rollback(txMock).Return(nil)
@@ -167,7 +231,8 @@ func TestPostKeyRotation_UpsertError(t *testing.T) {
 	})
 
 	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
-	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, machine.ID, []byte("enc-key")).Return(errors.New("db error"))
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(nil, sql.ErrNoRows)
+	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, machine.ID, []byte("enc-key"), int64(1)).Return(errors.New("db error"))
 	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
 		return mockRotationRepo, nil
 	})
@@ -181,6 +246,308 @@ func TestPostKeyRotation_UpsertError(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, rr.Code)
 }
 
+func TestPostKeyRotation_StaleEpoch(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	user.MasterKeyEpoch = 3
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "submitter"}
+	other := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "other"}
+
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: other.ID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       3,
+	})
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*submitter, *other}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "current epoch 3")
+}
+
+func TestPostKeyRotation_LosesRace(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "submitter"}
+	other := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "other"}
+
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: other.ID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       1,
+	})
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*submitter, *other}, nil)
+	mockMachineRepo.EXPECT().GetUserMachinesTx(user.ID, gomock.Any()).Return([]models.Machine{*submitter, *other}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	txMock := pgxmock.NewMockTx(ctrl)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	// Another machine advanced the epoch after the user was read.
+	mockUserRepo.EXPECT().AdvanceMasterKeyEpochTx(user.ID, int64(1), txMock).Return(repository.ErrStaleMasterKeyEpoch)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockTxService := query.NewMockTransactionService(ctrl)
+	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTxService.EXPECT().Rollback(txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTxService, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestPostKeyRotation_PendingForSubmitter(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "submitter"}
+
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{Epoch: 2})
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*submitter}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(&models.MasterKeyRotation{MachineID: submitter.ID, Epoch: 1}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestPostKeyRotation_MustCoverRemainingMachines(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"}
+	covered := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	uncovered := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "work"}
+	suspendedAt := time.Now()
+	compromised := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "stolen", SuspendedAt: &suspendedAt}
+
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: covered.ID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       1,
+	})
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*submitter, *covered, *uncovered, *compromised}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "work")
+	assert.NotContains(t, rr.Body.String(), "stolen")
+}
+
+func TestPostKeyRotation_ClearsRequirement(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	requiredAt := time.Now().Add(-time.Hour)
+	user.RotationRequiredAt = &requiredAt
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"}
+	other := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: other.ID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       1,
+	})
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*submitter, *other}, nil)
+	mockMachineRepo.EXPECT().GetUserMachinesTx(user.ID, gomock.Any()).Return([]models.Machine{*submitter, *other}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	txMock := pgxmock.NewMockTx(ctrl)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	mockUserRepo.EXPECT().AdvanceMasterKeyEpochTx(user.ID, int64(1), txMock).Return(nil)
+	mockUserRepo.EXPECT().ClearMasterKeyRotationRequirementTx(user.ID, requiredAt, txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockTxService := query.NewMockTransactionService(ctrl)
+	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTxService.EXPECT().Commit(txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTxService, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(nil, sql.ErrNoRows)
+	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, other.ID, []byte("enc-key"), int64(1)).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestPostKeyRotation_WithData(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"}
+	other := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+
+	rotation, err := json.Marshal(MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: other.ID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("rotation", string(rotation))
+	_ = writer.WriteField("ssh_config", `[{"host":"test"}]`)
+	part, err := writer.CreateFormFile("file", "id_ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write([]byte("re-encrypted key")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, submitter)
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*submitter, *other}, nil)
+	mockMachineRepo.EXPECT().GetUserMachinesTx(user.ID, gomock.Any()).Return([]models.Machine{*submitter, *other}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	txMock := pgxmock.NewMockTx(ctrl)
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	mockUserRepo.EXPECT().AdvanceMasterKeyEpochTx(user.ID, int64(1), txMock).Return(nil)
+	mockUserRepo.EXPECT().AddAndUpdateConfigTx(gomock.Any(), txMock).Return(nil)
+	mockUserRepo.EXPECT().AddAndUpdateKeysTx(gomock.Any(), txMock).DoAndReturn(func(u *models.User, _ any) error {
+		assert.Len(t, u.Keys, 1)
+		assert.Equal(t, "id_ed25519", u.Keys[0].Filename)
+		return nil
+	})
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockTxService := query.NewMockTransactionService(ctrl)
+	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTxService.EXPECT().Commit(txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTxService, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(nil, sql.ErrNoRows)
+	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, other.ID, []byte("enc-key"), int64(1)).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
 func TestGetKeyRotation(t *testing.T) {
 	// Arrange
 	machine := testutils.GenerateMachine()
@@ -189,6 +556,7 @@ func TestGetKeyRotation(t *testing.T) {
 		ID:                 uuid.New(),
 		MachineID:          machine.ID,
 		EncryptedMasterKey: encKey,
+		Epoch:              4,
 		CreatedAt:          time.Now(),
 	}
 
@@ -212,9 +580,10 @@ func TestGetKeyRotation(t *testing.T) {
 
 	// Assert
 	assert.Equal(t, http.StatusOK, rr.Code)
-	var rotDto dto.EncryptedMasterKeyDto
+	var rotDto EncryptedMasterKeyDto
 	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&rotDto))
 	assert.Equal(t, encKey, rotDto.EncryptedMasterKey)
+	assert.Equal(t, int64(4), rotDto.Epoch)
 }
 
 func TestGetKeyRotation_NotFound(t *testing.T) {
@@ -278,7 +647,7 @@ func TestDeleteKeyRotation(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
-	mockRotationRepo.EXPECT().DeleteRotationForMachine(machine.ID).Return(nil)
+	mockRotationRepo.EXPECT().AcknowledgeRotationForMachine(machine.ID).Return(nil)
 	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
 		return mockRotationRepo, nil
 	})
@@ -303,7 +672,7 @@ func TestDeleteKeyRotation_Error(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
-	mockRotationRepo.EXPECT().DeleteRotationForMachine(machine.ID).Return(errors.New("db error"))
+	mockRotationRepo.EXPECT().AcknowledgeRotationForMachine(machine.ID).Return(errors.New("db error"))
 	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
 		return mockRotationRepo, nil
 	})
@@ -316,3 +685,196 @@ func TestDeleteKeyRotation_Error(t *testing.T) {
 	// Assert
 	assert.Equal(t, http.StatusInternalServerError, rr.Code)
 }
+
+func TestGetKeyRotationStatus(t *testing.T) {
+	// Arrange
+	t.Setenv("KEY_ROTATION_PENDING_TTL", "7d")
+	user := testutils.GenerateUser()
+	user.MasterKeyEpoch = 2
+	submitter := models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"}
+	pending := models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	applied := models.Machine{ID: uuid.New(), UserID: user.ID, Name: "work"}
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	acknowledged := created.Add(time.Hour)
+
+	req := httptest.NewRequest("GET", "/status", nil)
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	mockUserRepo.EXPECT().GetUserKeys(user.ID).Return([]models.SshKey{
+		{Filename: "id_ed25519", KeyEpoch: 2},
+		{Filename: "id_rsa", KeyEpoch: 1},
+	}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{submitter, pending, applied}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationsForUser(user.ID).Return([]models.MasterKeyRotation{
+		{MachineID: pending.ID, Epoch: 2, CreatedAt: created},
+		{MachineID: applied.ID, Epoch: 2, CreatedAt: created, AcknowledgedAt: &acknowledged},
+	}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(getKeyRotationStatus(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var status KeyRotationStatusDto
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	assert.Equal(t, int64(2), status.Epoch)
+	assert.Len(t, status.Machines, 3)
+	assert.Equal(t, RotationStatusNone, status.Machines[0].Status)
+	assert.Nil(t, status.Machines[0].CreatedAt)
+	assert.Equal(t, RotationStatusPending, status.Machines[1].Status)
+	assert.Equal(t, created.Add(7*24*time.Hour), status.Machines[1].ExpiresAt.UTC())
+	assert.Equal(t, RotationStatusAcknowledged, status.Machines[2].Status)
+	assert.Equal(t, acknowledged, status.Machines[2].AcknowledgedAt.UTC())
+	assert.Nil(t, status.Machines[2].ExpiresAt)
+	assert.Equal(t, []string{"id_rsa"}, status.StaleKeys)
+}
+
+func TestGetKeyRotationStatus_Error(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	req := httptest.NewRequest("GET", "/status", nil)
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationsForUser(user.ID).Return(nil, errors.New("db error"))
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(getKeyRotationStatus(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestNewMachineRotationStatusDto_RecoveryKey(t *testing.T) {
+	recoveryKey := models.Machine{ID: uuid.New(), Name: "recovery-key", RecoveryKey: true}
+	rotation := &models.MasterKeyRotation{MachineID: recoveryKey.ID, Epoch: 2, CreatedAt: time.Now().Add(-30 * 24 * time.Hour)}
+
+	status := newMachineRotationStatusDto(recoveryKey, rotation, jobs.RotationExpiryPolicy{PendingFor: 7 * 24 * time.Hour})
+
+	assert.Equal(t, RotationStatusHeld, status.Status)
+	assert.True(t, status.RecoveryKey)
+	assert.Equal(t, int64(2), status.Epoch)
+	assert.Nil(t, status.ExpiresAt, "recovery keys keep the master key until the next rotation")
+}
+
+func TestPostKeyRotation_SuspendedMachine(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"}
+	suspendedAt := time.Now()
+	compromised := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "stolen", SuspendedAt: &suspendedAt}
+
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: compromised.ID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       1,
+	})
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*submitter, *compromised}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "stolen is suspended")
+}
+
+func TestPostKeyRotation_MachineAddedConcurrently(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	submitter := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "desktop"}
+	other := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	added := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "new-vm"}
+
+	req := newKeyRotationRequest(t, user, submitter, MasterKeyRotationRequestDto{
+		MasterKeyRotationRequestDto: rotationKeys(dto.PerMachineMasterKeyDto{MachineID: other.ID, EncryptedMasterKey: []byte("enc-key")}),
+		Epoch:                       1,
+	})
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	txMock := pgxmock.NewMockTx(ctrl)
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*submitter, *other}, nil)
+	mockMachineRepo.EXPECT().GetUserMachinesTx(user.ID, txMock).Return([]models.Machine{*submitter, *other, *added}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockTxService := query.NewMockTransactionService(ctrl)
+	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTxService.EXPECT().Rollback(txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTxService, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(submitter.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(postKeyRotation(injector))
+	handler.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "new-vm")
+}
@@ -4,8 +4,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/google/uuid"
@@ -16,6 +19,8 @@ import (
 	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/jobs"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
 )
@@ -24,6 +29,115 @@ type DeleteRequest struct {
 	MachineName string `json:"machine_name"`
 }
 
+// MachineDetailsDto extends dto.MachineDto, keeping its name field, with what
+// the server knows about the machine.
+type MachineDetailsDto struct {
+	ID                uuid.UUID  `json:"id"`
+	Name              string     `json:"name"`
+	PreviousNames     []string   `json:"previous_names,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastSeenAt        *time.Time `json:"last_seen_at,omitempty"`
+	LastSeenIP        *string    `json:"last_seen_ip,omitempty"`
+	LastSeenUserAgent *string    `json:"last_seen_user_agent,omitempty"`
+	LastAuthAlgorithm *string    `json:"last_auth_algorithm,omitempty"`
+	Algorithm         string     `json:"algorithm"`
+	KeyFingerprint    string     `json:"key_fingerprint"`
+	SuspendedAt       *time.Time `json:"suspended_at,omitempty"`
+	SuspendedReason   *string    `json:"suspended_reason,omitempty"`
+	CompromisedAt     *time.Time `json:"compromised_at,omitempty"`
+	// DormantSuspendAt and DormantDeleteAt are when the dormancy policy will
+	// suspend or delete the machine unless it is used again.
+	DormantSuspendAt *time.Time `json:"dormant_suspend_at,omitempty"`
+	DormantDeleteAt  *time.Time `json:"dormant_delete_at,omitempty"`
+	RecoveryKey      bool       `json:"recovery_key,omitempty"`
+}
+
+func newMachineDetailsDto(machine models.Machine, dormancy jobs.DormancyPolicy) MachineDetailsDto {
+	return MachineDetailsDto{
+		ID:                machine.ID,
+		Name:              machine.Name,
+		PreviousNames:     machine.PreviousNames,
+		CreatedAt:         machine.CreatedAt,
+		LastSeenAt:        machine.LastSeenAt,
+		LastSeenIP:        machine.LastSeenIP,
+		LastSeenUserAgent: machine.LastSeenUserAgent,
+		LastAuthAlgorithm: machine.LastAuthAlgorithm,
+		Algorithm:         crypto.DetectKeyType(machine.PublicKey).String(),
+		KeyFingerprint:    crypto.PublicKeyFingerprint(machine.PublicKey),
+		SuspendedAt:       machine.SuspendedAt,
+		SuspendedReason:   machine.SuspendedReason,
+		CompromisedAt:     machine.CompromisedAt,
+		DormantSuspendAt:  dormancy.SuspendsAt(&machine),
+		DormantDeleteAt:   dormancy.DeletesAt(&machine),
+		RecoveryKey:       machine.RecoveryKey,
+	}
+}
+
+// MachinePublicKeyDto extends dto.MachinePublicKeyDto with the ML-KEM parameter
+// set of the machine's encapsulation key, and whether it is a recovery key.
+type MachinePublicKeyDto struct {
+	dto.MachinePublicKeyDto
+	KEMParameterSet string `json:"kem_parameter_set,omitempty"`
+	RecoveryKey     bool   `json:"recovery_key,omitempty"`
+}
+
+type MachinesPublicKeysDto struct {
+	Machines []MachinePublicKeyDto `json:"machines"`
+}
+
+// KeyProofNonceDto is the nonce a machine signs with its new key in the proof
+// sent along with a key update.
+type KeyProofNonceDto struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type MachineKeyHistoryDto struct {
+	Fingerprint string    `json:"fingerprint"`
+	Algorithm   string    `json:"algorithm"`
+	ReplacedAt  time.Time `json:"replaced_at"`
+}
+
+type RenameRequest struct {
+	Name string `json:"name"`
+}
+
+type SuspendRequest struct {
+	Reason string `json:"reason"`
+}
+
+// CompromisedRequest reports a machine as compromised. The machine is suspended
+// unless Delete is set.
+type CompromisedRequest struct {
+	Delete bool   `json:"delete"`
+	Reason string `json:"reason"`
+}
+
+// CompromisedSuspendReason is the suspension reason of machines reported as
+// compromised without one.
+const CompromisedSuspendReason = "reported compromised"
+
+// getOwnedMachine looks up the machine in the URL, which must belong to user.
+// It writes the error response itself when it returns false.
+func getOwnedMachine(i *do.Injector, w http.ResponseWriter, r *http.Request, user *models.User) (*models.Machine, bool) {
+	machineId, err := uuid.Parse(chi.URLParam(r, "machineId"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	machineRepo := do.MustInvoke[repository.MachineRepository](i)
+	machine, err := machineRepo.GetMachine(machineId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && machine.UserID != user.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Err(err).Msg("Error getting machine by id")
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return machine, true
+}
+
 func getMachineById(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
@@ -54,10 +168,13 @@ func getMachineById(i *do.Injector) http.HandlerFunc {
 			return
 		}
 		log.Debug().Str("machine_name", machine.Name).Msg("getMachineById: found machine")
-		machineDto := dto.MachineDto{
-			Name: machine.Name,
+		dormancy, err := jobs.LoadDormancyPolicy()
+		if err != nil {
+			log.Err(err).Msg("getMachineById: error loading dormancy policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-		json.NewEncoder(w).Encode(machineDto)
+		json.NewEncoder(w).Encode(newMachineDetailsDto(machine, dormancy))
 	}
 }
 
@@ -77,11 +194,15 @@ func getMachines(i *do.Injector) http.HandlerFunc {
 		}
 		log.Debug().Int("machines_count", len(machines)).Msg("getMachines: fetched machines for user")
 		user.Machines = machines
-		machineDtos := make([]dto.MachineDto, len(user.Machines))
+		dormancy, err := jobs.LoadDormancyPolicy()
+		if err != nil {
+			log.Err(err).Msg("getMachines: error loading dormancy policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		machineDtos := make([]MachineDetailsDto, len(user.Machines))
 		for i, machine := range user.Machines {
-			machineDtos[i] = dto.MachineDto{
-				Name: machine.Name,
-			}
+			machineDtos[i] = newMachineDetailsDto(machine, dormancy)
 		}
 		json.NewEncoder(w).Encode(machineDtos)
 	}
@@ -117,12 +238,45 @@ func deleteMachine(i *do.Injector) http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		do.MustInvoke[*crypto.PublicKeyCache](i).Invalidate(machine.ID)
+		if err := do.MustInvoke[*crypto.SessionManager](i).RevokeMachine(machine.ID); err != nil {
+			log.Err(err).Str("machine_id", machine.ID.String()).Msg("error revoking machine sessions")
+		}
+		publishEvents(i, live.NewMachineEvent(live.EventMachineRemoved, machine, requestMachineID(r)))
 		log.Debug().Str("machine_id", machine.ID.String()).Msg("deleteMachine: machine deleted")
 	}
 }
 
+func createKeyProofNonce(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		machine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("machine_name", machine.Name).Msg("createKeyProofNonce: request received")
+		nonce, expiresAt, err := do.MustInvoke[*crypto.KeyProofNonces](i).Issue(machine.ID)
+		if err != nil {
+			log.Err(err).Msg("error issuing key proof nonce")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(KeyProofNonceDto{Nonce: nonce, ExpiresAt: expiresAt})
+	}
+}
+
+const keyProofMessage = "proof must be a token signed by the new key over a nonce from POST /machines/key/nonce"
+
+// updateMachineKey replaces the calling machine's public key. Besides the key,
+// the form carries a proof: a token signed by the new key whose nonce claim is a
+// nonce from createKeyProofNonce.
 func updateMachineKey(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		machine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
 		if !ok {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -147,10 +301,22 @@ func updateMachineKey(i *do.Injector) http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if _, err := crypto.ValidatePublicKey(fileBytes); err != nil {
+		keyType, err := crypto.ValidatePublicKey(fileBytes)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		policy, err := crypto.PolicyForUser(user)
+		if err != nil {
+			log.Err(err).Msg("error loading algorithm policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := policy.CheckKeyType(keyType, time.Now()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+			return
+		}
 		log.Debug().Msg("updateMachineKey: public key validated")
 		var ekBytes []byte
 		ekFile, _, ekErr := r.FormFile("encapsulation_key")
@@ -162,18 +328,304 @@ func updateMachineKey(i *do.Injector) http.HandlerFunc {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			if _, err := crypto.ValidateEncapsulationKey(ekBytes); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+				return
+			}
 		}
-		machineRepo := do.MustInvoke[repository.MachineRepository](i)
-		if err := machineRepo.UpdateMachineKeys(machine.ID, fileBytes, ekBytes); err != nil {
+		proof := r.FormValue("proof")
+		proofAlg, err := crypto.DetectJWTAlgorithm(proof)
+		if err == nil {
+			err = policy.CheckJWTAlgorithm(proofAlg)
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("updateMachineKey: key proof rejected")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: keyProofMessage})
+			return
+		}
+		// The nonce is only used up once the keys are updated.
+		err = do.MustInvoke[*crypto.KeyProofNonces](i).Verify(machine.ID, proof, proofAlg, fileBytes, func() error {
+			return do.MustInvoke[repository.MachineRepository](i).UpdateMachineKeys(machine.ID, fileBytes, ekBytes)
+		})
+		if errors.Is(err, crypto.ErrInvalidKeyProof) {
+			log.Debug().Err(err).Msg("updateMachineKey: key proof rejected")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: keyProofMessage})
+			return
+		}
+		if err != nil {
 			log.Err(err).Msg("error updating machine keys")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		do.MustInvoke[*crypto.PublicKeyCache](i).Invalidate(machine.ID)
+		if err := do.MustInvoke[*crypto.SessionManager](i).RevokeMachine(machine.ID); err != nil {
+			log.Err(err).Str("machine_id", machine.ID.String()).Msg("error revoking machine sessions")
+		}
 		log.Debug().Str("machine_id", machine.ID.String()).Msg("updateMachineKey: machine keys updated")
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
+func getMachineKeyHistory(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Msg("getMachineKeyHistory: request received")
+		machine, ok := getOwnedMachine(i, w, r, user)
+		if !ok {
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		history, err := machineRepo.GetMachineKeyHistory(machine.ID)
+		if err != nil {
+			log.Err(err).Msg("error getting machine key history")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		dtos := lo.Map(history, func(key models.MachineKeyHistory, _ int) MachineKeyHistoryDto {
+			return MachineKeyHistoryDto{
+				Fingerprint: crypto.PublicKeyFingerprint(key.PublicKey),
+				Algorithm:   crypto.DetectKeyType(key.PublicKey).String(),
+				ReplacedAt:  key.ReplacedAt,
+			}
+		})
+		json.NewEncoder(w).Encode(dtos)
+	}
+}
+
+func deleteMachineById(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Msg("deleteMachineById: request received")
+		machine, ok := getOwnedMachine(i, w, r, user)
+		if !ok {
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		if err := machineRepo.DeleteMachine(machine.ID); err != nil {
+			log.Err(err).Msg("Error deleting machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		do.MustInvoke[*crypto.PublicKeyCache](i).Invalidate(machine.ID)
+		if err := do.MustInvoke[*crypto.SessionManager](i).RevokeMachine(machine.ID); err != nil {
+			log.Err(err).Str("machine_id", machine.ID.String()).Msg("error revoking machine sessions")
+		}
+		publishEvents(i, live.NewMachineEvent(live.EventMachineRemoved, machine, requestMachineID(r)))
+		log.Debug().Str("machine_id", machine.ID.String()).Msg("deleteMachineById: machine deleted")
+	}
+}
+
+func renameMachine(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Msg("renameMachine: request received")
+		var renameRequest RenameRequest
+		if err := json.NewDecoder(r.Body).Decode(&renameRequest); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		newName := strings.TrimSpace(renameRequest.Name)
+		if newName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "machine name must not be empty"})
+			return
+		}
+		machine, ok := getOwnedMachine(i, w, r, user)
+		if !ok {
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		renamedMachine, err := machineRepo.RenameMachine(machine, newName)
+		if errors.Is(err, repository.ErrMachineAlreadyExists) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: fmt.Sprintf("a machine named %q already exists", newName)})
+			return
+		} else if err != nil {
+			log.Err(err).Msg("Error renaming machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("machine_id", machine.ID.String()).Str("machine_name", newName).Msg("renameMachine: machine renamed")
+		dormancy, err := jobs.LoadDormancyPolicy()
+		if err != nil {
+			log.Err(err).Msg("renameMachine: error loading dormancy policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(newMachineDetailsDto(*renamedMachine, dormancy))
+	}
+}
+
+func suspendMachine(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		currentMachine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Msg("suspendMachine: request received")
+		var suspendRequest SuspendRequest
+		if err := json.NewDecoder(r.Body).Decode(&suspendRequest); err != nil && !errors.Is(err, io.EOF) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		machine, ok := getOwnedMachine(i, w, r, user)
+		if !ok {
+			return
+		}
+		if machine.ID == currentMachine.ID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "a machine cannot suspend itself"})
+			return
+		}
+		if machine.IsSuspended() {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		if err := machineRepo.SuspendMachine(machine.ID, suspendRequest.Reason); err != nil {
+			log.Err(err).Msg("Error suspending machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := do.MustInvoke[*crypto.SessionManager](i).RevokeMachine(machine.ID); err != nil {
+			log.Err(err).Str("machine_id", machine.ID.String()).Msg("error revoking machine sessions")
+		}
+		log.Debug().Str("machine_id", machine.ID.String()).Msg("suspendMachine: machine suspended")
+	}
+}
+
+// reportCompromisedMachine revokes a machine that may have leaked its keys. The
+// machine still holds the current master key, so the user is required to
+// rotate it before any further uploads.
+func reportCompromisedMachine(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		currentMachine, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Msg("reportCompromisedMachine: request received")
+		var compromisedRequest CompromisedRequest
+		if err := json.NewDecoder(r.Body).Decode(&compromisedRequest); err != nil && !errors.Is(err, io.EOF) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		machine, ok := getOwnedMachine(i, w, r, user)
+		if !ok {
+			return
+		}
+		if machine.ID == currentMachine.ID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "a machine cannot report itself as compromised"})
+			return
+		}
+		reason := fmt.Sprintf("machine %q was reported compromised", machine.Name)
+		if compromisedRequest.Reason != "" {
+			reason = fmt.Sprintf("%s (%s)", reason, compromisedRequest.Reason)
+		}
+		// Require the rotation first, so that a failure below cannot leave the
+		// machine revoked without it.
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		if err := userRepo.RequireMasterKeyRotation(user.ID, reason); err != nil {
+			log.Err(err).Msg("Error requiring master key rotation")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		var err error
+		if compromisedRequest.Delete {
+			if err = machineRepo.DeleteMachine(machine.ID); err == nil {
+				do.MustInvoke[*crypto.PublicKeyCache](i).Invalidate(machine.ID)
+			}
+		} else {
+			suspendReason := CompromisedSuspendReason
+			if compromisedRequest.Reason != "" {
+				suspendReason = compromisedRequest.Reason
+			}
+			err = machineRepo.MarkMachineCompromised(machine.ID, suspendReason)
+		}
+		if err != nil {
+			log.Err(err).Msg("Error revoking compromised machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := do.MustInvoke[*crypto.SessionManager](i).RevokeMachine(machine.ID); err != nil {
+			log.Err(err).Str("machine_id", machine.ID.String()).Msg("error revoking machine sessions")
+		}
+		// A pending rotation for the machine holds a master key it must not get.
+		rotationRepo := do.MustInvoke[repository.MasterKeyRotationRepository](i)
+		if err := rotationRepo.DeleteRotationForMachine(machine.ID); err != nil {
+			log.Err(err).Msg("Error deleting pending rotation of compromised machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// The removal ends the machine's own event stream before the others
+		// learn that they have to rotate.
+		publishEvents(i,
+			live.NewMachineEvent(live.EventMachineRemoved, machine, &currentMachine.ID),
+			live.NewMachineEvent(live.EventRotationRequired, machine, &currentMachine.ID),
+		)
+		log.Info().Str("machine_id", machine.ID.String()).Bool("deleted", compromisedRequest.Delete).Msg("reportCompromisedMachine: machine revoked, master key rotation required")
+	}
+}
+
+func reinstateMachine(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Msg("reinstateMachine: request received")
+		machine, ok := getOwnedMachine(i, w, r, user)
+		if !ok {
+			return
+		}
+		if !machine.IsSuspended() {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if machine.IsCompromised() {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "machines reported as compromised cannot be reinstated"})
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		if err := machineRepo.ReinstateMachine(machine.ID); err != nil {
+			log.Err(err).Msg("Error reinstating machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("machine_id", machine.ID.String()).Msg("reinstateMachine: machine reinstated")
+	}
+}
+
 func getMachinePublicKeys(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
@@ -188,26 +640,51 @@ func getMachinePublicKeys(i *do.Injector) http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		dtos := make([]dto.MachinePublicKeyDto, len(machines))
+		// Suspended machines must not receive newly wrapped keys.
+		machines = lo.Reject(machines, func(m models.Machine, _ int) bool {
+			return m.IsSuspended()
+		})
+		dtos := make([]MachinePublicKeyDto, len(machines))
 		for idx, m := range machines {
-			dtos[idx] = dto.MachinePublicKeyDto{
-				MachineID:        m.ID,
-				Name:             m.Name,
-				PublicKey:        m.PublicKey,
-				EncapsulationKey: m.EncapsulationKey,
+			dtos[idx] = MachinePublicKeyDto{
+				MachinePublicKeyDto: dto.MachinePublicKeyDto{
+					MachineID:        m.ID,
+					Name:             m.Name,
+					PublicKey:        m.PublicKey,
+					EncapsulationKey: m.EncapsulationKey,
+				},
+				RecoveryKey: m.RecoveryKey,
+			}
+			if len(m.EncapsulationKey) > 0 {
+				// Keys stored before validation was added may not parse; those
+				// are reported without a parameter set.
+				dtos[idx].KEMParameterSet, _ = crypto.ValidateEncapsulationKey(m.EncapsulationKey)
 			}
 		}
-		json.NewEncoder(w).Encode(dto.MachinesPublicKeysDto{Machines: dtos})
+		json.NewEncoder(w).Encode(MachinesPublicKeysDto{Machines: dtos})
 	}
 }
 
 func MachineRoutes(i *do.Injector) chi.Router {
 	r := chi.NewRouter()
-	r.Use(middleware.ConfigureAuth(i))
-	r.Get("/{machineId}", getMachineById(i))
-	r.Get("/", getMachines(i))
-	r.Get("/public-keys", getMachinePublicKeys(i))
-	r.Delete("/", deleteMachine(i))
-	r.Put("/key", updateMachineKey(i))
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.ConfigureAuth(i))
+		r.Get("/{machineId}", getMachineById(i))
+		r.Get("/", getMachines(i))
+		r.Get("/public-keys", getMachinePublicKeys(i))
+		r.Delete("/", deleteMachine(i))
+		r.Patch("/{machineId}", renameMachine(i))
+		r.Delete("/{machineId}", deleteMachineById(i))
+		r.Post("/{machineId}/suspend", suspendMachine(i))
+		r.Post("/{machineId}/reinstate", reinstateMachine(i))
+		r.Post("/{machineId}/compromised", reportCompromisedMachine(i))
+		r.Get("/{machineId}/key-history", getMachineKeyHistory(i))
+		r.Post("/recovery-key", registerRecoveryKey(i))
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.ConfigureKeyMigrationAuth(i))
+		r.Post("/key/nonce", createKeyProofNonce(i))
+		r.Put("/key", updateMachineKey(i))
+	})
 	return r
 }
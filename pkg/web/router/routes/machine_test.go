@@ -10,15 +10,19 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"filippo.io/mldsa"
 	"github.com/go-chi/chi"
 	"go.uber.org/mock/gomock"
 	"github.com/google/uuid"
 	"github.com/samber/do"
 	"github.com/stretchr/testify/assert"
 	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
 )
 
@@ -153,6 +157,17 @@ func TestDeleteMachine(t *testing.T) {
 	}
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	keyCache := primedPublicKeyCache(t, machineId)
+	do.ProvideValue(injector, keyCache)
+	sessionManager, err := testutils.ProvideSessionManager(injector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionToken, _, err := sessionManager.Issue(user, userMachine)
+	if err != nil {
+		t.Fatal(err)
+	}
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
@@ -170,11 +185,32 @@ func TestDeleteMachine(t *testing.T) {
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
+	_, err = sessionManager.Verify(sessionToken)
+	assert.ErrorIs(t, err, crypto.ErrSessionRevoked)
+	assert.Zero(t, keyCache.Stats().Size)
+}
+
+// primedPublicKeyCache returns a cache holding a parsed key for the machine.
+func primedPublicKeyCache(t *testing.T, machineID uuid.UUID) *crypto.PublicKeyCache {
+	t.Helper()
+	priv, pub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, _, err := testutils.EncodeToPem(priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := crypto.NewPublicKeyCache(time.Minute)
+	if _, err := cache.Get(machineID, pubBytes); err != nil {
+		t.Fatal(err)
+	}
+	return cache
 }
 
 func TestUpdateMachineKey(t *testing.T) {
 	// Arrange
-	pub, _, err := testutils.GenerateMLDSATestKeys()
+	pub, priv, err := testutils.GenerateMLDSATestKeys()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -183,6 +219,10 @@ func TestUpdateMachineKey(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	machineID := uuid.New()
+	nonces := crypto.NewKeyProofNonces(crypto.KeyProofNonceTTL)
+	proof := issueKeyProof(t, nonces, machineID, priv)
+
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 	part, err := writer.CreateFormFile("key", "key")
@@ -193,6 +233,9 @@ func TestUpdateMachineKey(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := writer.WriteField("proof", proof); err != nil {
+		t.Fatal(err)
+	}
 	err = writer.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -206,7 +249,7 @@ func TestUpdateMachineKey(t *testing.T) {
 
 	user := testutils.GenerateUser()
 	machine := &models.Machine{
-		ID:        uuid.New(),
+		ID:        machineID,
 		UserID:    user.ID,
 		Name:      "test",
 		PublicKey: []byte("old-key"),
@@ -215,6 +258,12 @@ func TestUpdateMachineKey(t *testing.T) {
 	req = testutils.AddMachineContext(req, machine)
 
 	injector := do.New()
+	do.ProvideValue(injector, nonces)
+	keyCache := primedPublicKeyCache(t, machineID)
+	do.ProvideValue(injector, keyCache)
+	if _, err := testutils.ProvideSessionManager(injector); err != nil {
+		t.Fatal(err)
+	}
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
@@ -231,11 +280,12 @@ func TestUpdateMachineKey(t *testing.T) {
 
 	// Assert
 	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Zero(t, keyCache.Stats().Size)
 }
 
 func TestUpdateMachineKey_WithEncapsulationKey(t *testing.T) {
 	// Arrange
-	pub, _, err := testutils.GenerateMLDSATestKeys()
+	pub, priv, err := testutils.GenerateMLDSATestKeys()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -243,7 +293,14 @@ func TestUpdateMachineKey_WithEncapsulationKey(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ekBytes := []byte("fake-encapsulation-key-pem")
+	ekBytes, err := testutils.GenerateMLKEMTestKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machineID := uuid.New()
+	nonces := crypto.NewKeyProofNonces(crypto.KeyProofNonceTTL)
+	proof := issueKeyProof(t, nonces, machineID, priv)
 
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -261,6 +318,9 @@ func TestUpdateMachineKey_WithEncapsulationKey(t *testing.T) {
 	if _, err = ekPart.Write(ekBytes); err != nil {
 		t.Fatal(err)
 	}
+	if err := writer.WriteField("proof", proof); err != nil {
+		t.Fatal(err)
+	}
 	if err = writer.Close(); err != nil {
 		t.Fatal(err)
 	}
@@ -273,7 +333,7 @@ func TestUpdateMachineKey_WithEncapsulationKey(t *testing.T) {
 
 	user := testutils.GenerateUser()
 	machine := &models.Machine{
-		ID:        uuid.New(),
+		ID:        machineID,
 		UserID:    user.ID,
 		Name:      "test",
 		PublicKey: []byte("old-key"),
@@ -282,6 +342,11 @@ func TestUpdateMachineKey_WithEncapsulationKey(t *testing.T) {
 	req = testutils.AddMachineContext(req, machine)
 
 	injector := do.New()
+	do.ProvideValue(injector, nonces)
+	do.ProvideValue(injector, crypto.NewPublicKeyCache(time.Minute))
+	if _, err := testutils.ProvideSessionManager(injector); err != nil {
+		t.Fatal(err)
+	}
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
@@ -374,6 +439,7 @@ func TestDeleteMachine_NotFound(t *testing.T) {
 	req = testutils.AddUserContext(req, user)
 
 	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
@@ -390,7 +456,7 @@ func TestDeleteMachine_NotFound(t *testing.T) {
 }
 
 func TestUpdateMachineKey_UpdateError(t *testing.T) {
-	pub, _, err := testutils.GenerateMLDSATestKeys()
+	pub, priv, err := testutils.GenerateMLDSATestKeys()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -399,6 +465,10 @@ func TestUpdateMachineKey_UpdateError(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	machineID := uuid.New()
+	nonces := crypto.NewKeyProofNonces(crypto.KeyProofNonceTTL)
+	proof := issueKeyProof(t, nonces, machineID, priv)
+
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 	part, err := writer.CreateFormFile("key", "key")
@@ -408,6 +478,9 @@ func TestUpdateMachineKey_UpdateError(t *testing.T) {
 	if _, err = part.Write(pubPEM); err != nil {
 		t.Fatal(err)
 	}
+	if err := writer.WriteField("proof", proof); err != nil {
+		t.Fatal(err)
+	}
 	if err = writer.Close(); err != nil {
 		t.Fatal(err)
 	}
@@ -417,7 +490,7 @@ func TestUpdateMachineKey_UpdateError(t *testing.T) {
 
 	user := testutils.GenerateUser()
 	machine := &models.Machine{
-		ID:        uuid.New(),
+		ID:        machineID,
 		UserID:    user.ID,
 		Name:      "test",
 		PublicKey: []byte("old-key"),
@@ -426,6 +499,7 @@ func TestUpdateMachineKey_UpdateError(t *testing.T) {
 	req = testutils.AddMachineContext(req, machine)
 
 	injector := do.New()
+	do.ProvideValue(injector, nonces)
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
@@ -439,4 +513,948 @@ func TestUpdateMachineKey_UpdateError(t *testing.T) {
 	router.Put("/key", updateMachineKey(injector))
 	router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assertKeyProofNonceLive(t, nonces, machineID, proof, pubPEM)
+}
+
+// assertKeyProofNonceLive checks that a rejected key update left the proof's
+// nonce usable.
+func assertKeyProofNonceLive(t *testing.T, nonces *crypto.KeyProofNonces, machineID uuid.UUID, proof string, pubPEM []byte) {
+	t.Helper()
+	alg, err := crypto.DetectJWTAlgorithm(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, nonces.Verify(machineID, proof, alg, pubPEM, func() error { return nil }))
+}
+
+func TestUpdateMachineKey_HybridRequired(t *testing.T) {
+	// Arrange
+	pub, _, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := testutils.EncodeMLDSAToPem(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("key", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write(pubPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("PUT", "/key", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	user := testutils.GenerateUser()
+	user.RequireHybridAuth = true
+	machine := testutils.GenerateMachine()
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, machine)
+
+	injector := do.New()
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Put("/key", updateMachineKey(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestSuspendMachine(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	currentMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "current"}
+	lostMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "lost-laptop"}
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(SuspendRequest{Reason: "left on a train"}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("/%s/suspend", lostMachine.ID), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, currentMachine)
+
+	injector := do.New()
+	sessionManager, err := testutils.ProvideSessionManager(injector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionToken, _, err := sessionManager.Issue(user, lostMachine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(lostMachine.ID).Return(lostMachine, nil)
+	mockMachineRepo.EXPECT().SuspendMachine(lostMachine.ID, "left on a train").Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/suspend", suspendMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	_, err = sessionManager.Verify(sessionToken)
+	assert.ErrorIs(t, err, crypto.ErrSessionRevoked)
+}
+
+func TestSuspendMachine_Self(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	currentMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "current"}
+	req, err := http.NewRequest("POST", fmt.Sprintf("/%s/suspend", currentMachine.ID), http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, currentMachine)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(currentMachine.ID).Return(currentMachine, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/suspend", suspendMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestSuspendMachine_OtherUsersMachine(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	currentMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "current"}
+	otherMachine := &models.Machine{ID: uuid.New(), UserID: uuid.New(), Name: "someone-else"}
+	req, err := http.NewRequest("POST", fmt.Sprintf("/%s/suspend", otherMachine.ID), http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, currentMachine)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(otherMachine.ID).Return(otherMachine, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/suspend", suspendMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestReinstateMachine(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	suspendedAt := time.Now()
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "found-laptop", SuspendedAt: &suspendedAt}
+	req, err := http.NewRequest("POST", fmt.Sprintf("/%s/reinstate", machine.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(machine.ID).Return(machine, nil)
+	mockMachineRepo.EXPECT().ReinstateMachine(machine.ID).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/reinstate", reinstateMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestReinstateMachine_NotSuspended(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	req, err := http.NewRequest("POST", fmt.Sprintf("/%s/reinstate", machine.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(machine.ID).Return(machine, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/reinstate", reinstateMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestGetMachine_Details(t *testing.T) {
+	// Arrange
+	pub, _, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := testutils.EncodeMLDSAToPem(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := testutils.GenerateUser()
+	lastSeen := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	ip := "192.0.2.1"
+	alg := "ML-DSA-65"
+	machine := models.Machine{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		Name:      "ci-runner",
+		PublicKey: pubPEM,
+		CreatedAt: lastSeen.Add(-24 * time.Hour),
+		MachineActivity: models.MachineActivity{
+			LastSeenAt:        &lastSeen,
+			LastSeenIP:        &ip,
+			LastAuthAlgorithm: &alg,
+		},
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("/%s", machine.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{machine}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Get("/{machineId}", getMachineById(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var details MachineDetailsDto
+	if err := json.NewDecoder(rr.Body).Decode(&details); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, machine.ID, details.ID)
+	assert.Equal(t, machine.Name, details.Name)
+	assert.True(t, machine.CreatedAt.Equal(details.CreatedAt))
+	if assert.NotNil(t, details.LastSeenAt) {
+		assert.True(t, lastSeen.Equal(*details.LastSeenAt))
+	}
+	assert.Equal(t, &ip, details.LastSeenIP)
+	assert.Equal(t, &alg, details.LastAuthAlgorithm)
+	assert.Equal(t, "ml-dsa", details.Algorithm)
+	assert.Equal(t, crypto.PublicKeyFingerprint(pubPEM), details.KeyFingerprint)
+}
+
+func TestGetMachines_DormancyDeadline(t *testing.T) {
+	// Arrange
+	t.Setenv("MACHINE_DORMANT_SUSPEND_AFTER", "90d")
+	user := testutils.GenerateUser()
+	created := time.Now().Add(-10 * 24 * time.Hour).UTC().Truncate(time.Second)
+	machine := models.Machine{ID: uuid.New(), UserID: user.ID, Name: "vm", PublicKey: []byte("test"), CreatedAt: created}
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{machine}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Get("/", getMachines(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var machineDtos []MachineDetailsDto
+	if err := json.NewDecoder(rr.Body).Decode(&machineDtos); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, machineDtos, 1) && assert.NotNil(t, machineDtos[0].DormantSuspendAt) {
+		assert.True(t, created.Add(90*24*time.Hour).Equal(*machineDtos[0].DormantSuspendAt))
+	}
+	assert.Nil(t, machineDtos[0].DormantDeleteAt)
+}
+
+func TestRenameMachine(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop", PublicKey: []byte("test")}
+	renamed := &models.Machine{ID: machine.ID, UserID: user.ID, Name: "work-laptop", PublicKey: []byte("test"), PreviousNames: []string{"laptop"}}
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(RenameRequest{Name: " work-laptop "}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("/%s", machine.ID), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(machine.ID).Return(machine, nil)
+	mockMachineRepo.EXPECT().RenameMachine(machine, "work-laptop").Return(renamed, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Patch("/{machineId}", renameMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var details MachineDetailsDto
+	if err := json.NewDecoder(rr.Body).Decode(&details); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "work-laptop", details.Name)
+	assert.Equal(t, []string{"laptop"}, details.PreviousNames)
+}
+
+func TestRenameMachine_Conflict(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(RenameRequest{Name: "desktop"}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("/%s", machine.ID), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(machine.ID).Return(machine, nil)
+	mockMachineRepo.EXPECT().RenameMachine(machine, "desktop").Return(nil, repository.ErrMachineAlreadyExists)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Patch("/{machineId}", renameMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestRenameMachine_EmptyName(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(RenameRequest{Name: "  "}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("/%s", uuid.New()), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+	injector := do.New()
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Patch("/{machineId}", renameMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestDeleteMachineById(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "old-laptop"}
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("/%s", machine.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
+	do.ProvideValue(injector, crypto.NewPublicKeyCache(time.Minute))
+	if _, err := testutils.ProvideSessionManager(injector); err != nil {
+		t.Fatal(err)
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(machine.ID).Return(machine, nil)
+	mockMachineRepo.EXPECT().DeleteMachine(machine.ID).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Delete("/{machineId}", deleteMachineById(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	event := <-subscription.Events
+	assert.Equal(t, live.EventMachineRemoved, event.Type)
+	assert.Equal(t, &machine.ID, event.MachineID)
+	assert.Equal(t, "old-laptop", event.Name)
+}
+
+func TestDeleteMachineById_NotFound(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	machineId := uuid.New()
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("/%s", machineId), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(machineId).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Delete("/{machineId}", deleteMachineById(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestUpdateMachineKey_ProofSignedByOtherKey(t *testing.T) {
+	// Arrange
+	pub, _, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := testutils.EncodeMLDSAToPem(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := testutils.GenerateMachine()
+	nonces := crypto.NewKeyProofNonces(crypto.KeyProofNonceTTL)
+	proof := issueKeyProof(t, nonces, machine.ID, otherPriv)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("key", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write(pubPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteField("proof", proof); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("PUT", "/key", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req = testutils.AddUserContext(req, testutils.GenerateUser())
+	req = testutils.AddMachineContext(req, machine)
+
+	injector := do.New()
+	do.ProvideValue(injector, nonces)
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Put("/key", updateMachineKey(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestUpdateMachineKey_MissingProof(t *testing.T) {
+	// Arrange
+	pub, _, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := testutils.EncodeMLDSAToPem(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("key", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write(pubPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("PUT", "/key", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req = testutils.AddUserContext(req, testutils.GenerateUser())
+	req = testutils.AddMachineContext(req, testutils.GenerateMachine())
+
+	injector := do.New()
+	do.ProvideValue(injector, crypto.NewKeyProofNonces(crypto.KeyProofNonceTTL))
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Put("/key", updateMachineKey(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestCreateKeyProofNonce(t *testing.T) {
+	// Arrange
+	machine := testutils.GenerateMachine()
+	req := httptest.NewRequest("POST", "/key/nonce", nil)
+	req = testutils.AddMachineContext(req, machine)
+
+	injector := do.New()
+	do.ProvideValue(injector, crypto.NewKeyProofNonces(crypto.KeyProofNonceTTL))
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/key/nonce", createKeyProofNonce(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var nonce KeyProofNonceDto
+	if err := json.NewDecoder(rr.Body).Decode(&nonce); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, nonce.Nonce)
+	assert.True(t, nonce.ExpiresAt.After(time.Now()))
+}
+
+func TestGetMachineKeyHistory(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	pub, _, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := testutils.EncodeMLDSAToPem(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	history := []models.MachineKeyHistory{
+		{ID: uuid.New(), MachineID: machine.ID, PublicKey: pubPEM, ReplacedAt: replacedAt},
+	}
+	req := httptest.NewRequest("GET", fmt.Sprintf("/%s/key-history", machine.ID), nil)
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(machine.ID).Return(machine, nil)
+	mockMachineRepo.EXPECT().GetMachineKeyHistory(machine.ID).Return(history, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Get("/{machineId}/key-history", getMachineKeyHistory(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var dtos []MachineKeyHistoryDto
+	if err := json.NewDecoder(rr.Body).Decode(&dtos); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, dtos, 1)
+	assert.Equal(t, crypto.PublicKeyFingerprint(pubPEM), dtos[0].Fingerprint)
+	assert.Equal(t, crypto.KeyTypeMLDSA.String(), dtos[0].Algorithm)
+	assert.True(t, replacedAt.Equal(dtos[0].ReplacedAt))
+}
+
+func TestUpdateMachineKey_InvalidEncapsulationKey(t *testing.T) {
+	// Arrange
+	pub, priv, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := testutils.EncodeMLDSAToPem(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := testutils.GenerateMachine()
+	nonces := crypto.NewKeyProofNonces(crypto.KeyProofNonceTTL)
+	proof := issueKeyProof(t, nonces, machine.ID, priv)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("key", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write(pubPEM); err != nil {
+		t.Fatal(err)
+	}
+	ekPart, err := writer.CreateFormFile("encapsulation_key", "encapsulation_key.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ekPart.Write([]byte("fake-encapsulation-key-pem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteField("proof", proof); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("PUT", "/key", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req = testutils.AddUserContext(req, testutils.GenerateUser())
+	req = testutils.AddMachineContext(req, machine)
+
+	injector := do.New()
+	do.ProvideValue(injector, nonces)
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Put("/key", updateMachineKey(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "encapsulation key")
+	assertKeyProofNonceLive(t, nonces, machine.ID, proof, pubPEM)
+}
+
+func TestGetMachinePublicKeys_KEMParameterSet(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	ekPEM, err := testutils.GenerateMLKEMTestKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machines := []models.Machine{
+		{ID: uuid.New(), UserID: user.ID, Name: "with-kem", PublicKey: []byte("pub"), EncapsulationKey: ekPEM},
+		{ID: uuid.New(), UserID: user.ID, Name: "without-kem", PublicKey: []byte("pub")},
+	}
+	req := httptest.NewRequest("GET", "/public-keys", nil)
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return(machines, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Get("/public-keys", getMachinePublicKeys(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result MachinesPublicKeysDto
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, result.Machines, 2)
+	assert.Equal(t, crypto.KEMParameterSetMLKEM768, result.Machines[0].KEMParameterSet)
+	assert.Equal(t, ekPEM, result.Machines[0].EncapsulationKey)
+	assert.Empty(t, result.Machines[1].KEMParameterSet)
+}
+
+func TestReportCompromisedMachine(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	currentMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "current"}
+	stolenMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "stolen"}
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(CompromisedRequest{Reason: "laptop bag stolen"}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", fmt.Sprintf("/%s/compromised", stolenMachine.ID), body)
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, currentMachine)
+
+	injector := do.New()
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
+	sessionManager, err := testutils.ProvideSessionManager(injector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionToken, _, err := sessionManager.Issue(user, stolenMachine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().RequireMasterKeyRotation(user.ID, `machine "stolen" was reported compromised (laptop bag stolen)`).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(stolenMachine.ID).Return(stolenMachine, nil)
+	mockMachineRepo.EXPECT().MarkMachineCompromised(stolenMachine.ID, "laptop bag stolen").Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().DeleteRotationForMachine(stolenMachine.ID).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/compromised", reportCompromisedMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	_, err = sessionManager.Verify(sessionToken)
+	assert.ErrorIs(t, err, crypto.ErrSessionRevoked)
+	for _, eventType := range []string{live.EventMachineRemoved, live.EventRotationRequired} {
+		event := <-subscription.Events
+		assert.Equal(t, eventType, event.Type)
+		assert.Equal(t, &stolenMachine.ID, event.MachineID)
+		assert.Equal(t, &currentMachine.ID, event.SourceMachineID)
+	}
+}
+
+func TestReportCompromisedMachine_Delete(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	currentMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "current"}
+	stolenMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "stolen"}
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(CompromisedRequest{Delete: true}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", fmt.Sprintf("/%s/compromised", stolenMachine.ID), body)
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, currentMachine)
+
+	injector := do.New()
+	do.ProvideValue[live.EventBroker](injector, live.NewMemoryEventBroker())
+	do.ProvideValue(injector, crypto.NewPublicKeyCache(time.Minute))
+	if _, err := testutils.ProvideSessionManager(injector); err != nil {
+		t.Fatal(err)
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().RequireMasterKeyRotation(user.ID, `machine "stolen" was reported compromised`).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(stolenMachine.ID).Return(stolenMachine, nil)
+	mockMachineRepo.EXPECT().DeleteMachine(stolenMachine.ID).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().DeleteRotationForMachine(stolenMachine.ID).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/compromised", reportCompromisedMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestReportCompromisedMachine_Self(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	currentMachine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "current"}
+	req := httptest.NewRequest("POST", fmt.Sprintf("/%s/compromised", currentMachine.ID), http.NoBody)
+	req = testutils.AddUserContext(req, user)
+	req = testutils.AddMachineContext(req, currentMachine)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(currentMachine.ID).Return(currentMachine, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/compromised", reportCompromisedMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestReinstateMachine_Compromised(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	suspendedAt := time.Now()
+	reason := CompromisedSuspendReason
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "stolen", SuspendedAt: &suspendedAt, SuspendedReason: &reason, CompromisedAt: &suspendedAt}
+	req := httptest.NewRequest("POST", fmt.Sprintf("/%s/reinstate", machine.ID), nil)
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetMachine(machine.ID).Return(machine, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Post("/{machineId}/reinstate", reinstateMachine(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func issueKeyProof(t *testing.T, nonces *crypto.KeyProofNonces, machineID uuid.UUID, priv *mldsa.PrivateKey) string {
+	t.Helper()
+	nonce, _, err := nonces.Issue(machineID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := testutils.GenerateMLDSAKeyProof(nonce, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
 }
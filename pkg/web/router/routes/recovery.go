@@ -0,0 +1,297 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/do"
+	"github.com/samber/lo"
+	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/jobs"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
+)
+
+// A recovery key is a machine whose keys are derived from a secret the user
+// keeps on paper. It is given the master key when registered and in every
+// rotation, which must cover it like any other machine, but it cannot sign in.
+// Its only use is enrolling a fresh machine through POST /api/v1/recovery once
+// every other machine is lost.
+
+const defaultRecoveryKeyName = "recovery-key"
+
+// RecoveryKeyRequest registers a recovery key. Name defaults to
+// "recovery-key".
+type RecoveryKeyRequest struct {
+	Name               string `json:"name"`
+	PublicKey          []byte `json:"public_key"`
+	EncapsulationKey   []byte `json:"encapsulation_key"`
+	EncryptedMasterKey []byte `json:"encrypted_master_key"`
+}
+
+// recordAuditEvent records event for machine, with details naming the machine
+// that caused it.
+func recordAuditEvent(i *do.Injector, r *http.Request, event string, source, machine *models.Machine) {
+	entry := &models.AuditEvent{
+		Event:     event,
+		UserID:    &machine.UserID,
+		MachineID: &machine.ID,
+		Details:   "by " + source.Name + " (" + source.ID.String() + ")",
+		SourceIP:  middleware.ClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err := do.MustInvoke[repository.AuditEventRepository](i).RecordAuditEvent(entry); err != nil {
+		log.Err(err).Str("event", event).Msg("error recording audit event")
+	}
+}
+
+// registerRecoveryKey adds a recovery key for the user, with the current master
+// key encrypted for it by the registering machine. A user has at most one
+// recovery key; delete it like a machine to register another.
+func registerRecoveryKey(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		registrar, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var req RecoveryKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.PublicKey) == 0 || len(req.EncapsulationKey) == 0 || len(req.EncryptedMasterKey) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			req.Name = defaultRecoveryKeyName
+		}
+
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		current, err := userRepo.GetUser(user.ID)
+		if err != nil {
+			log.Err(err).Msg("registerRecoveryKey: error fetching user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		keyType, err := crypto.ValidatePublicKey(req.PublicKey)
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid public key")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		policy, err := crypto.PolicyForUser(current)
+		if err != nil {
+			log.Err(err).Msg("error loading algorithm policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := policy.CheckKeyType(keyType, time.Now()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+			return
+		}
+		if _, err := crypto.ValidateEncapsulationKey(req.EncapsulationKey); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+			return
+		}
+
+		// A machine that has not applied the latest rotation would hand over a
+		// master key that is no longer current.
+		rotationRepo := do.MustInvoke[repository.MasterKeyRotationRepository](i)
+		if _, err := rotationRepo.GetRotationForMachine(registrar.ID); err == nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "a master key rotation is pending; run 'ssh-sync download' to apply it before registering a recovery key"})
+			return
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			log.Err(err).Msg("registerRecoveryKey: error checking pending rotation")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		machines, err := machineRepo.GetUserMachines(user.ID)
+		if err != nil {
+			log.Err(err).Msg("registerRecoveryKey: error fetching machines")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if lo.ContainsBy(machines, func(m models.Machine) bool { return m.RecoveryKey }) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "this account already has a recovery key; delete it before registering a new one"})
+			return
+		}
+
+		txQueryService := do.MustInvoke[query.TransactionService](i)
+		tx, err := txQueryService.StartTx(pgx.TxOptions{})
+		if err != nil {
+			log.Err(err).Msg("registerRecoveryKey: error starting transaction")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var recoveryKey *models.Machine
+		// Deferred before the commit so that it runs after it.
+		defer func() {
+			if err == nil && recoveryKey != nil {
+				recordAuditEvent(i, r, models.AuditRecoveryKeyRegistered, registrar, recoveryKey)
+				publishEvents(i, live.NewMachineEvent(live.EventMachineAdded, recoveryKey, &registrar.ID))
+			}
+		}()
+		defer query.RollbackFunc(txQueryService, tx, w, &err)
+		recoveryKey, err = machineRepo.CreateMachineTx(&models.Machine{
+			UserID:           user.ID,
+			Name:             req.Name,
+			PublicKey:        req.PublicKey,
+			EncapsulationKey: req.EncapsulationKey,
+			RecoveryKey:      true,
+		}, tx)
+		if err != nil {
+			if errors.Is(err, repository.ErrMachineAlreadyExists) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			log.Err(err).Msg("registerRecoveryKey: error creating recovery key")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// The recovery key keeps its copy of the master key as a rotation it
+		// never acknowledges, which the next rotation replaces.
+		if err = rotationRepo.UpsertRotationTx(tx, recoveryKey.ID, req.EncryptedMasterKey, current.MasterKeyEpoch); err != nil {
+			log.Err(err).Msg("registerRecoveryKey: error storing encrypted master key")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("registered_by", registrar.Name).Msg("registerRecoveryKey: recovery key registered")
+		json.NewEncoder(w).Encode(newMachineDetailsDto(*recoveryKey, jobs.DormancyPolicy{}))
+	}
+}
+
+// recoverAccount enrolls a new machine, authenticated by the recovery key. It
+// takes the same form as startDeviceAuthorization, without the username, and
+// returns the master key encrypted for the recovery key, so that the client
+// decrypts it with the secret on paper. It bypasses the user's approval
+// quorum, since there may be no machine left to approve.
+func recoverAccount(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recoveryKey, ok := r.Context().Value(context_keys.MachineContextKey).(*models.Machine)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		machineName := r.FormValue("machine_name")
+		if machineName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("key")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		publicKey, err := io.ReadAll(file)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var encapsulationKey []byte
+		if ekFile, _, err := r.FormFile("encapsulation_key"); err == nil {
+			defer ekFile.Close()
+			encapsulationKey, err = io.ReadAll(ekFile)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		keyType, err := crypto.ValidatePublicKey(publicKey)
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid public key")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		policy, err := crypto.PolicyForUser(user)
+		if err != nil {
+			log.Err(err).Msg("error loading algorithm policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := policy.CheckKeyType(keyType, time.Now()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+			return
+		}
+		if len(encapsulationKey) > 0 {
+			if _, err := crypto.ValidateEncapsulationKey(encapsulationKey); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+				return
+			}
+		}
+
+		rotationRepo := do.MustInvoke[repository.MasterKeyRotationRepository](i)
+		masterKey, err := rotationRepo.GetRotationForMachine(recoveryKey.ID)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && masterKey.Epoch != user.MasterKeyEpoch) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "the recovery key does not hold the current master key"})
+			return
+		} else if err != nil {
+			log.Err(err).Msg("recoverAccount: error fetching encrypted master key")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		machine, err := machineRepo.CreateMachine(&models.Machine{
+			UserID:           user.ID,
+			Name:             machineName,
+			PublicKey:        publicKey,
+			EncapsulationKey: encapsulationKey,
+		})
+		if errors.Is(err, repository.ErrMachineAlreadyExists) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Err(err).Msg("recoverAccount: error creating machine")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Info().Str("username", user.Username).Str("machine_name", machineName).Msg("recoverAccount: machine enrolled with recovery key")
+		recordAuditEvent(i, r, models.AuditRecoveryKeyUsed, recoveryKey, machine)
+		publishEvents(i, live.NewMachineEvent(live.EventMachineAdded, machine, &recoveryKey.ID))
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(EncryptedMasterKeyDto{
+			EncryptedMasterKeyDto: dto.EncryptedMasterKeyDto{EncryptedMasterKey: masterKey.EncryptedMasterKey},
+			Epoch:                 masterKey.Epoch,
+		})
+	}
+}
+
+func RecoveryRoutes(i *do.Injector) chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.ConfigureRecoveryAuth(i))
+	r.Post("/", recoverAccount(i))
+	return r
+}
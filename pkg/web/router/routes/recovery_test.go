@@ -0,0 +1,250 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/samber/do"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
+	pgxmock "github.com/therealpaulgg/ssh-sync-server/test/pgx"
+	"go.uber.org/mock/gomock"
+)
+
+func newRecoveryKeyRequest(t *testing.T, user *models.User, registrar *models.Machine) *http.Request {
+	t.Helper()
+	priv, pub, err := testutils.GenerateTestKeys()
+	require.NoError(t, err)
+	pubBytes, _, err := testutils.EncodeToPem(priv, pub)
+	require.NoError(t, err)
+	ekBytes, err := testutils.GenerateMLKEMTestKeyPEM()
+	require.NoError(t, err)
+	body, err := json.Marshal(RecoveryKeyRequest{PublicKey: pubBytes, EncapsulationKey: ekBytes, EncryptedMasterKey: []byte("wrapped")})
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/recovery-key", bytes.NewReader(body))
+	req = testutils.AddUserContext(req, user)
+	return testutils.AddMachineContext(req, registrar)
+}
+
+func newRecoverAccountRequest(t *testing.T, user *models.User, recoveryKey *models.Machine, machineName string) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("machine_name", machineName))
+	priv, pub, err := testutils.GenerateTestKeys()
+	require.NoError(t, err)
+	pubBytes, _, err := testutils.EncodeToPem(priv, pub)
+	require.NoError(t, err)
+	part, err := writer.CreateFormFile("key", "key")
+	require.NoError(t, err)
+	_, err = part.Write(pubBytes)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req = testutils.AddUserContext(req, user)
+	return testutils.AddMachineContext(req, recoveryKey)
+}
+
+func TestRegisterRecoveryKey(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	user.MasterKeyEpoch = 3
+	registrar := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	req := newRecoveryKeyRequest(t, user, registrar)
+	injector := do.New()
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	txMock := pgxmock.NewMockTx(ctrl)
+	recoveryKeyID := uuid.New()
+	var created *models.Machine
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{*registrar}, nil)
+	mockMachineRepo.EXPECT().CreateMachineTx(gomock.Any(), txMock).DoAndReturn(func(machine *models.Machine, _ any) (*models.Machine, error) {
+		created = machine
+		machine.ID = recoveryKeyID
+		return machine, nil
+	})
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(registrar.ID).Return(nil, sql.ErrNoRows)
+	mockRotationRepo.EXPECT().UpsertRotationTx(txMock, recoveryKeyID, []byte("wrapped"), int64(3)).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+	mockTxService := query.NewMockTransactionService(ctrl)
+	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTxService.EXPECT().Commit(txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTxService, nil
+	})
+	var audited *models.AuditEvent
+	mockAuditRepo := repository.NewMockAuditEventRepository(ctrl)
+	mockAuditRepo.EXPECT().RecordAuditEvent(gomock.Any()).DoAndReturn(func(event *models.AuditEvent) error {
+		audited = event
+		return nil
+	})
+	do.Provide(injector, func(i *do.Injector) (repository.AuditEventRepository, error) {
+		return mockAuditRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	registerRecoveryKey(injector).ServeHTTP(rr, req)
+
+	// Assert
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, created.RecoveryKey)
+	assert.Equal(t, defaultRecoveryKeyName, created.Name)
+	var resp MachineDetailsDto
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.True(t, resp.RecoveryKey)
+	assert.Equal(t, models.AuditRecoveryKeyRegistered, audited.Event)
+	assert.Equal(t, &recoveryKeyID, audited.MachineID)
+	event := <-subscription.Events
+	assert.Equal(t, live.EventMachineAdded, event.Type)
+	assert.Equal(t, &registrar.ID, event.SourceMachineID)
+}
+
+func TestRegisterRecoveryKey_AlreadyRegistered(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	registrar := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	req := newRecoveryKeyRequest(t, user, registrar)
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().GetUser(user.ID).Return(user, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{
+		*registrar,
+		{ID: uuid.New(), UserID: user.ID, Name: defaultRecoveryKeyName, RecoveryKey: true},
+	}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(registrar.ID).Return(nil, sql.ErrNoRows)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	registerRecoveryKey(injector).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "already has a recovery key")
+}
+
+func TestRecoverAccount(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	user.MasterKeyEpoch = 3
+	recoveryKey := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: defaultRecoveryKeyName, RecoveryKey: true}
+	req := newRecoverAccountRequest(t, user, recoveryKey, "new-laptop")
+	injector := do.New()
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(recoveryKey.ID).Return(&models.MasterKeyRotation{MachineID: recoveryKey.ID, EncryptedMasterKey: []byte("wrapped"), Epoch: 3}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+	var created *models.Machine
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().CreateMachine(gomock.Any()).DoAndReturn(func(machine *models.Machine) (*models.Machine, error) {
+		created = machine
+		machine.ID = uuid.New()
+		return machine, nil
+	})
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	var audited *models.AuditEvent
+	mockAuditRepo := repository.NewMockAuditEventRepository(ctrl)
+	mockAuditRepo.EXPECT().RecordAuditEvent(gomock.Any()).DoAndReturn(func(event *models.AuditEvent) error {
+		audited = event
+		return nil
+	})
+	do.Provide(injector, func(i *do.Injector) (repository.AuditEventRepository, error) {
+		return mockAuditRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	recoverAccount(injector).ServeHTTP(rr, req)
+
+	// Assert
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp EncryptedMasterKeyDto
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, []byte("wrapped"), resp.EncryptedMasterKey)
+	assert.Equal(t, int64(3), resp.Epoch)
+	assert.Equal(t, "new-laptop", created.Name)
+	assert.False(t, created.RecoveryKey)
+	assert.Equal(t, models.AuditRecoveryKeyUsed, audited.Event)
+	assert.Equal(t, &created.ID, audited.MachineID)
+	event := <-subscription.Events
+	assert.Equal(t, live.EventMachineAdded, event.Type)
+	assert.Equal(t, &recoveryKey.ID, event.SourceMachineID)
+}
+
+func TestRecoverAccount_StaleMasterKey(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	user.MasterKeyEpoch = 4
+	recoveryKey := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: defaultRecoveryKeyName, RecoveryKey: true}
+	req := newRecoverAccountRequest(t, user, recoveryKey, "new-laptop")
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRotationRepo := repository.NewMockMasterKeyRotationRepository(ctrl)
+	mockRotationRepo.EXPECT().GetRotationForMachine(recoveryKey.ID).Return(&models.MasterKeyRotation{MachineID: recoveryKey.ID, EncryptedMasterKey: []byte("wrapped"), Epoch: 3}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MasterKeyRotationRepository, error) {
+		return mockRotationRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	recoverAccount(injector).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "does not hold the current master key")
+}
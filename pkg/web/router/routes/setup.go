@@ -1,9 +1,11 @@
 package routes
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jackc/pgx/v5"
@@ -52,11 +54,23 @@ func initialSetup(i *do.Injector) http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if _, err := crypto.ValidatePublicKey(fileBytes); err != nil {
+		keyType, err := crypto.ValidatePublicKey(fileBytes)
+		if err != nil {
 			log.Debug().Err(err).Msg("invalid public key")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		policy, err := crypto.LoadServerAlgorithmPolicy()
+		if err != nil {
+			log.Err(err).Msg("error loading algorithm policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := policy.CheckKeyType(keyType, time.Now()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+			return
+		}
 		log.Debug().Msg("initialSetup: public key validated")
 		var encapsulationKeyBytes []byte
 		ekFile, _, ekErr := r.FormFile("encapsulation_key")
@@ -68,6 +82,11 @@ func initialSetup(i *do.Injector) http.HandlerFunc {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			if _, err := crypto.ValidateEncapsulationKey(encapsulationKeyBytes); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+				return
+			}
 		}
 		txQueryService := do.MustInvoke[query.TransactionService](i)
 		tx, err := txQueryService.StartTx(pgx.TxOptions{})
@@ -148,5 +167,14 @@ func SetupRoutes(i *do.Injector) chi.Router {
 	ch.Get("/", challengeResponse(i))
 	r.Mount("/challenge", ch)
 	r.Get("/existing", getExisting(i))
+	r.Route("/device", func(r chi.Router) {
+		r.Post("/", startDeviceAuthorization(i))
+		r.Post("/token", pollDeviceAuthorization(i))
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.ConfigureAuth(i))
+			r.Get("/requests", getDeviceAuthorizations(i))
+			r.Post("/requests/{requestId}/approve", approveDeviceAuthorization(i))
+		})
+	})
 	return r
 }
@@ -169,3 +169,47 @@ func TestInitialSetup_InvalidKey(t *testing.T) {
 			status, http.StatusBadRequest)
 	}
 }
+
+func TestInitialSetup_InvalidEncapsulationKey(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("username", "test")
+	_ = writer.WriteField("machine_name", "mymachine")
+	pub, _, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM, err := testutils.EncodeMLDSAToPem(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := writer.CreateFormFile("key", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write(pubPEM); err != nil {
+		t.Fatal(err)
+	}
+	ekPart, err := writer.CreateFormFile("encapsulation_key", "encapsulation_key.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An ML-DSA public key is not an encapsulation key.
+	if _, err = ekPart.Write(pubPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	handler := initialSetup(do.New())
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("initialSetup returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+}
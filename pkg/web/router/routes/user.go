@@ -4,15 +4,36 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/rs/zerolog/log"
 	"github.com/samber/do"
+	"github.com/samber/lo"
 	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
 )
 
+type UserPolicyDto struct {
+	RequireHybridAuth    bool       `json:"require_hybrid_auth"`
+	AllowedKeyAlgorithms []string   `json:"allowed_key_algorithms,omitempty"`
+	AllowedJWTAlgorithms []string   `json:"allowed_jwt_algorithms,omitempty"`
+	ClassicalMigrateBy   *time.Time `json:"classical_migrate_by,omitempty"`
+	// MachineApprovalQuorum is how many existing machines must approve a new
+	// machine in the live challenge.
+	MachineApprovalQuorum int `json:"machine_approval_quorum,omitempty"`
+}
+
 func getUser(i *do.Injector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Debug().Str("username", chi.URLParam(r, "username")).Msg("getUser: request received")
@@ -34,8 +55,185 @@ func getUser(i *do.Injector) http.HandlerFunc {
 	}
 }
 
+func getUserPolicy(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(UserPolicyDto{
+			RequireHybridAuth:     user.RequireHybridAuth,
+			AllowedKeyAlgorithms:  user.AllowedKeyAlgorithms,
+			AllowedJWTAlgorithms:  user.AllowedJWTAlgorithms,
+			ClassicalMigrateBy:    user.ClassicalMigrateBy,
+			MachineApprovalQuorum: user.MachineApprovalQuorum,
+		})
+	}
+}
+
+func updateUserPolicy(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Msg("updateUserPolicy: request received")
+		var policyDto UserPolicyDto
+		if err := json.NewDecoder(r.Body).Decode(&policyDto); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		updated := *user
+		updated.RequireHybridAuth = policyDto.RequireHybridAuth
+		updated.AllowedKeyAlgorithms = lo.Ternary(len(policyDto.AllowedKeyAlgorithms) == 0, nil, policyDto.AllowedKeyAlgorithms)
+		updated.AllowedJWTAlgorithms = lo.Ternary(len(policyDto.AllowedJWTAlgorithms) == 0, nil, policyDto.AllowedJWTAlgorithms)
+		updated.ClassicalMigrateBy = policyDto.ClassicalMigrateBy
+		updated.MachineApprovalQuorum = policyDto.MachineApprovalQuorum
+		if updated.MachineApprovalQuorum < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "machine_approval_quorum must not be negative"})
+			return
+		}
+		if err := (crypto.AlgorithmPolicy{KeyAlgorithms: updated.AllowedKeyAlgorithms, JWTAlgorithms: updated.AllowedJWTAlgorithms}).Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: err.Error()})
+			return
+		}
+		policy, err := crypto.PolicyForUser(&updated)
+		if err != nil {
+			log.Err(err).Msg("updateUserPolicy: error loading algorithm policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// A policy that immediately rejects an existing machine's key would force an
+		// unplanned rotation, so refuse it. Classical key deadlines are exempt since
+		// they are the planned way to migrate machines.
+		machineRepo := do.MustInvoke[repository.MachineRepository](i)
+		machines, err := machineRepo.GetUserMachines(user.ID)
+		if err != nil {
+			log.Err(err).Msg("updateUserPolicy: error fetching machines")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Machines are approved by other, unsuspended machines, so a larger
+		// quorum could never be met.
+		if approvers := lo.CountBy(machines, func(m models.Machine) bool { return m.CanApprove() }); updated.ApprovalQuorum() > max(1, approvers) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: fmt.Sprintf("a quorum of %d machines cannot be met by %d active machines", updated.ApprovalQuorum(), approvers)})
+			return
+		}
+		now := time.Now()
+		for _, m := range machines {
+			keyType := crypto.DetectKeyType(m.PublicKey)
+			if err := policy.CheckKeyType(keyType, now); err != nil && !errors.Is(err, crypto.ErrClassicalKeyMigrationDue) {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(dto.MessageDto{Message: fmt.Sprintf("machine %q has a %s key, which the new policy does not allow", m.Name, keyType)})
+				return
+			}
+		}
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		if err := userRepo.UpdateUserPolicy(&updated); err != nil {
+			log.Err(err).Msg("updateUserPolicy: error updating policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		*user = updated
+		// Sessions were issued under the old policy.
+		if err := do.MustInvoke[*crypto.SessionManager](i).RevokeUser(user.ID); err != nil {
+			log.Err(err).Str("user_id", user.ID.String()).Msg("error revoking user sessions")
+		}
+		log.Debug().Bool("require_hybrid_auth", user.RequireHybridAuth).Msg("updateUserPolicy: policy updated")
+		json.NewEncoder(w).Encode(policyDto)
+	}
+}
+
+// DeleteAccountRequest confirms an account deletion. Confirm must repeat the
+// username.
+type DeleteAccountRequest struct {
+	Confirm string `json:"confirm"`
+}
+
+// AccountDeletionReceiptDto tells the user what was deleted, as the number of
+// rows removed from each table.
+type AccountDeletionReceiptDto struct {
+	UserID    uuid.UUID        `json:"user_id"`
+	Username  string           `json:"username"`
+	DeletedAt time.Time        `json:"deleted_at"`
+	Deleted   map[string]int64 `json:"deleted"`
+}
+
+// deleteAccount deletes the user and everything stored for them in one
+// transaction. Once committed, their session tokens are revoked and their
+// event streams are ended.
+func deleteAccount(i *do.Injector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(context_keys.UserContextKey).(*models.User)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debug().Str("username", user.Username).Msg("deleteAccount: request received")
+		var req DeleteAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Confirm != user.Username {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(dto.MessageDto{Message: "set \"confirm\" to the username to delete the account"})
+			return
+		}
+
+		txQueryService := do.MustInvoke[query.TransactionService](i)
+		tx, err := txQueryService.StartTx(pgx.TxOptions{})
+		if err != nil {
+			log.Err(err).Msg("deleteAccount: error starting transaction")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		userRepo := do.MustInvoke[repository.UserRepository](i)
+		deleted, err := userRepo.DeleteUserTx(user.ID, tx)
+		if err != nil {
+			log.Err(err).Msg("deleteAccount: error deleting user")
+			if err := txQueryService.Rollback(tx); err != nil {
+				log.Err(err).Msg("deleteAccount: error rolling back transaction")
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Nothing is reported as deleted until it is.
+		if err := txQueryService.Commit(tx); err != nil {
+			log.Err(err).Msg("deleteAccount: error committing transaction")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := do.MustInvoke[*crypto.SessionManager](i).RevokeUser(user.ID); err != nil {
+			log.Err(err).Str("user_id", user.ID.String()).Msg("error revoking user sessions")
+		}
+		publishEvents(i, live.NewEvent(live.EventAccountDeleted, user.ID, requestMachineID(r)))
+		log.Info().Str("user_id", user.ID.String()).Msg("deleteAccount: account deleted")
+		json.NewEncoder(w).Encode(AccountDeletionReceiptDto{
+			UserID:    user.ID,
+			Username:  user.Username,
+			DeletedAt: time.Now().UTC(),
+			Deleted:   deleted,
+		})
+	}
+}
+
 func UserRoutes(i *do.Injector) chi.Router {
 	r := chi.NewRouter()
 	r.Get("/{username}", getUser(i))
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.ConfigureSignedAuth(i))
+		r.Get("/me/policy", getUserPolicy(i))
+		r.Put("/me/policy", updateUserPolicy(i))
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.ConfigureRequestBoundAuth(i))
+		r.Delete("/me", deleteAccount(i))
+	})
 	return r
 }
@@ -1,20 +1,29 @@
 package routes
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi"
 	"go.uber.org/mock/gomock"
+	"github.com/google/uuid"
 	"github.com/samber/do"
 	"github.com/stretchr/testify/assert"
 	"github.com/therealpaulgg/ssh-sync-common/pkg/dto"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/database/query"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/repository"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/live"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/web/testutils"
+	pgxmock "github.com/therealpaulgg/ssh-sync-server/test/pgx"
 )
 
 func TestGetUser(t *testing.T) {
@@ -106,3 +115,233 @@ func TestUserInternalServerError(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 }
+
+func TestUpdateUserPolicy_RequireHybrid(t *testing.T) {
+	// Arrange
+	_, ecPub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mldsaPub, _, err := testutils.GenerateMLDSATestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybridPEM, err := testutils.EncodeHybridToPem(ecPub, mldsaPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := testutils.GenerateUser()
+	body, _ := json.Marshal(UserPolicyDto{RequireHybridAuth: true})
+	req := httptest.NewRequest("PUT", "/me/policy", bytes.NewReader(body))
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	if _, err := testutils.ProvideSessionManager(injector); err != nil {
+		t.Fatal(err)
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{{ID: uuid.New(), UserID: user.ID, Name: "hybrid", PublicKey: hybridPEM}}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().UpdateUserPolicy(gomock.Any()).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Put("/me/policy", updateUserPolicy(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, user.RequireHybridAuth)
+}
+
+func TestUpdateUserPolicy_RequireHybrid_NonHybridMachine(t *testing.T) {
+	// Arrange
+	priv, pub, err := testutils.GenerateTestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEM, _, err := testutils.EncodeToPem(priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := testutils.GenerateUser()
+	body, _ := json.Marshal(UserPolicyDto{RequireHybridAuth: true})
+	req := httptest.NewRequest("PUT", "/me/policy", bytes.NewReader(body))
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{{ID: uuid.New(), UserID: user.ID, Name: "classic", PublicKey: ecPEM}}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Put("/me/policy", updateUserPolicy(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.False(t, user.RequireHybridAuth)
+}
+
+func TestUpdateUserPolicy_QuorumTooLarge(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	body, _ := json.Marshal(UserPolicyDto{MachineApprovalQuorum: 2})
+	req := httptest.NewRequest("PUT", "/me/policy", bytes.NewReader(body))
+	req = testutils.AddUserContext(req, user)
+
+	injector := do.New()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMachineRepo := repository.NewMockMachineRepository(ctrl)
+	suspendedAt := time.Now()
+	mockMachineRepo.EXPECT().GetUserMachines(user.ID).Return([]models.Machine{
+		{ID: uuid.New(), UserID: user.ID, Name: "laptop"},
+		{ID: uuid.New(), UserID: user.ID, Name: "old", SuspendedAt: &suspendedAt},
+	}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.MachineRepository, error) {
+		return mockMachineRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Put("/me/policy", updateUserPolicy(injector))
+	router.ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Zero(t, user.MachineApprovalQuorum)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	body, _ := json.Marshal(DeleteAccountRequest{Confirm: user.Username})
+	req := httptest.NewRequest("DELETE", "/me", bytes.NewReader(body))
+	req = testutils.AddMachineContext(testutils.AddUserContext(req, user), machine)
+
+	injector := do.New()
+	sessionManager, err := testutils.ProvideSessionManager(injector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := sessionManager.Issue(user, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	txMock := pgxmock.NewMockTx(ctrl)
+	mockTxService := query.NewMockTransactionService(ctrl)
+	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTxService.EXPECT().Commit(txMock).Return(nil)
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTxService, nil
+	})
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().DeleteUserTx(user.ID, txMock).Return(map[string]int64{"users": 1, "machines": 2, "master_key_rotations": 1}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	deleteAccount(injector).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var receipt AccountDeletionReceiptDto
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&receipt))
+	assert.Equal(t, user.ID, receipt.UserID)
+	assert.Equal(t, int64(2), receipt.Deleted["machines"])
+	assert.Equal(t, int64(1), receipt.Deleted["master_key_rotations"])
+	event := <-subscription.Events
+	assert.Equal(t, live.EventAccountDeleted, event.Type)
+	_, err = sessionManager.Verify(token)
+	assert.ErrorIs(t, err, crypto.ErrSessionRevoked)
+}
+
+func TestDeleteAccount_CommitFails(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	machine := &models.Machine{ID: uuid.New(), UserID: user.ID, Name: "laptop"}
+	body, _ := json.Marshal(DeleteAccountRequest{Confirm: user.Username})
+	req := httptest.NewRequest("DELETE", "/me", bytes.NewReader(body))
+	req = testutils.AddMachineContext(testutils.AddUserContext(req, user), machine)
+
+	injector := do.New()
+	sessionManager, err := testutils.ProvideSessionManager(injector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := sessionManager.Issue(user, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := live.NewMemoryEventBroker()
+	do.ProvideValue[live.EventBroker](injector, broker)
+	subscription := broker.Subscribe(user.ID)
+	defer subscription.Close()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	txMock := pgxmock.NewMockTx(ctrl)
+	mockTxService := query.NewMockTransactionService(ctrl)
+	mockTxService.EXPECT().StartTx(gomock.Any()).Return(txMock, nil)
+	mockTxService.EXPECT().Commit(txMock).Return(errors.New("connection reset"))
+	do.Provide(injector, func(i *do.Injector) (query.TransactionService, error) {
+		return mockTxService, nil
+	})
+	mockUserRepo := repository.NewMockUserRepository(ctrl)
+	mockUserRepo.EXPECT().DeleteUserTx(user.ID, txMock).Return(map[string]int64{"users": 1}, nil)
+	do.Provide(injector, func(i *do.Injector) (repository.UserRepository, error) {
+		return mockUserRepo, nil
+	})
+
+	// Act
+	rr := httptest.NewRecorder()
+	deleteAccount(injector).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Empty(t, rr.Body.String())
+	assert.Empty(t, subscription.Events)
+	_, err = sessionManager.Verify(token)
+	assert.NoError(t, err)
+}
+
+func TestDeleteAccount_NotConfirmed(t *testing.T) {
+	// Arrange
+	user := testutils.GenerateUser()
+	body, _ := json.Marshal(DeleteAccountRequest{Confirm: "someone-else"})
+	req := httptest.NewRequest("DELETE", "/me", bytes.NewReader(body))
+	req = testutils.AddUserContext(req, user)
+	injector := do.New()
+
+	// Act
+	rr := httptest.NewRecorder()
+	deleteAccount(injector).ServeHTTP(rr, req)
+
+	// Assert
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/mlkem"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/base64"
@@ -15,6 +16,10 @@ import (
 
 	"filippo.io/mldsa"
 	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/samber/do"
+	"github.com/therealpaulgg/ssh-sync-server/pkg/crypto"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/database/models"
 	"github.com/therealpaulgg/ssh-sync-server/pkg/web/middleware/context_keys"
 )
@@ -47,6 +52,16 @@ func AddMachineContext(req *http.Request, machine *models.Machine) *http.Request
 	return req.Clone(ctx)
 }
 
+// ProvideSessionManager registers a session manager with an ephemeral signing key.
+func ProvideSessionManager(i *do.Injector) (*crypto.SessionManager, error) {
+	sessionManager, err := crypto.LoadSessionManager()
+	if err != nil {
+		return nil, err
+	}
+	do.ProvideValue(i, sessionManager)
+	return sessionManager, nil
+}
+
 // GenerateTestKeys generates a pair of ecdsa keys
 func GenerateTestKeys() (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
 	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -93,6 +108,18 @@ func EncodeMLDSAToPem(pub *mldsa.PublicKey) ([]byte, error) {
 	}), nil
 }
 
+// GenerateMLKEMTestKeyPEM generates a PEM encoded ML-KEM-768 encapsulation key.
+func GenerateMLKEMTestKeyPEM() ([]byte, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "ML-KEM PUBLIC KEY",
+		Bytes: dk.EncapsulationKey().Bytes(),
+	}), nil
+}
+
 // GenerateMLDSATestToken creates and signs a JWT with ML-DSA for testing.
 func GenerateMLDSATestToken(username, machine string, priv *mldsa.PrivateKey) (string, error) {
 	header := fmt.Sprintf(`{"alg":"%s","typ":"JWT"}`, mldsa.MLDSA65().String())
@@ -120,6 +147,31 @@ func GenerateMLDSATestToken(username, machine string, priv *mldsa.PrivateKey) (s
 	return signingInput + "." + s, nil
 }
 
+// GenerateMLDSAKeyProof creates a key update proof over nonce, signed with ML-DSA.
+func GenerateMLDSAKeyProof(nonce string, priv *mldsa.PrivateKey) (string, error) {
+	header := fmt.Sprintf(`{"alg":"%s","typ":"JWT"}`, mldsa.MLDSA65().String())
+	now := time.Now()
+	claims, err := json.Marshal(map[string]any{
+		"iat":   now.Add(-1 * time.Minute).Unix(),
+		"exp":   now.Add(2 * time.Minute).Unix(),
+		"nonce": nonce,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	h := base64.RawURLEncoding.EncodeToString([]byte(header))
+	c := base64.RawURLEncoding.EncodeToString(claims)
+	signingInput := h + "." + c
+
+	sig, err := priv.Sign(nil, []byte(signingInput), nil)
+	if err != nil {
+		return "", err
+	}
+	s := base64.RawURLEncoding.EncodeToString(sig)
+	return signingInput + "." + s, nil
+}
+
 // GenerateExpiredMLDSATestToken creates an expired ML-DSA JWT for testing.
 func GenerateExpiredMLDSATestToken(username, machine string, priv *mldsa.PrivateKey) (string, error) {
 	header := fmt.Sprintf(`{"alg":"%s","typ":"JWT"}`, mldsa.MLDSA65().String())
@@ -146,3 +198,48 @@ func GenerateExpiredMLDSATestToken(username, machine string, priv *mldsa.Private
 	s := base64.RawURLEncoding.EncodeToString(sig)
 	return signingInput + "." + s, nil
 }
+
+// EncodeHybridToPem PEM-encodes an ECDSA and an ML-DSA public key into a single hybrid bundle.
+func EncodeHybridToPem(ecPub *ecdsa.PublicKey, mldsaPub *mldsa.PublicKey) ([]byte, error) {
+	ecBytes, err := x509.MarshalPKIXPublicKey(ecPub)
+	if err != nil {
+		return nil, err
+	}
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecBytes})
+	return append(bundle, pem.EncodeToMemory(&pem.Block{Type: "ML-DSA PUBLIC KEY", Bytes: mldsaPub.Bytes()})...), nil
+}
+
+// GenerateHybridTestToken creates a JWT carrying a composite ML-DSA-65 + ES256 signature for testing.
+func GenerateHybridTestToken(username, machine string, ecPriv *ecdsa.PrivateKey, mldsaPriv *mldsa.PrivateKey) (string, error) {
+	header := fmt.Sprintf(`{"alg":"%s-%s","typ":"JWT"}`, mldsa.MLDSA65().String(), jwa.ES256.String())
+	now := time.Now()
+	claims, err := json.Marshal(map[string]any{
+		"iss":      "github.com/therealpaulgg/ssh-sync",
+		"iat":      now.Add(-1 * time.Minute).Unix(),
+		"exp":      now.Add(2 * time.Minute).Unix(),
+		"username": username,
+		"machine":  machine,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	h := base64.RawURLEncoding.EncodeToString([]byte(header))
+	c := base64.RawURLEncoding.EncodeToString(claims)
+	signingInput := h + "." + c
+
+	mldsaSig, err := mldsaPriv.Sign(nil, []byte(signingInput), nil)
+	if err != nil {
+		return "", err
+	}
+	signer, err := jws.NewSigner(jwa.ES256)
+	if err != nil {
+		return "", err
+	}
+	ecSig, err := signer.Sign([]byte(signingInput), ecPriv)
+	if err != nil {
+		return "", err
+	}
+	s := base64.RawURLEncoding.EncodeToString(append(mldsaSig, ecSig...))
+	return signingInput + "." + s, nil
+}